@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"github.com/mattn/go-mastodon"
+)
+
+// currentAccount returns the Mastodon account that the access token belongs
+// to. When AccountCacheTTL is set, the account is cached in state and only
+// fetched again once the cache is older than that, or if it was fetched from
+// a different server than MastodonServerURL or with a different access token
+// than MastodonAccessToken. The state file is saved after
+// the account is fetched so that the cache survives a run that posts
+// nothing.
+func currentAccount(ctx context.Context, conf *Conf, client mastodonClient, state *State,
+	now time.Time) (*mastodon.Account, error) {
+	tokenHash := accessTokenHash(conf.MastodonAccessToken)
+
+	if conf.AccountCacheTTL > 0 && state.Account != nil && state.Account.Server == conf.MastodonServerURL &&
+		state.Account.TokenHash == tokenHash && now.Sub(state.Account.FetchedAt) < conf.AccountCacheTTL {
+		logger.Infof("Using Mastodon account %v cached at %v", state.Account.ID,
+			state.Account.FetchedAt.Format(time.RFC3339))
+		return &mastodon.Account{ID: mastodon.ID(state.Account.ID), Acct: state.Account.Acct}, nil
+	}
+
+	account, err := client.GetAccountCurrentUser(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error getting current user account: %w", err)
+	}
+
+	if conf.AccountCacheTTL > 0 {
+		state.Account = &StateAccount{
+			Acct:      account.Acct,
+			FetchedAt: now,
+			ID:        string(account.ID),
+			Server:    conf.MastodonServerURL,
+			TokenHash: tokenHash,
+		}
+
+		if conf.StateFile != "" {
+			if err := state.save(conf.StateFile); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return account, nil
+}
+
+// accessTokenHash returns the hex-encoded SHA256 hash of an access token,
+// which is stored with the cached account instead of the token itself.
+func accessTokenHash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
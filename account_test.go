@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mattn/go-mastodon"
+	assert "github.com/stretchr/testify/require"
+)
+
+func TestCurrentAccount(t *testing.T) {
+	now := time.Date(2021, 1, 2, 3, 4, 5, 0, time.UTC)
+	conf := &Conf{
+		AccountCacheTTL:     24 * time.Hour,
+		MastodonAccessToken: "token",
+		MastodonServerURL:   "https://mastodon.example",
+		StateFile:           filepath.Join(t.TempDir(), "state.toml"),
+	}
+	client := &fakeClient{account: &mastodon.Account{ID: "123", Acct: "brandur"}}
+
+	state := &State{}
+	account, err := currentAccount(context.Background(), conf, client, state, now)
+	assert.NoError(t, err)
+	assert.Equal(t, mastodon.ID("123"), account.ID)
+	assert.Equal(t, 1, client.accountFetches)
+
+	// The cache is saved, so it's reused by the next run.
+	state, err = loadState(conf.StateFile, false)
+	assert.NoError(t, err)
+	assert.Equal(t, &StateAccount{
+		Acct:      "brandur",
+		FetchedAt: now,
+		ID:        "123",
+		Server:    "https://mastodon.example",
+		TokenHash: accessTokenHash("token"),
+	}, state.Account)
+	assert.NotContains(t, state.Account.TokenHash, "token")
+
+	account, err = currentAccount(context.Background(), conf, client, state, now.Add(time.Hour))
+	assert.NoError(t, err)
+	assert.Equal(t, mastodon.ID("123"), account.ID)
+	assert.Equal(t, "brandur", account.Acct)
+	assert.Equal(t, 1, client.accountFetches)
+
+	t.Run("RefreshedWhenServerChanges", func(t *testing.T) {
+		conf := *conf
+		conf.MastodonServerURL = "https://other.example"
+		client := &fakeClient{account: &mastodon.Account{ID: "456", Acct: "brandur"}}
+
+		account, err := currentAccount(context.Background(), &conf, client, state, now.Add(time.Hour))
+		assert.NoError(t, err)
+		assert.Equal(t, mastodon.ID("456"), account.ID)
+		assert.Equal(t, 1, client.accountFetches)
+		assert.Equal(t, "https://other.example", state.Account.Server)
+	})
+
+	t.Run("RefreshedWhenAccessTokenChanges", func(t *testing.T) {
+		conf := *conf
+		conf.MastodonAccessToken = "other-token"
+		conf.StateFile = ""
+		client := &fakeClient{account: &mastodon.Account{ID: "789", Acct: "other"}}
+		state := &State{Account: &StateAccount{
+			ID: "123", FetchedAt: now, Server: conf.MastodonServerURL, TokenHash: accessTokenHash("token"),
+		}}
+
+		account, err := currentAccount(context.Background(), &conf, client, state, now.Add(time.Hour))
+		assert.NoError(t, err)
+		assert.Equal(t, mastodon.ID("789"), account.ID)
+		assert.Equal(t, 1, client.accountFetches)
+		assert.Equal(t, accessTokenHash("other-token"), state.Account.TokenHash)
+	})
+
+	t.Run("RefreshedWhenCachedWithoutAccessTokenHash", func(t *testing.T) {
+		client := &fakeClient{account: &mastodon.Account{ID: "123", Acct: "brandur"}}
+		state := &State{Account: &StateAccount{ID: "123", FetchedAt: now, Server: conf.MastodonServerURL}}
+
+		_, err := currentAccount(context.Background(), conf, client, state, now.Add(time.Hour))
+		assert.NoError(t, err)
+		assert.Equal(t, 1, client.accountFetches)
+	})
+
+	t.Run("RefreshedWhenExpired", func(t *testing.T) {
+		state := &State{Account: &StateAccount{
+			ID: "123", FetchedAt: now, Server: conf.MastodonServerURL, TokenHash: accessTokenHash("token"),
+		}}
+
+		_, err := currentAccount(context.Background(), conf, client, state, now.Add(25*time.Hour))
+		assert.NoError(t, err)
+		assert.Equal(t, 2, client.accountFetches)
+		assert.Equal(t, now.Add(25*time.Hour), state.Account.FetchedAt)
+	})
+
+	t.Run("OffByDefault", func(t *testing.T) {
+		client := &fakeClient{}
+		state := &State{}
+
+		for i := 0; i < 2; i++ {
+			_, err := currentAccount(context.Background(), &Conf{}, client, state, now)
+			assert.NoError(t, err)
+		}
+		assert.Equal(t, 2, client.accountFetches)
+		assert.Nil(t, state.Account)
+	})
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/mattn/go-mastodon"
+)
+
+// UpdateStatusMedia edits a status, setting the descriptions of the given
+// media attachments along the way. Mastodon's media update endpoint refuses
+// media that's already attached to a status, so an edit that carries media
+// attributes is the only way to change them after posting.
+func (c *apiClient) UpdateStatusMedia(ctx context.Context, toot *mastodon.Toot, id mastodon.ID,
+	descriptions map[mastodon.ID]string) (*mastodon.Status, error) {
+	params := url.Values{}
+	params.Set("status", toot.Status)
+	for _, mediaID := range toot.MediaIDs {
+		params.Add("media_ids[]", string(mediaID))
+
+		if description, ok := descriptions[mediaID]; ok {
+			params.Add("media_attributes[][id]", string(mediaID))
+			params.Add("media_attributes[][description]", description)
+		}
+	}
+	if toot.Language != "" {
+		params.Set("language", toot.Language)
+	}
+	if toot.Sensitive {
+		params.Set("sensitive", "true")
+	}
+	if toot.SpoilerText != "" {
+		params.Set("spoiler_text", toot.SpoilerText)
+	}
+
+	u, err := url.Parse(c.Config.Server)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing server URL: %w", err)
+	}
+	u.Path = path.Join(u.Path, "/api/v1/statuses", string(id))
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, u.String(), strings.NewReader(params.Encode()))
+	if err != nil {
+		return nil, fmt.Errorf("error creating request: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+c.Config.AccessToken)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := c.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error editing status: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status editing status: %v", resp.Status)
+	}
+
+	var status mastodon.Status
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		return nil, fmt.Errorf("error decoding status: %w", err)
+	}
+
+	return &status, nil
+}
+
+// backfillAltText sets the descriptions of media on statuses that tweets
+// were previously synced to from the tweets' alt text, which improves the
+// accessibility of statuses posted before alt text was carried over. It
+// never posts anything. In a dry run, every description that would change is
+// listed along with its current value, and no status is edited.
+//
+// Tweets are matched to statuses the same way as by reconcile, against up to
+// ReconcileLimit of the account's most recent statuses. A tweet's photos are
+// paired with the status' media attachments by position, so statuses whose
+// number of attachments differs from the tweet's number of photos (like
+// those where some media was dropped) are skipped.
+func backfillAltText(ctx context.Context, conf *Conf, client mastodonClient, tweets []*Tweet) error {
+	account, err := client.GetAccountCurrentUser(ctx)
+	if err != nil {
+		return fmt.Errorf("error getting current user account: %w", err)
+	}
+
+	statuses, err := fetchAccountStatuses(ctx, client, account.ID, conf.ReconcileLimit)
+	if err != nil {
+		return err
+	}
+	logger.Infof("Backfilling alt text of %v tweet(s) against %v existing status(es)", len(tweets), len(statuses))
+
+	var numUpdated int
+
+	for _, tweet := range tweets {
+		if tweet.Entities == nil {
+			continue
+		}
+
+		var altTexts []string
+		for _, media := range tweet.Entities.Medias {
+			if media.Type == "photo" {
+				altTexts = append(altTexts, media.AltText)
+			}
+		}
+		if len(altTexts) < 1 {
+			continue
+		}
+
+		status, _ := findMatchingStatus(conf, statuses, tweet)
+		if status == nil {
+			continue
+		}
+
+		if len(status.MediaAttachments) != len(altTexts) {
+			logger.Warnf("Skipping Mastodon status %v for tweet %v: it has %v media attachment(s), but the tweet has %v photo(s)",
+				status.ID, tweet.ID, len(status.MediaAttachments), len(altTexts))
+			continue
+		}
+
+		var mediaIDs []mastodon.ID
+		descriptions := make(map[mastodon.ID]string)
+		for i, attachment := range status.MediaAttachments {
+			mediaIDs = append(mediaIDs, attachment.ID)
+
+			if altTexts[i] != "" && altTexts[i] != attachment.Description {
+				descriptions[attachment.ID] = altTexts[i]
+
+				// List every change in a dry run so that the source of alt
+				// text can be checked before any status is touched.
+				if conf.DryRun {
+					before, after := attachment.Description, altTexts[i]
+					if conf.RedactLogs {
+						before, after = logSample(conf, before), logSample(conf, after)
+					}
+					logger.Infof("Would have changed description of media %v of Mastodon status %v from %q to %q",
+						attachment.ID, status.ID, before, after)
+				}
+			}
+		}
+		if len(descriptions) < 1 {
+			continue
+		}
+
+		if conf.DryRun {
+			logger.Infof("Would have updated %v media description(s) of Mastodon status %v for tweet %v",
+				len(descriptions), status.ID, tweet.ID)
+			numUpdated++
+			continue
+		}
+
+		// Edits replace a status' text wholesale, so start from its source
+		// to leave everything but its media descriptions untouched.
+		source, err := client.GetStatusSource(ctx, status.ID)
+		if err != nil {
+			return fmt.Errorf("error getting source of status %v: %w", status.ID, err)
+		}
+
+		toot := &mastodon.Toot{
+			Language:    status.Language,
+			MediaIDs:    mediaIDs,
+			Sensitive:   status.Sensitive,
+			SpoilerText: source.SpoilerText,
+			Status:      source.Text,
+		}
+
+		if _, err := client.UpdateStatusMedia(ctx, toot, status.ID, descriptions); err != nil {
+			return fmt.Errorf("error updating media of status %v: %w", status.ID, err)
+		}
+
+		logger.Infof("Updated %v media description(s) of Mastodon status %v for tweet %v",
+			len(descriptions), status.ID, tweet.ID)
+		numUpdated++
+	}
+
+	logger.Infof("Backfilled alt text of %v status(es)", numUpdated)
+
+	return nil
+}
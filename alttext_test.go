@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/mattn/go-mastodon"
+	assert "github.com/stretchr/testify/require"
+)
+
+func TestAPIClientUpdateStatusMedia(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodPut, r.Method)
+		assert.Equal(t, "/api/v1/statuses/100", r.URL.Path)
+		assert.Equal(t, "Bearer token", r.Header.Get("Authorization"))
+
+		assert.NoError(t, r.ParseForm())
+		assert.Equal(t, "Some text", r.PostForm.Get("status"))
+		assert.Equal(t, []string{"media-1", "media-2"}, r.PostForm["media_ids[]"])
+		assert.Equal(t, []string{"media-2"}, r.PostForm["media_attributes[][id]"])
+		assert.Equal(t, []string{"A cat"}, r.PostForm["media_attributes[][description]"])
+
+		w.Write([]byte(`{"id": "100"}`))
+	}))
+	defer server.Close()
+
+	client := &apiClient{mastodon.NewClient(&mastodon.Config{AccessToken: "token", Server: server.URL})}
+
+	status, err := client.UpdateStatusMedia(context.Background(),
+		&mastodon.Toot{Status: "Some text", MediaIDs: []mastodon.ID{"media-1", "media-2"}},
+		"100", map[mastodon.ID]string{"media-2": "A cat"})
+	assert.NoError(t, err)
+	assert.Equal(t, mastodon.ID("100"), status.ID)
+}
+
+func TestBackfillAltText(t *testing.T) {
+	source := writeTweetData(t, `
+[[tweets]]
+id = 3
+text = "A tweet that was never posted to Mastodon."
+
+  [[tweets.entities.medias]]
+  alt_text = "A dog"
+  id = 30
+  type = "photo"
+  url = "https://pbs.twimg.com/media/dog.jpg"
+
+[[tweets]]
+id = 2
+text = "Birdwatching this morning turned up a heron."
+
+  [[tweets.entities.medias]]
+  alt_text = "A bird"
+  id = 20
+  type = "photo"
+  url = "https://pbs.twimg.com/media/bird.jpg"
+
+[[tweets]]
+id = 1
+text = "My cat found the only sunny spot in the house."
+
+  [[tweets.entities.medias]]
+  alt_text = "A cat"
+  id = 10
+  type = "photo"
+  url = "https://pbs.twimg.com/media/cat.jpg"
+`)
+
+	conf := &Conf{BackfillAltText: true, MaxTweetsToSync: 10, ReconcileLimit: 100}
+
+	newClient := func() *fakeClient {
+		return &fakeClient{statuses: []*mastodon.Status{
+			{ID: "200", Content: `<p>Birdwatching this morning turned up a heron.</p>`,
+				MediaAttachments: []mastodon.Attachment{{ID: "media-2", Description: "A bird"}}},
+			{ID: "100", Content: `<p>My cat found the only sunny spot in the house.</p>`, Language: "en",
+				MediaAttachments: []mastodon.Attachment{{ID: "media-1"}}},
+		}}
+	}
+
+	client := newClient()
+	assert.NoError(t, syncTwitter(context.Background(), conf, client, source))
+
+	// Never posts.
+	assert.Empty(t, client.postedToots)
+
+	assert.Len(t, client.updatedMedia, 1)
+	assert.Equal(t, map[mastodon.ID]string{"media-1": "A cat"}, client.updatedMedia["100"])
+	assert.Equal(t, &mastodon.Toot{
+		Language: "en",
+		MediaIDs: []mastodon.ID{"media-1"},
+		Status:   "source of 100",
+	}, client.updatedToots["100"])
+
+	t.Run("DryRun", func(t *testing.T) {
+		conf := *conf
+		conf.DryRun = true
+
+		client := newClient()
+		logs := captureLogger(t)
+		assert.NoError(t, syncTwitter(context.Background(), &conf, client, source))
+		assert.Empty(t, client.postedToots)
+		assert.Empty(t, client.updatedMedia)
+		assert.Empty(t, client.updatedToots)
+
+		assert.Contains(t, logs.String(),
+			`Would have changed description of media media-1 of Mastodon status 100 from "" to "A cat"`)
+		assert.NotContains(t, logs.String(), "media media-2")
+	})
+
+	t.Run("MismatchedAttachments", func(t *testing.T) {
+		client := newClient()
+		client.statuses[1].MediaAttachments = nil
+
+		logs := captureLogger(t)
+		assert.NoError(t, syncTwitter(context.Background(), conf, client, source))
+		assert.Empty(t, client.updatedMedia)
+		assert.Contains(t, logs.String(), "Skipping Mastodon status 100 for tweet 1")
+	})
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/mattn/go-mastodon"
+)
+
+// appScopes are the OAuth scopes requested for the app registered by
+// registerApp, which cover everything that syncing does.
+const appScopes = "read write"
+
+// oobRedirectURI is the redirect URI that has Mastodon show an authorization
+// code to be copied by hand rather than redirecting anywhere.
+const oobRedirectURI = "urn:ietf:wg:oauth:2.0:oob"
+
+// registerApp registers an app named AppName (linking to AppWebsite) with the
+// Mastodon server, then walks through authorizing it for an account by
+// writing an authorization URL to out and reading back the code that the
+// server shows once it's been visited from in. Returns an access token that
+// posts as the app.
+//
+// Mastodon shows which app posted each status, and that's the app that the
+// access token belongs to, so this is the only way of changing the name that
+// crossposts are attributed to.
+func registerApp(ctx context.Context, conf *Conf, in io.Reader, out io.Writer) (string, error) {
+	if conf.AppName == "" {
+		return "", fmt.Errorf("an app name must be configured with APP_NAME to register an app")
+	}
+
+	app, err := mastodon.RegisterApp(ctx, &mastodon.AppConfig{
+		Client:       *httpClient,
+		Server:       conf.MastodonServerURL,
+		ClientName:   conf.AppName,
+		RedirectURIs: oobRedirectURI,
+		Scopes:       appScopes,
+		Website:      conf.AppWebsite,
+	})
+	if err != nil {
+		return "", fmt.Errorf("error registering app: %w", err)
+	}
+
+	logger.Infof("Registered app '%s' with client ID %s", conf.AppName, app.ClientID)
+
+	fmt.Fprintf(out, "Visit this URL while logged in to the account to sync to and authorize the app:\n\n%s\n\n",
+		app.AuthURI)
+	fmt.Fprintf(out, "Authorization code: ")
+
+	line, err := bufio.NewReader(in).ReadString('\n')
+	code := strings.TrimSpace(line)
+	if code == "" {
+		if err != nil {
+			return "", fmt.Errorf("error reading authorization code: %w", err)
+		}
+		return "", fmt.Errorf("no authorization code given")
+	}
+
+	client := mastodon.NewClient(&mastodon.Config{
+		ClientID:     app.ClientID,
+		ClientSecret: app.ClientSecret,
+		Server:       conf.MastodonServerURL,
+	})
+	client.Client = *httpClient
+
+	if err := client.AuthenticateToken(ctx, code, oobRedirectURI); err != nil {
+		return "", fmt.Errorf("error exchanging authorization code for access token: %w", err)
+	}
+
+	return client.Config.AccessToken, nil
+}
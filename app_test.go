@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	assert "github.com/stretchr/testify/require"
+)
+
+func TestRegisterApp(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodPost, r.Method)
+		assert.NoError(t, r.ParseForm())
+
+		switch r.URL.Path {
+		case "/api/v1/apps":
+			assert.Equal(t, "Brandur's Crossposter", r.PostForm.Get("client_name"))
+			assert.Equal(t, "https://brandur.org", r.PostForm.Get("website"))
+			assert.Equal(t, appScopes, r.PostForm.Get("scopes"))
+			w.Write([]byte(`{"id": "1", "client_id": "client-id", "client_secret": "client-secret"}`))
+
+		case "/oauth/token":
+			assert.Equal(t, "client-id", r.PostForm.Get("client_id"))
+			assert.Equal(t, "client-secret", r.PostForm.Get("client_secret"))
+			assert.Equal(t, "auth-code", r.PostForm.Get("code"))
+			w.Write([]byte(`{"access_token": "access-token"}`))
+
+		default:
+			t.Fatalf("unexpected request to %s", r.URL.Path)
+		}
+	}))
+	defer server.Close()
+
+	conf := &Conf{AppName: "Brandur's Crossposter", AppWebsite: "https://brandur.org", MastodonServerURL: server.URL}
+
+	var out bytes.Buffer
+	accessToken, err := registerApp(context.Background(), conf, strings.NewReader("auth-code\n"), &out)
+	assert.NoError(t, err)
+	assert.Equal(t, "access-token", accessToken)
+	assert.Contains(t, out.String(), server.URL+"/oauth/authorize?client_id=client-id")
+
+	t.Run("NoCode", func(t *testing.T) {
+		_, err := registerApp(context.Background(), conf, strings.NewReader(""), &out)
+		assert.EqualError(t, err, "error reading authorization code: EOF")
+	})
+
+	t.Run("NoName", func(t *testing.T) {
+		conf := *conf
+		conf.AppName = ""
+
+		_, err := registerApp(context.Background(), &conf, strings.NewReader("auth-code\n"), &out)
+		assert.EqualError(t, err, "an app name must be configured with APP_NAME to register an app")
+	})
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// checkpoint records the IDs of tweets that a backfill has synced to a
+// checkpoint file (see `Conf.CheckpointEvery`), so that a run that's
+// interrupted partway through can be resumed without posting them again.
+//
+// It's only used without a state file. The state file records every tweet as
+// it's posted and is saved after each one, and syncing stops at the first
+// tweet that it records, so it already lets a backfill be resumed. The
+// checkpoint gives runs without one the same, more cheaply than keeping a
+// state file: it's a list of tweet IDs, one per line, written every so many
+// tweets and whenever a run ends. A run that's killed outright might lose the
+// last few since the most recent write, which are then left to be matched
+// against existing statuses like usual.
+type checkpoint struct {
+	path string
+
+	done    map[int64]bool
+	ids     []int64
+	pending int
+}
+
+// readCheckpoint reads the checkpoint file at the given path. An empty
+// checkpoint is returned if the file doesn't exist yet.
+func readCheckpoint(path string) (*checkpoint, error) {
+	c := &checkpoint{path: path, done: make(map[int64]bool)}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading checkpoint file: %w", err)
+	}
+
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		id, err := strconv.ParseInt(line, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing checkpoint file: invalid tweet ID '%s'", line)
+		}
+
+		if !c.done[id] {
+			c.done[id] = true
+			c.ids = append(c.ids, id)
+		}
+	}
+
+	return c, nil
+}
+
+// filter returns only those tweets that haven't been checkpointed, including
+// tweets merged from others any of which was checkpointed.
+func (c *checkpoint) filter(tweets []*Tweet) []*Tweet {
+	var filtered []*Tweet
+	for _, tweet := range tweets {
+		done := c.done[tweet.ID]
+		for _, mergedID := range tweet.mergedIDs {
+			done = done || c.done[mergedID]
+		}
+
+		if done {
+			continue
+		}
+		filtered = append(filtered, tweet)
+	}
+
+	if numSkipped := len(tweets) - len(filtered); numSkipped > 0 {
+		logger.Infof("Skipping %v tweet(s) already synced according to checkpoint file", numSkipped)
+	}
+
+	return filtered
+}
+
+// flush writes any tweets recorded since the last write to the checkpoint
+// file.
+func (c *checkpoint) flush() error {
+	if c.pending < 1 {
+		return nil
+	}
+
+	var sb strings.Builder
+	for _, id := range c.ids {
+		sb.WriteString(strconv.FormatInt(id, 10))
+		sb.WriteString("\n")
+	}
+
+	if err := writeFileAtomic(c.path, []byte(sb.String())); err != nil {
+		return fmt.Errorf("error writing checkpoint file: %w", err)
+	}
+
+	c.pending = 0
+	return nil
+}
+
+// record records a synced tweet, along with the IDs of any tweets merged into
+// it, writing the checkpoint file once every tweets have been recorded since
+// the last write.
+func (c *checkpoint) record(tweet *Tweet, every int) error {
+	for _, id := range append([]int64{tweet.ID}, tweet.mergedIDs...) {
+		if !c.done[id] {
+			c.done[id] = true
+			c.ids = append(c.ids, id)
+		}
+	}
+
+	c.pending++
+	if c.pending < every {
+		return nil
+	}
+
+	return c.flush()
+}
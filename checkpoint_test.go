@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	assert "github.com/stretchr/testify/require"
+)
+
+func TestCheckpoint(t *testing.T) {
+	const tweetData = `
+[[tweets]]
+id = 5
+text = "Fifth"
+
+[[tweets]]
+id = 4
+text = "Fourth"
+%s
+
+[[tweets]]
+id = 3
+text = "Third"
+
+[[tweets]]
+id = 2
+text = "Second"
+
+[[tweets]]
+id = 1
+text = "First"
+`
+
+	conf := &Conf{
+		CheckpointEvery: 2,
+		CheckpointFile:  filepath.Join(t.TempDir(), "checkpoint"),
+		MaxTweetsToSync: 10,
+	}
+
+	statuses := func(client *fakeClient) []string {
+		var statuses []string
+		for _, toot := range client.postedToots {
+			statuses = append(statuses, toot.Status)
+		}
+		return statuses
+	}
+
+	// The run is interrupted by the fourth tweet, whose media is missing.
+	// The first two were checkpointed along the way, and the third is when
+	// the run ends with the error.
+	client := &fakeClient{}
+	source := writeTweetData(t, fmt.Sprintf(tweetData, `
+  [[tweets.entities.medias]]
+  id = 40
+  type = "photo"
+  url = "/missing/cat.jpg"
+`))
+	assert.Error(t, syncTwitter(context.Background(), conf, client, source))
+	assert.Equal(t, []string{"First", "Second", "Third"}, statuses(client))
+
+	data, err := ioutil.ReadFile(conf.CheckpointFile)
+	assert.NoError(t, err)
+	assert.Equal(t, "1\n2\n3\n", string(data))
+
+	// The next run resumes from the checkpoint.
+	client = &fakeClient{}
+	source = writeTweetData(t, fmt.Sprintf(tweetData, ""))
+	assert.NoError(t, syncTwitter(context.Background(), conf, client, source))
+	assert.Equal(t, []string{"Fourth", "Fifth"}, statuses(client))
+
+	data, err = ioutil.ReadFile(conf.CheckpointFile)
+	assert.NoError(t, err)
+	assert.Equal(t, "1\n2\n3\n4\n5\n", string(data))
+
+	t.Run("StateFileTakesPrecedence", func(t *testing.T) {
+		conf := *conf
+		conf.CheckpointFile = filepath.Join(t.TempDir(), "checkpoint")
+		conf.StateFile = filepath.Join(t.TempDir(), "state.toml")
+
+		client := &fakeClient{}
+		source := writeTweetData(t, fmt.Sprintf(tweetData, `
+  [[tweets.entities.medias]]
+  id = 40
+  type = "photo"
+  url = "/missing/cat.jpg"
+`))
+		assert.Error(t, syncTwitter(context.Background(), &conf, client, source))
+		assert.Equal(t, []string{"First", "Second", "Third"}, statuses(client))
+		assert.NoFileExists(t, conf.CheckpointFile)
+
+		client = &fakeClient{}
+		source = writeTweetData(t, fmt.Sprintf(tweetData, ""))
+		assert.NoError(t, syncTwitter(context.Background(), &conf, client, source))
+		assert.Equal(t, []string{"Fourth", "Fifth"}, statuses(client))
+	})
+
+	t.Run("RequiresFile", func(t *testing.T) {
+		conf := *conf
+		conf.CheckpointFile = ""
+		assert.EqualError(t, syncTwitter(context.Background(), &conf, &fakeClient{}, source),
+			"a checkpoint file must be configured with CHECKPOINT_FILE to checkpoint progress")
+	})
+}
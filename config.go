@@ -0,0 +1,163 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/joeshaw/envdecode"
+	"github.com/pelletier/go-toml"
+)
+
+// decodeConf decodes configuration from environmental variables, along with
+// the TOML config file at the given path if it's not empty (see
+// loadConfFile).
+func decodeConf(path string) (*Conf, error) {
+	if path != "" {
+		if err := loadConfFile(path); err != nil {
+			return nil, err
+		}
+	}
+
+	var conf Conf
+	if err := envdecode.Decode(&conf); err != nil {
+		return nil, fmt.Errorf("error decoding conf from env: %w", err)
+	}
+
+	return &conf, nil
+}
+
+// offlineConf is the subset of Conf used by the modes that only work with the
+// state file, like `-export-map`, which don't otherwise need a server or the
+// settings required to sync.
+type offlineConf struct {
+	StateFile   string `env:"STATE_FILE"`
+	TwitterUser string `env:"TWITTER_USER"`
+}
+
+// decodeOfflineConf is decodeConf for the modes that only work with the state
+// file. Only the fields of offlineConf are decoded, so configuration that's
+// required to sync, like MastodonServerURL, isn't required by them.
+func decodeOfflineConf(path string) (*Conf, error) {
+	if path != "" {
+		if err := loadConfFile(path); err != nil {
+			return nil, err
+		}
+	}
+
+	var offline offlineConf
+	err := envdecode.Decode(&offline)
+	if err != nil && !errors.Is(err, envdecode.ErrNoTargetFieldsAreSet) {
+		return nil, fmt.Errorf("error decoding conf from env: %w", err)
+	}
+
+	return &Conf{
+		StateFile:   offline.StateFile,
+		TwitterUser: offline.TwitterUser,
+	}, nil
+}
+
+// loadConfFile loads configuration from a TOML config file whose keys are the
+// `toml` tags of Conf's fields, like `max_tweets_to_sync = 10`.
+//
+// Each value is set as the environmental variable of its field unless that
+// variable is already set, so real environmental variables override the file,
+// and envdecode then decodes and validates configuration from both sources
+// in the same way. Lists can be given as arrays and maps as tables, and are
+// converted to the semicolon-separated forms expected in the environment.
+func loadConfFile(path string) error {
+	tree, err := toml.LoadFile(path)
+	if err != nil {
+		return fmt.Errorf("error reading config file: %w", err)
+	}
+
+	envNames := make(map[string]string)
+	confType := reflect.TypeOf(Conf{})
+	for i := 0; i < confType.NumField(); i++ {
+		field := confType.Field(i)
+
+		key := field.Tag.Get("toml")
+		envName := strings.Split(field.Tag.Get("env"), ",")[0]
+		if key == "" || key == "-" || envName == "" {
+			continue
+		}
+
+		envNames[key] = envName
+	}
+
+	values := tree.ToMap()
+
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		envName, ok := envNames[key]
+		if !ok {
+			return fmt.Errorf("unknown key in config file: '%s'", key)
+		}
+
+		if _, ok := os.LookupEnv(envName); ok {
+			continue
+		}
+
+		value, err := confFileValueString(values[key])
+		if err != nil {
+			return fmt.Errorf("error in config file key '%s': %w", key, err)
+		}
+
+		if err := os.Setenv(envName, value); err != nil {
+			return fmt.Errorf("error setting %s: %w", envName, err)
+		}
+	}
+
+	return nil
+}
+
+// confFileValueString converts a value from a TOML config file to the form
+// that it'd take in an environmental variable.
+func confFileValueString(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case []interface{}:
+		parts := make([]string, len(v))
+		for i, element := range v {
+			s, err := confFileValueString(element)
+			if err != nil {
+				return "", err
+			}
+			parts[i] = s
+		}
+		return strings.Join(parts, ";"), nil
+
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		parts := make([]string, len(keys))
+		for i, key := range keys {
+			s, err := confFileValueString(v[key])
+			if err != nil {
+				return "", err
+			}
+			parts[i] = key + "=" + s
+		}
+		return strings.Join(parts, ";"), nil
+
+	case time.Time:
+		return v.Format(time.RFC3339), nil
+
+	case bool, float64, int64, string:
+		return fmt.Sprint(v), nil
+	}
+
+	return "", fmt.Errorf("unsupported value type %T", value)
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	assert "github.com/stretchr/testify/require"
+)
+
+func TestDecodeConf(t *testing.T) {
+	// Isolate tests from the real environment. Values set by loadConfFile are
+	// also restored when each test finishes.
+	clearEnv := func(t *testing.T) {
+		for _, name := range []string{
+			"DRY_RUN", "HANDLE_MAPPINGS", "MASTODON_ACCESS_TOKEN", "MASTODON_SERVER_URL",
+			"MAX_TWEETS_TO_SYNC", "MEDIA_URL_VARIANTS", "MIN_TWEET_ID", "SCHEDULE_SPACING",
+		} {
+			t.Setenv(name, "")
+			assert.NoError(t, os.Unsetenv(name))
+		}
+	}
+
+	writeConfFile := func(t *testing.T, data string) string {
+		path := filepath.Join(t.TempDir(), "conf.toml")
+		assert.NoError(t, ioutil.WriteFile(path, []byte(data), 0o600))
+		return path
+	}
+
+	fullConfFile := `
+dry_run = true
+handle_mappings = { brandur = "brandur@mastodon.social" }
+mastodon_access_token = "file-token"
+mastodon_server_url = "https://mastodon.example"
+max_tweets_to_sync = 10
+media_url_variants = ["large", "medium"]
+min_tweet_id = 123
+schedule_spacing = "1h"
+`
+
+	t.Run("FileOnly", func(t *testing.T) {
+		clearEnv(t)
+
+		conf, err := decodeConf(writeConfFile(t, fullConfFile))
+		assert.NoError(t, err)
+		assert.True(t, conf.DryRun)
+		assert.Equal(t, ConfMap{"brandur": "brandur@mastodon.social"}, conf.HandleMappings)
+		assert.Equal(t, "file-token", conf.MastodonAccessToken)
+		assert.Equal(t, "https://mastodon.example", conf.MastodonServerURL)
+		assert.Equal(t, 10, conf.MaxTweetsToSync)
+		assert.Equal(t, []string{"large", "medium"}, conf.MediaURLVariants)
+		assert.Equal(t, int64(123), conf.MinTweetID)
+		assert.Equal(t, 1*time.Hour, conf.ScheduleSpacing)
+	})
+
+	t.Run("EnvOverridesFile", func(t *testing.T) {
+		clearEnv(t)
+		t.Setenv("MASTODON_ACCESS_TOKEN", "env-token")
+		t.Setenv("MAX_TWEETS_TO_SYNC", "20")
+
+		conf, err := decodeConf(writeConfFile(t, fullConfFile))
+		assert.NoError(t, err)
+		assert.Equal(t, "env-token", conf.MastodonAccessToken)
+		assert.Equal(t, 20, conf.MaxTweetsToSync)
+		assert.Equal(t, int64(123), conf.MinTweetID)
+	})
+
+	t.Run("RequiredFromEitherSource", func(t *testing.T) {
+		clearEnv(t)
+		t.Setenv("MIN_TWEET_ID", "123")
+
+		conf, err := decodeConf(writeConfFile(t, `
+dry_run = false
+mastodon_access_token = "file-token"
+mastodon_server_url = "https://mastodon.example"
+max_tweets_to_sync = 10
+`))
+		assert.NoError(t, err)
+		assert.Equal(t, int64(123), conf.MinTweetID)
+	})
+
+	t.Run("MissingRequiredInBoth", func(t *testing.T) {
+		clearEnv(t)
+
+		_, err := decodeConf(writeConfFile(t, `
+dry_run = false
+mastodon_access_token = "file-token"
+mastodon_server_url = "https://mastodon.example"
+max_tweets_to_sync = 10
+`))
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "MIN_TWEET_ID")
+	})
+
+	t.Run("UnknownKey", func(t *testing.T) {
+		clearEnv(t)
+
+		_, err := decodeConf(writeConfFile(t, `max_tweets = 10`))
+		assert.EqualError(t, err, "unknown key in config file: 'max_tweets'")
+	})
+}
+
+func TestDecodeOfflineConf(t *testing.T) {
+	for _, name := range []string{
+		"DRY_RUN", "MASTODON_SERVER_URL", "MAX_TWEETS_TO_SYNC", "MIN_TWEET_ID", "STATE_FILE", "TWITTER_USER",
+	} {
+		t.Setenv(name, "")
+		assert.NoError(t, os.Unsetenv(name))
+	}
+
+	t.Run("WithoutSyncConfiguration", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "conf.toml")
+		assert.NoError(t, ioutil.WriteFile(path, []byte(`
+state_file = "state.toml"
+twitter_user = "brandur"
+`), 0o600))
+
+		conf, err := decodeOfflineConf(path)
+		assert.NoError(t, err)
+		assert.Equal(t, "state.toml", conf.StateFile)
+		assert.Equal(t, "brandur", conf.TwitterUser)
+	})
+
+	t.Run("NothingSet", func(t *testing.T) {
+		t.Setenv("STATE_FILE", "")
+		assert.NoError(t, os.Unsetenv("STATE_FILE"))
+		t.Setenv("TWITTER_USER", "")
+		assert.NoError(t, os.Unsetenv("TWITTER_USER"))
+
+		conf, err := decodeOfflineConf("")
+		assert.NoError(t, err)
+		assert.Equal(t, "", conf.StateFile)
+	})
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/mattn/go-mastodon"
+)
+
+// confirmer prompts for confirmation before each of the first ConfirmFirst
+// tweets of a run is posted, showing the toot that it'll be posted as.
+type confirmer struct {
+	in        *bufio.Reader
+	out       io.Writer
+	remaining int
+}
+
+// newConfirmer returns a confirmer that reads answers from in and writes
+// prompts to out, or nil if there's nothing to confirm because ConfirmFirst
+// isn't set, the run is a dry run, or confirmation was given up front with
+// `-yes`. Prompting when in isn't a terminal (like when running from cron)
+// would hang or read garbage, so that's an error instead.
+func newConfirmer(conf *Conf, in io.Reader, out io.Writer, isTerminal bool) (*confirmer, error) {
+	if conf.ConfirmFirst < 1 || conf.DryRun || conf.Yes {
+		return nil, nil
+	}
+
+	if !isTerminal {
+		return nil, fmt.Errorf("confirming the first %v tweet(s) requires an interactive terminal; "+
+			"re-run with -yes to post without confirmation", conf.ConfirmFirst)
+	}
+
+	return &confirmer{in: bufio.NewReader(in), out: out, remaining: conf.ConfirmFirst}, nil
+}
+
+// errConfirmationDeclined is returned when posting a tweet is declined when
+// prompted for confirmation.
+var errConfirmationDeclined = errors.New("posting declined")
+
+// confirm prompts for confirmation of what's about to be done with a tweet,
+// which is described by action (like "posted as") and content (see
+// describeToot), returning true if it's given. Once ConfirmFirst tweets have
+// been confirmed, the rest are confirmed without prompting. Running out of
+// input counts as declining.
+func (c *confirmer) confirm(tweet *Tweet, action, content string) bool {
+	if c == nil || c.remaining < 1 {
+		return true
+	}
+
+	fmt.Fprintf(c.out, "Tweet %v will be %s:\n\n%s\n\n", tweet.ID, action, content)
+
+	for {
+		fmt.Fprintf(c.out, "Post it? [y/n] ")
+
+		line, err := c.in.ReadString('\n')
+		switch strings.ToLower(strings.TrimSpace(line)) {
+		case "y", "yes":
+			c.remaining--
+			if c.remaining < 1 {
+				fmt.Fprintf(c.out, "Posting the rest without confirmation\n")
+			}
+			return true
+		case "n", "no":
+			return false
+		}
+
+		if err != nil {
+			fmt.Fprintf(c.out, "\n")
+			return false
+		}
+	}
+}
+
+// describeToot describes a toot for confirmation, which is its content
+// followed by anything else about it that differs from a plain public
+// status.
+func describeToot(toot *mastodon.Toot) string {
+	var sb strings.Builder
+	sb.WriteString(toot.Status)
+
+	var details []string
+	if toot.SpoilerText != "" {
+		details = append(details, fmt.Sprintf("Content warning: %s", toot.SpoilerText))
+	}
+	if toot.Visibility != "" {
+		details = append(details, fmt.Sprintf("Visibility: %s", toot.Visibility))
+	}
+	if toot.InReplyToID != "" {
+		details = append(details, fmt.Sprintf("In reply to: %v", toot.InReplyToID))
+	}
+	if len(toot.MediaIDs) > 0 {
+		details = append(details, fmt.Sprintf("Media: %v attachment(s)", len(toot.MediaIDs)))
+	}
+	if toot.Poll != nil {
+		details = append(details, fmt.Sprintf("Poll: %s", strings.Join(toot.Poll.Options, " / ")))
+	}
+	if toot.ScheduledAt != nil {
+		details = append(details, fmt.Sprintf("Scheduled for: %s", toot.ScheduledAt.Format(time.RFC3339)))
+	}
+
+	if len(details) > 0 {
+		sb.WriteString("\n\n")
+		sb.WriteString(strings.Join(details, "\n"))
+	}
+
+	return sb.String()
+}
+
+// stdinIsTerminal returns whether stdin is connected to a terminal rather
+// than a pipe or file.
+func stdinIsTerminal() bool {
+	info, err := os.Stdin.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/mattn/go-mastodon"
+	assert "github.com/stretchr/testify/require"
+)
+
+func TestConfirmer(t *testing.T) {
+	conf := &Conf{ConfirmFirst: 2}
+	tweet := &Tweet{ID: 123}
+
+	t.Run("ConfirmsFirstTweets", func(t *testing.T) {
+		var out bytes.Buffer
+		confirmer, err := newConfirmer(conf, strings.NewReader("maybe\ny\nYes\n"), &out, true)
+		assert.NoError(t, err)
+
+		// Unrecognized answers are asked again.
+		assert.True(t, confirmer.confirm(tweet, "posted as", "A toot"))
+		assert.Equal(t, "Tweet 123 will be posted as:\n\nA toot\n\nPost it? [y/n] Post it? [y/n] ", out.String())
+
+		assert.True(t, confirmer.confirm(tweet, "posted as", "A toot"))
+		assert.Contains(t, out.String(), "Posting the rest without confirmation")
+
+		// The rest are confirmed without prompting.
+		out.Reset()
+		assert.True(t, confirmer.confirm(tweet, "posted as", "A toot"))
+		assert.Empty(t, out.String())
+	})
+
+	t.Run("Declines", func(t *testing.T) {
+		confirmer, err := newConfirmer(conf, strings.NewReader("n\n"), &bytes.Buffer{}, true)
+		assert.NoError(t, err)
+		assert.False(t, confirmer.confirm(tweet, "posted as", "A toot"))
+	})
+
+	t.Run("DeclinesOnEndOfInput", func(t *testing.T) {
+		confirmer, err := newConfirmer(conf, strings.NewReader(""), &bytes.Buffer{}, true)
+		assert.NoError(t, err)
+		assert.False(t, confirmer.confirm(tweet, "posted as", "A toot"))
+	})
+
+	t.Run("RefusesWithoutTerminal", func(t *testing.T) {
+		_, err := newConfirmer(conf, strings.NewReader("y\n"), &bytes.Buffer{}, false)
+		assert.EqualError(t, err, "confirming the first 2 tweet(s) requires an interactive terminal; "+
+			"re-run with -yes to post without confirmation")
+	})
+
+	t.Run("SkippedWithYes", func(t *testing.T) {
+		conf := *conf
+		conf.Yes = true
+
+		confirmer, err := newConfirmer(&conf, strings.NewReader(""), &bytes.Buffer{}, false)
+		assert.NoError(t, err)
+		assert.Nil(t, confirmer)
+		assert.True(t, confirmer.confirm(tweet, "posted as", "A toot"))
+	})
+}
+
+func TestConfirmerShowsPostedToot(t *testing.T) {
+	conf := &Conf{
+		ConfirmFirst:      1,
+		DefaultSpoiler:    "Old tweets",
+		ThreadSelfReplies: true,
+		TwitterUser:       "brandur",
+		Visibility:        "unlisted",
+	}
+	state := &State{}
+	state.recordTweetStatus(1, "100", "unlisted")
+
+	reply := &Tweet{
+		ID:    2,
+		Text:  "A reply to a synced tweet",
+		Reply: &TweetReply{StatusID: 1, User: "brandur"},
+	}
+
+	var out bytes.Buffer
+	confirmer, err := newConfirmer(conf, strings.NewReader("n\n"), &out, true)
+	assert.NoError(t, err)
+
+	client := &fakeClient{}
+	_, err = syncTweet(context.Background(), conf, client, state, nil, confirmer, reply, "")
+	assert.True(t, errors.Is(err, errConfirmationDeclined))
+	assert.Empty(t, client.postedToots)
+
+	assert.Equal(t, "Tweet 2 will be posted as:\n\n"+
+		"A reply to a synced tweet\n\n"+
+		"Content warning: Old tweets\n"+
+		"Visibility: unlisted\n"+
+		"In reply to: 100\n\n"+
+		"Post it? [y/n] ", out.String())
+}
+
+func TestDescribeToot(t *testing.T) {
+	assert.Equal(t, "A toot", describeToot(&mastodon.Toot{Status: "A toot"}))
+
+	assert.Equal(t, "A toot\n\nMedia: 2 attachment(s)\nPoll: Yes / No", describeToot(&mastodon.Toot{
+		MediaIDs: []mastodon.ID{"1", "2"},
+		Poll:     &mastodon.TootPoll{Options: []string{"Yes", "No"}},
+		Status:   "A toot",
+	}))
+}
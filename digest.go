@@ -0,0 +1,156 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// digestBullet prefixes each tweet in a digest.
+const digestBullet = "• "
+
+// isDigestable returns whether a tweet is short and plain enough to be
+// bundled into a digest (see mergeShortTweetDigests).
+func isDigestable(conf *Conf, tweet *Tweet) bool {
+	if tweet.CreatedAt.IsZero() || tweet.Reply != nil || tweet.Retweet != nil || tweet.Quote != nil ||
+		len(tweet.mergedIDs) > 0 {
+		return false
+	}
+
+	if tweet.Entities != nil && len(tweet.Entities.Medias) > 0 {
+		return false
+	}
+
+	return utf8.RuneCountInString(digestLine(tweet)) <= conf.DigestMaxLength
+}
+
+// digestLine returns the text of a tweet as it appears in a digest, which is
+// its display text on a single line.
+func digestLine(tweet *Tweet) string {
+	return strings.Join(strings.Fields(displayTextTweet(tweet).Text), " ")
+}
+
+// mergeShortTweetDigests bundles short tweets (see isDigestable) from the same
+// UTC day into digest tweets whose text is a bulleted list of theirs, for days
+// with at least DigestMinCount of them. tweets are ordered by descending ID,
+// and other tweets are returned as they are. Does nothing unless
+// DigestShortTweets is on.
+//
+// A digest takes the ID and creation time of the newest tweet it contains so
+// that it's posted after the others, and records the IDs of all of them. A
+// digest that would be too long for a status is split into several.
+//
+// A digest is matched to an existing status like any other tweet, by
+// comparing its rendered text. That only works if the same tweets are bundled
+// the same way every run, so short tweets from a day that isn't over yet are
+// held back until it is (the returned time is the creation time of the
+// oldest that was, or zero if none were), and the membership of a day's
+// digests depends only on the tweets from that day.
+func mergeShortTweetDigests(conf *Conf, tweets []*Tweet, now time.Time) ([]*Tweet, time.Time) {
+	if !conf.DigestShortTweets {
+		return tweets, time.Time{}
+	}
+
+	today := now.UTC().Truncate(24 * time.Hour)
+
+	days := make(map[time.Time][]*Tweet)
+	for _, tweet := range tweets {
+		if isDigestable(conf, tweet) {
+			day := tweet.CreatedAt.UTC().Truncate(24 * time.Hour)
+			days[day] = append(days[day], tweet)
+		}
+	}
+
+	var heldSince time.Time
+	var merged []*Tweet
+	bundled := make(map[int64]bool)
+
+	for day, dayTweets := range days {
+		if !day.Before(today) {
+			for _, tweet := range dayTweets {
+				bundled[tweet.ID] = true
+				if heldSince.IsZero() || tweet.CreatedAt.Before(heldSince) {
+					heldSince = tweet.CreatedAt
+				}
+			}
+			continue
+		}
+
+		if len(dayTweets) < conf.DigestMinCount {
+			continue
+		}
+
+		for _, tweet := range dayTweets {
+			bundled[tweet.ID] = true
+		}
+
+		// Oldest first.
+		sort.Slice(dayTweets, func(i, j int) bool { return dayTweets[i].ID < dayTweets[j].ID })
+		merged = append(merged, mergeDigest(dayTweets)...)
+	}
+
+	for _, tweet := range tweets {
+		if !bundled[tweet.ID] {
+			merged = append(merged, tweet)
+		}
+	}
+
+	sort.SliceStable(merged, func(i, j int) bool { return merged[i].ID > merged[j].ID })
+
+	return merged, heldSince
+}
+
+// mergeDigest merges tweets, ordered oldest first, into digest tweets whose
+// text is a bulleted list of theirs, starting a new digest whenever the list
+// would grow longer than a status allows.
+func mergeDigest(tweets []*Tweet) []*Tweet {
+	maxLength := defaultInstanceLimits.MaxCharacters
+
+	var digests []*Tweet
+	var current *Tweet
+	var lines []string
+	var length int
+
+	finish := func() {
+		if current == nil {
+			return
+		}
+
+		current.Text = strings.Join(lines, "\n")
+		digests = append(digests, current)
+		current, lines, length = nil, nil, 0
+	}
+
+	for _, tweet := range tweets {
+		line := digestBullet + digestLine(tweet)
+		lineLength := utf8.RuneCountInString(line)
+
+		if current != nil && length+1+lineLength > maxLength {
+			finish()
+		}
+
+		if current == nil {
+			current = &Tweet{Entities: &TweetEntities{}}
+		}
+
+		lines = append(lines, line)
+		length += lineLength + 1
+
+		current.CreatedAt = tweet.CreatedAt
+		current.ID = tweet.ID
+		current.FavoriteCount += tweet.FavoriteCount
+		current.RetweetCount += tweet.RetweetCount
+		current.mergedIDs = append(current.mergedIDs, tweet.ID)
+		current.author = tweet.author
+
+		if tweet.Entities != nil {
+			current.Entities.URLs = append(current.Entities.URLs, tweet.Entities.URLs...)
+			current.Entities.UserMentions = append(current.Entities.UserMentions, tweet.Entities.UserMentions...)
+		}
+	}
+
+	finish()
+
+	return digests
+}
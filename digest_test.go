@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	assert "github.com/stretchr/testify/require"
+)
+
+func TestMergeShortTweetDigests(t *testing.T) {
+	conf := &Conf{DigestMaxLength: 80, DigestMinCount: 3, DigestShortTweets: true}
+	now := time.Date(2021, 1, 3, 12, 0, 0, 0, time.UTC)
+
+	at := func(day, hour int) time.Time { return time.Date(2021, 1, day, hour, 0, 0, 0, time.UTC) }
+
+	substantive := &Tweet{ID: 6, CreatedAt: at(2, 12),
+		Text: "A substantive tweet with enough to say that it deserves to be posted on its own, without any others."}
+	tweets := []*Tweet{
+		{ID: 9, CreatedAt: at(3, 9), Text: "Short, but from today"},
+		{ID: 8, CreatedAt: at(2, 20), Text: "Good night"},
+		{ID: 7, CreatedAt: at(2, 15), Text: "Coffee  #2"},
+		substantive,
+		{ID: 5, CreatedAt: at(2, 9), Text: "Good morning"},
+		{ID: 4, CreatedAt: at(1, 20), Text: "Only one"},
+		{ID: 3, CreatedAt: at(1, 9), Text: "of two"},
+	}
+
+	merged, heldSince := mergeShortTweetDigests(conf, tweets, now)
+	assert.Equal(t, at(3, 9), heldSince)
+	assert.Len(t, merged, 4)
+
+	// The digest takes the place of its newest tweet.
+	digest := merged[0]
+	assert.Equal(t, int64(8), digest.ID)
+	assert.Equal(t, at(2, 20), digest.CreatedAt)
+	assert.Equal(t, "• Good morning\n• Coffee #2\n• Good night", digest.Text)
+	assert.Equal(t, []int64{5, 7, 8}, digest.mergedIDs)
+
+	assert.Equal(t, substantive, merged[1])
+
+	// Days with too few short tweets are left alone.
+	assert.Equal(t, int64(4), merged[2].ID)
+	assert.Equal(t, int64(3), merged[3].ID)
+
+	t.Run("SplitsLongDigests", func(t *testing.T) {
+		var tweets []*Tweet
+		for i := 20; i > 0; i-- {
+			tweets = append(tweets, &Tweet{ID: int64(i), CreatedAt: at(2, 0).Add(time.Duration(i) * time.Minute),
+				Text: "A short tweet that's still long enough to add up quickly"})
+		}
+
+		merged, _ := mergeShortTweetDigests(conf, tweets, now)
+		assert.Greater(t, len(merged), 1)
+		for _, digest := range merged {
+			assert.LessOrEqual(t, len([]rune(digest.Text)), defaultInstanceLimits.MaxCharacters)
+		}
+	})
+
+	t.Run("OffByDefault", func(t *testing.T) {
+		merged, heldSince := mergeShortTweetDigests(&Conf{}, tweets, now)
+		assert.True(t, heldSince.IsZero())
+		assert.Equal(t, tweets, merged)
+	})
+}
+
+func TestSyncTwitterDigestShortTweets(t *testing.T) {
+	source := writeTweetData(t, `
+[[tweets]]
+created_at = 2021-01-02T20:00:00Z
+id = 4
+text = "Good night"
+
+[[tweets]]
+created_at = 2021-01-02T15:00:00Z
+id = 3
+text = "Coffee"
+
+[[tweets]]
+created_at = 2021-01-02T12:00:00Z
+id = 2
+text = "A substantive tweet with enough to say that it deserves to be posted on its own, without any others."
+
+[[tweets]]
+created_at = 2021-01-02T09:00:00Z
+id = 1
+text = "Good morning"
+`)
+
+	conf := &Conf{
+		DigestMaxLength:   80,
+		DigestMinCount:    3,
+		DigestShortTweets: true,
+		MaxTweetsToSync:   10,
+		Yes:               true,
+	}
+
+	client := &fakeClient{}
+	assert.NoError(t, syncTwitter(context.Background(), conf, client, source))
+
+	assert.Len(t, client.postedToots, 2)
+	assert.Equal(t, "A substantive tweet with enough to say that it deserves to be posted on its own, without any others.",
+		client.postedToots[0].Status)
+	assert.Equal(t, "• Good morning\n• Coffee\n• Good night", client.postedToots[1].Status)
+}
+
+func TestSyncTwitterDigestAdvancesLastRunToHeldTweets(t *testing.T) {
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+
+	source := writeTweetData(t, fmt.Sprintf(`
+[[tweets]]
+created_at = %s
+id = 2
+text = "A substantive tweet with enough to say that it deserves to be posted on its own, without any others."
+
+[[tweets]]
+created_at = %s
+id = 1
+text = "Good morning"
+`, today.Add(2*time.Second).Format(time.RFC3339), today.Add(1*time.Second).Format(time.RFC3339)))
+
+	conf := &Conf{
+		DigestMaxLength:   80,
+		DigestMinCount:    3,
+		DigestShortTweets: true,
+		LastRunFile:       filepath.Join(t.TempDir(), "last_run"),
+		MaxTweetsToSync:   10,
+	}
+
+	client := &fakeClient{}
+	assert.NoError(t, syncTwitter(context.Background(), conf, client, source))
+	assert.Len(t, client.postedToots, 1)
+
+	// The last run stops just short of the short tweet held back for today's
+	// digest rather than staying where it was.
+	lastRun, err := readLastRun(conf.LastRunFile)
+	assert.NoError(t, err)
+	assert.Equal(t, today, lastRun)
+}
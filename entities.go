@@ -0,0 +1,84 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+)
+
+// validateEntities checks that the URL entities of tweets line up with their
+// text, which they don't in some exports that pair truncated text with the
+// entities of the full tweet. Expanding a URL that isn't in the text does
+// nothing, and one that's only in the text as part of a longer URL mangles it,
+// so both are caught here instead of failing silently while rendering.
+//
+// A URL that was cut off at the end of truncated text (like
+// `https://t.co/ab…`) is repaired by restoring it from its entity. The
+// entities of any other URLs that can't be found in the text are dropped with
+// a warning, unless the text already has them expanded.
+func validateEntities(conf *Conf, tweets []*Tweet) {
+	for _, tweet := range tweets {
+		if tweet.Entities == nil || len(tweet.Entities.URLs) < 1 {
+			continue
+		}
+
+		var urls []*TweetEntitiesURL
+		for _, url := range tweet.Entities.URLs {
+			if url.URL == "" || containsURL(tweet.Text, url.URL) ||
+				(url.ExpandedURL != "" && containsURL(tweet.Text, url.ExpandedURL)) {
+				urls = append(urls, url)
+				continue
+			}
+
+			if repaired, ok := repairTruncatedURL(tweet.Text, url.URL); ok {
+				logger.Infof("Repaired truncated URL %s in the text of tweet %v", logURL(conf, url.URL), tweet.ID)
+				tweet.Text = repaired
+				urls = append(urls, url)
+				continue
+			}
+
+			logger.Warnf("URL entity %s of tweet %v doesn't appear in its text, which may be truncated; "+
+				"ignoring it", logURL(conf, url.URL), tweet.ID)
+		}
+
+		tweet.Entities.URLs = urls
+	}
+}
+
+// containsURL checks whether text contains a URL as a whole rather than only
+// as the start of a longer one.
+func containsURL(text, url string) bool {
+	for offset := 0; ; {
+		i := strings.Index(text[offset:], url)
+		if i < 0 {
+			return false
+		}
+
+		if urlEndRE.MatchString(text[offset+i+len(url):]) {
+			return true
+		}
+
+		offset += i + 1
+	}
+}
+
+// urlEndRE matches text that may follow the end of a URL, which is the end of
+// the text, a character that can't be part of the URL, or punctuation that
+// ends a sentence.
+var urlEndRE = regexp.MustCompile(`^($|[^\w/.-]|[.-]($|\s))`)
+
+// repairTruncatedURL replaces the start of a URL that text was truncated in
+// the middle of, like `https://t.co/ab…`, with the whole URL.
+func repairTruncatedURL(text, url string) (string, bool) {
+	trimmed := strings.TrimRight(text, "…. ")
+	if trimmed == text {
+		return text, false
+	}
+
+	i := strings.LastIndexAny(trimmed, " \n")
+	fragment := trimmed[i+1:]
+	if len(fragment) < len("https://") || !strings.HasPrefix(url, fragment) {
+		return text, false
+	}
+
+	return trimmed[:i+1] + url, true
+}
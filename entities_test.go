@@ -0,0 +1,54 @@
+package main
+
+import (
+	"testing"
+
+	assert "github.com/stretchr/testify/require"
+)
+
+func TestValidateEntities(t *testing.T) {
+	newTweet := func(text string, urls ...*TweetEntitiesURL) *Tweet {
+		return &Tweet{ID: 1, Text: text, Entities: &TweetEntities{URLs: urls}}
+	}
+	blog := &TweetEntitiesURL{URL: "https://t.co/abc", ExpandedURL: "https://brandur.org/fragments"}
+
+	t.Run("Valid", func(t *testing.T) {
+		tweet := newTweet("New post: https://t.co/abc.", blog)
+		validateEntities(&Conf{}, []*Tweet{tweet})
+		assert.Equal(t, []*TweetEntitiesURL{blog}, tweet.Entities.URLs)
+		assert.Equal(t, "New post: https://brandur.org/fragments.", renderToot(&Conf{}, tweet))
+	})
+
+	t.Run("MissingFromText", func(t *testing.T) {
+		logs := captureLogger(t)
+
+		tweet := newTweet("A thought that was cut short", blog)
+		validateEntities(&Conf{}, []*Tweet{tweet})
+		assert.Empty(t, tweet.Entities.URLs)
+		assert.Contains(t, logs.String(), "URL entity https://t.co/abc of tweet 1 doesn't appear in its text")
+	})
+
+	t.Run("OnlyAsPartOfLongerURL", func(t *testing.T) {
+		logs := captureLogger(t)
+
+		// Expanding the entity would mangle the other link.
+		tweet := newTweet("Read this: https://t.co/abcdef", blog)
+		validateEntities(&Conf{}, []*Tweet{tweet})
+		assert.Empty(t, tweet.Entities.URLs)
+		assert.Equal(t, "Read this: https://t.co/abcdef", renderToot(&Conf{}, tweet))
+		assert.Contains(t, logs.String(), "URL entity https://t.co/abc of tweet 1 doesn't appear in its text")
+	})
+
+	t.Run("Truncated", func(t *testing.T) {
+		tweet := newTweet("A very long tweet about my new post https://t.co/a…", blog)
+		validateEntities(&Conf{}, []*Tweet{tweet})
+		assert.Equal(t, []*TweetEntitiesURL{blog}, tweet.Entities.URLs)
+		assert.Equal(t, "A very long tweet about my new post https://brandur.org/fragments", renderToot(&Conf{}, tweet))
+	})
+
+	t.Run("AlreadyExpanded", func(t *testing.T) {
+		tweet := newTweet("New post: https://brandur.org/fragments", blog)
+		validateEntities(&Conf{}, []*Tweet{tweet})
+		assert.Equal(t, []*TweetEntitiesURL{blog}, tweet.Entities.URLs)
+	})
+}
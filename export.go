@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ExportedTweet is a tweet's entry in the map of tweets to Mastodon statuses
+// produced by exportMap.
+//
+// IDs are strings so that they survive tools that parse JSON numbers as
+// floating point, which can't represent all 64-bit tweet IDs.
+type ExportedTweet struct {
+	TweetID   string     `json:"tweet_id"`
+	TweetURL  string     `json:"tweet_url"`
+	StatusID  string     `json:"status_id"`
+	StatusURL string     `json:"status_url,omitempty"`
+	PostedAt  *time.Time `json:"posted_at,omitempty"`
+}
+
+// exportMap writes a map of the tweets recorded in state to the Mastodon
+// statuses that they were posted as, for use by external tools. It's written
+// as CSV if the path has a `.csv` extension, and as a JSON array otherwise,
+// ordered by tweet ID.
+//
+// Only statuses that have been published are included. The status URL and
+// posting time aren't recorded by older versions of the program, and are
+// left empty for tweets posted by them.
+func exportMap(conf *Conf, state *State, path string) error {
+	var exported []*ExportedTweet
+	for tweetID, stateTweet := range state.Tweets {
+		if !stateTweet.ScheduledAt.IsZero() {
+			continue
+		}
+
+		var postedAt *time.Time
+		if !stateTweet.PostedAt.IsZero() {
+			t := stateTweet.PostedAt.UTC()
+			postedAt = &t
+		}
+
+		exported = append(exported, &ExportedTweet{
+			TweetID:   tweetID,
+			TweetURL:  tweetURL(conf, tweetID),
+			StatusID:  stateTweet.StatusID,
+			StatusURL: stateTweet.StatusURL,
+			PostedAt:  postedAt,
+		})
+	}
+
+	sort.Slice(exported, func(i, j int) bool {
+		// Keys were produced by formatting integers, so they always parse.
+		a, _ := strconv.ParseInt(exported[i].TweetID, 10, 64)
+		b, _ := strconv.ParseInt(exported[j].TweetID, 10, 64)
+		return a < b
+	})
+
+	var data []byte
+	if strings.EqualFold(filepath.Ext(path), ".csv") {
+		var buf bytes.Buffer
+		w := csv.NewWriter(&buf)
+		w.Write([]string{"tweet_id", "tweet_url", "status_id", "status_url", "posted_at"})
+		for _, tweet := range exported {
+			var postedAt string
+			if tweet.PostedAt != nil {
+				postedAt = tweet.PostedAt.Format(time.RFC3339)
+			}
+			w.Write([]string{tweet.TweetID, tweet.TweetURL, tweet.StatusID, tweet.StatusURL, postedAt})
+		}
+		w.Flush()
+		if err := w.Error(); err != nil {
+			return fmt.Errorf("error encoding CSV: %w", err)
+		}
+		data = buf.Bytes()
+	} else {
+		// An empty array rather than null when there's nothing to export.
+		if exported == nil {
+			exported = []*ExportedTweet{}
+		}
+
+		var err error
+		data, err = json.MarshalIndent(exported, "", "  ")
+		if err != nil {
+			return fmt.Errorf("error encoding JSON: %w", err)
+		}
+		data = append(data, '\n')
+	}
+
+	if err := writeFileAtomic(path, data); err != nil {
+		return fmt.Errorf("error writing export: %w", err)
+	}
+
+	logger.Infof("Exported %v tweet(s) to '%s'", len(exported), path)
+
+	return nil
+}
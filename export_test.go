@@ -0,0 +1,76 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mattn/go-mastodon"
+	assert "github.com/stretchr/testify/require"
+)
+
+func TestExportMap(t *testing.T) {
+	conf := &Conf{TwitterUser: "brandur"}
+	postedAt := time.Date(2021, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	// Seed a state file like one left behind by a few runs.
+	statePath := filepath.Join(t.TempDir(), "state.toml")
+	{
+		state := &State{}
+		state.recordTweetPost(20, &mastodon.Status{
+			ID:        "200",
+			URL:       "https://mastodon.example/@brandur/200",
+			CreatedAt: postedAt,
+		}, "public")
+		state.recordTweetStatus(3, "100", "public")
+		state.recordTweetScheduledStatus(30, "scheduled-1", "public", postedAt.Add(24*time.Hour))
+		assert.NoError(t, state.save(statePath))
+	}
+
+	state, err := loadState(statePath, false)
+	assert.NoError(t, err)
+
+	t.Run("JSON", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "map.json")
+		assert.NoError(t, exportMap(conf, state, path))
+
+		data, err := ioutil.ReadFile(path)
+		assert.NoError(t, err)
+		assert.JSONEq(t, `[
+			{
+				"tweet_id": "3",
+				"tweet_url": "https://twitter.com/brandur/status/3",
+				"status_id": "100"
+			},
+			{
+				"tweet_id": "20",
+				"tweet_url": "https://twitter.com/brandur/status/20",
+				"status_id": "200",
+				"status_url": "https://mastodon.example/@brandur/200",
+				"posted_at": "2021-01-02T03:04:05Z"
+			}
+		]`, string(data))
+	})
+
+	t.Run("CSV", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "map.csv")
+		assert.NoError(t, exportMap(&Conf{}, state, path))
+
+		data, err := ioutil.ReadFile(path)
+		assert.NoError(t, err)
+		assert.Equal(t, "tweet_id,tweet_url,status_id,status_url,posted_at\n"+
+			"3,https://twitter.com/i/web/status/3,100,,\n"+
+			"20,https://twitter.com/i/web/status/20,200,https://mastodon.example/@brandur/200,2021-01-02T03:04:05Z\n",
+			string(data))
+	})
+
+	t.Run("Empty", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "map.json")
+		assert.NoError(t, exportMap(conf, &State{}, path))
+
+		data, err := ioutil.ReadFile(path)
+		assert.NoError(t, err)
+		assert.Equal(t, "[]\n", string(data))
+	})
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/mattn/go-mastodon"
+)
+
+// findGaps finds the candidates that follow at least GapNotes consecutive
+// tweets that were left out by selectTweetCandidates, returning the number
+// of tweets skipped before each, keyed by candidate ID. Replies to other
+// people are left out as a matter of course rather than by a filter, so they
+// don't count towards a gap.
+//
+// Gaps are rate limited to one every GapNoteMinInterval by the creation
+// times of the tweets that end them. Gaps are found across the whole source
+// rather than just the tweets being synced so that the same ones are found
+// every run.
+func findGaps(conf *Conf, allTweets, candidates []*Tweet) map[int64]int {
+	if conf.GapNotes < 1 {
+		return nil
+	}
+
+	selected := make(map[int64]bool)
+	for _, tweet := range candidates {
+		selected[tweet.ID] = true
+	}
+
+	gaps := make(map[int64]int)
+	var lastNoted time.Time
+	var skipped int
+
+	// Tweets are ordered by descending ID, so walk them oldest first.
+	for i := len(allTweets) - 1; i >= 0; i-- {
+		tweet := allTweets[i]
+		if tweet.ID < conf.MinTweetID {
+			continue
+		}
+
+		if !selected[tweet.ID] {
+			if tweet.Reply == nil || isThreadReply(conf, tweet) {
+				skipped++
+			}
+			continue
+		}
+
+		if skipped >= conf.GapNotes {
+			if lastNoted.IsZero() || tweet.CreatedAt.IsZero() ||
+				tweet.CreatedAt.Sub(lastNoted) >= conf.GapNoteMinInterval {
+				gaps[tweet.ID] = skipped
+				lastNoted = tweet.CreatedAt
+			}
+		}
+		skipped = 0
+	}
+
+	return gaps
+}
+
+// gapBefore returns the number of tweets skipped before a tweet to sync
+// according to gaps (see findGaps), including before the oldest of the tweets
+// merged into it, if any.
+func gapBefore(gaps map[int64]int, tweet *Tweet) int {
+	if skipped, ok := gaps[tweet.ID]; ok {
+		return skipped
+	}
+
+	for _, mergedID := range tweet.mergedIDs {
+		if skipped, ok := gaps[mergedID]; ok {
+			return skipped
+		}
+	}
+
+	return 0
+}
+
+// postGapNote posts GapNoteText ahead of a tweet that follows a gap of
+// skipped tweets so that followers aren't left wondering about the jump in
+// time. The note is recorded in state so that a retry after the tweet fails
+// to post doesn't post it twice, and is posted with an idempotency key derived
+// from the tweet in case state can't be saved.
+func postGapNote(ctx context.Context, conf *Conf, client mastodonClient, state *State, tweet *Tweet, skipped int) error {
+	if statusID, ok := state.gapNoteStatusID(tweet.ID); ok {
+		logger.Infof("Gap note before tweet %v was already posted as Mastodon status %v", tweet.ID, statusID)
+		return nil
+	}
+
+	if conf.DryRun {
+		logger.Infof("Would have posted gap note before tweet %v after %v skipped tweet(s)", tweet.ID, skipped)
+		return nil
+	}
+
+	status, err := client.PostStatus(withIdempotencyKey(ctx, fmt.Sprintf("gap-%v", tweet.ID)), &mastodon.Toot{
+		Status:     conf.GapNoteText,
+		Visibility: string(conf.Visibility),
+	})
+	if err != nil {
+		return fmt.Errorf("error posting gap note: %w", err)
+	}
+
+	state.recordGapNote(tweet.ID, status.ID)
+
+	logger.Infof("Posted gap note %v before tweet %v after %v skipped tweet(s)", status.ID, tweet.ID, skipped)
+
+	return nil
+}
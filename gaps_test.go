@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mattn/go-mastodon"
+	assert "github.com/stretchr/testify/require"
+)
+
+func TestFindGaps(t *testing.T) {
+	day := func(d int) time.Time { return time.Date(2021, 1, d, 12, 0, 0, 0, time.UTC) }
+
+	// Newest first, like the source.
+	allTweets := []*Tweet{
+		{ID: 9, CreatedAt: day(9)},
+		{ID: 8, CreatedAt: day(8)},
+		{ID: 7, CreatedAt: day(7)},
+		{ID: 6, CreatedAt: day(6), Reply: &TweetReply{StatusID: 100, User: "someone"}},
+		{ID: 5, CreatedAt: day(5)},
+		{ID: 4, CreatedAt: day(4)},
+		{ID: 3, CreatedAt: day(3)},
+		{ID: 2, CreatedAt: day(2)},
+		{ID: 1, CreatedAt: day(1)},
+	}
+	candidates := []*Tweet{allTweets[0], allTweets[4], allTweets[8]}
+
+	conf := &Conf{GapNotes: 3}
+
+	// The reply to someone else doesn't count, so tweet 9 only follows two
+	// skipped tweets.
+	assert.Equal(t, map[int64]int{5: 3}, findGaps(conf, allTweets, candidates))
+
+	t.Run("Off", func(t *testing.T) {
+		assert.Nil(t, findGaps(&Conf{}, allTweets, candidates))
+	})
+
+	t.Run("RateLimited", func(t *testing.T) {
+		conf := &Conf{GapNotes: 2}
+		assert.Equal(t, map[int64]int{5: 3, 9: 2}, findGaps(conf, allTweets, candidates))
+
+		conf.GapNoteMinInterval = 5 * 24 * time.Hour
+		assert.Equal(t, map[int64]int{5: 3}, findGaps(conf, allTweets, candidates))
+	})
+}
+
+func TestPostGapNote(t *testing.T) {
+	source := writeTweetData(t, `
+[[tweets]]
+id = 6
+created_at = 2021-01-06T12:00:00Z
+text = "Back from a long hike through the hills."
+
+[[tweets]]
+id = 5
+created_at = 2021-01-05T12:00:00Z
+text = "Nice"
+
+[[tweets]]
+id = 4
+created_at = 2021-01-04T12:00:00Z
+text = "Yes"
+
+[[tweets]]
+id = 3
+created_at = 2021-01-03T12:00:00Z
+text = "Ha"
+
+[[tweets]]
+id = 2
+created_at = 2021-01-02T12:00:00Z
+text = "Good morning, everyone, from a very rainy city."
+
+[[tweets]]
+id = 1
+created_at = 2021-01-01T12:00:00Z
+text = "Ok"
+`)
+
+	conf := &Conf{
+		GapNoteText:       "(some tweets from this period weren't crossposted)",
+		GapNotes:          3,
+		MaxTweetsToSync:   10,
+		MinAuthoredLength: 10,
+	}
+
+	client := &fakeClient{}
+	assert.NoError(t, syncTwitter(context.Background(), conf, client, source))
+
+	// Exactly one gap note, ahead of the tweet that follows the gap.
+	var statuses []string
+	for _, toot := range client.postedToots {
+		statuses = append(statuses, toot.Status)
+	}
+	assert.Equal(t, []string{
+		"Good morning, everyone, from a very rainy city.",
+		"(some tweets from this period weren't crossposted)",
+		"Back from a long hike through the hills.",
+	}, statuses)
+
+	t.Run("DryRun", func(t *testing.T) {
+		conf := *conf
+		conf.DryRun = true
+
+		client := &fakeClient{}
+		logs := captureLogger(t)
+		assert.NoError(t, syncTwitter(context.Background(), &conf, client, source))
+		assert.Empty(t, client.postedToots)
+		assert.Contains(t, logs.String(), "Would have posted gap note before tweet 6 after 3 skipped tweet(s)")
+	})
+
+	t.Run("NotPostedTwice", func(t *testing.T) {
+		conf := *conf
+		conf.StateFile = filepath.Join(t.TempDir(), "state.toml")
+
+		client := &fakeClient{}
+		assert.NoError(t, syncTwitter(context.Background(), &conf, client, source))
+		assert.Len(t, client.postedToots, 3)
+
+		state, err := loadState(conf.StateFile, false)
+		assert.NoError(t, err)
+		assert.Equal(t, map[string]string{"6": "2"}, state.GapNotes)
+
+		// As if the tweet after the gap had failed to post after its note.
+		delete(state.Tweets, "6")
+		assert.NoError(t, state.save(conf.StateFile))
+
+		client = &fakeClient{}
+		logs := captureLogger(t)
+		assert.NoError(t, syncTwitter(context.Background(), &conf, client, source))
+		assert.Len(t, client.postedToots, 1)
+		assert.Equal(t, "Back from a long hike through the hills.", client.postedToots[0].Status)
+		assert.Contains(t, logs.String(), "Gap note before tweet 6 was already posted as Mastodon status 2")
+	})
+
+	t.Run("NotForMatchedTweets", func(t *testing.T) {
+		client := &fakeClient{statuses: []*mastodon.Status{
+			{ID: "200", Content: `<p>Back from a long hike through the hills.</p>`},
+		}}
+		assert.NoError(t, syncTwitter(context.Background(), conf, client, source))
+		assert.Empty(t, client.postedToots)
+	})
+}
@@ -1,14 +1,22 @@
 module github.com/brandur/mastodon-cross-post
 
-go 1.16
+go 1.21
 
 require (
-	github.com/agnivade/levenshtein v1.1.0 // indirect
-	github.com/gorilla/websocket v1.4.2 // indirect
-	github.com/grokify/html-strip-tags-go v0.0.1 // indirect
-	github.com/joeshaw/envdecode v0.0.0-20200121155833-099f1fc765bd // indirect
-	github.com/mattn/go-mastodon v0.0.4 // indirect
-	github.com/pelletier/go-toml v1.8.1 // indirect
-	github.com/stretchr/testify v1.6.1 // indirect
+	github.com/agnivade/levenshtein v1.1.0
+	github.com/grokify/html-strip-tags-go v0.0.1
+	github.com/joeshaw/envdecode v0.0.0-20200121155833-099f1fc765bd
+	github.com/mattn/go-mastodon v0.0.9
+	github.com/pelletier/go-toml v1.8.1
+	github.com/stretchr/testify v1.6.1
+	golang.org/x/net v0.25.0
+	golang.org/x/text v0.16.0
+)
+
+require (
+	github.com/davecgh/go-spew v1.1.1 // indirect
+	github.com/gorilla/websocket v1.5.1 // indirect
+	github.com/pmezard/go-difflib v1.0.0 // indirect
+	github.com/tomnomnom/linkheader v0.0.0-20180905144013-02ca5825eb80 // indirect
 	gopkg.in/yaml.v3 v3.0.0-20210107192922-496545a6307b // indirect
 )
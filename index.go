@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// indexSnippetLength is the maximum length of the snippets of statuses' text
+// recorded in state for generateIndex.
+const indexSnippetLength = 140
+
+// twitterEpoch is the epoch of the timestamps embedded in tweet IDs.
+var twitterEpoch = time.UnixMilli(1288834974657).UTC()
+
+// minTimestampedTweetID is the lowest ID of a tweet with a timestamp embedded
+// in it. IDs of older tweets were assigned sequentially.
+const minTimestampedTweetID = 30_000_000_000
+
+// IndexedTweet is a tweet's entry in the index of crossposts produced by
+// generateIndex.
+type IndexedTweet struct {
+	Snippet   string
+	StatusURL string
+	TweetID   string
+	TweetURL  string
+	TweetedAt time.Time
+}
+
+// indexTemplate renders the index of crossposts as HTML. It's also valid XML
+// so that it's easy to process further.
+var indexTemplate = template.Must(template.New("index").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8" />
+<title>Crossposted tweets</title>
+</head>
+<body>
+<h1>Crossposted tweets</h1>
+<ol>
+{{- range .}}
+<li>
+{{- if not .TweetedAt.IsZero}}<time datetime="{{.TweetedAt.Format "2006-01-02T15:04:05Z07:00"}}">{{.TweetedAt.Format "January 2, 2006"}}</time>: {{end -}}
+{{if .StatusURL}}<a href="{{.StatusURL}}">{{or .Snippet "(no text)"}}</a>{{else}}{{or .Snippet "(no text)"}}{{end}} (<a href="{{.TweetURL}}">original</a>)</li>
+{{- end}}
+</ol>
+</body>
+</html>
+`))
+
+// jsonFeed is a JSON Feed (https://jsonfeed.org/version/1.1) of crossposts.
+type jsonFeed struct {
+	Version string          `json:"version"`
+	Title   string          `json:"title"`
+	Items   []*jsonFeedItem `json:"items"`
+}
+
+type jsonFeedItem struct {
+	ID            string     `json:"id"`
+	URL           string     `json:"url,omitempty"`
+	ExternalURL   string     `json:"external_url"`
+	ContentText   string     `json:"content_text"`
+	DatePublished *time.Time `json:"date_published,omitempty"`
+}
+
+// generateIndex writes an index of the tweets recorded in state as having
+// been crossposted, with each tweet's date, a snippet of its text, and a link
+// to the Mastodon status it was posted as, for embedding as an archive on a
+// website. It's written as a JSON Feed if the path has a `.json` extension,
+// and as HTML otherwise, ordered chronologically.
+//
+// Only statuses that have been published are included. Snippets and status
+// URLs aren't recorded by older versions of the program, and are left out
+// for tweets posted by them, as are the dates of tweets from before Twitter
+// started embedding timestamps in IDs.
+func generateIndex(conf *Conf, state *State, path string) error {
+	var indexed []*IndexedTweet
+	for tweetID, stateTweet := range state.Tweets {
+		if !stateTweet.ScheduledAt.IsZero() {
+			continue
+		}
+
+		// Keys were produced by formatting integers, so they always parse.
+		id, _ := strconv.ParseInt(tweetID, 10, 64)
+
+		indexed = append(indexed, &IndexedTweet{
+			Snippet:   stateTweet.Snippet,
+			StatusURL: stateTweet.StatusURL,
+			TweetID:   tweetID,
+			TweetURL:  tweetURL(conf, tweetID),
+			TweetedAt: tweetIDTime(id),
+		})
+	}
+
+	// Tweet IDs increase over time, including those without timestamps.
+	sort.Slice(indexed, func(i, j int) bool {
+		a, _ := strconv.ParseInt(indexed[i].TweetID, 10, 64)
+		b, _ := strconv.ParseInt(indexed[j].TweetID, 10, 64)
+		return a < b
+	})
+
+	var data []byte
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		feed := &jsonFeed{
+			Version: "https://jsonfeed.org/version/1.1",
+			Title:   "Crossposted tweets",
+			Items:   []*jsonFeedItem{},
+		}
+		for _, tweet := range indexed {
+			item := &jsonFeedItem{
+				ID:          tweet.TweetID,
+				URL:         tweet.StatusURL,
+				ExternalURL: tweet.TweetURL,
+				ContentText: tweet.Snippet,
+			}
+			if !tweet.TweetedAt.IsZero() {
+				item.DatePublished = &tweet.TweetedAt
+			}
+			feed.Items = append(feed.Items, item)
+		}
+
+		var err error
+		data, err = json.MarshalIndent(feed, "", "  ")
+		if err != nil {
+			return fmt.Errorf("error encoding JSON: %w", err)
+		}
+		data = append(data, '\n')
+	} else {
+		var buf bytes.Buffer
+		if err := indexTemplate.Execute(&buf, indexed); err != nil {
+			return fmt.Errorf("error rendering HTML: %w", err)
+		}
+		data = buf.Bytes()
+	}
+
+	if err := writeFileAtomic(path, data); err != nil {
+		return fmt.Errorf("error writing index: %w", err)
+	}
+
+	logger.Infof("Wrote index of %v tweet(s) to '%s'", len(indexed), path)
+
+	return nil
+}
+
+// tweetIDTime returns the time embedded in a tweet's ID, or the zero time for
+// tweets from before Twitter started embedding them.
+func tweetIDTime(id int64) time.Time {
+	if id < minTimestampedTweetID {
+		return time.Time{}
+	}
+
+	return twitterEpoch.Add(time.Duration(id>>22) * time.Millisecond)
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mattn/go-mastodon"
+	assert "github.com/stretchr/testify/require"
+)
+
+func TestGenerateIndex(t *testing.T) {
+	conf := &Conf{TwitterUser: "brandur"}
+
+	// Seed a state file like one left behind by a few runs, with tweets
+	// recorded out of order.
+	statePath := filepath.Join(t.TempDir(), "state.toml")
+	{
+		state := &State{}
+		state.recordTweetPost(1600000000000000000, &mastodon.Status{
+			ID:      "200",
+			URL:     "https://mastodon.example/@brandur/200",
+			Content: `<p>Comparing <code>a &lt; b</code> &amp; "c"</p><p>&lt;script&gt;alert(1)&lt;/script&gt;</p>`,
+		}, "public")
+		state.recordTweetPost(1500000000000000000, &mastodon.Status{
+			ID:      "100",
+			URL:     "https://mastodon.example/@brandur/100",
+			Content: `<p>An older tweet</p>`,
+		}, "public")
+		state.recordTweetStatus(3, "50", "public")
+		state.recordTweetScheduledStatus(1700000000000000000, "scheduled-1", "public", time.Now())
+		assert.NoError(t, state.save(statePath))
+	}
+
+	state, err := loadState(statePath, false)
+	assert.NoError(t, err)
+
+	t.Run("HTML", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "index.html")
+		assert.NoError(t, generateIndex(conf, state, path))
+
+		data, err := ioutil.ReadFile(path)
+		assert.NoError(t, err)
+
+		// Well formed.
+		decoder := xml.NewDecoder(bytes.NewReader(data))
+		for {
+			_, err := decoder.Token()
+			if err == io.EOF {
+				break
+			}
+			assert.NoError(t, err)
+		}
+
+		assert.Contains(t, string(data), `<ol>
+<li>(no text) (<a href="https://twitter.com/brandur/status/3">original</a>)</li>
+<li><time datetime="2022-03-05T06:47:23Z">March 5, 2022</time>: <a href="https://mastodon.example/@brandur/100">An older tweet</a> (<a href="https://twitter.com/brandur/status/1500000000000000000">original</a>)</li>
+<li><time datetime="2022-12-06T05:31:41Z">December 6, 2022</time>: <a href="https://mastodon.example/@brandur/200">Comparing a &lt; b &amp; &#34;c&#34; &lt;script&gt;alert(1)&lt;/script&gt;</a> (<a href="https://twitter.com/brandur/status/1600000000000000000">original</a>)</li>
+</ol>`)
+		assert.NotContains(t, string(data), "scheduled")
+	})
+
+	t.Run("JSONFeed", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "index.json")
+		assert.NoError(t, generateIndex(conf, state, path))
+
+		data, err := ioutil.ReadFile(path)
+		assert.NoError(t, err)
+		assert.JSONEq(t, `{
+			"version": "https://jsonfeed.org/version/1.1",
+			"title": "Crossposted tweets",
+			"items": [
+				{
+					"id": "3",
+					"external_url": "https://twitter.com/brandur/status/3",
+					"content_text": ""
+				},
+				{
+					"id": "1500000000000000000",
+					"url": "https://mastodon.example/@brandur/100",
+					"external_url": "https://twitter.com/brandur/status/1500000000000000000",
+					"content_text": "An older tweet",
+					"date_published": "2022-03-05T06:47:23.309Z"
+				},
+				{
+					"id": "1600000000000000000",
+					"url": "https://mastodon.example/@brandur/200",
+					"external_url": "https://twitter.com/brandur/status/1600000000000000000",
+					"content_text": "Comparing a < b & \"c\" <script>alert(1)</script>",
+					"date_published": "2022-12-06T05:31:41.219Z"
+				}
+			]
+		}`, string(data))
+	})
+}
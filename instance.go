@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"mime"
+	"os"
+	"path"
+	"strings"
+	"unicode/utf8"
+)
+
+// InstanceLimits are limits on new statuses imposed by a Mastodon server.
+type InstanceLimits struct {
+	// MaxCharacters is the maximum weighted length of a status.
+	MaxCharacters int
+
+	// MaxMediaAttachments is the maximum number of media attachments that a
+	// status may have.
+	MaxMediaAttachments int
+
+	// SupportedMIMETypes are the MIME types of media that the server will
+	// accept as uploads.
+	SupportedMIMETypes []string
+
+	// URLWeight is the number of characters that a URL counts as when
+	// measuring a status' length.
+	URLWeight int
+}
+
+// defaultInstanceLimits are the limits used for a server that doesn't
+// advertise its own, which are those of a stock Mastodon installation.
+var defaultInstanceLimits = InstanceLimits{
+	MaxCharacters:       500,
+	MaxMediaAttachments: 4,
+	SupportedMIMETypes: []string{
+		"image/gif",
+		"image/jpeg",
+		"image/png",
+		"image/webp",
+		"video/mp4",
+		"video/quicktime",
+		"video/webm",
+	},
+	URLWeight: 23,
+}
+
+// instanceLimits are the limits of the server being posted to. They're set on
+// startup by fetchInstanceLimits, and are the defaults until then.
+var instanceLimits = &defaultInstanceLimits
+
+// fetchInstanceLimits fetches the limits on new statuses advertised by a
+// Mastodon server through its instance configuration. Any limits that the
+// server doesn't advertise (older versions of Mastodon advertise none at all)
+// fall back to the defaults of its software (see ServerProfile).
+func fetchInstanceLimits(ctx context.Context, client mastodonClient) (*InstanceLimits, error) {
+	instance, err := client.GetInstance(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error getting instance: %w", err)
+	}
+
+	limits := serverProfile.DefaultLimits
+
+	config := instance.Configuration
+	if config == nil {
+		return &limits, nil
+	}
+
+	if config.Statuses != nil {
+		statuses := *config.Statuses
+
+		if v, ok := statuses["max_characters"]; ok && v > 0 {
+			limits.MaxCharacters = v
+		}
+		if v, ok := statuses["max_media_attachments"]; ok && v > 0 {
+			limits.MaxMediaAttachments = v
+		}
+		if v, ok := statuses["characters_reserved_per_url"]; ok && v > 0 {
+			limits.URLWeight = v
+		}
+	}
+
+	if mimeTypes, ok := config.MediaAttachments["supported_mime_types"].([]interface{}); ok {
+		var supported []string
+		for _, mimeType := range mimeTypes {
+			if s, ok := mimeType.(string); ok {
+				supported = append(supported, s)
+			}
+		}
+
+		if len(supported) > 0 {
+			limits.SupportedMIMETypes = supported
+		}
+	}
+
+	return &limits, nil
+}
+
+// TweetValidation is the result of validating a tweet's rendered toot against
+// a server's limits.
+type TweetValidation struct {
+	Tweet      *Tweet
+	Violations []string
+}
+
+// validateTweet checks the toot that would be rendered for a tweet against a
+// server's limits, returning a description of each limit that it violates.
+//
+// Media MIME types are guessed based on extension so that validation can be
+// done without fetching anything.
+func validateTweet(conf *Conf, limits *InstanceLimits, tweet *Tweet) *TweetValidation {
+	validation := &TweetValidation{Tweet: tweet}
+
+	// Mastodon counts spoiler text toward a status' length.
+	length := weightedLength(renderToot(conf, tweet), limits.URLWeight) +
+		utf8.RuneCountInString(tweetSpoilerText(conf, tweet))
+
+	if length > limits.MaxCharacters {
+		validation.Violations = append(validation.Violations,
+			fmt.Sprintf("length %d exceeds maximum of %d characters", length, limits.MaxCharacters))
+	}
+
+	if tweet.Entities != nil {
+		var numPhotos int
+		for _, media := range tweet.Entities.Medias {
+			if media.Type != "photo" {
+				continue
+			}
+			numPhotos++
+
+			mimeType := mime.TypeByExtension(path.Ext(media.URL))
+			if mimeType == "" {
+				continue
+			}
+
+			// Strip any parameters like `; charset=utf-8`.
+			mimeType = strings.TrimSpace(strings.Split(mimeType, ";")[0])
+
+			if !containsString(limits.SupportedMIMETypes, mimeType) {
+				validation.Violations = append(validation.Violations,
+					fmt.Sprintf("media %v has unsupported type %s", media.ID, mimeType))
+			}
+		}
+
+		// Photos that don't fit are left to the overflow note instead.
+		if numPhotos > limits.MaxMediaAttachments && conf.OverflowMediaNote == "" {
+			validation.Violations = append(validation.Violations,
+				fmt.Sprintf("%d media attachments exceeds maximum of %d", numPhotos, limits.MaxMediaAttachments))
+		}
+	}
+
+	return validation
+}
+
+// validateTweets validates the toots that would be rendered for the given
+// tweets against the limits of the Mastodon server, writing a report to
+// stdout. Returns an error if any tweet failed validation.
+func validateTweets(ctx context.Context, conf *Conf, client mastodonClient, tweets []*Tweet) error {
+	limits, err := fetchInstanceLimits(ctx, client)
+	if err != nil {
+		return err
+	}
+
+	var validations []*TweetValidation
+	for _, tweet := range tweets {
+		validations = append(validations, validateTweet(conf, limits, tweet))
+	}
+
+	numFailed := writeValidationReport(os.Stdout, validations)
+	if numFailed > 0 {
+		return fmt.Errorf("%d tweet(s) failed validation", numFailed)
+	}
+
+	return nil
+}
+
+// writeValidationReport writes a pass/fail line for each validated tweet
+// along with any of its violations. Returns the number of tweets that failed.
+func writeValidationReport(w io.Writer, validations []*TweetValidation) int {
+	var numFailed int
+
+	for _, validation := range validations {
+		if len(validation.Violations) < 1 {
+			fmt.Fprintf(w, "PASS %v\n", validation.Tweet.ID)
+			continue
+		}
+
+		numFailed++
+		fmt.Fprintf(w, "FAIL %v\n", validation.Tweet.ID)
+		for _, violation := range validation.Violations {
+			fmt.Fprintf(w, "  - %s\n", violation)
+		}
+	}
+
+	fmt.Fprintf(w, "%d tweet(s) validated, %d failed\n", len(validations), numFailed)
+
+	return numFailed
+}
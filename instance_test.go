@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/mattn/go-mastodon"
+	assert "github.com/stretchr/testify/require"
+)
+
+func TestFetchInstanceLimits(t *testing.T) {
+	t.Run("Defaults", func(t *testing.T) {
+		limits, err := fetchInstanceLimits(context.Background(), &fakeClient{})
+		assert.NoError(t, err)
+		assert.Equal(t, defaultInstanceLimits, *limits)
+	})
+
+	t.Run("FromConfiguration", func(t *testing.T) {
+		limits, err := fetchInstanceLimits(context.Background(), &fakeClient{
+			instance: &mastodon.Instance{
+				Configuration: &mastodon.InstanceConfig{
+					Statuses: &mastodon.InstanceConfigMap{
+						"characters_reserved_per_url": 20,
+						"max_characters":              1000,
+						"max_media_attachments":       6,
+					},
+					MediaAttachments: map[string]interface{}{
+						"supported_mime_types": []interface{}{"image/jpeg", "image/png"},
+					},
+				},
+			},
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, InstanceLimits{
+			MaxCharacters:       1000,
+			MaxMediaAttachments: 6,
+			SupportedMIMETypes:  []string{"image/jpeg", "image/png"},
+			URLWeight:           20,
+		}, *limits)
+	})
+}
+
+func TestValidateTweet(t *testing.T) {
+	limits := &InstanceLimits{
+		MaxCharacters:       50,
+		MaxMediaAttachments: 1,
+		SupportedMIMETypes:  []string{"image/jpeg"},
+		URLWeight:           23,
+	}
+
+	validTweet := &Tweet{
+		ID:   1,
+		Text: `A short tweet https://example.com/a/long/link/that/counts/as/23`,
+		Entities: &TweetEntities{
+			Medias: []*TweetEntitiesMedia{
+				{ID: 10, Type: "photo", URL: "https://pbs.twimg.com/media/image.jpg"},
+			},
+		},
+	}
+
+	invalidTweet := &Tweet{
+		ID:   2,
+		Text: strings.Repeat("x", 51),
+		Entities: &TweetEntities{
+			Medias: []*TweetEntitiesMedia{
+				{ID: 20, Type: "photo", URL: "https://pbs.twimg.com/media/image.jpg"},
+				{ID: 21, Type: "photo", URL: "https://pbs.twimg.com/media/image.svg"},
+			},
+		},
+	}
+
+	validations := []*TweetValidation{
+		validateTweet(&Conf{}, limits, validTweet),
+		validateTweet(&Conf{}, limits, invalidTweet),
+	}
+
+	assert.Empty(t, validations[0].Violations)
+	assert.Len(t, validations[1].Violations, 3)
+
+	var buf bytes.Buffer
+	numFailed := writeValidationReport(&buf, validations)
+	assert.Equal(t, 1, numFailed)
+	assert.Equal(t, `PASS 1
+FAIL 2
+  - length 51 exceeds maximum of 50 characters
+  - media 21 has unsupported type image/svg+xml
+  - 2 media attachments exceeds maximum of 1
+2 tweet(s) validated, 1 failed
+`, buf.String())
+}
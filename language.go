@@ -0,0 +1,126 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// languageScripts maps Unicode scripts that are (mostly) used by a single
+// language to that language's ISO 639-1 code. Han is handled separately
+// because it's shared by Chinese and Japanese.
+var languageScripts = []struct {
+	language string
+	script   *unicode.RangeTable
+}{
+	{"ar", unicode.Arabic},
+	{"el", unicode.Greek},
+	{"he", unicode.Hebrew},
+	{"hi", unicode.Devanagari},
+	{"ja", unicode.Hiragana},
+	{"ja", unicode.Katakana},
+	{"ko", unicode.Hangul},
+	{"ru", unicode.Cyrillic},
+	{"th", unicode.Thai},
+}
+
+// languageStopwords are common short words for languages written in the Latin
+// script, which are counted to guess which language a text is in. Words that
+// are shared between languages count toward each of them.
+var languageStopwords = map[string][]string{
+	"de": {"der", "die", "das", "und", "ist", "nicht", "ich", "mit", "sich", "auf", "für", "ein", "eine", "auch", "wir", "aber", "noch", "wie", "nach", "sind"},
+	"en": {"the", "and", "is", "are", "was", "of", "to", "that", "it", "this", "with", "for", "you", "have", "not", "but", "be", "just", "my", "what"},
+	"es": {"el", "la", "los", "las", "y", "es", "que", "del", "por", "una", "con", "para", "pero", "muy", "como", "más", "está", "yo", "su", "lo"},
+	"fr": {"le", "les", "et", "est", "une", "des", "du", "que", "pas", "pour", "dans", "avec", "sur", "je", "nous", "vous", "mais", "qui", "ce", "très"},
+	"it": {"il", "gli", "e", "è", "che", "di", "della", "per", "una", "non", "sono", "con", "ma", "anche", "questo", "io", "mi", "ho", "molto", "come"},
+	"nl": {"de", "het", "een", "en", "is", "van", "niet", "dat", "ik", "met", "voor", "op", "maar", "ook", "zijn", "wat", "je", "we", "nog", "als"},
+	"pt": {"o", "os", "as", "e", "é", "que", "do", "da", "não", "uma", "com", "para", "mas", "muito", "como", "eu", "em", "um", "isso", "está"},
+}
+
+// minLanguageStopwords is the minimum number of stopwords that must be found
+// for a text in the Latin script before its language is detected with any
+// confidence.
+const minLanguageStopwords = 2
+
+// languageNoiseRE matches parts of a tweet that say nothing about the
+// language it's written in, like URLs, mentions, and hashtags.
+var languageNoiseRE = regexp.MustCompile(`https?://\S+|[@#]\w+`)
+
+// detectLanguage makes a lightweight guess at the language that text is
+// written in, returning its ISO 639-1 code and whether the guess was made
+// with any confidence. Languages written in a script of their own are detected
+// by script, and a handful of common languages written in the Latin script
+// are detected by counting common words. Anything else (including text that's
+// too short to say) isn't detected confidently.
+func detectLanguage(text string) (string, bool) {
+	text = languageNoiseRE.ReplaceAllString(text, " ")
+
+	scriptCounts := make(map[string]int)
+	var numHan, numLetters int
+
+	for _, r := range text {
+		if !unicode.IsLetter(r) {
+			continue
+		}
+		numLetters++
+
+		if unicode.Is(unicode.Han, r) {
+			numHan++
+			continue
+		}
+
+		for _, languageScript := range languageScripts {
+			if unicode.Is(languageScript.script, r) {
+				scriptCounts[languageScript.language]++
+				break
+			}
+		}
+	}
+
+	if numLetters < 1 {
+		return "", false
+	}
+
+	for language, count := range scriptCounts {
+		if count*2 > numLetters {
+			return language, true
+		}
+	}
+
+	// Japanese mixes Han with kana, so Han on its own suggests Chinese.
+	if numHan*2 > numLetters {
+		if scriptCounts["ja"] > 0 {
+			return "ja", true
+		}
+		return "zh", true
+	}
+
+	wordCounts := make(map[string]int)
+	for _, word := range strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && r != '\''
+	}) {
+		for language, stopwords := range languageStopwords {
+			if containsString(stopwords, word) {
+				wordCounts[language]++
+			}
+		}
+	}
+
+	var best, runnerUp int
+	var bestLanguage string
+	for language, count := range wordCounts {
+		switch {
+		case count > best:
+			runnerUp = best
+			best, bestLanguage = count, language
+		case count > runnerUp:
+			runnerUp = count
+		}
+	}
+
+	if best < minLanguageStopwords || best == runnerUp {
+		return bestLanguage, false
+	}
+
+	return bestLanguage, true
+}
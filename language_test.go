@@ -0,0 +1,31 @@
+package main
+
+import (
+	"testing"
+
+	assert "github.com/stretchr/testify/require"
+)
+
+func TestDetectLanguage(t *testing.T) {
+	testCases := []struct {
+		text      string
+		language  string
+		confident bool
+	}{
+		{`This is the best write up of the new release that I've seen so far https://example.com`, "en", true},
+		{`Esta es la mejor explicación de la nueva versión que he visto hasta ahora`, "es", true},
+		{`Das ist die beste Zusammenfassung, die ich bisher gesehen habe und sie ist kurz`, "de", true},
+		{`今日はとても良い天気ですね`, "ja", true},
+		{`今天天气很好`, "zh", true},
+		{`Это лучший обзор нового релиза`, "ru", true},
+		{`https://example.com #golang`, "", false},
+	}
+
+	for _, tc := range testCases {
+		language, confident := detectLanguage(tc.text)
+		assert.Equal(t, tc.confident, confident, tc.text)
+		if tc.confident {
+			assert.Equal(t, tc.language, language, tc.text)
+		}
+	}
+}
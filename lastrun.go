@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mattn/go-mastodon"
+)
+
+// catchUpFloor finds the time before which tweets shouldn't be synced in
+// CatchUpOnly mode, which is the creation time of the tweet that the most
+// recent of the given statuses was synced from. The tweet is looked up in the
+// state file first, then by matching the status against tweets, and if it
+// can't be found, the status' own creation time is used, which is
+// conservative because statuses are always created after their tweets. Returns
+// a zero time if there are no statuses.
+func catchUpFloor(conf *Conf, state *State, statuses []*mastodon.Status, tweets []*Tweet) time.Time {
+	if len(statuses) < 1 {
+		return time.Time{}
+	}
+
+	newest := statuses[0]
+
+	for tweetID, stateTweet := range state.Tweets {
+		if stateTweet.StatusID != string(newest.ID) {
+			continue
+		}
+
+		for _, tweet := range tweets {
+			if strconv.FormatInt(tweet.ID, 10) == tweetID {
+				return tweet.CreatedAt
+			}
+		}
+	}
+
+	for _, tweet := range tweets {
+		if status, _ := findMatchingStatus(conf, []*mastodon.Status{newest}, tweet); status != nil {
+			return tweet.CreatedAt
+		}
+	}
+
+	logger.Infof("Couldn't find tweet for newest status %v; using its creation time", newest.ID)
+	return newest.CreatedAt
+}
+
+// filterTweetsSince returns only those tweets created after the given time.
+// All tweets are returned if it's zero.
+func filterTweetsSince(tweets []*Tweet, since time.Time) []*Tweet {
+	if since.IsZero() {
+		return tweets
+	}
+
+	var filtered []*Tweet
+	for _, tweet := range tweets {
+		if tweet.CreatedAt.After(since) {
+			filtered = append(filtered, tweet)
+		}
+	}
+
+	return filtered
+}
+
+// readLastRun reads the creation time of the newest tweet synced by a
+// previous run from a last run file (see `Conf.LastRunFile`). A zero time is
+// returned if the file doesn't exist yet.
+func readLastRun(path string) (time.Time, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, fmt.Errorf("error reading last run file: %w", err)
+	}
+
+	lastRun, err := time.Parse(time.RFC3339, strings.TrimSpace(string(data)))
+	if err != nil {
+		return time.Time{}, fmt.Errorf("error parsing last run file: %w", err)
+	}
+
+	return lastRun, nil
+}
+
+// writeLastRun atomically writes the creation time of the newest tweet
+// synced to a last run file.
+func writeLastRun(path string, lastRun time.Time) error {
+	err := writeFileAtomic(path, []byte(lastRun.UTC().Format(time.RFC3339)+"\n"))
+	if err != nil {
+		return fmt.Errorf("error writing last run file: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mattn/go-mastodon"
+	assert "github.com/stretchr/testify/require"
+)
+
+func TestCatchUpFloor(t *testing.T) {
+	tweets := []*Tweet{
+		{ID: 3, CreatedAt: time.Date(2021, 1, 3, 0, 0, 0, 0, time.UTC), Text: `The newest tweet, which hasn't been synced to Mastodon.`},
+		{ID: 2, CreatedAt: time.Date(2021, 1, 2, 0, 0, 0, 0, time.UTC), Text: `A tweet that was synced to Mastodon a little while ago.`},
+		{ID: 1, CreatedAt: time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC), Text: `An old tweet that was never synced to Mastodon at all.`},
+	}
+
+	statuses := []*mastodon.Status{
+		{ID: "200", CreatedAt: time.Date(2021, 1, 2, 12, 0, 0, 0, time.UTC), Content: `<p>A tweet that was synced to Mastodon a little while ago.</p>`},
+	}
+
+	t.Run("ByMatching", func(t *testing.T) {
+		floor := catchUpFloor(&Conf{}, &State{}, statuses, tweets)
+		assert.Equal(t, tweets[1].CreatedAt, floor)
+
+		// Only tweets newer than the floor are considered.
+		assert.Equal(t, []*Tweet{tweets[0]}, filterTweetsSince(tweets, floor))
+	})
+
+	t.Run("ByState", func(t *testing.T) {
+		state := &State{}
+		state.recordTweetStatus(1, "201", "")
+
+		floor := catchUpFloor(&Conf{}, state, []*mastodon.Status{{ID: "201", Content: `<p>Edited since.</p>`}}, tweets)
+		assert.Equal(t, tweets[2].CreatedAt, floor)
+	})
+
+	t.Run("FallsBackToStatusTime", func(t *testing.T) {
+		status := &mastodon.Status{ID: "202", CreatedAt: time.Date(2021, 1, 2, 12, 0, 0, 0, time.UTC), Content: `<p>Unrelated.</p>`}
+		assert.Equal(t, status.CreatedAt, catchUpFloor(&Conf{}, &State{}, []*mastodon.Status{status}, tweets))
+	})
+
+	t.Run("NoStatuses", func(t *testing.T) {
+		assert.True(t, catchUpFloor(&Conf{}, &State{}, nil, tweets).IsZero())
+	})
+}
+
+func TestFilterTweetsSince(t *testing.T) {
+	tweets := []*Tweet{
+		{ID: 3, CreatedAt: time.Date(2021, 1, 3, 0, 0, 0, 0, time.UTC)},
+		{ID: 2, CreatedAt: time.Date(2021, 1, 2, 0, 0, 0, 0, time.UTC)},
+		{ID: 1, CreatedAt: time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)},
+	}
+
+	t.Run("ZeroTime", func(t *testing.T) {
+		assert.Equal(t, tweets, filterTweetsSince(tweets, time.Time{}))
+	})
+
+	t.Run("ExcludesOlderTweets", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "last_run")
+		assert.NoError(t, writeLastRun(path, time.Date(2021, 1, 2, 0, 0, 0, 0, time.UTC)))
+
+		since, err := readLastRun(path)
+		assert.NoError(t, err)
+
+		assert.Equal(t, []*Tweet{tweets[0]}, filterTweetsSince(tweets, since))
+	})
+}
+
+func TestReadLastRun(t *testing.T) {
+	t.Run("MissingFile", func(t *testing.T) {
+		lastRun, err := readLastRun(filepath.Join(t.TempDir(), "last_run"))
+		assert.NoError(t, err)
+		assert.True(t, lastRun.IsZero())
+	})
+
+	t.Run("RoundTrip", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "last_run")
+		createdAt := time.Date(2021, 1, 2, 3, 4, 5, 0, time.UTC)
+		assert.NoError(t, writeLastRun(path, createdAt))
+
+		lastRun, err := readLastRun(path)
+		assert.NoError(t, err)
+		assert.True(t, createdAt.Equal(lastRun))
+	})
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/mattn/go-mastodon"
+)
+
+// mirrorLikes favorites the statuses that liked tweets were synced to, for
+// mirroring likes of the account's own tweets. The source is read as an
+// export of liked tweets rather than tweets to sync, and nothing is posted.
+//
+// A liked tweet is looked up in the state file first, and otherwise matched
+// the same way as by reconcile, against up to ReconcileLimit of the account's
+// most recent statuses. Liked tweets that aren't the account's own won't have
+// a status to match. Statuses that are already favorited are left alone, so
+// running this again doesn't do anything new.
+func mirrorLikes(ctx context.Context, conf *Conf, client mastodonClient, state *State, likes []*Tweet) error {
+	account, err := currentAccount(ctx, conf, client, state, time.Now())
+	if err != nil {
+		return err
+	}
+
+	statuses, err := fetchAccountStatuses(ctx, client, account.ID, conf.ReconcileLimit)
+	if err != nil {
+		return err
+	}
+	logger.Infof("Mirroring %v liked tweet(s) against %v existing status(es)", len(likes), len(statuses))
+
+	statusesByID := make(map[mastodon.ID]*mastodon.Status, len(statuses))
+	for _, status := range statuses {
+		statusesByID[status.ID] = status
+	}
+
+	var numFavorited int
+	favorited := make(map[mastodon.ID]bool)
+
+	for _, like := range likes {
+		var status *mastodon.Status
+		if stateTweet, ok := state.tweetStatus(like.ID); ok {
+			status = statusesByID[mastodon.ID(stateTweet.StatusID)]
+		} else {
+			status, _ = findMatchingStatus(conf, statuses, like)
+		}
+		if status == nil {
+			continue
+		}
+
+		if alreadyFavorited, ok := status.Favourited.(bool); (ok && alreadyFavorited) || favorited[status.ID] {
+			logger.Debugf("Mastodon status %v for liked tweet %v is already favorited", status.ID, like.ID)
+			continue
+		}
+		favorited[status.ID] = true
+
+		if conf.DryRun {
+			logger.Infof("Would have favorited Mastodon status %v for liked tweet %v", status.ID, like.ID)
+			numFavorited++
+			continue
+		}
+
+		if _, err := client.Favourite(ctx, status.ID); err != nil {
+			return fmt.Errorf("error favoriting status %v: %w", status.ID, err)
+		}
+
+		logger.Infof("Favorited Mastodon status %v for liked tweet %v", status.ID, like.ID)
+		numFavorited++
+	}
+
+	logger.Infof("Favorited %v status(es)", numFavorited)
+
+	return nil
+}
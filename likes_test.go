@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/mattn/go-mastodon"
+	assert "github.com/stretchr/testify/require"
+)
+
+func TestMirrorLikes(t *testing.T) {
+	source := writeTweetData(t, `
+[[tweets]]
+id = 3
+text = "Someone else's tweet, which was never synced to this account."
+
+[[tweets]]
+id = 2
+text = "Birdwatching this morning turned up a heron."
+
+[[tweets]]
+id = 1
+text = "My cat found the only sunny spot in the house."
+`)
+
+	conf := &Conf{
+		MaxTweetsToSync: 10,
+		MirrorLikes:     true,
+		ReconcileLimit:  100,
+		StateFile:       filepath.Join(t.TempDir(), "state.toml"),
+	}
+
+	client := &fakeClient{statuses: []*mastodon.Status{
+		{ID: "200", Content: `<p>Birdwatching this morning turned up a heron.</p>`},
+		{ID: "100", Content: `<p>My cat found the only sunny spot in the house.</p>`, Favourited: true},
+	}}
+
+	assert.NoError(t, syncTwitter(context.Background(), conf, client, source))
+
+	// Only the status that isn't already favorited is, and nothing's posted.
+	assert.Equal(t, []mastodon.ID{"200"}, client.favourited)
+	assert.Empty(t, client.postedToots)
+
+	t.Run("Idempotent", func(t *testing.T) {
+		client.statuses[0].Favourited = true
+		client.favourited = nil
+
+		assert.NoError(t, syncTwitter(context.Background(), conf, client, source))
+		assert.Empty(t, client.favourited)
+	})
+
+	t.Run("FromState", func(t *testing.T) {
+		conf := *conf
+		conf.StateFile = filepath.Join(t.TempDir(), "state.toml")
+
+		state := &State{}
+		state.recordTweetStatus(2, "250", "public")
+		assert.NoError(t, state.save(conf.StateFile))
+
+		// The status was edited since, so its content no longer matches.
+		client := &fakeClient{statuses: []*mastodon.Status{
+			{ID: "250", Content: `<p>Birdwatching this morning turned up a heron (edited).</p>`},
+		}}
+		assert.NoError(t, syncTwitter(context.Background(), &conf, client, source))
+		assert.Equal(t, []mastodon.ID{"250"}, client.favourited)
+	})
+
+	t.Run("DryRun", func(t *testing.T) {
+		conf := *conf
+		conf.DryRun = true
+
+		client := &fakeClient{statuses: []*mastodon.Status{
+			{ID: "200", Content: `<p>Birdwatching this morning turned up a heron.</p>`},
+		}}
+		assert.NoError(t, syncTwitter(context.Background(), &conf, client, source))
+		assert.Empty(t, client.favourited)
+	})
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// isLocalMediaPath checks whether the URL of a tweet's media is actually the
+// path of a local file, like those of an archive that was exported along
+// with its media. Paths are either plain or `file://` URLs.
+func isLocalMediaPath(mediaURL string) bool {
+	return mediaURL != "" && (strings.HasPrefix(mediaURL, "file://") || !strings.Contains(mediaURL, "://"))
+}
+
+// localMediaPath returns the path of the local file that media is stored at
+// (see isLocalMediaPath).
+func localMediaPath(mediaURL string) string {
+	return strings.TrimPrefix(mediaURL, "file://")
+}
+
+// resolveLocalMedia resolves the relative paths of tweets' local media (see
+// isLocalMediaPath) to absolute ones by trying them relative to MediaRoot (if
+// it's set), the directory of the source file, and the working directory, in
+// that order, since archives lay out their media relative to any of them.
+// Media that can't be found at any of them is left as it is and reported
+// along with every path tried, and fails to sync later on like any other
+// media that can't be fetched (see PartialMediaOK and StrictMedia).
+func resolveLocalMedia(conf *Conf, tweets []*Tweet, source string) {
+	var bases []string
+	if conf.MediaRoot != "" {
+		bases = append(bases, conf.MediaRoot)
+	}
+	if source != "-" {
+		bases = append(bases, filepath.Dir(source))
+	}
+	if wd, err := os.Getwd(); err == nil {
+		bases = append(bases, wd)
+	}
+
+	for _, tweet := range tweets {
+		if tweet.Entities == nil {
+			continue
+		}
+
+		for _, media := range tweet.Entities.Medias {
+			if !isLocalMediaPath(media.URL) {
+				continue
+			}
+
+			mediaPath := localMediaPath(media.URL)
+
+			candidates := []string{mediaPath}
+			if !filepath.IsAbs(mediaPath) {
+				candidates = nil
+				for _, base := range bases {
+					candidates = append(candidates, filepath.Join(base, mediaPath))
+				}
+			}
+
+			var resolved string
+			for _, candidate := range candidates {
+				if info, err := os.Stat(candidate); err == nil && !info.IsDir() {
+					resolved = candidate
+					break
+				}
+			}
+
+			if resolved == "" {
+				logger.Warnf("Couldn't locate media %v of tweet %v; tried %s",
+					media.ID, tweet.ID, strings.Join(candidates, ", "))
+				continue
+			}
+
+			if abs, err := filepath.Abs(resolved); err == nil {
+				resolved = abs
+			}
+			media.URL = resolved
+		}
+	}
+}
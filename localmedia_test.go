@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	assert "github.com/stretchr/testify/require"
+)
+
+func TestResolveLocalMedia(t *testing.T) {
+	exportDir := filepath.Join(t.TempDir(), "export")
+	assert.NoError(t, os.MkdirAll(filepath.Join(exportDir, "media"), 0o700))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(exportDir, "media", "cat.gif"),
+		[]byte("GIF89a fake image contents"), 0o600))
+
+	source := filepath.Join(exportDir, "tweets.toml")
+
+	newTweet := func(mediaURL string) *Tweet {
+		return &Tweet{ID: 1, Text: "My cat", Entities: &TweetEntities{Medias: []*TweetEntitiesMedia{
+			{ID: 10, Type: "photo", URL: mediaURL},
+		}}}
+	}
+
+	t.Run("RelativeToSource", func(t *testing.T) {
+		tweet := newTweet("media/cat.gif")
+		resolveLocalMedia(&Conf{}, []*Tweet{tweet}, source)
+		assert.Equal(t, filepath.Join(exportDir, "media", "cat.gif"), tweet.Entities.Medias[0].URL)
+	})
+
+	t.Run("RelativeToMediaRoot", func(t *testing.T) {
+		tweet := newTweet("file://cat.gif")
+		resolveLocalMedia(&Conf{MediaRoot: filepath.Join(exportDir, "media")}, []*Tweet{tweet}, "-")
+		assert.Equal(t, filepath.Join(exportDir, "media", "cat.gif"), tweet.Entities.Medias[0].URL)
+	})
+
+	t.Run("NotFound", func(t *testing.T) {
+		logs := captureLogger(t)
+
+		tweet := newTweet("media/dog.gif")
+		resolveLocalMedia(&Conf{}, []*Tweet{tweet}, source)
+		assert.Equal(t, "media/dog.gif", tweet.Entities.Medias[0].URL)
+		assert.Contains(t, logs.String(), "Couldn't locate media 10 of tweet 1; tried "+
+			filepath.Join(exportDir, "media", "dog.gif"))
+	})
+
+	t.Run("RemoteUnaffected", func(t *testing.T) {
+		tweet := newTweet("https://pbs.twimg.com/media/cat.jpg")
+		resolveLocalMedia(&Conf{}, []*Tweet{tweet}, source)
+		assert.Equal(t, "https://pbs.twimg.com/media/cat.jpg", tweet.Entities.Medias[0].URL)
+	})
+
+	t.Run("Syncs", func(t *testing.T) {
+		assert.NoError(t, ioutil.WriteFile(source, []byte(`
+[[tweets]]
+id = 1
+text = "My cat"
+
+  [[tweets.entities.medias]]
+  id = 10
+  type = "photo"
+  url = "media/cat.gif"
+`), 0o600))
+
+		client := &fakeClient{}
+		assert.NoError(t, syncTwitter(context.Background(), &Conf{MaxTweetsToSync: 10}, client, source))
+		assert.Equal(t, []string{filepath.Join(exportDir, "media", "cat.gif")}, client.uploadedMedia)
+		assert.Len(t, client.postedToots, 1)
+	})
+}
@@ -2,24 +2,37 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"flag"
 	"fmt"
 	"html"
 	"io"
 	"io/ioutil"
+	"math/rand"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"path"
 	"path/filepath"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/agnivade/levenshtein"
 	"github.com/grokify/html-strip-tags-go"
-	"github.com/joeshaw/envdecode"
 	"github.com/mattn/go-mastodon"
 	"github.com/pelletier/go-toml"
+	"golang.org/x/text/unicode/norm"
 )
 
 //////////////////////////////////////////////////////////////////////////////
@@ -33,22 +46,147 @@ import (
 //////////////////////////////////////////////////////////////////////////////
 
 func main() {
-	if len(os.Args) != 2 {
-		die(fmt.Sprintf("usage: %s <Twitter TOML data file>", os.Args[0]))
+	confPath := flag.String("config", "", "path to a TOML config file; environmental variables override its values")
+	exportMapPath := flag.String("export-map", "",
+		"write a map of tweets to Mastodon statuses from the state file to this path (.json or .csv) and exit")
+	force := flag.Bool("force", false, "run even if the run lock is held or the last run was too recent")
+	generateIndexPath := flag.String("generate-index", "",
+		"write an index of crossposted tweets from the state file to this path (.html, or .json for a JSON Feed) and exit")
+	registerAppFlag := flag.Bool("register-app", false,
+		"register an app named APP_NAME with the Mastodon server, authorize it, print its access token, and exit")
+	resetFailures := flag.Bool("reset-failures", false,
+		"forget tweets recorded in the state file as failing to post so that they're tried again, and exit")
+	yes := flag.Bool("yes", false, "confirm syncing to an account with no existing statuses and posting without prompting")
+	flag.Parse()
+
+	if flag.NArg() < 1 && *exportMapPath == "" && *generateIndexPath == "" && !*registerAppFlag && !*resetFailures {
+		die(fmt.Sprintf("usage: %s [-config <path>] [-force] [-yes] <Twitter TOML data file, or - for stdin>...\n"+
+			"       %s [-config <path>] -export-map <path>\n"+
+			"       %s [-config <path>] -generate-index <path>\n"+
+			"       %s [-config <path>] -register-app\n"+
+			"       %s [-config <path>] -reset-failures", os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0]))
 	}
-	source := os.Args[1]
+	sources := flag.Args()
 
-	var conf Conf
-	if err := envdecode.Decode(&conf); err != nil {
-		die(fmt.Errorf("error decoding conf from env: %v", err).Error())
+	// Modes that only work with the state file don't need the configuration
+	// required to sync, like a server.
+	offline := *exportMapPath != "" || *generateIndexPath != "" || *resetFailures
+
+	decode := decodeConf
+	if offline {
+		decode = decodeOfflineConf
+	}
+
+	conf, err := decode(*confPath)
+	if err != nil {
+		die(err.Error())
+	}
+	conf.Force = *force
+	conf.Yes = *yes
+
+	if !offline {
+		conf.MastodonServerURL, err = normalizeServerURL(conf.MastodonServerURL)
+		if err != nil {
+			die(err.Error())
+		}
+	}
+
+	if *exportMapPath != "" {
+		if conf.StateFile == "" {
+			die("a state file must be configured with STATE_FILE to export a map")
+		}
+
+		state, err := loadState(conf.StateFile, false)
+		if err != nil {
+			die(err.Error())
+		}
+
+		if err := exportMap(conf, state, *exportMapPath); err != nil {
+			die(fmt.Sprintf("error exporting map: %v", err))
+		}
+		return
+	}
+
+	if *generateIndexPath != "" {
+		if conf.StateFile == "" {
+			die("a state file must be configured with STATE_FILE to generate an index")
+		}
+
+		state, err := loadState(conf.StateFile, false)
+		if err != nil {
+			die(err.Error())
+		}
+
+		if err := generateIndex(conf, state, *generateIndexPath); err != nil {
+			die(fmt.Sprintf("error generating index: %v", err))
+		}
+		return
+	}
+
+	if *resetFailures {
+		if conf.StateFile == "" {
+			die("a state file must be configured with STATE_FILE to reset failures")
+		}
+
+		state, err := loadState(conf.StateFile, true)
+		if err != nil {
+			die(err.Error())
+		}
+
+		numSkipped := state.resetTweetFailures()
+		if err := state.save(conf.StateFile); err != nil {
+			die(err.Error())
+		}
+
+		logger.Infof("Reset failures, including %v skipped tweet(s)", numSkipped)
+		return
+	}
+
+	httpClient = newHTTPClient(conf)
+
+	if *registerAppFlag {
+		accessToken, err := registerApp(context.Background(), conf, os.Stdin, os.Stdout)
+		if err != nil {
+			die(err.Error())
+		}
+
+		fmt.Printf("\nSet MASTODON_ACCESS_TOKEN to this access token to post as '%s':\n\n%s\n",
+			conf.AppName, accessToken)
+		return
+	}
+
+	if conf.MastodonAccessToken == "" {
+		die("an access token must be configured with MASTODON_ACCESS_TOKEN; " +
+			"run with -register-app to generate one")
+	}
+
+	cache, err := newMediaCache(conf)
+	if err != nil {
+		die(err.Error())
 	}
+	mediaCache = cache
 
 	client := mastodon.NewClient(&mastodon.Config{
 		AccessToken: conf.MastodonAccessToken,
 		Server:      conf.MastodonServerURL,
 	})
+	client.Client = *httpClient
+	client.Client.Transport = &idempotencyTransport{base: httpClient.Transport}
+	if conf.AdaptiveThrottle {
+		client.Client.Transport = &throttleTransport{base: client.Client.Transport}
+	}
+
+	serverProfile = detectServerProfile(context.Background(), conf, &apiClient{client}, conf.MastodonServerURL)
+
+	if limits, err := fetchInstanceLimits(context.Background(), &apiClient{client}); err != nil {
+		logger.Warnf("Couldn't fetch instance limits; assuming those of a stock %s server: %v",
+			serverProfile.Software, err)
+		instanceLimits = &serverProfile.DefaultLimits
+	} else {
+		instanceLimits = limits
+	}
 
-	err := syncTwitter(context.Background(), &conf, client, source)
+	err = syncTwitter(context.Background(), conf, &apiClient{client}, sources...)
 	if err != nil {
 		die(fmt.Sprintf("error syncing: %v", err))
 	}
@@ -75,6 +213,10 @@ func main() {
 // that by doing fuzzy matching.
 const levenshteinDistanceTolerance = 10
 
+// defaultBackfillSummaryTemplate is the template used for the summary status
+// posted after a backfill when one hasn't been configured.
+const defaultBackfillSummaryTemplate = "Backfilled {count} old tweets from Twitter, starting here: {url}"
+
 //////////////////////////////////////////////////////////////////////////////
 //
 //
@@ -85,8 +227,17 @@ const levenshteinDistanceTolerance = 10
 //
 //////////////////////////////////////////////////////////////////////////////
 
+// httpClient is the HTTP client used for all outgoing requests, including
+// those made by the Mastodon client. It's replaced on startup by one built
+// according to the configured timeouts.
+var httpClient = http.DefaultClient
+
 var logger = &LeveledLogger{Level: LevelInfo}
 
+// mediaCache is the cache that media is fetched through if one is configured
+// (see `Conf.MediaCacheDir`). It's set on startup.
+var mediaCache *MediaCache
+
 //////////////////////////////////////////////////////////////////////////////
 //
 //
@@ -98,23 +249,1162 @@ var logger = &LeveledLogger{Level: LevelInfo}
 //////////////////////////////////////////////////////////////////////////////
 
 // Conf contains the program's configuration as specified through environmental
-// variables.
+// variables, and optionally a TOML config file (see loadConfFile).
 type Conf struct {
-	DryRun bool `env:"DRY_RUN,required"`
-
-	MastodonAccessToken string `env:"MASTODON_ACCESS_TOKEN,required"`
-	MastodonServerURL   string `env:"MASTODON_SERVER_URL,required"`
+	// AccountCacheTTL caches the Mastodon account that the access token
+	// belongs to in StateFile for this long instead of fetching it every
+	// run. The cache is also refreshed if MastodonServerURL changes. Not
+	// cached by default.
+	AccountCacheTTL time.Duration `env:"ACCOUNT_CACHE_TTL" toml:"account_cache_ttl"`
+
+	// AdaptiveThrottle waits between posts for longer while the server appears
+	// to be loaded, judging by how slowly it responds to posts and how much of
+	// its rate limit is left, and for less once it recovers, so that a backfill
+	// eases off a busy server by itself. The delay is added to any from
+	// DelayPerChar. See adaptiveThrottle for the exact algorithm. Only applies
+	// to statuses posted immediately rather than scheduled (see
+	// ScheduleSpacing). Off by default.
+	AdaptiveThrottle bool `env:"ADAPTIVE_THROTTLE" toml:"adaptive_throttle"`
+
+	// AdaptiveThrottleMax is the longest delay between posts when
+	// AdaptiveThrottle is on.
+	AdaptiveThrottleMax time.Duration `env:"ADAPTIVE_THROTTLE_MAX,default=5m" toml:"adaptive_throttle_max"`
+
+	// AllowedMediaTypes are the MIME types of media that will be uploaded to
+	// Mastodon, separated by semicolons. Types are detected by sniffing the
+	// contents of downloaded media, and media of any other type is skipped
+	// with a warning rather than failing its upload. Defaults to the types
+	// that the server advertises, or those accepted by a stock installation
+	// of its software if it doesn't advertise any (see fetchInstanceLimits).
+	AllowedMediaTypes []string `env:"ALLOWED_MEDIA_TYPES" toml:"allowed_media_types"`
+
+	// AllowedTweetLanguages are the languages (as ISO 639-1 codes like `en`,
+	// separated by semicolons) of tweets that are candidates for syncing.
+	// Tweets don't carry a language, so it's detected from their text, and
+	// tweets whose language can't be detected confidently are allowed. All
+	// languages are allowed by default.
+	AllowedTweetLanguages []string `env:"ALLOWED_TWEET_LANGUAGES" toml:"allowed_tweet_languages"`
+
+	// AppName is the name of the app registered with `-register-app`, which
+	// Mastodon shows as the app that each crosspost was posted from.
+	AppName string `env:"APP_NAME,default=mastodon-cross-post" toml:"app_name"`
+
+	// AppWebsite is the website of the app registered with `-register-app`,
+	// which Mastodon links its name to.
+	AppWebsite string `env:"APP_WEBSITE,default=https://github.com/brandur/mastodon-cross-post" toml:"app_website"`
+
+	// AppendedContentPriority orders the notes appended to toots from most
+	// to least important for when some have to be dropped to respect
+	// AppendedContentRatio. Notes are named `overflow` (OverflowMediaNote),
+	// `attribution` (Attribution), `engagement` (IncludeEngagement's
+	// footer), and `replies` (RepliesNote), separated by semicolons. Notes
+	// that aren't listed are dropped first.
+	AppendedContentPriority []string `env:"APPENDED_CONTENT_PRIORITY,default=overflow;attribution;engagement" toml:"appended_content_priority"`
+
+	// AppendedContentRatio limits the total length of the notes appended to
+	// a toot (see AppendedContentPriority) to this many times the length of
+	// the toot's body, dropping the least important notes until they fit, so
+	// that a short tweet doesn't end up mostly metadata. For example, 1.0
+	// allows notes as long as the body. No limit by default.
+	AppendedContentRatio float64 `env:"APPENDED_CONTENT_RATIO" toml:"appended_content_ratio"`
+
+	// AttachOGImage attaches the OpenGraph image of the linked page to
+	// statuses for tweets that are nothing but a link, which otherwise look
+	// bare on instances that don't show link cards. The image is fetched and
+	// uploaded like other media, and the status is posted without it if the
+	// page doesn't have one or it can't be fetched. Off by default.
+	AttachOGImage bool `env:"ATTACH_OG_IMAGE" toml:"attach_og_image"`
+
+	// Attribution appends the handle of the tweets' author to each status,
+	// like "— @brandur", for mirrors of accounts other than the Mastodon
+	// account's own owner. The handle is AttributionHandle if it's set, and
+	// otherwise the name of the source file without extensions, like
+	// `brandur` for `brandur.toml.gz`. Attribution counts toward a status'
+	// length. Off by default.
+	Attribution bool `env:"ATTRIBUTION" toml:"attribution"`
+
+	// AttributionHandle is the Twitter handle that statuses are attributed to
+	// when Attribution is on, overriding the one taken from the source file's
+	// name. Required to use Attribution when reading from stdin.
+	AttributionHandle string `env:"ATTRIBUTION_HANDLE" toml:"attribution_handle"`
+
+	// AuditDrift logs a warning for any status matched to a tweet whose
+	// normalized content isn't an exact match for the tweet's rendered
+	// content (i.e. distance is greater than zero, but still within
+	// tolerance). Drift that starts showing up consistently is a sign that
+	// Mastodon has changed how it transforms content and that `tootToTweet`
+	// needs to be updated before the changes are large enough to cause
+	// reposts.
+	AuditDrift bool `env:"AUDIT_DRIFT" toml:"audit_drift"`
+
+	// BackfillAltText sets the descriptions of media on statuses that tweets
+	// were previously synced to from the alt text of the tweets' media
+	// instead of syncing, for statuses posted before media was uploaded with
+	// its alt text. Statuses are edited in place and nothing new is
+	// posted. See backfillAltText.
+	BackfillAltText bool `env:"BACKFILL_ALT_TEXT" toml:"backfill_alt_text"`
+
+	// BackfillSummaryTemplate is the template for the status posted when
+	// PostBackfillSummary is on. The placeholder `{count}` is replaced with
+	// the number of tweets synced and `{url}` with the URL of the first status
+	// posted. Defaults to defaultBackfillSummaryTemplate.
+	BackfillSummaryTemplate string `env:"BACKFILL_SUMMARY_TEMPLATE" toml:"backfill_summary_template"`
+
+	// CatchUpOnly only considers tweets newer than the one that the account's
+	// most recent status was synced from, so that ongoing mirroring never
+	// backfills older tweets. The tweet is found through the state file or by
+	// matching, falling back to the status' own creation time. An account
+	// with no statuses requires the `-yes` flag to proceed.
+	CatchUpOnly bool `env:"CATCH_UP_ONLY" toml:"catch_up_only"`
+
+	// CheckQuotedAvailability checks whether each tweet quoted by a quote
+	// tweet still exists through Twitter's oEmbed endpoint, and replaces the
+	// link to any that doesn't with a note saying it's no longer available.
+	// This adds a network call per quoted tweet amongst the candidates for
+	// syncing, though each is only checked once a run, before any are
+	// rendered. Statuses posted with the link before a quoted tweet went
+	// away still match.
+	CheckQuotedAvailability bool `env:"CHECK_QUOTED_AVAILABILITY" toml:"check_quoted_availability"`
+
+	// CheckpointEvery records the IDs of synced tweets to CheckpointFile
+	// after every this many tweets are synced (and whenever a run ends), and
+	// skips tweets recorded there, so that a long backfill run without a
+	// state file that's interrupted can be resumed from its last checkpoint.
+	// A state file already records every tweet as it's posted and is saved
+	// after each one, so progress is taken from it instead when StateFile is
+	// set, and this has no effect. Off by default.
+	CheckpointEvery int `env:"CHECKPOINT_EVERY" toml:"checkpoint_every"`
+
+	// CheckpointFile is the path to the file that progress is recorded to
+	// when CheckpointEvery is set. Tweets recorded in it are never synced
+	// again, so it should be removed to start a backfill over.
+	CheckpointFile string `env:"CHECKPOINT_FILE" toml:"checkpoint_file"`
+
+	// ConfirmFirst prompts for confirmation before posting each of the first
+	// this many tweets of a run, showing the toot that each will be posted as
+	// (or the status it'll boost or edit), along with its content warning,
+	// visibility and the like, and posts the rest automatically. Declining
+	// stops the run without posting the tweet, which is left for the next run.
+	// Running without a terminal (like from cron) is an error unless `-yes` is
+	// given, which skips confirmation.
+	ConfirmFirst int `env:"CONFIRM_FIRST" toml:"confirm_first"`
+
+	// DefaultSpoiler is a content warning that every status is posted
+	// behind, like "Archived tweet", for accounts whose backfilled content
+	// should be hidden by default. A content warning from HashtagSpoilers
+	// takes precedence over it, and a tweet's own `spoiler` (which may be
+	// empty to post it without one) over both. No content warning by
+	// default.
+	DefaultSpoiler string `env:"DEFAULT_SPOILER" toml:"default_spoiler"`
+
+	// DelayPerChar waits this long for each character of a posted toot
+	// before posting the next one, so that longer toots dwell longer in a
+	// backfill, clamped by DelayPerCharMin and DelayPerCharMax and varied
+	// by PostJitter. Only applies to statuses posted immediately rather
+	// than scheduled (see ScheduleSpacing). Disabled by default.
+	DelayPerChar time.Duration `env:"DELAY_PER_CHAR" toml:"delay_per_char"`
+
+	// DelayPerCharMax is the longest delay after posting a toot when
+	// DelayPerChar is set. Unlimited by default.
+	DelayPerCharMax time.Duration `env:"DELAY_PER_CHAR_MAX" toml:"delay_per_char_max"`
+
+	// DelayPerCharMin is the shortest delay after posting a toot when
+	// DelayPerChar is set.
+	DelayPerCharMin time.Duration `env:"DELAY_PER_CHAR_MIN" toml:"delay_per_char_min"`
+
+	// DetectEditedStatuses logs when the status that the newest synced tweet
+	// was posted as according to StateFile has been edited on Mastodon since.
+	// Edited statuses are never re-posted or changed either way, because
+	// tweets recorded in the state file are considered synced regardless of
+	// whether their statuses still match them. Off by default.
+	DetectEditedStatuses bool `env:"DETECT_EDITED_STATUSES" toml:"detect_edited_statuses"`
+
+	// DigestMaxLength is the maximum length in characters of a tweet's text
+	// for it to be considered short enough to be bundled into a digest when
+	// DigestShortTweets is on.
+	DigestMaxLength int `env:"DIGEST_MAX_LENGTH,default=80" toml:"digest_max_length"`
+
+	// DigestMinCount is the minimum number of short tweets from the same day
+	// that are bundled into a digest when DigestShortTweets is on. Days with
+	// fewer have their short tweets posted individually.
+	DigestMinCount int `env:"DIGEST_MIN_COUNT,default=3" toml:"digest_min_count"`
+
+	// DigestShortTweets bundles short tweets (see DigestMaxLength) from the
+	// same day into a single digest status with a bulleted list of them
+	// instead of posting each one, for days with at least DigestMinCount of
+	// them. Substantive tweets, and those with media, replies, retweets, and
+	// quotes, are posted individually as usual. Short tweets from the current
+	// day (in UTC) are held back until it's over so that its digest is
+	// complete. See mergeShortTweetDigests for how digests are matched to
+	// existing statuses.
+	DigestShortTweets bool `env:"DIGEST_SHORT_TWEETS" toml:"digest_short_tweets"`
+
+	DryRun bool `env:"DRY_RUN,required" toml:"dry_run"`
+
+	// DryRunMatchReport writes a report to stdout during a dry run listing
+	// whether each candidate tweet matched an existing status (and at what
+	// distance) or would be newly posted. Unlike a normal run, matching
+	// doesn't stop at the first match, so every candidate is checked, which
+	// is useful for verifying deduplication before a real run.
+	DryRunMatchReport bool `env:"DRY_RUN_MATCH_REPORT" toml:"dry_run_match_report"`
+
+	// DumpStatuses prints the raw content of the account's existing statuses
+	// alongside the normalized form that tweets are matched against, then
+	// exits without syncing anything. Useful for debugging why a tweet
+	// doesn't match the status that it was posted as.
+	DumpStatuses bool `env:"DUMP_STATUSES" toml:"dump_statuses"`
+
+	// DumpStatusesLimit is the maximum number of statuses printed by
+	// DumpStatuses, fetched a page at a time starting with the most recent.
+	DumpStatusesLimit int `env:"DUMP_STATUSES_LIMIT,default=100" toml:"dump_statuses_limit"`
+
+	// EmptyAccountSyncThreshold is the number of tweets that can be synced to
+	// an account with no existing statuses without confirmation when
+	// RequireConfirmationOnEmptyAccount is on.
+	EmptyAccountSyncThreshold int `env:"EMPTY_ACCOUNT_SYNC_THRESHOLD,default=10" toml:"empty_account_sync_threshold"`
+
+	// EngagementTemplate are the parts of the engagement stats included
+	// through IncludeEngagement, separated by semicolons. The placeholder
+	// `{favorites}` is replaced with a tweet's favorite count and
+	// `{retweets}` with its retweet count. Parts are joined with ` · `, and
+	// parts whose count is zero are omitted.
+	EngagementTemplate []string `env:"ENGAGEMENT_TEMPLATE,default=♥ {favorites};🔁 {retweets}" toml:"engagement_template"`
+
+	// ExcludedSources are the names of clients (like "IFTTT"), separated by
+	// semicolons, whose tweets aren't candidates for syncing, which keeps
+	// tweets posted by automation tools out of the mirror. Names are compared
+	// case insensitively. Tweets that don't record their source are never
+	// excluded.
+	ExcludedSources []string `env:"EXCLUDED_SOURCES" toml:"excluded_sources"`
+
+	// Force is set from the `-force` command line flag rather than the
+	// environment, and runs even if RunLockFile indicates that another run is
+	// in progress or that the last one was too recent.
+	Force bool `toml:"-"`
+
+	// GapNoteMinInterval is the minimum time between the tweets that gap
+	// notes are posted before (see GapNotes), so that they don't appear
+	// constantly for an account whose tweets are often skipped.
+	GapNoteMinInterval time.Duration `env:"GAP_NOTE_MIN_INTERVAL,default=168h" toml:"gap_note_min_interval"`
+
+	// GapNoteText is the text of the note posted for GapNotes.
+	GapNoteText string `env:"GAP_NOTE_TEXT,default=(some tweets from this period weren't crossposted)" toml:"gap_note_text"`
+
+	// GapNotes posts a note (GapNoteText) before a tweet that follows at
+	// least this many consecutive tweets that were skipped by filters like
+	// MinAuthoredLength, so that followers of a backfill aren't left
+	// wondering about unexplained jumps in time. Notes are rate limited by
+	// GapNoteMinInterval, and aren't posted for scheduled tweets. Off by
+	// default.
+	GapNotes int `env:"GAP_NOTES" toml:"gap_notes"`
+
+	// HandleMappings maps Twitter handles to the Mastodon accounts of the same
+	// people, like `brandur=brandur@mastodon.social`. Multiple mappings are
+	// separated by semicolons. Twitter handles are matched
+	// case-insensitively.
+	HandleMappings ConfMap `env:"HANDLE_MAPPINGS" toml:"handle_mappings"`
+
+	// HashtagCase is a rule for normalizing the casing of hashtags so that
+	// they're consistent on Mastodon, whose tag timelines are
+	// case-insensitive but display tags with whichever casing was seen first.
+	// Either `lower` to lowercase hashtags entirely or `preserve_first` to
+	// keep their first letter as is and lowercase the rest. Leaves hashtags
+	// untouched by default.
+	HashtagCase HashtagCaseRule `env:"HASHTAG_CASE" toml:"hashtag_case"`
+
+	// HashtagCaseMappings maps hashtags (without `#`, matched
+	// case-insensitively) to their canonical casing, like
+	// `golang=GoLang;postgres=Postgres`. Takes precedence over HashtagCase
+	// for hashtags that it contains.
+	HashtagCaseMappings ConfMap `env:"HASHTAG_CASE_MAPPINGS" toml:"hashtag_case_mappings"`
+
+	// HTTPDialTimeout is the maximum amount of time to wait for a connection
+	// to a remote host to be established. It's kept short relative to
+	// HTTPTimeout so that requests to dead hosts fail fast.
+	HTTPDialTimeout time.Duration `env:"HTTP_DIAL_TIMEOUT,default=10s" toml:"http_dial_timeout"`
+
+	// HTTPResponseHeaderTimeout is the maximum amount of time to wait for a
+	// server's response headers after a request has been fully written.
+	HTTPResponseHeaderTimeout time.Duration `env:"HTTP_RESPONSE_HEADER_TIMEOUT,default=30s" toml:"http_response_header_timeout"`
+
+	// HTTPTimeout is the overall time limit for an HTTP request, including
+	// connecting, redirects, and reading the response body. It applies to
+	// both media fetches and requests to Mastodon.
+	HTTPTimeout time.Duration `env:"HTTP_TIMEOUT,default=60s" toml:"http_timeout"`
+
+	// HTTPTLSHandshakeTimeout is the maximum amount of time to wait for a TLS
+	// handshake to complete.
+	HTTPTLSHandshakeTimeout time.Duration `env:"HTTP_TLS_HANDSHAKE_TIMEOUT,default=10s" toml:"http_tls_handshake_timeout"`
+
+	// HashtagSpoilers maps hashtags (without the `#`) to content warnings
+	// that tweets containing them are posted behind, like
+	// `politics=Politics;food=Food`. Hashtags are matched case-insensitively,
+	// and if a tweet has several that are mapped, the first wins. Multiple
+	// mappings are separated by semicolons.
+	HashtagSpoilers ConfMap `env:"HASHTAG_SPOILERS" toml:"hashtag_spoilers"`
+
+	// HashtagVisibility maps hashtags (without the `#`) to the visibility
+	// that tweets containing them are posted with, like
+	// `private=private;public=public`, as a way to control visibility
+	// while writing a tweet. Hashtags are matched case-insensitively, and if
+	// a tweet has several that are mapped, the first wins. A hashtag's
+	// visibility takes precedence over ThreadReplyVisibility, the visibility
+	// inherited by a thread reply, and Visibility, in that order. Multiple
+	// mappings are separated by semicolons.
+	HashtagVisibility ConfVisibilityMap `env:"HASHTAG_VISIBILITY" toml:"hashtag_visibility"`
+
+	// HashtagVisibilityStrip removes the hashtags of HashtagVisibility from
+	// the statuses of the tweets that contain them.
+	HashtagVisibilityStrip bool `env:"HASHTAG_VISIBILITY_STRIP" toml:"hashtag_visibility_strip"`
+
+	// IgnoreLastRun considers all tweets regardless of the time recorded in
+	// LastRunFile, which is still updated at the end of the run.
+	IgnoreLastRun bool `env:"IGNORE_LAST_RUN" toml:"ignore_last_run"`
+
+	// IncludeEngagement includes a tweet's original engagement stats (see
+	// EngagementTemplate) in its toot, either as a `footer` after its content
+	// or as its `spoiler` text. Off by default.
+	IncludeEngagement EngagementMode `env:"INCLUDE_ENGAGEMENT" toml:"include_engagement"`
+
+	// IncludeReadingTime prepends a note like `(2 min read)` to toots at
+	// least ReadingTimeMinLength characters long, estimated from their word
+	// count at ReadingTimeWPM. The note counts towards the toot's length.
+	IncludeReadingTime bool `env:"INCLUDE_READING_TIME" toml:"include_reading_time"`
+
+	// IncludeReplies includes tweets that are replies to other users as
+	// candidates for syncing. By default they're skipped because most replies
+	// don't make much sense out of the context of their conversation, but
+	// some are substantive enough to stand on their own.
+	IncludeReplies bool `env:"INCLUDE_REPLIES" toml:"include_replies"`
+
+	// InlineAltText appends the alt text of a tweet's photos to the body of
+	// its status as lines like "[image: A cat]", for instances that don't
+	// show media descriptions well. The lines count towards the status'
+	// length like the rest of its content. Off by default.
+	InlineAltText bool `env:"INLINE_ALT_TEXT" toml:"inline_alt_text"`
+
+	// IntroToot is the text of a status to post before the first tweet is
+	// synced to an account with no existing statuses, like "I'm mirroring my
+	// Twitter here, follow for updates", giving context before a backfill.
+	// It's recorded in StateFile so that it's only ever posted once. Not
+	// posted by default.
+	IntroToot string `env:"INTRO_TOOT" toml:"intro_toot"`
+
+	// LastRunFile is the path to a file recording the creation time of the
+	// newest tweet synced. When set, only tweets created after that time are
+	// considered on the next run, which suits syncing incrementally from
+	// cron. The file is only updated after a run completes successfully.
+	LastRunFile string `env:"LAST_RUN_FILE" toml:"last_run_file"`
+
+	// LogSampleLength is the maximum length in characters of the samples of
+	// status content included in log lines.
+	LogSampleLength int `env:"LOG_SAMPLE_LENGTH,default=50" toml:"log_sample_length"`
+
+	// MastodonAccessToken is the access token used to post to Mastodon.
+	// It's required to sync, and can be generated with `-register-app`.
+	MastodonAccessToken string `env:"MASTODON_ACCESS_TOKEN" toml:"mastodon_access_token"`
+	MastodonServerURL   string `env:"MASTODON_SERVER_URL,required" toml:"mastodon_server_url"`
+
+	// MaxImageDimension is the maximum width or height in pixels of JPEG and
+	// PNG images uploaded to Mastodon. Larger images are downscaled to fit
+	// before being uploaded, preserving their aspect ratio, for servers that
+	// reject high resolution images. Images aren't resized by default.
+	MaxImageDimension int `env:"MAX_IMAGE_DIMENSION" toml:"max_image_dimension"`
+
+	// MaxRunDuration stops a run cleanly once it's been going for this long,
+	// posting as many tweets as fit in the time and leaving the rest for the
+	// next run, which is useful for cron slots with a time limit. Unlike
+	// MaxTweetsToSync, it's based on wall-clock time. A thread that's
+	// being posted when the budget runs out is finished first so that it's
+	// never left partial. No limit by default.
+	MaxRunDuration time.Duration `env:"MAX_RUN_DURATION" toml:"max_run_duration"`
+
+	// MaxStatusesToCompare caps the number of existing statuses (the most
+	// recent ones) that each tweet is compared against when looking for one
+	// that it was already synced to, bounding the cost of matching on large
+	// accounts. The trade-off is that a tweet whose status is older than the
+	// window is missed and would be posted again, so a warning is logged for
+	// tweets older than the oldest status compared. No cap by default.
+	MaxStatusesToCompare int `env:"MAX_STATUSES_TO_COMPARE" toml:"max_statuses_to_compare"`
+
+	// MaxTweetFailures is the number of runs that a tweet can fail to post in
+	// before it's skipped by all future runs, so that a tweet that can never
+	// be posted (like one with permanently dead media, or content that the
+	// instance rejects) doesn't block every run after it. Failures and the
+	// reason for them are recorded in StateFile, which is required for this
+	// to have any effect, and can be reset with the `-reset-failures` flag.
+	// Failing tweets are retried forever by default.
+	MaxTweetFailures int `env:"MAX_TWEET_FAILURES" toml:"max_tweet_failures"`
 
 	// MaxTweetsToSync is the maximum number of tweets to post in a single run.
 	// This helps space things out a bit when syncing over a large number of
 	// tweets.
-	MaxTweetsToSync int `env:"MAX_TWEETS_TO_SYNC,required"`
+	MaxTweetsToSync int `env:"MAX_TWEETS_TO_SYNC,required" toml:"max_tweets_to_sync"`
+
+	// MediaCacheDir is an optional path to a directory where fetched media is
+	// cached between runs so that it doesn't have to be fetched again. See
+	// MediaCache.
+	MediaCacheDir string `env:"MEDIA_CACHE_DIR" toml:"media_cache_dir"`
+
+	// MediaCacheMaxBytes is the maximum total size of media kept in
+	// MediaCacheDir, beyond which the least recently used media is evicted.
+	// Unbounded by default.
+	MediaCacheMaxBytes int64 `env:"MEDIA_CACHE_MAX_BYTES" toml:"media_cache_max_bytes"`
+
+	// MediaProcessingRetries is the number of times to retry posting a status
+	// that the server rejected because its just-uploaded media hadn't
+	// finished processing yet (a 422). This is separate from any other kind
+	// of retry.
+	MediaProcessingRetries int `env:"MEDIA_PROCESSING_RETRIES,default=3" toml:"media_processing_retries"`
+
+	// MediaProcessingRetryDelay is how long to wait before each retry made
+	// through MediaProcessingRetries.
+	//
+	// With ThreadSelfReplies, MediaProcessingRetries and
+	// MediaProcessingRetryDelay also bound how long media is polled for
+	// before posting a status that might be part of a thread, so that each
+	// status in a thread has its media ready before it's posted and before
+	// the next reply's media starts uploading.
+	MediaProcessingRetryDelay time.Duration `env:"MEDIA_PROCESSING_RETRY_DELAY,default=2s" toml:"media_processing_retry_delay"`
+
+	// MediaProxyBase routes media fetches through an image proxy (like a
+	// self-hosted wsrv or imgproxy instance) so that fetching media doesn't
+	// reveal this machine's IP to Twitter's CDN. Media URLs are query-escaped
+	// and appended to it, e.g. `https://wsrv.example.com/?url=`. Requests to
+	// Mastodon aren't affected.
+	MediaProxyBase string `env:"MEDIA_PROXY_BASE" toml:"media_proxy_base"`
+
+	// MediaReuseTTL is how long after being uploaded media recorded in the
+	// state file may be reused by a subsequent run instead of being uploaded
+	// again. Mastodon reaps unattached media after about a day, so this should
+	// stay comfortably below that.
+	MediaReuseTTL time.Duration `env:"MEDIA_REUSE_TTL,default=12h" toml:"media_reuse_ttl"`
+
+	// MediaRoot is a directory that the relative paths of local media (media
+	// whose URLs are paths, like those of an archive exported along with its
+	// media) are tried relative to before the directory of the source file
+	// and the working directory. See resolveLocalMedia.
+	MediaRoot string `env:"MEDIA_ROOT" toml:"media_root"`
+
+	// MediaURLVariants are size variants of media on Twitter's media hosts
+	// to fall back to, in order, if media can't be fetched or uploaded from
+	// its own URL, like `large;medium` to retry originals that exceed the
+	// server's media size limit with smaller versions. Not used by default.
+	MediaURLVariants []string `env:"MEDIA_URL_VARIANTS" toml:"media_url_variants"`
+
+	// MergePhotoThreads merges photo threads (chains of self-replies that
+	// each have photos, as reconstructed through ThreadSelfReplies) into a
+	// single status with the text and photos of all of them, up to the
+	// maximum number of media attachments that the server allows on a
+	// status. Photos beyond that continue in a reply.
+	MergePhotoThreads bool `env:"MERGE_PHOTO_THREADS" toml:"merge_photo_threads"`
+
+	// MinAuthoredLength skips tweets whose own authored text is shorter than
+	// this many characters, like bare quote tweets or replies that are only
+	// mentions. Authored text excludes leading mentions and links to a quoted
+	// or retweeted tweet. Plain retweets are never skipped. Off by default.
+	MinAuthoredLength int `env:"MIN_AUTHORED_LENGTH" toml:"min_authored_length"`
+
+	// MinRunInterval is the minimum amount of time between the starts of
+	// consecutive runs when RunLockFile is set. A run that starts too soon
+	// after the last is refused, which guards against something like a
+	// misfiring cron double-posting tweets whose statuses aren't visible
+	// through the API yet.
+	MinRunInterval time.Duration `env:"MIN_RUN_INTERVAL" toml:"min_run_interval"`
 
 	// MinTweetID is the Twitter 64-bit integer ID of the tweet to start to try
 	// and sync from. The idea is that we're not going to go back all the way
 	// into ancient history, and rather start posting from some more recent
 	// content only.
-	MinTweetID int64 `env:"MIN_TWEET_ID,required"`
+	MinTweetID int64 `env:"MIN_TWEET_ID,required" toml:"min_tweet_id"`
+
+	// MirrorLikes reads the source as an export of liked tweets instead of
+	// tweets to sync, and favorites the statuses that any of the account's
+	// own liked tweets were synced to. Nothing is posted, and statuses that
+	// are already favorited are left alone. See mirrorLikes.
+	MirrorLikes bool `env:"MIRROR_LIKES" toml:"mirror_likes"`
+
+	// NativeBoosts tries to mirror retweets of users mapped in
+	// HandleMappings by boosting the original toot natively on Mastodon
+	// instead of posting the (often truncated) retweet text. The original
+	// toot is looked for amongst the recent statuses of the mapped account
+	// that are known to our server. If one can't be found, the retweet is
+	// posted as usual with a link back to the original tweet.
+	NativeBoosts bool `env:"NATIVE_BOOSTS" toml:"native_boosts"`
+
+	// NormalizeEmoji strips stray Unicode variation selectors (those that
+	// don't follow a character that they could apply to, like at the start
+	// of a tweet or after whitespace) from the content of posted statuses.
+	// Twitter sometimes stores these left over from editing or from emoji
+	// pickers, and some clients render them as boxes. Variation selectors
+	// are always ignored when matching tweets to statuses, so this only
+	// changes what's posted. Off by default so that intended emoji
+	// presentation isn't altered.
+	NormalizeEmoji bool `env:"NORMALIZE_EMOJI" toml:"normalize_emoji"`
+
+	// OverflowMediaNote is a note appended to statuses for tweets with more
+	// photos than can be attached to a status, which are posted with only as
+	// many photos as fit. The placeholder `{count}` is replaced with the
+	// number of photos left out and `{url}` with a link to the original
+	// tweet, like "+{count} more images in the original: {url}". The note
+	// counts toward a status' length. When set, photo threads merged by
+	// MergePhotoThreads are no longer split into a chain of replies on
+	// overflow. Not used by default.
+	OverflowMediaNote string `env:"OVERFLOW_MEDIA_NOTE" toml:"overflow_media_note"`
+
+	// PartialMediaOK allows a tweet to be posted with only the subset of its
+	// media that was fetched and uploaded successfully, logging a warning
+	// about the media that was dropped. By default, failing to sync any media
+	// fails the whole tweet. Ignored if StrictMedia is set.
+	PartialMediaOK bool `env:"PARTIAL_MEDIA_OK" toml:"partial_media_ok"`
+
+	// PerceptualMediaMatch compares the photos of a tweet against the media
+	// of statuses whose text matches it equally well, picking the one whose
+	// media looks most alike, to tell apart statuses for tweets with the
+	// same text but different images. Images are compared by perceptual
+	// hash so that recompressed copies still match, and matching falls back
+	// to the first status with the same text if media can't be fetched.
+	// Off by default.
+	PerceptualMediaMatch bool `env:"PERCEPTUAL_MEDIA_MATCH" toml:"perceptual_media_match"`
+
+	// PlaceholderForEmptyText is used as the body of statuses for tweets that
+	// have media, but whose text is empty or only whitespace (like a photo
+	// posted without a caption, or one whose text was lost from an export),
+	// so that their media is still posted with something to go along with it.
+	// Not used by default.
+	PlaceholderForEmptyText string `env:"PLACEHOLDER_FOR_EMPTY_TEXT" toml:"placeholder_for_empty_text"`
+
+	// PollExpiresIn is how long polls attached through PollTrigger stay open.
+	PollExpiresIn time.Duration `env:"POLL_EXPIRES_IN,default=24h" toml:"poll_expires_in"`
+
+	// PollMultiple allows multiple choices to be selected in polls attached
+	// through PollTrigger.
+	PollMultiple bool `env:"POLL_MULTIPLE" toml:"poll_multiple"`
+
+	// PollOptions are the options of the poll attached to tweets containing
+	// PollTrigger, separated by semicolons like `Yes;No;Maybe`.
+	PollOptions []string `env:"POLL_OPTIONS" toml:"poll_options"`
+
+	// PollTrigger is a phrase that when contained in a tweet's text (matched
+	// case-insensitively) attaches a poll built from PollOptions to its
+	// toot, e.g. "thoughts?". Mastodon doesn't allow a status to have both a
+	// poll and media, so no poll is attached to tweets that have media.
+	PollTrigger string `env:"POLL_TRIGGER" toml:"poll_trigger"`
+
+	// PostBackfillSummary posts one final status after a run that's synced
+	// tweets, linking back to the first status that the run posted. It's
+	// intended for one-off backfills of old tweets so that followers can
+	// understand where the sudden flood of content came from.
+	PostBackfillSummary bool `env:"POST_BACKFILL_SUMMARY" toml:"post_backfill_summary"`
+
+	// PostJitter varies the intervals between scheduled statuses (see
+	// ScheduleSpacing) and the delays after posting (see DelayPerChar)
+	// randomly by up to this fraction of them in either direction, so that
+	// they look less mechanical. For example, 0.2 with a spacing of an hour
+	// produces intervals between 48 and 72 minutes. Between 0 and 1, and 0
+	// (no jitter) by default.
+	PostJitter ConfFraction `env:"POST_JITTER" toml:"post_jitter"`
+
+	// QuoteSelfAsEdit treats tweets quoting one of TwitterUser's own earlier
+	// tweets (often to correct it) as edits, editing the status that the
+	// earlier tweet was synced to instead of posting a new one. The earlier
+	// tweet must be in the state file. Edited statuses keep only the media of
+	// the quoting tweet. Falls back to posting normally if there's no status
+	// to edit or the server doesn't support editing.
+	QuoteSelfAsEdit bool `env:"QUOTE_SELF_AS_EDIT" toml:"quote_self_as_edit"`
+
+	// ReadingTimeMinLength is the length in characters that a toot must
+	// reach to get a reading time note when IncludeReadingTime is on.
+	ReadingTimeMinLength int `env:"READING_TIME_MIN_LENGTH,default=1000" toml:"reading_time_min_length"`
+
+	// ReadingTimeWPM is the reading speed in words per minute that reading
+	// time notes are estimated with when IncludeReadingTime is on.
+	ReadingTimeWPM int `env:"READING_TIME_WPM,default=200" toml:"reading_time_wpm"`
+
+	// Reconcile re-matches all candidate tweets against the account's
+	// existing statuses and repairs the mappings in StateFile accordingly
+	// instead of syncing, which is useful after changes to how tweets are
+	// matched. Nothing is posted. See reconcile.
+	Reconcile bool `env:"RECONCILE" toml:"reconcile"`
+
+	// ReconcileLimit is the maximum number of the account's most recent
+	// statuses that are fetched to match against when Reconcile,
+	// BackfillAltText, MirrorLikes, ReportUnmatchedStatuses, or
+	// RepairMissingMedia is on.
+	ReconcileLimit int `env:"RECONCILE_LIMIT,default=1000" toml:"reconcile_limit"`
+
+	// RedactLogs keeps the content of tweets, the URLs of their media, links,
+	// and quoted tweets, and the fediverse addresses of WebFingerHandleMappings
+	// out of log lines and error messages, logging only the length of content
+	// and a short hash of each URL or address alongside IDs, for running where
+	// logs are shared. Off by default.
+	RedactLogs bool `env:"REDACT_LOGS" toml:"redact_logs"`
+
+	// RepairMissingMedia finds statuses that tweets were previously synced
+	// to that have fewer media attachments than their tweets have photos,
+	// and edits them to carry all of the tweets' media, instead of syncing.
+	// Nothing new is posted. See repairMissingMedia.
+	RepairMissingMedia bool `env:"REPAIR_MISSING_MEDIA" toml:"repair_missing_media"`
+
+	// RepliesNote is a note appended to each status, like "(I don't check
+	// replies here, find me at https://brandur.org)", for accounts whose
+	// replies on Mastodon go unread because they're only crossposted to. It
+	// counts towards a status' length like the rest of its content. Not
+	// appended by default.
+	RepliesNote string `env:"REPLIES_NOTE" toml:"replies_note"`
+
+	// RepliesNoteThreadRootsOnly appends RepliesNote only to the first status
+	// of each reconstructed thread (see ThreadSelfReplies) rather than to
+	// every status in it.
+	RepliesNoteThreadRootsOnly bool `env:"REPLIES_NOTE_THREAD_ROOTS_ONLY" toml:"replies_note_thread_roots_only"`
+
+	// ReplyPrefix is an optional template that's prepended to replies to
+	// other users when IncludeReplies is on to give them some context. The
+	// placeholder `{user}` is replaced with the handle of the Twitter user
+	// being replied to, e.g. "Replying to @{user} (on Twitter):". The user
+	// being replied to is on Twitter rather than Mastodon, so any mentions in
+	// the prefix are defanged so that they don't notify a Mastodon user who
+	// happens to have the same name.
+	ReplyPrefix string `env:"REPLY_PREFIX" toml:"reply_prefix"`
+
+	// ReportUnmatchedStatuses lists the account's existing statuses (up to
+	// ReconcileLimit of the most recent) that don't match any candidate
+	// tweet instead of syncing, which is useful for finding statuses that
+	// were posted by hand or that matching missed. The report is printed, or
+	// written to UnmatchedStatusesFile if it's set. Nothing is posted.
+	ReportUnmatchedStatuses bool `env:"REPORT_UNMATCHED_STATUSES" toml:"report_unmatched_statuses"`
+
+	// RequireConfirmationOnEmptyAccount refuses to sync more than
+	// EmptyAccountSyncThreshold tweets to an account that has no existing
+	// statuses unless the `-yes` flag is given. This guards against a
+	// misconfigured access token for the wrong (empty) account causing an
+	// entire archive to be posted to it.
+	RequireConfirmationOnEmptyAccount bool `env:"REQUIRE_CONFIRMATION_ON_EMPTY_ACCOUNT" toml:"require_confirmation_on_empty_account"`
+
+	// RunLockFile is an optional path to a file where the start time of each
+	// run is recorded. A lock file alongside it with a `.lock` suffix is held
+	// while the program runs so that concurrent runs are refused, and runs
+	// are also refused if they start within MinRunInterval of the last one.
+	// Dry runs don't use it.
+	RunLockFile string `env:"RUN_LOCK_FILE" toml:"run_lock_file"`
+
+	// ScheduleSpacing schedules statuses at evenly spaced future times using
+	// Mastodon's scheduled statuses instead of posting them immediately, so
+	// that a large backfill drips out over time without the program having
+	// to keep running. Scheduled statuses don't show up in an account's
+	// statuses until they're published, so set StateFile so that scheduled
+	// tweets are tracked, or avoid running again before then lest tweets be
+	// scheduled a second time. With StateFile, a run schedules its statuses
+	// after those scheduled by earlier runs. Mastodon allows at most 25
+	// statuses to be scheduled for a day and 300 in total, so days that are
+	// full are skipped, and a run stops once 300 are scheduled.
+	ScheduleSpacing time.Duration `env:"SCHEDULE_SPACING" toml:"schedule_spacing"`
+
+	// ScheduleStart is the time (in RFC 3339 format) at which to schedule the
+	// first status when ScheduleSpacing is set. Defaults to as soon as
+	// Mastodon allows.
+	ScheduleStart time.Time `env:"SCHEDULE_START" toml:"schedule_start"`
+
+	// ServerSoftware is the software that the Mastodon server runs, like
+	// `mastodon`, `pleroma`, `akkoma`, or `gotosocial`, which adjusts for how
+	// it differs from Mastodon, like in its default character limit and
+	// whether it supports idempotency keys. It's detected through the
+	// server's nodeinfo on startup by default, and setting it skips
+	// detection. Unknown software is treated like Mastodon.
+	ServerSoftware string `env:"SERVER_SOFTWARE" toml:"server_software"`
+
+	// SkipAuthFailedMedia posts tweets as text only if any of their media
+	// can't be fetched because it requires authentication (a 401 or 403),
+	// which is what happens to the media of an account that was protected
+	// once the credentials it was exported with expire. By default, such
+	// media fails the tweet like any other media that can't be fetched.
+	// Takes precedence over PartialMediaOK and StrictMedia.
+	SkipAuthFailedMedia bool `env:"SKIP_AUTH_FAILED_MEDIA" toml:"skip_auth_failed_media"`
+
+	// SkipHashtagOnly skips tweets whose text is nothing but hashtags,
+	// mentions, and links (like "#tbt #nofilter"), which add little on
+	// Mastodon. A tweet with at least one real word is kept. Plain retweets
+	// are never skipped. Off by default.
+	SkipHashtagOnly bool `env:"SKIP_HASHTAG_ONLY" toml:"skip_hashtag_only"`
+
+	// SourceChecksum is the expected SHA256 checksum (hex-encoded) of the
+	// source Twitter data. The checksum of the data read is logged on every
+	// run, so it can be taken from a planning run (like a dry run) and set
+	// here for the real one to make sure that the data hasn't been truncated
+	// or otherwise changed in the meantime. Can only be checked when syncing
+	// a single source file. Not checked by default.
+	SourceChecksum string `env:"SOURCE_CHECKSUM" toml:"source_checksum"`
+
+	// StateFile is an optional path to a TOML file where state is persisted
+	// between runs. See State.
+	StateFile string `env:"STATE_FILE" toml:"state_file"`
+
+	// StrictMedia fails the run if any photo of a tweet being synced can't be
+	// fetched or uploaded, or is skipped because its type isn't allowed (see
+	// AllowedMediaTypes), so that no media is ever silently lost. Takes
+	// precedence over PartialMediaOK, which is ignored when both are set.
+	// Media other than photos is never synced and isn't affected.
+	StrictMedia bool `env:"STRICT_MEDIA" toml:"strict_media"`
+
+	// StripRTPrefix strips the leading "RT @user: " prefix that Twitter adds
+	// to the text of retweets, leaving just the retweeted content followed by
+	// a link to the original tweet. Off by default so that statuses synced by
+	// earlier runs keep matching their tweets.
+	StripRTPrefix bool `env:"STRIP_RT_PREFIX" toml:"strip_rt_prefix"`
+
+	// SyncNotAfter is a cutoff after which tweets are never synced, which
+	// protects recent tweets so that they can be curated by hand while older
+	// ones are still mirrored automatically. It's either a timestamp (like
+	// `2022-11-01T00:00:00Z`) or an age relative to the start of the run
+	// (like `72h`), and tweets created after it or whose creation time isn't
+	// known are left out. Not used by default.
+	//
+	// Time-based filters compose, so a tweet must pass all of them to be
+	// synced: it must be no older than MinTweetID, newer than the last
+	// synced tweet recorded in LastRunFile (unless IgnoreLastRun is set) and
+	// in CatchUpOnly mode, and no newer than SyncNotAfter. Because
+	// SyncNotAfter is only an upper bound, it never causes a tweet excluded
+	// by one of the others to be synced, and an age-based cutoff lets
+	// tweets through on later runs as they age past it.
+	SyncNotAfter ConfCutoff `env:"SYNC_NOT_AFTER" toml:"sync_not_after"`
+
+	// TextHandleMappings maps Twitter handles mentioned in the prose of
+	// tweets (as `@handle`, but not picked up by Twitter as a mention) to
+	// what they should be rewritten to, like `alice=alice@mastodon.social`.
+	// A value containing an `@` is taken to be a Mastodon account and
+	// rewritten to a mention of it, and any other value is used as plain
+	// text, which is useful for de-pinging a handle with no Mastodon
+	// equivalent. Handles are matched case-insensitively and only as whole
+	// words, so email addresses and fediverse handles are left alone.
+	// Mentions that are entities of the tweet are never rewritten by these
+	// mappings. Multiple mappings are separated by semicolons.
+	TextHandleMappings ConfMap `env:"TEXT_HANDLE_MAPPINGS" toml:"text_handle_mappings"`
+
+	// ThreadReplySpacing schedules each reply in a reconstructed thread (see
+	// ThreadSelfReplies) this long after its parent using Mastodon's scheduled
+	// statuses, so that a long thread assembles over a period of days while
+	// staying linked.
+	//
+	// A scheduled status gets a new ID when it's published, so a reply can't
+	// be scheduled until its parent has been published, and only one reply
+	// per thread is scheduled each run. Later replies are deferred until a run
+	// after their parent has been published, which means that the program
+	// needs to be run regularly (e.g. from cron) for the thread to complete,
+	// and that StateFile must be set so scheduled statuses can be tracked.
+	ThreadReplySpacing time.Duration `env:"THREAD_REPLY_SPACING" toml:"thread_reply_spacing"`
+
+	// ThreadReplyVisibility is the visibility of statuses posted as replies in
+	// threads reconstructed through ThreadSelfReplies. One of `public`,
+	// `unlisted`, `private`, or `direct`. By default replies inherit the
+	// visibility of the root of their thread.
+	ThreadReplyVisibility StatusVisibility `env:"THREAD_REPLY_VISIBILITY" toml:"thread_reply_visibility"`
+
+	// ThreadSelfReplies reconstructs threads by posting tweets that are
+	// replies to TwitterUser's own tweets as replies to the statuses that
+	// those tweets were synced to. Self-replies are candidates for syncing
+	// even if IncludeReplies is off. Replies to tweets that weren't synced
+	// (or were synced before a state file was configured and the run that
+	// synced them) are posted as standalone statuses. Threads are
+	// reconstructed across all the source files given, so one that spans
+	// two exports is posted as a single thread when both are synced together.
+	ThreadSelfReplies bool `env:"THREAD_SELF_REPLIES" toml:"thread_self_replies"`
+
+	// ThreadsOnly restricts candidates for syncing to tweets that are part of
+	// self-reply threads (see ThreadSelfReplies, which must be on along with
+	// TwitterUser) of at least this many tweets, dropping standalone tweets
+	// and shorter threads, for mirroring only long-form content. It must be
+	// at least 2, the length of the shortest thread, and a run with it set
+	// otherwise, or without ThreadSelfReplies and TwitterUser, fails before
+	// doing anything. Off by default.
+	ThreadsOnly int `env:"THREADS_ONLY" toml:"threads_only"`
+
+	// TrailingLinkPatterns are regular expressions matching redundant links
+	// (or other artifacts) at the end of tweets to strip from toots, like
+	// the links that Twitter appended for some YouTube or Instagram embeds.
+	// Multiple patterns are separated by semicolons, and each is only applied
+	// where it matches through to the end of the content. URLs that are part
+	// of a tweet's entities are never stripped. The t.co shortlinks that
+	// Twitter appends to tweets with media are always stripped (see
+	// mediaShortlinkPatterns), so patterns don't need to cover them.
+	TrailingLinkPatterns ConfRegexpList `env:"TRAILING_LINK_PATTERNS" toml:"trailing_link_patterns"`
+
+	// TwitterBearerToken is a bearer token sent in the Authorization header
+	// when fetching media from TwitterMediaHosts, which is required for some
+	// media from tweets sourced through Twitter's API.
+	TwitterBearerToken string `env:"TWITTER_BEARER_TOKEN" toml:"twitter_bearer_token"`
+
+	// TwitterMediaHosts are the hosts (separated by semicolons) that
+	// TwitterBearerToken is sent to when fetching media. Subdomains of these
+	// hosts match too.
+	TwitterMediaHosts []string `env:"TWITTER_MEDIA_HOSTS,default=pbs.twimg.com;video.twimg.com;ton.twitter.com" toml:"twitter_media_hosts"`
+
+	// TwitterUser is the Twitter handle of the user whose tweets are being
+	// synced, which is used to recognize replies to their own tweets.
+	TwitterUser string `env:"TWITTER_USER" toml:"twitter_user"`
+
+	// URLWeight is the number of characters that any URL counts as when
+	// measuring a toot's length against a server's character limit. Mastodon
+	// counts every URL as 23 characters regardless of its actual length.
+	URLWeight int `env:"URL_WEIGHT,default=23" toml:"url_weight"`
+
+	// UnmatchedStatusesFile is a path that the report produced by
+	// ReportUnmatchedStatuses is written to instead of being printed.
+	UnmatchedStatusesFile string `env:"UNMATCHED_STATUSES_FILE" toml:"unmatched_statuses_file"`
+
+	// UnrolledTweets maps the IDs of tweets to content to post in their place,
+	// like `1234567890=Now a blog post: https://example.com/post`. It's meant
+	// for threads that were later unrolled into something else, whose root
+	// can be posted as a single pointer to it. A mapped tweet's text and media
+	// are replaced wholesale, though reply prefixes, attribution, and
+	// engagement counts are still added as configured. Unmapped tweets are
+	// posted normally. Multiple mappings are separated by semicolons, so a
+	// replacement containing one must be configured through TOML.
+	UnrolledTweets ConfMap `env:"UNROLLED_TWEETS" toml:"unrolled_tweets"`
+
+	// ValidateEntities checks that the URL entities of tweets line up with
+	// their text before syncing, restoring URLs that were cut off at the end
+	// of truncated text and ignoring (with a warning) entities that can't be
+	// found in it, which some exports have when their text is truncated but
+	// their entities aren't. Off by default.
+	ValidateEntities bool `env:"VALIDATE_ENTITIES" toml:"validate_entities"`
+
+	// ValidateOnly validates the toots that would be posted for tweets that
+	// need syncing against the limits of the Mastodon server (characters,
+	// attachment count, and media types) instead of posting them. A pass/fail
+	// report is printed for every tweet and the program exits non-zero if any
+	// failed, allowing problems to be fixed before they interrupt a backfill.
+	ValidateOnly bool `env:"VALIDATE_ONLY" toml:"validate_only"`
+
+	// Visibility is the visibility of posted statuses. One of `public`,
+	// `unlisted`, `private`, or `direct`. Defaults to the account's default
+	// visibility.
+	Visibility StatusVisibility `env:"VISIBILITY" toml:"visibility"`
+
+	// WebFingerHandleMappings maps Twitter handles mentioned in the prose of
+	// tweets to hints of their fediverse addresses, like
+	// `alice=alice@example.com`, which are resolved to canonical accounts
+	// with WebFinger once up front each run and rewritten to mentions of them
+	// like TextHandleMappings (which take precedence). Handles whose
+	// addresses can't be resolved are rewritten as plain text. Statuses
+	// posted before a mapping was added still match their tweets. Multiple
+	// mappings are separated by semicolons.
+	WebFingerHandleMappings ConfMap `env:"WEBFINGER_HANDLE_MAPPINGS" toml:"webfinger_handle_mappings"`
+
+	// Yes is set from the `-yes` command line flag rather than the
+	// environment, and confirms syncing to an account with no existing
+	// statuses (see RequireConfirmationOnEmptyAccount) and posting without
+	// prompting (see ConfirmFirst).
+	Yes bool `toml:"-"`
+}
+
+// ConfCutoff is a cutoff in time that's either a fixed timestamp or an age
+// relative to the current time.
+type ConfCutoff struct {
+	age time.Duration
+	at  time.Time
+}
+
+// Decode decodes a ConfCutoff from an environmental variable's value, which
+// is either an RFC 3339 timestamp or a duration. It implements envdecode's
+// Decoder interface.
+func (c *ConfCutoff) Decode(value string) error {
+	if at, err := time.Parse(time.RFC3339, value); err == nil {
+		*c = ConfCutoff{at: at}
+		return nil
+	}
+
+	age, err := time.ParseDuration(value)
+	if err != nil {
+		return fmt.Errorf("cutoff must be an RFC 3339 timestamp or a duration, but got: %v", value)
+	}
+	if age < 0 {
+		return fmt.Errorf("cutoff age must not be negative, but got: %v", value)
+	}
+
+	*c = ConfCutoff{age: age}
+	return nil
+}
+
+// time returns the cutoff's time given the current time, which is zero if the
+// cutoff isn't set.
+func (c ConfCutoff) time(now time.Time) time.Time {
+	if !c.at.IsZero() {
+		return c.at
+	}
+	if c.age > 0 {
+		return now.Add(-c.age)
+	}
+	return time.Time{}
+}
+
+// ConfFraction is a fraction between 0 and 1 inclusive.
+type ConfFraction float64
+
+// Decode decodes a ConfFraction from an environmental variable's value,
+// checking that it's between 0 and 1. It implements envdecode's Decoder
+// interface.
+func (f *ConfFraction) Decode(value string) error {
+	fraction, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return fmt.Errorf("error parsing fraction: %w", err)
+	}
+
+	if fraction < 0 || fraction > 1 {
+		return fmt.Errorf("fraction must be between 0 and 1, but got: %v", fraction)
+	}
+
+	*f = ConfFraction(fraction)
+	return nil
+}
+
+// ConfMap is a map of strings that can be decoded from an environmental
+// variable of the form `key1=value1;key2=value2`.
+type ConfMap map[string]string
+
+// Decode decodes a ConfMap from an environmental variable's value. It
+// implements envdecode's Decoder interface.
+func (m *ConfMap) Decode(value string) error {
+	*m = make(ConfMap)
+
+	for _, pair := range strings.Split(value, ";") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("expected map pair in form 'key=value', but got: '%s'", pair)
+		}
+
+		(*m)[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+	}
+
+	return nil
+}
+
+// GetFold looks up a value in the map by key, matching keys
+// case-insensitively.
+func (m ConfMap) GetFold(key string) (string, bool) {
+	if value, ok := m[key]; ok {
+		return value, true
+	}
+
+	for k, value := range m {
+		if strings.EqualFold(k, key) {
+			return value, true
+		}
+	}
+
+	return "", false
+}
+
+// ConfVisibilityMap is a map of strings to status visibilities that can be
+// decoded from an environmental variable of the form `key1=value1;key2=value2`.
+type ConfVisibilityMap map[string]StatusVisibility
+
+// Decode decodes a ConfVisibilityMap from an environmental variable's value,
+// checking that each value is a visibility that Mastodon knows about. It
+// implements envdecode's Decoder interface.
+func (m *ConfVisibilityMap) Decode(value string) error {
+	var pairs ConfMap
+	if err := pairs.Decode(value); err != nil {
+		return err
+	}
+
+	*m = make(ConfVisibilityMap)
+	for key, value := range pairs {
+		var visibility StatusVisibility
+		if err := visibility.Decode(value); err != nil {
+			return err
+		}
+
+		(*m)[key] = visibility
+	}
+
+	return nil
+}
+
+// GetFold looks up a value in the map by key, matching keys
+// case-insensitively.
+func (m ConfVisibilityMap) GetFold(key string) (StatusVisibility, bool) {
+	if value, ok := m[key]; ok {
+		return value, true
+	}
+
+	for k, value := range m {
+		if strings.EqualFold(k, key) {
+			return value, true
+		}
+	}
+
+	return "", false
+}
+
+// ConfRegexpList is a list of regular expressions that can be decoded from an
+// environmental variable of the form `pattern1;pattern2`.
+type ConfRegexpList []*regexp.Regexp
+
+// Decode decodes a ConfRegexpList from an environmental variable's value,
+// compiling each pattern. It implements envdecode's Decoder interface.
+func (l *ConfRegexpList) Decode(value string) error {
+	*l = nil
+
+	for _, pattern := range strings.Split(value, ";") {
+		pattern = strings.TrimSpace(pattern)
+		if pattern == "" {
+			continue
+		}
+
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return fmt.Errorf("error compiling pattern '%s': %w", pattern, err)
+		}
+
+		*l = append(*l, re)
+	}
+
+	return nil
+}
+
+// EngagementMode is where a tweet's engagement stats are included in its
+// toot. See `Conf.IncludeEngagement`.
+type EngagementMode string
+
+// Engagement modes.
+const (
+	EngagementFooter  EngagementMode = "footer"
+	EngagementSpoiler EngagementMode = "spoiler"
+)
+
+// Decode decodes an EngagementMode from an environmental variable's value,
+// checking that it's a known mode. It implements envdecode's Decoder
+// interface.
+func (m *EngagementMode) Decode(value string) error {
+	switch mode := EngagementMode(value); mode {
+	case "", EngagementFooter, EngagementSpoiler:
+		*m = mode
+		return nil
+	}
+
+	return fmt.Errorf("unknown engagement mode: '%s'", value)
+}
+
+// HashtagCaseRule is a rule for normalizing the casing of hashtags. See
+// `Conf.HashtagCase`.
+type HashtagCaseRule string
+
+// Hashtag case rules.
+const (
+	HashtagCaseLower         HashtagCaseRule = "lower"
+	HashtagCasePreserveFirst HashtagCaseRule = "preserve_first"
+)
+
+// Decode decodes a HashtagCaseRule from an environmental variable's value,
+// checking that it's a known rule. It implements envdecode's Decoder
+// interface.
+func (r *HashtagCaseRule) Decode(value string) error {
+	switch rule := HashtagCaseRule(value); rule {
+	case "", HashtagCaseLower, HashtagCasePreserveFirst:
+		*r = rule
+		return nil
+	}
+
+	return fmt.Errorf("unknown hashtag case rule: '%s'", value)
+}
+
+// StatusVisibility is the visibility of a Mastodon status.
+type StatusVisibility string
+
+// Decode decodes a StatusVisibility from an environmental variable's value,
+// checking that it's a visibility that Mastodon knows about. It implements
+// envdecode's Decoder interface.
+func (v *StatusVisibility) Decode(value string) error {
+	switch visibility := StatusVisibility(value); visibility {
+	case "", "public", "unlisted", "private", "direct":
+		*v = visibility
+		return nil
+	}
+
+	return fmt.Errorf("unknown status visibility: '%s'", value)
+}
+
+// apiClient is a Mastodon client that adds endpoints that go-mastodon doesn't
+// support.
+type apiClient struct {
+	*mastodon.Client
+}
+
+// countingWriter is an io.Writer that counts the bytes written to it and
+// discards them.
+type countingWriter struct {
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.n += int64(len(p))
+	return len(p), nil
+}
+
+// mastodonClient is the subset of the API of `*mastodon.Client` that this
+// program uses. It's an interface so that a fake can be substituted in tests.
+type mastodonClient interface {
+	AccountsSearch(ctx context.Context, q string, limit int64) ([]*mastodon.Account, error)
+	Favourite(ctx context.Context, id mastodon.ID) (*mastodon.Status, error)
+	GetAccountCurrentUser(ctx context.Context) (*mastodon.Account, error)
+	GetAccountStatuses(ctx context.Context, id mastodon.ID, pg *mastodon.Pagination) ([]*mastodon.Status, error)
+	GetInstance(ctx context.Context) (*mastodon.Instance, error)
+	GetMediaProcessed(ctx context.Context, id mastodon.ID) (bool, error)
+	GetStatusSource(ctx context.Context, id mastodon.ID) (*mastodon.Source, error)
+	PostStatus(ctx context.Context, toot *mastodon.Toot) (*mastodon.Status, error)
+	Reblog(ctx context.Context, id mastodon.ID) (*mastodon.Status, error)
+	UpdateStatus(ctx context.Context, toot *mastodon.Toot, id mastodon.ID) (*mastodon.Status, error)
+	UpdateStatusMedia(ctx context.Context, toot *mastodon.Toot, id mastodon.ID, descriptions map[mastodon.ID]string) (*mastodon.Status, error)
+	UploadMediaFromMedia(ctx context.Context, media *mastodon.Media) (*mastodon.Attachment, error)
+}
+
+// mediaAuthError is an error fetching media that requires authentication,
+// which is usually because it belongs to a protected account and was exported
+// along with credentials that have since expired.
+type mediaAuthError struct {
+	url        string
+	statusCode int
+}
+
+func (e *mediaAuthError) Error() string {
+	return fmt.Sprintf("'%v' requires authentication to fetch (status code %d), probably because the account "+
+		"was protected; set SKIP_AUTH_FAILED_MEDIA to post tweets with such media as text only",
+		e.url, e.statusCode)
+}
+
+// mediaSyncError is an error fetching or uploading media, which might succeed
+// with a different variant of it (see mediaURLVariants).
+type mediaSyncError struct {
+	op  string
+	err error
+}
+
+func (e *mediaSyncError) Error() string {
+	return e.op + ": " + e.err.Error()
+}
+
+func (e *mediaSyncError) Unwrap() error {
+	return e.err
+}
+
+// redactedError is an error with a URL redacted from its message (see
+// redactError), which still unwraps to the original.
+type redactedError struct {
+	msg string
+	err error
+}
+
+func (e *redactedError) Error() string {
+	return e.msg
+}
+
+func (e *redactedError) Unwrap() error {
+	return e.err
 }
 
 //
@@ -128,14 +1418,54 @@ type TweetDB struct {
 
 // Tweet is a single tweet stored to a TOML file.
 type Tweet struct {
-	CreatedAt     time.Time      `toml:"created_at"`
+	CreatedAt time.Time `toml:"created_at"`
+
+	// DisplayTextRange is the start and end (exclusive) of the part of Text
+	// that Twitter displays as the tweet, in characters, which excludes any
+	// leading reply mentions and trailing media links. Optional, and not
+	// present in older exports.
+	DisplayTextRange []int `toml:"display_text_range,omitempty"`
+
 	Entities      *TweetEntities `toml:"entities"`
 	FavoriteCount int            `toml:"favorite_count,omitempty"`
 	ID            int64          `toml:"id"`
+	Quote         *TweetQuote    `toml:"quote"`
 	Reply         *TweetReply    `toml:"reply"`
 	Retweet       *TweetRetweet  `toml:"retweet"`
 	RetweetCount  int            `toml:"retweet_count,omitempty"`
-	Text          string         `toml:"text"`
+
+	// Source is the client that the tweet was posted from, like "Twitter for
+	// iPhone", either as its name or as the HTML link to it that Twitter's
+	// API returns (see tweetSource). Optional, and not present in older
+	// exports.
+	Source string `toml:"source,omitempty"`
+
+	// Spoiler overrides the content warning that the tweet is posted with
+	// (see DefaultSpoiler and HashtagSpoilers). An empty string posts it
+	// without one. Optional, and only present if added by hand.
+	Spoiler *string `toml:"spoiler,omitempty"`
+
+	Text string `toml:"text"`
+
+	// author is the handle of the tweet's author that the tweet is
+	// attributed to when Attribution is on. It's set based on the source
+	// that the tweet was read from (see sourceAuthor).
+	author string
+
+	// mergedIDs are the IDs of the tweets merged into this one when it was
+	// produced by mergePhotoThreads.
+	mergedIDs []int64
+
+	// photoThread is the whole photo thread that this tweet was merged from
+	// by mergePhotoThreads, if it was, which is kept so that it can be
+	// regrouped by legacyPhotoThreadBatches.
+	photoThread []*Tweet
+
+	// quoteUnavailable is whether the tweet quoted by this one was found to
+	// be no longer available when CheckQuotedAvailability is on. It's set
+	// before the tweet is rendered by resolveQuotedAvailability so that
+	// rendering doesn't depend on the network.
+	quoteUnavailable bool
 }
 
 // TweetEntities contains various multimedia entries that may be contained in a
@@ -148,6 +1478,9 @@ type TweetEntities struct {
 
 // TweetEntitiesMedia is an image or video stored in a tweet.
 type TweetEntitiesMedia struct {
+	// AltText is the media's description, if it has one.
+	AltText string `toml:"alt_text,omitempty"`
+
 	ID   int64  `toml:"id"`
 	Type string `toml:"type"`
 	URL  string `toml:"url"`
@@ -166,6 +1499,19 @@ type TweetEntitiesUserMention struct {
 	UserID int64  `toml:"user_id"`
 }
 
+// TweetQuote is populated with information on the quoted tweet for when a
+// tweet is a quote tweet.
+//
+// Some older exports represent a quote tweet as a retweet whose text is the
+// quote commentary, and set both Quote and Retweet. When both are set, Quote
+// takes precedence and the tweet is rendered as commentary with a single link
+// to the quoted tweet.
+type TweetQuote struct {
+	StatusID int64  `toml:"status_id"`
+	User     string `toml:"user"`
+	UserID   int64  `toml:"user_id"`
+}
+
 // TweetReply is populated with reply information for when a tweet is a
 // reply.
 type TweetReply struct {
@@ -192,191 +1538,1735 @@ type TweetRetweet struct {
 //
 //////////////////////////////////////////////////////////////////////////////
 
-func die(message string) {
-	fmt.Fprintf(os.Stderr, message)
-	os.Exit(1)
-}
+// leadingMentionsRE matches any number of mentions at the start of a tweet,
+// like those Twitter prepends to replies.
+var leadingMentionsRE = regexp.MustCompile(`^(@\w+\s*)+`)
 
-func fetchURL(url, target string) error {
-	resp, err := http.Get(url)
-	if err != nil {
-		return fmt.Errorf("error fetching '%v': %w", url, err)
-	}
-	defer resp.Body.Close()
+// authoredText returns the text of a tweet that was written by its author,
+// excluding leading mentions and any link to a quoted or retweeted tweet.
+func authoredText(tweet *Tweet) string {
+	text := leadingMentionsRE.ReplaceAllString(tweet.Text, "")
 
-	if resp.StatusCode != 200 {
-		return fmt.Errorf("unexpected status code fetching '%v': %d",
-			url, resp.StatusCode)
+	var statusIDs []int64
+	if tweet.Quote != nil {
+		statusIDs = append(statusIDs, tweet.Quote.StatusID)
+	}
+	if tweet.Retweet != nil {
+		statusIDs = append(statusIDs, tweet.Retweet.StatusID)
 	}
 
-	f, err := os.Create(target)
-	if err != nil {
-		return fmt.Errorf("Error creating '%v': %w", target, err)
+	if tweet.Entities != nil {
+		for _, url := range tweet.Entities.URLs {
+			for _, statusID := range statusIDs {
+				if strings.Contains(url.ExpandedURL, fmt.Sprintf("/status/%v", statusID)) {
+					text = strings.Replace(text, url.URL, "", -1)
+					text = strings.Replace(text, url.ExpandedURL, "", -1)
+				}
+			}
+		}
 	}
-	defer f.Close()
 
-	w := bufio.NewWriter(f)
+	return strings.TrimSpace(text)
+}
 
-	// probably not needed
-	defer w.Flush()
+// auditMatchDrift checks a status that was matched to a tweet for content
+// drift, logging a warning and returning true if any was found.
+func auditMatchDrift(status *mastodon.Status, tweet *Tweet, distance int) bool {
+	if distance == 0 {
+		return false
+	}
 
-	_, err = io.Copy(w, resp.Body)
-	if err != nil {
-		return fmt.Errorf("error copying to '%v' from HTTP response: %w",
-			target, err)
+	logger.Warnf("Content drift for tweet %v in Mastodon status %v (distance: %v); "+
+		"check whether `tootToTweet` needs updating", tweet.ID, status.ID, distance)
+	return true
+}
+
+// checkEmptyAccount returns an error if tweets are about to be synced to an
+// account with no existing statuses and confirmation is required to do so.
+func checkEmptyAccount(conf *Conf, statuses []*mastodon.Status, tweetsToSync []*Tweet) error {
+	if !conf.RequireConfirmationOnEmptyAccount || conf.DryRun || conf.Yes {
+		return nil
 	}
 
-	logger.Infof("Fetched '%s' to '%s'", url, target)
+	if len(statuses) > 0 || len(tweetsToSync) <= conf.EmptyAccountSyncThreshold {
+		return nil
+	}
 
-	return nil
+	return fmt.Errorf("account has no existing statuses, but %d tweet(s) would be synced to it; "+
+		"check that the access token is for the right account and re-run with -yes to proceed",
+		len(tweetsToSync))
 }
 
-func findMatchingStatus(statuses []*mastodon.Status, tweet *Tweet) (*mastodon.Status, int) {
-	var distance int
-	var matchingStatus *mastodon.Status
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
 
-StatusChecksLoop:
-	for _, status := range statuses {
-		originalContent := tootToTweet(status)
+// containsEntityURL checks whether text contains any of the (expanded) URLs in
+// a tweet's entities.
+func containsEntityURL(tweet *Tweet, text string) bool {
+	if tweet.Entities == nil {
+		return false
+	}
 
-		// Go through every tweet to toot version we've ever had so that if a
-		// new one produces a significantly different enough result from one
-		// that posted an earlier status to Mastodon, we don't accidentally
-		// mistake it for a new tweet.
-		tweetToTootImplementations := []func(*Tweet) string{
-			tweetToTootV2,
-			tweetToTootV1,
+	for _, url := range tweet.Entities.URLs {
+		if url.ExpandedURL != "" && strings.Contains(text, url.ExpandedURL) {
+			return true
 		}
+	}
 
-		// Unfortunately, once a status is posted to Masotodon, it does a lot
-		// of post-manipulation on the string, including adding HTML markup.
-		//
-		// I try to unwind it as much as possible above, and indeed I've gotten
-		// down to zero difference for my test cases, but I'm still worried
-		// this'll cause degenerate behavior along some edge I haven't tested.
-		// So here, we use Levenschtein distance to call a match as long as it
-		// looks reasonably close.
-		for _, tweetToToot := range tweetToTootImplementations {
-			distance = levenshtein.ComputeDistance(originalContent, tweetToToot(tweet))
-			if distance < levenshteinDistanceTolerance {
-				matchingStatus = status
-				break StatusChecksLoop
-			}
+	return false
+}
+
+// containsStringFold checks whether values contains value, ignoring case.
+func containsStringFold(values []string, value string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, value) {
+			return true
 		}
 	}
+	return false
+}
 
-	if matchingStatus == nil {
-		distance = 0
-	}
+// mentionRE matches the start of a mention, capturing the character before it
+// (if any) and the first character of the mentioned name.
+var mentionRE = regexp.MustCompile(`(^|[^=/\w])@(\w)`)
 
-	return matchingStatus, distance
+// defangMentions inserts a zero-width space after the `@` of any mentions in
+// text so that Mastodon renders them as plain text instead of linking and
+// notifying the mentioned accounts.
+func defangMentions(text string) string {
+	return mentionRE.ReplaceAllString(text, "$1@\u200b$2")
 }
 
-func readTweetsFromFile(source string) ([]*Tweet, error) {
-	existingData, err := ioutil.ReadFile(source)
+// detectMediaType detects the MIME type of the file at the given path by
+// sniffing its contents.
+func detectMediaType(path string) (string, error) {
+	f, err := os.Open(path)
 	if err != nil {
-		return nil, fmt.Errorf("error reading source twitter data file: %w", err)
+		return "", fmt.Errorf("error opening '%v': %w", path, err)
 	}
+	defer f.Close()
 
-	var existingTweetDB TweetDB
-	err = toml.Unmarshal(existingData, &existingTweetDB)
-	if err != nil {
-		return nil, fmt.Errorf("error unmarshaling toml: %w", err)
+	// DetectContentType considers at most the first 512 bytes.
+	buf := make([]byte, 512)
+	n, err := io.ReadFull(f, buf)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", fmt.Errorf("error reading '%v': %w", path, err)
 	}
 
-	return existingTweetDB.Tweets, nil
+	// Strip any parameters like `; charset=utf-8`.
+	mimeType := http.DetectContentType(buf[:n])
+	return strings.TrimSpace(strings.Split(mimeType, ";")[0]), nil
 }
 
-func syncMedia(ctx context.Context, conf *Conf, client *mastodon.Client, tweet *Tweet, tempDir string) ([]mastodon.ID, error) {
-	if tweet.Entities == nil || tweet.Entities.Medias == nil {
-		return nil, nil
-	}
-
+func die(message string) {
+	fmt.Fprintf(os.Stderr, message)
+	os.Exit(1)
+}
+
+// displayTextTweet returns a copy of a tweet with its text trimmed to its
+// DisplayTextRange, which is more accurate than the heuristics used to strip
+// reply mentions and media links otherwise. The tweet is returned as is if it
+// doesn't have a range or its range is invalid.
+func displayTextTweet(tweet *Tweet) *Tweet {
+	if len(tweet.DisplayTextRange) != 2 {
+		return tweet
+	}
+
+	runes := []rune(tweet.Text)
+	start, end := tweet.DisplayTextRange[0], tweet.DisplayTextRange[1]
+	if start < 0 || end < start || end > len(runes) {
+		logger.Warnf("Ignoring invalid display text range %v of tweet %v", tweet.DisplayTextRange, tweet.ID)
+		return tweet
+	}
+
+	trimmed := *tweet
+	trimmed.Text = string(runes[start:end])
+	return &trimmed
+}
+
+// dumpStatuses fetches the account's existing statuses and writes a dump of
+// each one's raw content and normalized form.
+func dumpStatuses(ctx context.Context, conf *Conf, client mastodonClient, w io.Writer) error {
+	account, err := client.GetAccountCurrentUser(ctx)
+	if err != nil {
+		return fmt.Errorf("error getting current user account: %w", err)
+	}
+
+	statuses, err := fetchAccountStatuses(ctx, client, account.ID, conf.DumpStatusesLimit)
+	if err != nil {
+		return err
+	}
+
+	writeStatusDump(w, statuses)
+
+	return nil
+}
+
+// fetchAccountStatuses fetches up to limit of an account's most recent
+// statuses, paginating as necessary.
+func fetchAccountStatuses(ctx context.Context, client mastodonClient, id mastodon.ID, limit int) ([]*mastodon.Status, error) {
+	var statuses []*mastodon.Status
+	pg := &mastodon.Pagination{}
+
+	for len(statuses) < limit {
+		maxID := pg.MaxID
+
+		page, err := client.GetAccountStatuses(ctx, id, pg)
+		if err != nil {
+			return nil, fmt.Errorf("error getting statuses: %w", err)
+		}
+
+		statuses = append(statuses, page...)
+
+		// The pagination is updated from the response's Link header, and left
+		// as is if there isn't one.
+		if len(page) < 1 || pg.MaxID == "" || pg.MaxID == maxID {
+			break
+		}
+	}
+
+	if len(statuses) > limit {
+		statuses = statuses[:limit]
+	}
+
+	return statuses, nil
+}
+
+func fetchURL(conf *Conf, url, target string, header http.Header) error {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return fmt.Errorf("error building request for '%v': %w", logURL(conf, url), redactError(conf, err, url))
+	}
+
+	for key, values := range header {
+		req.Header[key] = values
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("error fetching '%v': %w", logURL(conf, url), redactError(conf, err, url))
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+		return &mediaAuthError{url: logURL(conf, url), statusCode: resp.StatusCode}
+	}
+
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("unexpected status code fetching '%v': %d",
+			logURL(conf, url), resp.StatusCode)
+	}
+
+	f, err := os.Create(target)
+	if err != nil {
+		return fmt.Errorf("Error creating '%v': %w", target, err)
+	}
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+
+	// probably not needed
+	defer w.Flush()
+
+	_, err = io.Copy(w, resp.Body)
+	if err != nil {
+		return fmt.Errorf("error copying to '%v' from HTTP response: %w",
+			target, err)
+	}
+
+	logger.Infof("Fetched '%s' to '%s'", logURL(conf, url), target)
+
+	return nil
+}
+
+// filterTweetsNotAfter returns only those tweets created at or before the
+// given cutoff. Tweets whose creation time isn't known are left out because
+// it can't be known that they're old enough.
+func filterTweetsNotAfter(tweets []*Tweet, cutoff time.Time) []*Tweet {
+	var filtered []*Tweet
+	for _, tweet := range tweets {
+		if tweet.CreatedAt.IsZero() || tweet.CreatedAt.After(cutoff) {
+			logger.Debugf("Skipping tweet %v created after cutoff %v", tweet.ID, cutoff)
+			continue
+		}
+
+		filtered = append(filtered, tweet)
+	}
+
+	return filtered
+}
+
+// Matches the prefix that Twitter adds to the text of retweets.
+var retweetPrefixRE = regexp.MustCompile(`^RT @\w+: `)
+
+// minNativeBoostBodyLength is the minimum length of retweet body that we'll
+// try to match against a toot by prefix. Anything shorter is too likely to
+// produce a false positive.
+const minNativeBoostBodyLength = 20
+
+// findNativeBoostTarget looks for the original toot of a retweet amongst the
+// statuses of the Mastodon account that the retweeted user is mapped to in
+// HandleMappings. Returns nil if the user isn't mapped or no such toot could
+// be found.
+func findNativeBoostTarget(ctx context.Context, conf *Conf, client mastodonClient, tweet *Tweet) (*mastodon.Status, error) {
+	if tweet.Retweet == nil {
+		return nil, nil
+	}
+
+	acct, ok := conf.HandleMappings.GetFold(tweet.Retweet.User)
+	if !ok {
+		return nil, nil
+	}
+
+	accounts, err := client.AccountsSearch(ctx, acct, 1)
+	if err != nil {
+		return nil, fmt.Errorf("error searching for account '%s': %w", acct, err)
+	}
+	if len(accounts) < 1 {
+		logger.Infof("Couldn't find Mastodon account '%s' for retweeted user '%s'",
+			acct, tweet.Retweet.User)
+		return nil, nil
+	}
+
+	statuses, err := client.GetAccountStatuses(ctx, accounts[0].ID, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error getting statuses for account '%s': %w", acct, err)
+	}
+
+	// Retweet text is prefixed with "RT @user: " and often truncated by
+	// Twitter with a trailing ellipsis, so strip both and then look for a toot
+	// that starts with what's left.
+	body := tweetToTootV1(tweet)
+	if tweet.Entities != nil && tweet.Entities.URLs != nil {
+		for _, url := range tweet.Entities.URLs {
+			body = strings.Replace(body, url.URL, url.ExpandedURL, -1)
+		}
+	}
+	body = retweetPrefixRE.ReplaceAllString(body, "")
+	body = strings.TrimSpace(strings.TrimSuffix(body, "…"))
+
+	for _, status := range statuses {
+		if status.Reblog != nil {
+			continue
+		}
+
+		content := tootToTweet(status)
+
+		if levenshtein.ComputeDistance(content, body) < levenshteinDistanceTolerance {
+			return status, nil
+		}
+
+		if len(body) >= minNativeBoostBodyLength && strings.HasPrefix(content, body) {
+			return status, nil
+		}
+	}
+
+	return nil, nil
+}
+
+func findMatchingStatus(conf *Conf, statuses []*mastodon.Status, tweet *Tweet) (*mastodon.Status, int) {
+	var distance int
+	var matchingStatus *mastodon.Status
+
+	var candidates []*mastodon.Status
+	var candidateDistances []int
+
+	// Boosts carry the content of someone else's status, so they never
+	// correspond to one of the account's own tweets and could only produce
+	// spurious matches. They're dropped before MaxStatusesToCompare is
+	// applied so that they don't crowd out statuses that could match.
+	// Retweets synced as native boosts are deduplicated by syncTweetAsBoost
+	// instead.
+	originals := make([]*mastodon.Status, 0, len(statuses))
+	for _, status := range statuses {
+		if status.Reblog == nil {
+			originals = append(originals, status)
+		}
+	}
+	statuses = originals
+
+	if conf.MaxStatusesToCompare > 0 && len(statuses) > conf.MaxStatusesToCompare {
+		statuses = statuses[:conf.MaxStatusesToCompare]
+
+		oldest := statuses[len(statuses)-1]
+		if !tweet.CreatedAt.IsZero() && tweet.CreatedAt.Before(oldest.CreatedAt) {
+			logger.Warnf("Tweet %v is older than the oldest of the %v status(es) compared; "+
+				"a status it was synced to may be missed", tweet.ID, conf.MaxStatusesToCompare)
+		}
+	}
+
+	// Go through every tweet to toot version we've ever had so that if a new
+	// one produces a significantly different enough result from one that
+	// posted an earlier status to Mastodon, we don't accidentally mistake it
+	// for a new tweet. Twitter and Mastodon don't agree on which emoji carry
+	// variation selectors, or on whether accented characters are composed, so
+	// selectors are ignored and text is normalized to NFC on both sides.
+	renders := renderTootVersions(conf, tweet)
+	for i, render := range renders {
+		renders[i] = norm.NFC.String(stripVariationSelectors(render))
+	}
+
+StatusChecksLoop:
+	for _, status := range statuses {
+		originalContent := norm.NFC.String(stripVariationSelectors(tootToTweet(status)))
+
+		// Unfortunately, once a status is posted to Masotodon, it does a lot
+		// of post-manipulation on the string, including adding HTML markup.
+		//
+		// I try to unwind it as much as possible above, and indeed I've gotten
+		// down to zero difference for my test cases, but I'm still worried
+		// this'll cause degenerate behavior along some edge I haven't tested.
+		// So here, we use Levenschtein distance to call a match as long as it
+		// looks reasonably close.
+		for _, render := range renders {
+			distance = levenshtein.ComputeDistance(originalContent, render)
+			if distance < levenshteinDistanceTolerance {
+				if !conf.PerceptualMediaMatch || len(tweetPhotos(tweet)) < 1 {
+					matchingStatus = status
+					break StatusChecksLoop
+				}
+
+				// Keep looking for other statuses with the same text so
+				// that they can be told apart by their media.
+				candidates = append(candidates, status)
+				candidateDistances = append(candidateDistances, distance)
+				continue StatusChecksLoop
+			}
+		}
+	}
+
+	if len(candidates) > 0 {
+		i := pickByMediaSimilarity(conf, candidates, tweet)
+		matchingStatus, distance = candidates[i], candidateDistances[i]
+	}
+
+	if matchingStatus == nil {
+		distance = 0
+	}
+
+	return matchingStatus, distance
+}
+
+// isHashtagOnly checks whether text has no real words, being made up of
+// nothing but hashtags, mentions, links, and punctuation.
+func isHashtagOnly(text string) bool {
+	for _, field := range strings.Fields(text) {
+		if strings.HasPrefix(field, "#") || strings.HasPrefix(field, "@") ||
+			strings.HasPrefix(field, "http://") || strings.HasPrefix(field, "https://") {
+			continue
+		}
+
+		if strings.IndexFunc(field, func(r rune) bool { return unicode.IsLetter(r) || unicode.IsNumber(r) }) >= 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// isThreadReply checks whether a tweet is a reply to one of the user's own
+// tweets in a thread that's being reconstructed.
+func isThreadReply(conf *Conf, tweet *Tweet) bool {
+	return conf.ThreadSelfReplies && conf.TwitterUser != "" &&
+		tweet.Reply != nil && strings.EqualFold(tweet.Reply.User, conf.TwitterUser)
+}
+
+// isTwitterMediaURL checks whether a URL is on one of TwitterMediaHosts or a
+// subdomain of one.
+func isTwitterMediaURL(conf *Conf, mediaURL string) bool {
+	u, err := url.Parse(mediaURL)
+	if err != nil {
+		return false
+	}
+
+	host := strings.ToLower(u.Hostname())
+	for _, mediaHost := range conf.TwitterMediaHosts {
+		mediaHost = strings.ToLower(mediaHost)
+		if host == mediaHost || strings.HasSuffix(host, "."+mediaHost) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isVariationSelector returns whether r is a Unicode variation selector.
+func isVariationSelector(r rune) bool {
+	return (r >= '\uFE00' && r <= '\uFE0F') || (r >= '\U000E0100' && r <= '\U000E01EF')
+}
+
+// logEditedStatus logs that the status that a tweet was posted as was edited
+// after it was posted, if it's amongst statuses and was (see
+// DetectEditedStatuses). Nothing is done about it.
+func logEditedStatus(statuses []*mastodon.Status, tweet *Tweet, stateTweet *StateTweet) {
+	for _, status := range statuses {
+		if string(status.ID) != stateTweet.StatusID {
+			continue
+		}
+
+		if !status.EditedAt.IsZero() && status.EditedAt.After(status.CreatedAt) {
+			logger.Infof("Mastodon status %v for tweet %v was edited at %v after it was posted; leaving it alone",
+				status.ID, tweet.ID, status.EditedAt.Format(time.RFC3339))
+		}
+		return
+	}
+}
+
+// logSample produces a sample of status content for a log line (see
+// sampleContent), or only its length if RedactLogs is on.
+func logSample(conf *Conf, content string) string {
+	if conf.RedactLogs {
+		return fmt.Sprintf("<redacted, %d characters>", utf8.RuneCountInString(content))
+	}
+
+	return sampleContent(content, conf.LogSampleLength)
+}
+
+// logURL produces a URL for a log line or error message, which is replaced
+// by the start of its SHA256 hash if RedactLogs is on so that mentions of the
+// same URL can still be correlated.
+func logURL(conf *Conf, u string) string {
+	if conf.RedactLogs {
+		sum := sha256.Sum256([]byte(u))
+		return "<redacted URL " + hex.EncodeToString(sum[:4]) + ">"
+	}
+
+	return u
+}
+
+// mediaRequestHeader returns headers to send when fetching media from the
+// given URL, which include TwitterBearerToken for Twitter's own hosts (see
+// TwitterMediaHosts). Media from any other host is fetched without them so
+// that the token isn't leaked.
+func mediaRequestHeader(conf *Conf, mediaURL string) http.Header {
+	header := make(http.Header)
+
+	if conf.TwitterBearerToken != "" && isTwitterMediaURL(conf, mediaURL) {
+		header.Set("Authorization", "Bearer "+conf.TwitterBearerToken)
+	}
+
+	return header
+}
+
+// mediaURLVariants returns the URLs to try fetching media from, which are its
+// own URL followed by each of MediaURLVariants, like `large` for
+// `https://pbs.twimg.com/media/abc.jpg:large`. Variants are only supported by
+// Twitter's media hosts (see TwitterMediaHosts), so media from any other host
+// only has its own URL.
+func mediaURLVariants(conf *Conf, mediaURL string) []string {
+	urls := []string{mediaURL}
+
+	if len(conf.MediaURLVariants) < 1 || !isTwitterMediaURL(conf, mediaURL) {
+		return urls
+	}
+
+	// Strip any variant that the URL already has.
+	base := mediaURL
+	if i := strings.LastIndex(base, ":"); i > strings.LastIndex(base, "/") {
+		base = base[:i]
+	}
+
+	for _, variant := range conf.MediaURLVariants {
+		variantURL := base + ":" + variant
+		if !containsString(urls, variantURL) {
+			urls = append(urls, variantURL)
+		}
+	}
+
+	return urls
+}
+
+// newHTTPClient builds an HTTP client with a transport that uses the
+// configured timeouts. Dial, TLS handshake, and response header timeouts are
+// distinct from the overall request timeout so that a generous overall limit
+// can be combined with failing fast on hosts that can't be reached.
+func newHTTPClient(conf *Conf) *http.Client {
+	dialer := &net.Dialer{
+		Timeout:   conf.HTTPDialTimeout,
+		KeepAlive: 30 * time.Second,
+	}
+
+	return &http.Client{
+		Timeout: conf.HTTPTimeout,
+		Transport: &http.Transport{
+			DialContext:           dialer.DialContext,
+			ExpectContinueTimeout: 1 * time.Second,
+			IdleConnTimeout:       90 * time.Second,
+			MaxIdleConns:          100,
+			Proxy:                 http.ProxyFromEnvironment,
+			ResponseHeaderTimeout: conf.HTTPResponseHeaderTimeout,
+			TLSHandshakeTimeout:   conf.HTTPTLSHandshakeTimeout,
+		},
+	}
+}
+
+// postBackfillSummary posts a summary status after a backfill, linking to the
+// first status that was posted.
+func postBackfillSummary(ctx context.Context, conf *Conf, client mastodonClient, firstStatus *mastodon.Status, count int) error {
+	template := conf.BackfillSummaryTemplate
+	if template == "" {
+		template = defaultBackfillSummaryTemplate
+	}
+
+	if conf.DryRun {
+		content := strings.NewReplacer(
+			"{count}", fmt.Sprintf("%d", count),
+			"{url}", "<first status URL>",
+		).Replace(template)
+		logger.Infof("Would have published backfill summary: %s", content)
+		return nil
+	}
+
+	// Scheduled statuses don't have a URL until they're published.
+	if firstStatus.URL == "" {
+		logger.Infof("No new status to link to; skipping backfill summary")
+		return nil
+	}
+
+	content := strings.NewReplacer(
+		"{count}", fmt.Sprintf("%d", count),
+		"{url}", firstStatus.URL,
+	).Replace(template)
+
+	status, err := client.PostStatus(ctx, &mastodon.Toot{
+		Status: content,
+	})
+	if err != nil {
+		return fmt.Errorf("error posting backfill summary: %w", err)
+	}
+
+	logger.Infof("Posted backfill summary: %v", status.ID)
+
+	return nil
+}
+
+// normalizeEmoji strips stray variation selectors from content, which are
+// those at its start or following whitespace or another variation selector.
+// Variation selectors that follow any other character are left alone because
+// they may be choosing its intended presentation (like U+FE0F making "❤️" a
+// color emoji).
+func normalizeEmoji(content string) string {
+	var sb strings.Builder
+	previous := ' '
+
+	for _, r := range content {
+		if isVariationSelector(r) && (unicode.IsSpace(previous) || isVariationSelector(previous)) {
+			previous = r
+			continue
+		}
+
+		sb.WriteRune(r)
+		previous = r
+	}
+
+	return sb.String()
+}
+
+// hashtagRE matches a hashtag, capturing the character before it so that
+// `#` in the middle of a word or the fragment of a URL isn't treated as one.
+// Hashtags can contain letters and numbers from any script, like `#Zürich`.
+var hashtagRE = regexp.MustCompile(`(^|[^&/\p{L}\p{N}_])#([\p{L}\p{N}_]+)`)
+
+// normalizeHashtags canonicalizes the casing of hashtags in content according
+// to HashtagCaseMappings, falling back to the HashtagCase rule for hashtags
+// that aren't mapped.
+func normalizeHashtags(conf *Conf, content string) string {
+	if conf.HashtagCase == "" && len(conf.HashtagCaseMappings) < 1 {
+		return content
+	}
+
+	return hashtagRE.ReplaceAllStringFunc(content, func(match string) string {
+		parts := hashtagRE.FindStringSubmatch(match)
+		prefix, tag := parts[1], parts[2]
+
+		if mapped, ok := conf.HashtagCaseMappings.GetFold(tag); ok {
+			return prefix + "#" + mapped
+		}
+
+		switch conf.HashtagCase {
+		case HashtagCaseLower:
+			tag = strings.ToLower(tag)
+		case HashtagCasePreserveFirst:
+			_, size := utf8.DecodeRuneInString(tag)
+			tag = tag[:size] + strings.ToLower(tag[size:])
+		}
+
+		return prefix + "#" + tag
+	})
+}
+
+// formatEngagement formats a tweet's engagement stats according to
+// EngagementTemplate, omitting any whose count is zero. Returns an empty
+// string if the tweet had no engagement at all.
+func formatEngagement(conf *Conf, tweet *Tweet) string {
+	counts := map[string]int{
+		"{favorites}": tweet.FavoriteCount,
+		"{retweets}":  tweet.RetweetCount,
+	}
+
+	var parts []string
+	for _, part := range conf.EngagementTemplate {
+		include := true
+		for placeholder, count := range counts {
+			if strings.Contains(part, placeholder) {
+				if count == 0 {
+					include = false
+				}
+				part = strings.Replace(part, placeholder, strconv.Itoa(count), -1)
+			}
+		}
+
+		if include {
+			parts = append(parts, part)
+		}
+	}
+
+	return strings.Join(parts, " · ")
+}
+
+// overflowMediaCount returns the number of a tweet's photos beyond the
+// maximum number of media attachments allowed on a status.
+func overflowMediaCount(tweet *Tweet) int {
+	if tweet.Entities == nil {
+		return 0
+	}
+
+	var numPhotos int
+	for _, media := range tweet.Entities.Medias {
+		if media.Type == "photo" {
+			numPhotos++
+		}
+	}
+
+	return max(numPhotos-instanceLimits.MaxMediaAttachments, 0)
+}
+
+// pollForTweet returns the poll to attach to a tweet's toot if it contains the
+// configured poll trigger phrase, and nil otherwise.
+func pollForTweet(conf *Conf, tweet *Tweet) *mastodon.TootPoll {
+	if conf.PollTrigger == "" || len(conf.PollOptions) < 2 {
+		return nil
+	}
+
+	if !strings.Contains(strings.ToLower(tweet.Text), strings.ToLower(conf.PollTrigger)) {
+		return nil
+	}
+
+	return &mastodon.TootPoll{
+		ExpiresInSeconds: int64(conf.PollExpiresIn.Seconds()),
+		Multiple:         conf.PollMultiple,
+		Options:          conf.PollOptions,
+	}
+}
+
+// postIntroToot posts IntroToot if it's configured, the account has no
+// existing statuses, and it hasn't been posted before according to state.
+func postIntroToot(ctx context.Context, conf *Conf, client mastodonClient, state *State, statuses []*mastodon.Status) error {
+	if conf.IntroToot == "" || len(statuses) > 0 || state.IntroStatusID != "" {
+		return nil
+	}
+
+	if conf.DryRun {
+		logger.Infof("Would have published intro status: %s", sampleContent(conf.IntroToot, conf.LogSampleLength))
+		return nil
+	}
+
+	status, err := client.PostStatus(ctx, &mastodon.Toot{
+		Status:     conf.IntroToot,
+		Visibility: string(conf.Visibility),
+	})
+	if err != nil {
+		return fmt.Errorf("error posting intro status: %w", err)
+	}
+
+	state.IntroStatusID = string(status.ID)
+	if conf.StateFile != "" {
+		if err := state.save(conf.StateFile); err != nil {
+			return err
+		}
+	}
+
+	logger.Infof("Posted intro status: %v", status.ID)
+
+	return nil
+}
+
+// postStatusRetryingMedia posts a status, retrying according to
+// MediaProcessingRetries if the server rejects it because its media is still
+// being processed. Mastodon responds with a 422 when attaching media that
+// hasn't finished processing, which is common when a status is posted right
+// after its media was uploaded.
+func postStatusRetryingMedia(ctx context.Context, conf *Conf, client mastodonClient, toot *mastodon.Toot) (*mastodon.Status, error) {
+	for attempt := 0; ; attempt++ {
+		status, err := client.PostStatus(ctx, toot)
+
+		var apiErr *mastodon.APIError
+		if err == nil || len(toot.MediaIDs) < 1 || attempt >= conf.MediaProcessingRetries ||
+			!errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusUnprocessableEntity {
+			return status, err
+		}
+
+		logger.Warnf("Media may still be processing (%v); retrying in %v", err, conf.MediaProcessingRetryDelay)
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(conf.MediaProcessingRetryDelay):
+		}
+	}
+}
+
+// proxyMediaURL rewrites a media URL to be fetched through MediaProxyBase, if
+// one is configured.
+func proxyMediaURL(conf *Conf, mediaURL string) string {
+	if conf.MediaProxyBase == "" {
+		return mediaURL
+	}
+
+	return conf.MediaProxyBase + url.QueryEscape(mediaURL)
+}
+
+// gzipMagic are the bytes that every gzip stream starts with.
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// readTweets reads tweets from TOML data, which may be gzipped. Compression is
+// detected based on the data's magic bytes rather than a file extension so
+// that it works for data piped through stdin too.
+func readTweets(r io.Reader) ([]*Tweet, error) {
+	existingData, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("error reading source twitter data: %w", err)
+	}
+
+	if bytes.HasPrefix(existingData, gzipMagic) {
+		gzipReader, err := gzip.NewReader(bytes.NewReader(existingData))
+		if err != nil {
+			return nil, fmt.Errorf("error opening gzipped twitter data: %w", err)
+		}
+
+		existingData, err = ioutil.ReadAll(gzipReader)
+		if err != nil {
+			return nil, fmt.Errorf("error decompressing twitter data: %w", err)
+		}
+	}
+
+	var existingTweetDB TweetDB
+	err = toml.Unmarshal(existingData, &existingTweetDB)
+	if err != nil {
+		return nil, fmt.Errorf("error unmarshaling toml: %w", err)
+	}
+
+	return existingTweetDB.Tweets, nil
+}
+
+// readTweetsFromFile reads tweets from a TOML data file. A source of "-"
+// reads from stdin instead, which allows data to be piped in from another
+// program.
+//
+// The size and SHA256 checksum of the data read are logged, and if
+// expectedChecksum is non-empty, an error is returned if it doesn't match so
+// that a run can be made to fail fast if the data changed unexpectedly since
+// it was planned.
+func readTweetsFromFile(source string, expectedChecksum string) ([]*Tweet, error) {
+	var r io.Reader = os.Stdin
+	if source != "-" {
+		f, err := os.Open(source)
+		if err != nil {
+			return nil, fmt.Errorf("error reading source twitter data file: %w", err)
+		}
+		defer f.Close()
+
+		r = f
+	}
+
+	h := sha256.New()
+	counter := &countingWriter{}
+
+	tweets, err := readTweets(io.TeeReader(r, io.MultiWriter(h, counter)))
+	if err != nil {
+		return nil, err
+	}
+
+	checksum := hex.EncodeToString(h.Sum(nil))
+	logger.Infof("Read %v tweet(s) from %v (%v bytes, SHA256 %v)", len(tweets), source, counter.n, checksum)
+
+	if expectedChecksum != "" && !strings.EqualFold(checksum, expectedChecksum) {
+		return nil, fmt.Errorf("source twitter data checksum %v doesn't match expected checksum %v",
+			checksum, expectedChecksum)
+	}
+
+	if len(tweets) < 1 && counter.n > 0 {
+		logger.Warnf("Parsed zero tweets from non-empty source %v; check that it's in the expected format", source)
+	}
+
+	return tweets, nil
+}
+
+// readTweetsFromSources reads tweets from each of several sources (see
+// readTweetsFromFile), attributing them to their source's author (see
+// Attribution) and resolving their local media (see resolveLocalMedia), then
+// merges them into one list ordered by descending ID like a single source.
+// Tweets found in more than one source, like those of exports that overlap,
+// are kept once, as they were first read.
+//
+// Merging happens before anything else so that threads that span sources,
+// like one started near the end of the period of one export and continued in
+// the next, are reconstructed like any other.
+func readTweetsFromSources(conf *Conf, sources []string) ([]*Tweet, error) {
+	if conf.SourceChecksum != "" && len(sources) > 1 {
+		return nil, fmt.Errorf("a source checksum can only be checked when reading a single source")
+	}
+
+	var allTweets []*Tweet
+	seen := make(map[int64]bool)
+
+	for _, source := range sources {
+		tweets, err := readTweetsFromFile(source, conf.SourceChecksum)
+		if err != nil {
+			return nil, err
+		}
+
+		if conf.Attribution {
+			author, err := sourceAuthor(conf, source)
+			if err != nil {
+				return nil, err
+			}
+
+			for _, tweet := range tweets {
+				tweet.author = author
+			}
+		}
+
+		resolveLocalMedia(conf, tweets, source)
+
+		for _, tweet := range tweets {
+			if seen[tweet.ID] {
+				continue
+			}
+			seen[tweet.ID] = true
+
+			allTweets = append(allTweets, tweet)
+		}
+	}
+
+	if len(sources) > 1 {
+		sort.SliceStable(allTweets, func(i, j int) bool { return allTweets[i].ID > allTweets[j].ID })
+		logger.Infof("Merged %v tweet(s) from %v sources", len(allTweets), len(sources))
+	}
+
+	return allTweets, nil
+}
+
+// redactError redacts the URL u from an error about requesting it if
+// RedactLogs is on (see logURL). The HTTP client's errors quote the whole URL,
+// and errors connecting to its host or resolving it name the host, so both
+// are replaced.
+func redactError(conf *Conf, err error, u string) error {
+	if !conf.RedactLogs || err == nil {
+		return err
+	}
+
+	msg := err.Error()
+	msg = strings.ReplaceAll(msg, strconv.Quote(u), strconv.Quote(logURL(conf, u)))
+	msg = strings.ReplaceAll(msg, u, logURL(conf, u))
+	if parsed, parseErr := url.Parse(u); parseErr == nil && parsed.Host != "" {
+		msg = strings.ReplaceAll(msg, parsed.Host, logURL(conf, parsed.Host))
+		msg = strings.ReplaceAll(msg, parsed.Hostname(), logURL(conf, parsed.Hostname()))
+	}
+
+	return &redactedError{msg: msg, err: err}
+}
+
+// renderQuoteEdit renders a quote tweet like renderToot, but without the link
+// to the tweet it quotes, for when it's synced as an edit of that tweet's
+// status (see QuoteSelfAsEdit).
+func renderQuoteEdit(conf *Conf, tweet *Tweet) string {
+	return applyTransformers(tweet, tweet.Text, renderTransformersWithBase(conf, quoteEditTransformers))
+}
+
+// renderToot produces the content of a new Mastodon status for the given
+// tweet by running it through the pipeline from renderTransformers, which
+// starts with the most recent tweet to toot implementation, then applies any
+// additional transformations enabled through configuration.
+//
+// Transformations added to the pipeline should be ones that are off by
+// default so that content posted before they were enabled can still be matched
+// against the versioned implementations in `findMatchingStatus`.
+func renderToot(conf *Conf, tweet *Tweet) string {
+	return applyTransformers(tweet, tweet.Text, renderTransformers(conf))
+}
+
+// renderFallbacks turn off options that change how a tweet is rendered in a
+// copy of the configuration, each returning whether its option was on.
+// Statuses posted before an option was turned on were rendered without it, so
+// findMatchingStatus also renders tweets with each option that's on turned off
+// on its own, and with all of them turned off at once.
+var renderFallbacks = []func(conf *Conf) bool{
+	// Statuses posted before the budgeting of appended notes may have more
+	// of them appended.
+	func(conf *Conf) bool {
+		on := conf.AppendedContentRatio > 0
+		conf.AppendedContentRatio = 0
+		return on
+	},
+
+	// Statuses posted before a quoted tweet went away still link to it.
+	func(conf *Conf) bool {
+		on := conf.CheckQuotedAvailability
+		conf.CheckQuotedAvailability = false
+		return on
+	},
+
+	// Statuses posted before the stripping of visibility hashtags still have
+	// them.
+	func(conf *Conf) bool {
+		on := conf.HashtagVisibilityStrip
+		conf.HashtagVisibilityStrip = false
+		return on
+	},
+
+	// Statuses posted before engagement stats were included don't have them.
+	func(conf *Conf) bool {
+		on := conf.IncludeEngagement != ""
+		conf.IncludeEngagement = ""
+		return on
+	},
+
+	// Statuses posted before reading time notes don't have one.
+	func(conf *Conf) bool {
+		on := conf.IncludeReadingTime
+		conf.IncludeReadingTime = false
+		return on
+	},
+
+	// Statuses posted before inline alt text don't have any.
+	func(conf *Conf) bool {
+		on := conf.InlineAltText
+		conf.InlineAltText = false
+		return on
+	},
+
+	// Statuses posted before replies notes don't have one.
+	func(conf *Conf) bool {
+		on := conf.RepliesNote != ""
+		conf.RepliesNote = ""
+		return on
+	},
+
+	// Statuses posted before handles were mapped with WebFinger (or while an
+	// address couldn't be resolved) mention them as they were on Twitter.
+	func(conf *Conf) bool {
+		on := len(conf.WebFingerHandleMappings) > 0
+		conf.WebFingerHandleMappings = nil
+		return on
+	},
+}
+
+// renderTootVersions renders a tweet every way that it may have been posted
+// as a status, which is with the current configuration, with each of
+// renderFallbacks, with every version of the base pipeline, and for a merged
+// photo thread, as the old grouping of its photos (see
+// legacyPhotoThreadBatches).
+func renderTootVersions(conf *Conf, tweet *Tweet) []string {
+	renders := []string{renderToot(conf, tweet)}
+
+	allOff := *conf
+	var numOn int
+	for _, turnOff := range renderFallbacks {
+		fallback := *conf
+		if turnOff(&fallback) {
+			renders = append(renders, renderToot(&fallback, tweet))
+			turnOff(&allOff)
+			numOn++
+		}
+	}
+	if numOn > 1 {
+		renders = append(renders, renderToot(&allOff, tweet))
+	}
+
+	for _, transformers := range tootTransformerVersions {
+		renders = append(renders, applyTransformers(tweet, tweet.Text, transformers))
+	}
+
+	for _, batch := range legacyPhotoThreadBatches(conf, tweet) {
+		renders = append(renders, renderToot(conf, batch))
+	}
+
+	return renders
+}
+
+// sampleContent produces a sample of status content suitable for a log line,
+// truncating it to the given length if necessary. Truncation happens on rune
+// boundaries so that multibyte characters aren't garbled.
+func sampleContent(content string, length int) string {
+	if utf8.RuneCountInString(content) > length && length > 0 {
+		content = string([]rune(content)[0:length-1]) + " ..."
+		content = strings.Replace(content, "\n", " ", -1)
+	}
+
+	return content
+}
+
+// selectTweetCandidates narrows all tweets read from the source file down to
+// the ones that we might want to sync to Mastodon.
+func selectTweetCandidates(conf *Conf, allTweets []*Tweet) []*Tweet {
+	var tweetCandidates []*Tweet
+	for _, tweet := range allTweets {
+		// Assume the file is ordered by descending tweet ID
+		if tweet.ID < conf.MinTweetID {
+			break
+		}
+
+		// Don't include replies (unless configured to, or they're part of a
+		// thread that's being reconstructed) or @'s
+		if tweet.Reply != nil && !conf.IncludeReplies && !isThreadReply(conf, tweet) {
+			continue
+		}
+		if strings.HasSuffix(tweet.Text, "@") {
+			continue
+		}
+
+		// Don't include tweets without much (or any) commentary of their own
+		// if configured not to.
+		isPlainRetweet := tweet.Retweet != nil && tweet.Quote == nil
+		if conf.MinAuthoredLength > 0 && !isPlainRetweet &&
+			utf8.RuneCountInString(authoredText(tweet)) < conf.MinAuthoredLength {
+			continue
+		}
+
+		if conf.SkipHashtagOnly && !isPlainRetweet && isHashtagOnly(tweet.Text) {
+			continue
+		}
+
+		// Don't include tweets posted from excluded clients, like automation
+		// tools.
+		if len(conf.ExcludedSources) > 0 && tweet.Source != "" &&
+			containsStringFold(conf.ExcludedSources, tweetSource(tweet)) {
+			continue
+		}
+
+		// Don't include tweets in languages that aren't allowed
+		if len(conf.AllowedTweetLanguages) > 0 {
+			language, confident := detectLanguage(tweet.Text)
+			if confident && !containsString(conf.AllowedTweetLanguages, language) {
+				continue
+			}
+		}
+
+		tweetCandidates = append(tweetCandidates, tweet)
+	}
+
+	if conf.ThreadsOnly > 0 {
+		tweetCandidates = selectThreads(conf, tweetCandidates, conf.ThreadsOnly)
+	}
+
+	return tweetCandidates
+}
+
+// sourceAuthor returns the handle that tweets read from the given source are
+// attributed to when Attribution is on, which is AttributionHandle if it's
+// set, and otherwise the source file's name without any extensions.
+func sourceAuthor(conf *Conf, source string) (string, error) {
+	if conf.AttributionHandle != "" {
+		return strings.TrimPrefix(conf.AttributionHandle, "@"), nil
+	}
+
+	if source == "-" {
+		return "", fmt.Errorf("attribution handle must be set to use attribution when reading from stdin")
+	}
+
+	return strings.SplitN(filepath.Base(source), ".", 2)[0], nil
+}
+
+// stripTrailingLinks removes anything at the end of content matched by one of
+// the configured TrailingLinkPatterns, except for a tweet's entity URLs, which
+// are assumed to have been put there on purpose.
+func stripTrailingLinks(conf *Conf, tweet *Tweet, content string) string {
+	// Media shortlinks come last, so they're stripped first to expose any
+	// other trailing link before them.
+	var patterns ConfRegexpList
+	if tweet.Entities != nil && len(tweet.Entities.Medias) > 0 {
+		patterns = append(patterns, mediaShortlinkPatterns...)
+	}
+	patterns = append(patterns, conf.TrailingLinkPatterns...)
+
+	for _, re := range patterns {
+		loc := re.FindStringIndex(content)
+		if loc == nil || loc[1] != len(content) {
+			continue
+		}
+
+		if containsEntityURL(tweet, content[loc[0]:]) {
+			continue
+		}
+
+		content = strings.TrimRightFunc(content[:loc[0]], unicode.IsSpace)
+	}
+
+	return content
+}
+
+// stripVariationSelectors removes all Unicode variation selectors from
+// content, which only affect how the characters before them are presented.
+func stripVariationSelectors(content string) string {
+	return strings.Map(func(r rune) rune {
+		if isVariationSelector(r) {
+			return -1
+		}
+		return r
+	}, content)
+}
+
+// stripVisibilityHashtags removes hashtags that are keys of HashtagVisibility
+// from content, tidying up the whitespace that they leave behind.
+func stripVisibilityHashtags(conf *Conf, content string) string {
+	var stripped bool
+	content = hashtagRE.ReplaceAllStringFunc(content, func(match string) string {
+		parts := hashtagRE.FindStringSubmatch(match)
+		if _, ok := conf.HashtagVisibility.GetFold(parts[2]); ok {
+			stripped = true
+			return parts[1]
+		}
+		return match
+	})
+	if !stripped {
+		return content
+	}
+
+	content = strings.Join(strings.FieldsFunc(content, func(r rune) bool { return r == ' ' || r == '\t' }), " ")
+	content = strings.Replace(content, " \n", "\n", -1)
+	content = strings.Replace(content, "\n ", "\n", -1)
+	return strings.TrimSpace(content)
+}
+
+func syncMedia(ctx context.Context, conf *Conf, client mastodonClient, state *State, tweet *Tweet, tempDir string) ([]mastodon.ID, error) {
+	if tweet.Entities == nil || tweet.Entities.Medias == nil {
+		return nil, nil
+	}
+
+	// StrictMedia takes precedence.
+	partialMediaOK := conf.PartialMediaOK && !conf.StrictMedia
+
+	var attachmentIDs []mastodon.ID
+	var numPhotos int
+
+	for _, media := range tweet.Entities.Medias {
+		if media.Type != "photo" {
+			continue
+		}
+
+		// Photos past the limit are mentioned in the overflow note instead
+		// (see renderToot).
+		numPhotos++
+		if conf.OverflowMediaNote != "" && numPhotos > instanceLimits.MaxMediaAttachments {
+			break
+		}
+
+		var attachmentID mastodon.ID
+		var err error
+
+		for i, mediaURL := range mediaURLVariants(conf, media.URL) {
+			if i > 0 {
+				logger.Warnf("Retrying media %v from tweet %v with '%s' after %v",
+					media.ID, tweet.ID, logURL(conf, mediaURL), err)
+			}
+
+			attachmentID, err = syncMediaURL(ctx, conf, client, state, tweet, media, mediaURL, tempDir)
+
+			// Only failures to fetch or upload are worth retrying, and
+			// other variants of media that requires authentication will
+			// require it too.
+			var syncErr *mediaSyncError
+			var authErr *mediaAuthError
+			if !errors.As(err, &syncErr) || errors.As(err, &authErr) {
+				break
+			}
+		}
+
+		var authErr *mediaAuthError
+		if conf.SkipAuthFailedMedia && errors.As(err, &authErr) {
+			logger.Warnf("Posting tweet %v as text only because its media %v requires authentication "+
+				"to fetch (status code %d), probably because the account was protected",
+				tweet.ID, media.ID, authErr.statusCode)
+			return nil, nil
+		}
+
+		var syncErr *mediaSyncError
+		if errors.As(err, &syncErr) {
+			if partialMediaOK {
+				logger.Warnf("Dropping media %v from tweet %v: %v", media.ID, tweet.ID, err)
+				continue
+			}
+			return nil, fmt.Errorf("%s media %v of tweet %v: %v", syncErr.op, media.ID, tweet.ID, syncErr.err)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if attachmentID != "" {
+			attachmentIDs = append(attachmentIDs, attachmentID)
+		}
+	}
+
+	return attachmentIDs, nil
+}
+
+// syncMediaURL fetches media from the given URL (which may be a variant of the
+// media's own, see mediaURLVariants) and uploads it to Mastodon, returning the
+// ID of the uploaded attachment. An empty ID is returned without an error if
+// the media was skipped. Failures to fetch or upload are returned as
+// mediaSyncError.
+func syncMediaURL(ctx context.Context, conf *Conf, client mastodonClient, state *State, tweet *Tweet,
+	media *TweetEntitiesMedia, mediaURL, tempDir string) (mastodon.ID, error) {
+	target := path.Join(tempDir, filepath.Base(media.URL))
+	fetchableURL := proxyMediaURL(conf, mediaURL)
+
+	var err error
+	if isLocalMediaPath(mediaURL) {
+		// Local media is used where it is (see resolveLocalMedia).
+		target = localMediaPath(mediaURL)
+		if _, err := os.Stat(target); err != nil {
+			return "", &mediaSyncError{op: "error reading", err: err}
+		}
+	} else if mediaCache != nil {
+		var release func()
+		target, release, err = mediaCache.fetch(fetchableURL, mediaRequestHeader(conf, fetchableURL))
+		if err == nil {
+			// Keep the media from being evicted until it's been uploaded.
+			defer release()
+		}
+	} else {
+		err = fetchURL(conf, fetchableURL, target, mediaRequestHeader(conf, fetchableURL))
+	}
+	if err != nil {
+		return "", &mediaSyncError{op: "error fetching", err: err}
+	}
+
+	mimeType, err := detectMediaType(target)
+	if err != nil {
+		return "", err
+	}
+
+	allowedMediaTypes := conf.AllowedMediaTypes
+	if len(allowedMediaTypes) < 1 {
+		allowedMediaTypes = instanceLimits.SupportedMIMETypes
+	}
+
+	if !containsString(allowedMediaTypes, mimeType) {
+		if conf.StrictMedia {
+			return "", fmt.Errorf("media %v of tweet %v has type %s, which isn't allowed", media.ID, tweet.ID, mimeType)
+		}
+		logger.Warnf("Skipping media %v from tweet %v: type %s isn't allowed", media.ID, tweet.ID, mimeType)
+		return "", nil
+	}
+
+	if conf.DryRun {
+		logger.Infof("Would have synced media: %v", media.ID)
+		return "", nil
+	}
+
+	if conf.MaxImageDimension > 0 {
+		resizedTarget := path.Join(tempDir, "resized-"+filepath.Base(media.URL))
+		resized, err := resizeImage(target, resizedTarget, conf.MaxImageDimension)
+		if err != nil {
+			return "", err
+		}
+		if resized {
+			target = resizedTarget
+		}
+	}
+
+	hash, err := hashFile(target)
+	if err != nil {
+		return "", err
+	}
+
+	if id, ok := state.reusableMediaID(hash, conf.MediaReuseTTL, time.Now()); ok {
+		logger.Infof("Reusing previously uploaded media %v for %v", id, media.ID)
+		return id, nil
+	}
+
+	f, err := os.Open(target)
+	if err != nil {
+		return "", fmt.Errorf("error opening '%v': %w", target, err)
+	}
+	defer f.Close()
+
+	// Media is described with its alt text as it's uploaded. Statuses posted
+	// before this was done can have it added with BackfillAltText.
+	attachment, err := client.UploadMediaFromMedia(ctx, &mastodon.Media{File: f, Description: media.AltText})
+
+	// Some instances have been seen responding in a way that produces
+	// neither an attachment nor an error, which is treated like any other
+	// failed upload.
+	if err == nil && (attachment == nil || attachment.ID == "") {
+		err = fmt.Errorf("server returned no attachment")
+	}
+
+	if err != nil {
+		return "", &mediaSyncError{op: "error uploading", err: err}
+	}
+
+	state.recordMediaUpload(hash, attachment.ID, time.Now())
+
+	return attachment.ID, nil
+}
+
+// syncTweet posts a single tweet to Mastodon, returning the posted status. The
+// returned status is nil when running in dry run mode.
+func syncTweet(ctx context.Context, conf *Conf, client mastodonClient, state *State, schedule *Schedule, confirmer *confirmer, tweet *Tweet, tempDir string) (*mastodon.Status, error) {
+	if conf.NativeBoosts && tweet.Retweet != nil {
+		target, err := findNativeBoostTarget(ctx, conf, client, tweet)
+		if err != nil {
+			return nil, err
+		}
+
+		if target != nil {
+			return syncTweetAsBoost(ctx, conf, client, confirmer, tweet, target)
+		}
+	}
+
+	content := renderToot(conf, tweet)
+
+	contentSample := logSample(conf, content)
+
 	var attachmentIDs []mastodon.ID
+	var poll *mastodon.TootPoll
+
+	// Unrolled tweets are posted as their replacement content alone.
+	if _, unrolled := unrolledContent(conf, tweet); !unrolled {
+		var err error
+		attachmentIDs, err = syncMedia(ctx, conf, client, state, tweet, tempDir)
+		if err != nil {
+			return nil, fmt.Errorf("error syncing media: %w", err)
+		}
+
+		poll = pollForTweet(conf, tweet)
+		if poll != nil && len(attachmentIDs) > 0 {
+			logger.Warnf("Not attaching poll to tweet %v because it has media", tweet.ID)
+			poll = nil
+		}
 
-	for _, media := range tweet.Entities.Medias {
-		if media.Type != "photo" {
-			continue
+		// A poll can't be attached along with media, so it takes precedence.
+		if conf.AttachOGImage && len(attachmentIDs) < 1 && poll == nil {
+			attachmentIDs = attachOGImage(ctx, conf, client, state, tweet, tempDir)
 		}
+	}
 
-		target := path.Join(tempDir, filepath.Base(media.URL))
-		err := fetchURL(media.URL, target)
-		if err != nil {
-			return nil, fmt.Errorf("error fetching media: %v", err)
+	visibility := string(conf.Visibility)
+
+	var inReplyToID mastodon.ID
+	if isThreadReply(conf, tweet) {
+		if hasPendingParent(conf, state, tweet) {
+			return nil, fmt.Errorf("parent tweet %v of tweet %v is scheduled but not yet published",
+				tweet.Reply.StatusID, tweet.ID)
 		}
 
-		if conf.DryRun {
-			logger.Infof("Would have synced media: %v", media.ID)
-		} else {
-			attachment, err := client.UploadMedia(ctx, target)
-			if err != nil {
-				return nil, fmt.Errorf("error uploading media: %v", err)
+		if parent, ok := state.tweetStatus(tweet.Reply.StatusID); ok {
+			inReplyToID = mastodon.ID(parent.StatusID)
+
+			visibility = parent.Visibility
+			if conf.ThreadReplyVisibility != "" {
+				visibility = string(conf.ThreadReplyVisibility)
 			}
+		} else {
+			logger.Infof("Parent tweet %v of tweet %v wasn't synced; posting as standalone status",
+				tweet.Reply.StatusID, tweet.ID)
+		}
+	}
+
+	if hashtagVisibility, ok := visibilityForHashtags(conf, tweet); ok {
+		visibility = string(hashtagVisibility)
+	}
+
+	spoilerText := tweetSpoilerText(conf, tweet)
+
+	if conf.QuoteSelfAsEdit {
+		status, edited, err := syncTweetAsEdit(ctx, conf, client, state, confirmer, tweet, &mastodon.Toot{
+			MediaIDs:    attachmentIDs,
+			SpoilerText: spoilerText,
+			Status:      content,
+		})
+		if err != nil {
+			return nil, err
+		}
 
-			attachmentIDs = append(attachmentIDs, attachment.ID)
+		if edited {
+			return status, nil
 		}
 	}
 
-	return attachmentIDs, nil
+	var scheduledAt *time.Time
+	if inReplyToID != "" && conf.ThreadReplySpacing > 0 {
+		at := threadReplyScheduledAt(conf.ThreadReplySpacing, time.Now())
+		scheduledAt = &at
+
+		if schedule != nil {
+			schedule.count(at)
+		}
+	} else {
+		scheduledAt = schedule.next(time.Now())
+	}
+
+	if conf.DryRun {
+		if scheduledAt != nil {
+			logger.Infof("Would have scheduled Mastodon status for %v: %s",
+				scheduledAt.Format(time.RFC3339), contentSample)
+			return nil, nil
+		}
+
+		logger.Infof("Would have published Mastodon status: %s", contentSample)
+		return nil, nil
+	}
+
+	toot := &mastodon.Toot{
+		InReplyToID: inReplyToID,
+		MediaIDs:    attachmentIDs,
+		Poll:        poll,
+		ScheduledAt: scheduledAt,
+		SpoilerText: spoilerText,
+		Status:      content,
+		Visibility:  visibility,
+	}
+
+	if !confirmer.confirm(tweet, "posted as", describeToot(toot)) {
+		return nil, errConfirmationDeclined
+	}
+
+	// Statuses in a thread are posted one after another, so make sure this
+	// one's media is ready before posting it rather than relying on the
+	// server's rejection, which would otherwise overlap with the uploads of
+	// the next reply.
+	if conf.ThreadSelfReplies && len(attachmentIDs) > 0 && serverProfile.PollMediaProcessing {
+		if err := waitForMediaProcessed(ctx, conf, client, attachmentIDs); err != nil {
+			return nil, err
+		}
+	}
+
+	// Keep the status from being duplicated if posting it is retried, or if
+	// a run is interrupted after posting it but before recording it.
+	postCtx := withIdempotencyKey(ctx, fmt.Sprintf("tweet-%v", tweet.ID))
+
+	status, err := postStatusRetryingMedia(postCtx, conf, client, toot)
+	if err != nil {
+		return nil, fmt.Errorf("error posting status: %w", err)
+	}
+
+	state.attachMedia(attachmentIDs)
+
+	// Scheduled statuses can't be replied to until they're published, so
+	// they're recorded as such and resolved to their published statuses by a
+	// later run (see resolveScheduledTweets).
+	if scheduledAt != nil {
+		state.recordTweetScheduledStatus(tweet.ID, status.ID, visibility, *scheduledAt)
+		for _, mergedID := range tweet.mergedIDs {
+			state.recordTweetScheduledStatus(mergedID, status.ID, visibility, *scheduledAt)
+		}
+
+		logger.Infof("Scheduled Mastodon status %v for %v (%s)",
+			status.ID, scheduledAt.Format(time.RFC3339), contentSample)
+		return status, nil
+	}
+
+	state.recordTweetPost(tweet.ID, status, visibility)
+	for _, mergedID := range tweet.mergedIDs {
+		state.recordTweetPost(mergedID, status, visibility)
+	}
+
+	logger.Infof("Posted Mastodon status: %v (%s)", status.ID, contentSample)
+
+	return status, nil
 }
 
-func syncTweet(ctx context.Context, conf *Conf, client *mastodon.Client, tweet *Tweet, tempDir string) error {
-	content := tweetToTootV2(tweet)
+// syncTweetAsBoost mirrors a retweet by boosting the original toot that it was
+// found to correspond to.
+func syncTweetAsBoost(ctx context.Context, conf *Conf, client mastodonClient, confirmer *confirmer, tweet *Tweet, target *mastodon.Status) (*mastodon.Status, error) {
+	if reblogged, ok := target.Reblogged.(bool); ok && reblogged {
+		logger.Infof("Already boosted Mastodon status %v for retweet %v", target.ID, tweet.ID)
+		return nil, nil
+	}
+
+	if conf.DryRun {
+		logger.Infof("Would have boosted Mastodon status %v for retweet %v", target.ID, tweet.ID)
+		return nil, nil
+	}
 
-	contentSample := content
-	if len(contentSample) > 50 {
-		contentSample = contentSample[0:49] + " ..."
-		contentSample = strings.Replace(contentSample, "\n", " ", -1)
+	if !confirmer.confirm(tweet, "posted as a boost of", describeToot(&mastodon.Toot{
+		SpoilerText: target.SpoilerText,
+		Status:      fmt.Sprintf("%s\n\n%s", tootToTweet(target), target.URL),
+		Visibility:  target.Visibility,
+	})) {
+		return nil, errConfirmationDeclined
 	}
 
-	attachmentIDs, err := syncMedia(ctx, conf, client, tweet, tempDir)
+	status, err := client.Reblog(ctx, target.ID)
 	if err != nil {
-		return fmt.Errorf("error syncing media: %w", err)
+		return nil, fmt.Errorf("error boosting status: %w", err)
+	}
+
+	logger.Infof("Boosted Mastodon status %v for retweet %v", target.ID, tweet.ID)
+
+	return status, nil
+}
+
+// syncTweetAsEdit mirrors a tweet quoting one of the user's own earlier tweets
+// by editing the status that the earlier tweet was synced to, with the link
+// to the quoted tweet removed from the content of the given toot. Returns
+// false (and no error) if the tweet isn't a self-quote, there's no status to
+// edit, or the server doesn't support editing, in which case the tweet should
+// be posted normally.
+func syncTweetAsEdit(ctx context.Context, conf *Conf, client mastodonClient, state *State, confirmer *confirmer, tweet *Tweet, toot *mastodon.Toot) (*mastodon.Status, bool, error) {
+	if tweet.Quote == nil || conf.TwitterUser == "" || !strings.EqualFold(tweet.Quote.User, conf.TwitterUser) {
+		return nil, false, nil
+	}
+
+	target, ok := state.tweetStatus(tweet.Quote.StatusID)
+	if !ok {
+		logger.Infof("Quoted tweet %v of tweet %v wasn't synced; posting as new status",
+			tweet.Quote.StatusID, tweet.ID)
+		return nil, false, nil
+	}
+
+	// The edit is rendered without the link to the quoted tweet, which
+	// would link the status to itself.
+	editedToot := *toot
+	editedToot.Status = strings.TrimSpace(renderQuoteEdit(conf, tweet))
+	if editedToot.Status == "" {
+		return nil, false, nil
 	}
 
 	if conf.DryRun {
-		logger.Infof("Would have published Mastodon status: %s", contentSample)
-	} else {
+		logger.Infof("Would have edited Mastodon status %v for tweet %v: %s",
+			target.StatusID, tweet.ID, logSample(conf, editedToot.Status))
+		return nil, true, nil
+	}
 
-		status, err := client.PostStatus(ctx, &mastodon.Toot{
-			MediaIDs: attachmentIDs,
-			Status:   content,
-		})
-		if err != nil {
-			return fmt.Errorf("error posting status: %w", err)
+	if !confirmer.confirm(tweet, fmt.Sprintf("edited into Mastodon status %v as", target.StatusID),
+		describeToot(&editedToot)) {
+		return nil, false, errConfirmationDeclined
+	}
+
+	status, err := client.UpdateStatus(ctx, &editedToot, mastodon.ID(target.StatusID))
+	if err != nil {
+		// Servers that predate editing don't have the endpoint.
+		var apiErr *mastodon.APIError
+		if errors.As(err, &apiErr) && (apiErr.StatusCode == http.StatusNotFound ||
+			apiErr.StatusCode == http.StatusMethodNotAllowed) {
+			logger.Warnf("Couldn't edit Mastodon status %v (%v); posting as new status", target.StatusID, err)
+			return nil, false, nil
 		}
 
-		logger.Infof("Posted Mastodon status: %v (%s)", status.ID, contentSample)
+		return nil, false, fmt.Errorf("error editing status: %w", err)
 	}
 
-	return nil
+	state.attachMedia(editedToot.MediaIDs)
+	state.recordTweetPost(tweet.ID, status, target.Visibility)
+
+	logger.Infof("Edited Mastodon status %v for tweet %v", status.ID, tweet.ID)
+
+	return status, true, nil
 }
 
-func syncTwitter(ctx context.Context, conf *Conf, client *mastodon.Client, source string) error {
-	allTweets, err := readTweetsFromFile(source)
-	if err != nil {
+func syncTwitter(ctx context.Context, conf *Conf, client mastodonClient, sources ...string) (err error) {
+	runStarted := time.Now()
+
+	if conf.DumpStatuses {
+		return dumpStatuses(ctx, conf, client, os.Stdout)
+	}
+
+	if err := checkThreadsOnly(conf); err != nil {
 		return err
 	}
 
-	var tweetCandidates []*Tweet
-	for _, tweet := range allTweets {
-		// Assume the file is ordered by descending tweet ID
-		if tweet.ID < conf.MinTweetID {
-			break
+	if conf.RunLockFile != "" && !conf.DryRun {
+		release, err := acquireRunLock(conf.RunLockFile, conf.MinRunInterval, conf.Force, time.Now())
+		if err != nil {
+			return err
 		}
+		defer release()
+	}
 
-		// Don't include replies or @'s
-		if tweet.Reply != nil || strings.HasSuffix(tweet.Text, "@") {
-			continue
+	allTweets, err := readTweetsFromSources(conf, sources)
+	if err != nil {
+		return err
+	}
+
+	if conf.ValidateEntities {
+		validateEntities(conf, allTweets)
+	}
+
+	state, err := loadState(conf.StateFile, !conf.DryRun && !conf.ReportUnmatchedStatuses)
+	if err != nil {
+		return err
+	}
+
+	// The source is a likes export rather than tweets to sync.
+	if conf.MirrorLikes {
+		return mirrorLikes(ctx, conf, client, state, allTweets)
+	}
+
+	resolveWebFingerHandleMappings(conf)
+
+	tweetCandidates := selectTweetCandidates(conf, allTweets)
+	gaps := findGaps(conf, allTweets, tweetCandidates)
+
+	// Kept so that scheduled statuses can be resolved regardless of the
+	// filtering below (see resolveScheduledTweets).
+	unfilteredCandidates := tweetCandidates
+
+	if conf.Reconcile {
+		digests, _ := mergeShortTweetDigests(conf, mergePhotoThreads(conf, tweetCandidates), time.Now())
+		resolveQuotedAvailability(conf, digests)
+		return reconcile(ctx, conf, client, state, digests)
+	}
+
+	if conf.ReportUnmatchedStatuses {
+		digests, _ := mergeShortTweetDigests(conf, mergePhotoThreads(conf, tweetCandidates), time.Now())
+		resolveQuotedAvailability(conf, digests)
+		return reportUnmatchedStatuses(ctx, conf, client, digests, os.Stdout)
+	}
+
+	if conf.BackfillAltText {
+		return backfillAltText(ctx, conf, client, mergePhotoThreads(conf, tweetCandidates))
+	}
+
+	if conf.RepairMissingMedia {
+		return repairMissingMedia(ctx, conf, client, state, mergePhotoThreads(conf, tweetCandidates))
+	}
+
+	if conf.LastRunFile != "" && !conf.IgnoreLastRun {
+		lastRun, err := readLastRun(conf.LastRunFile)
+		if err != nil {
+			return err
 		}
 
-		tweetCandidates = append(tweetCandidates, tweet)
+		tweetCandidates = filterTweetsSince(tweetCandidates, lastRun)
+	}
+
+	if cutoff := conf.SyncNotAfter.time(time.Now()); !cutoff.IsZero() {
+		tweetCandidates = filterTweetsNotAfter(tweetCandidates, cutoff)
 	}
+
+	tweetCandidates = mergePhotoThreads(conf, tweetCandidates)
+
+	tweetCandidates, heldForDigest := mergeShortTweetDigests(conf, tweetCandidates, time.Now())
+	if !heldForDigest.IsZero() {
+		logger.Infof("Holding back short tweets from today until its digest is complete")
+	}
+
+	resolveQuotedAvailability(conf, tweetCandidates)
+
 	logger.Infof("Found %v candidate(s) for syncing to Mastodon", len(tweetCandidates))
 
-	account, err := client.GetAccountCurrentUser(ctx)
+	account, err := currentAccount(ctx, conf, client, state, time.Now())
 	if err != nil {
-		return fmt.Errorf("error getting current user account: %w", err)
+		return err
 	}
 
 	logger.Infof("Mastadon account ID: %v", account.ID)
@@ -387,10 +3277,57 @@ func syncTwitter(ctx context.Context, conf *Conf, client *mastodon.Client, sourc
 	}
 	logger.Infof("Found %v existing status(es)", len(statuses))
 
+	if conf.CatchUpOnly {
+		if len(statuses) < 1 && !conf.DryRun && !conf.Yes {
+			return fmt.Errorf("catch-up only mode can't find a floor for an account with no existing statuses; " +
+				"check that the access token is for the right account and re-run with -yes to sync everything")
+		}
+
+		floor := catchUpFloor(conf, state, statuses, tweetCandidates)
+		tweetCandidates = filterTweetsSince(tweetCandidates, floor)
+		logger.Infof("Catching up on %v candidate(s) newer than %v", len(tweetCandidates), floor)
+	}
+
+	if conf.DryRun && conf.DryRunMatchReport {
+		writeMatchReport(os.Stdout, conf, statuses, tweetCandidates)
+	}
+
+	// Scheduled tweets are resolved from all candidates rather than just
+	// those left after filtering by last run and the like because a tweet
+	// that was scheduled on an earlier run has usually been filtered out by
+	// the time it's published, and its replies are held back until it's
+	// resolved (see hasPendingParent).
+	scheduledCandidates, _ := mergeShortTweetDigests(conf, mergePhotoThreads(conf, unfilteredCandidates), time.Now())
+	resolveScheduledTweets(conf, state, statuses, scheduledCandidates, time.Now())
+
 	var tweetsToSync []*Tweet
 
 	for _, tweet := range tweetCandidates {
-		matchingStatus, distance := findMatchingStatus(statuses, tweet)
+		// Scheduled statuses don't show up in an account's statuses until
+		// they're published, so skip tweets known to be scheduled lest they
+		// be scheduled a second time.
+		if stateTweet, ok := state.tweetStatus(tweet.ID); ok && !stateTweet.ScheduledAt.IsZero() {
+			logger.Infof("Tweet %v is already scheduled for %v", tweet.ID,
+				stateTweet.ScheduledAt.Format(time.RFC3339))
+			continue
+		}
+
+		// The state file is authoritative about which tweets have been
+		// posted, which catches statuses that were edited since and so no
+		// longer match their tweets. Like a match, the tweets before this one
+		// are assumed to have been synced too.
+		if stateTweet, ok := state.tweetStatus(tweet.ID); ok && stateTweet.ScheduledAt.IsZero() {
+			logger.Infof("Tweet %v was already posted as Mastodon status %v according to state",
+				tweet.ID, stateTweet.StatusID)
+
+			if conf.DetectEditedStatuses {
+				logEditedStatus(statuses, tweet, stateTweet)
+			}
+
+			break
+		}
+
+		matchingStatus, distance := findMatchingStatus(conf, statuses, tweet)
 
 		if matchingStatus == nil {
 			tweetsToSync = append(tweetsToSync, tweet)
@@ -398,6 +3335,10 @@ func syncTwitter(ctx context.Context, conf *Conf, client *mastodon.Client, sourc
 			logger.Infof("Found content match for tweet %v in Mastodon status %v (distance: %v)",
 				tweet.ID, matchingStatus.ID, distance)
 
+			if conf.AuditDrift {
+				auditMatchDrift(matchingStatus, tweet, distance)
+			}
+
 			// Assume that all tweets previous to this one have also already
 			// been synced. This simplifies the program so that we don't have
 			// to paginate all the way back in history, etc.
@@ -405,18 +3346,68 @@ func syncTwitter(ctx context.Context, conf *Conf, client *mastodon.Client, sourc
 		}
 	}
 
+	var progress *checkpoint
+	if conf.CheckpointEvery > 0 && conf.StateFile != "" {
+		logger.Infof("Resuming from the state file, which records progress after every tweet; " +
+			"ignoring CHECKPOINT_EVERY")
+	} else if conf.CheckpointEvery > 0 {
+		if conf.CheckpointFile == "" {
+			return fmt.Errorf("a checkpoint file must be configured with CHECKPOINT_FILE to checkpoint progress")
+		}
+
+		progress, err = readCheckpoint(conf.CheckpointFile)
+		if err != nil {
+			return err
+		}
+
+		tweetsToSync = progress.filter(tweetsToSync)
+
+		// Flushed however the run ends so that tweets synced before an
+		// error aren't lost from the checkpoint.
+		defer func() {
+			if flushErr := progress.flush(); flushErr != nil && err == nil {
+				err = flushErr
+			}
+		}()
+	}
+
 	logger.Infof("Found %v tweet(s) to sync to Mastodon", len(tweetsToSync))
 
+	recoverThreadParents(conf, state, statuses, tweetCandidates, tweetsToSync)
+
+	if conf.ValidateOnly {
+		return validateTweets(ctx, conf, client, tweetsToSync)
+	}
+
+	if err := checkEmptyAccount(conf, statuses, tweetsToSync); err != nil {
+		return err
+	}
+
 	if len(tweetsToSync) < 1 {
 		return nil
 	}
 
+	if err := postIntroToot(ctx, conf, client, state, statuses); err != nil {
+		return err
+	}
+
 	tempDir, err := ioutil.TempDir("", "twitter-media-downloads")
 	if err != nil {
 		return fmt.Errorf("error creating temp dir: %w", err)
 	}
 	defer os.RemoveAll(tempDir)
 
+	confirmer, err := newConfirmer(conf, os.Stdin, os.Stdout, stdinIsTerminal())
+	if err != nil {
+		return err
+	}
+
+	var deferred bool
+	var firstStatus *mastodon.Status
+	var lastRun time.Time
+	schedule := newSchedule(conf, state, time.Now())
+	delayRand := rand.New(rand.NewSource(time.Now().UnixNano()))
+	syncedThisRun := make(map[int64]bool)
 	tweetsSynced := 0
 
 	// Move in reverse order so that we tweet the oldest first.
@@ -429,11 +3420,138 @@ func syncTwitter(ctx context.Context, conf *Conf, client *mastodon.Client, sourc
 			break
 		}
 
-		err := syncTweet(ctx, conf, client, tweet, tempDir)
+		// Replies continuing a thread posted this run are let through so
+		// that the thread isn't left partial.
+		continuesThread := isThreadReply(conf, tweet) && syncedThisRun[tweet.Reply.StatusID]
+		if conf.MaxRunDuration > 0 && !continuesThread && time.Since(runStarted) >= conf.MaxRunDuration {
+			logger.Infof("Hit maximum run duration (%v) after syncing %v tweet(s); breaking",
+				conf.MaxRunDuration, tweetsSynced)
+			break
+		}
+
+		// Mastodon would reject any more scheduled statuses, so stop rather
+		// than fail on every tweet that's left. They're picked up by a later
+		// run once some of the scheduled ones have been published.
+		if schedule.full() {
+			logger.Warnf("Hit Mastodon's limit of %v scheduled statuses after syncing %v tweet(s); breaking",
+				maxScheduledStatuses, tweetsSynced)
+			break
+		}
+
+		if hasPendingParent(conf, state, tweet) {
+			logger.Infof("Deferring tweet %v until the scheduled status of its parent tweet %v is published",
+				tweet.ID, tweet.Reply.StatusID)
+
+			// Don't advance the last run past a deferred tweet so that it's
+			// still a candidate next time.
+			deferred = true
+			continue
+		}
+
+		if failure, ok := state.tweetSkipped(tweet.ID); ok {
+			logger.Infof("Skipping tweet %v, which failed to post %v time(s): %v",
+				tweet.ID, failure.Count, failure.Reason)
+			continue
+		}
+
+		if skipped := gapBefore(gaps, tweet); skipped > 0 && schedule == nil {
+			if err := postGapNote(ctx, conf, client, state, tweet, skipped); err != nil {
+				return err
+			}
+		}
+
+		status, err := syncTweet(ctx, conf, client, state, schedule, confirmer, tweet, tempDir)
+		declined := errors.Is(err, errConfirmationDeclined)
+
+		var skipped bool
+		if conf.MaxTweetFailures > 0 && !conf.DryRun && !declined {
+			if err != nil {
+				skipped = state.recordTweetFailure(tweet.ID, err, conf.MaxTweetFailures, time.Now())
+			} else {
+				state.clearTweetFailures(tweet.ID)
+			}
+		}
+
+		// Save state after every tweet, even if syncing it failed, so that
+		// anything that was uploaded is remembered for next time.
+		if conf.StateFile != "" {
+			if err := state.save(conf.StateFile); err != nil {
+				return err
+			}
+		}
+
+		if declined {
+			logger.Infof("Declined to post tweet %v; stopping", tweet.ID)
+			break
+		}
+
 		if err != nil {
+			if skipped {
+				logger.Warnf("Skipping tweet %v from now on after failing to post it %v time(s): %v",
+					tweet.ID, conf.MaxTweetFailures, err)
+				continue
+			}
+
 			return fmt.Errorf("error syncing tweet: %w", err)
 		}
 		tweetsSynced++
+
+		syncedThisRun[tweet.ID] = true
+		for _, mergedID := range tweet.mergedIDs {
+			syncedThisRun[mergedID] = true
+		}
+
+		if progress != nil && !conf.DryRun {
+			if err := progress.record(tweet, conf.CheckpointEvery); err != nil {
+				return err
+			}
+		}
+
+		// Boosts are of someone else's toot, so the backfill summary
+		// doesn't link to them (see NativeBoosts).
+		if firstStatus == nil && status != nil && status.Reblog == nil {
+			firstStatus = status
+		}
+
+		if !deferred && tweet.CreatedAt.After(lastRun) {
+			lastRun = tweet.CreatedAt
+		}
+
+		// Dwell on what was just posted before posting the next one.
+		if i > 0 && schedule == nil && !conf.DryRun && tweetsSynced < conf.MaxTweetsToSync {
+			delay := postDelay(conf, renderToot(conf, tweet), delayRand)
+			if conf.AdaptiveThrottle {
+				delay += loadThrottle.next(conf)
+			}
+
+			if delay > 0 {
+				logger.Infof("Waiting %v before posting the next tweet", delay)
+				if err := sleepContext(ctx, delay); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	if conf.PostBackfillSummary && tweetsSynced > 0 {
+		if firstStatus == nil && !conf.DryRun {
+			logger.Infof("No new status to link to; skipping backfill summary")
+		} else if err := postBackfillSummary(ctx, conf, client, firstStatus, tweetsSynced); err != nil {
+			return err
+		}
+	}
+
+	// Don't advance the last run past short tweets held back for a digest so
+	// that they're still candidates once it's complete, but do advance it up
+	// to them so that a digest held back every run doesn't keep it in place.
+	if !heldForDigest.IsZero() && !lastRun.Before(heldForDigest) {
+		lastRun = heldForDigest.Add(-time.Nanosecond)
+	}
+
+	if conf.LastRunFile != "" && !conf.DryRun && !lastRun.IsZero() {
+		if err := writeLastRun(conf.LastRunFile, lastRun); err != nil {
+			return err
+		}
 	}
 
 	return nil
@@ -447,48 +3565,142 @@ func tootToTweet(status *mastodon.Status) string {
 	return content
 }
 
+// tweetSource returns the name of the client that a tweet was posted from,
+// extracting it from the HTML link that Twitter's API gives for it, like
+// `<a href="https://mobile.twitter.com" rel="nofollow">Twitter Web App</a>`.
+func tweetSource(tweet *Tweet) string {
+	return strings.TrimSpace(html.UnescapeString(strip.StripTags(tweet.Source)))
+}
+
+// tweetSpoilerText returns the spoiler text that a tweet is posted with,
+// which is its content warning, followed by its engagement when
+// IncludeEngagement is `spoiler`. The content warning is the tweet's own
+// Spoiler if it has one, otherwise that of the first of its hashtags that's
+// mapped in HashtagSpoilers, and otherwise DefaultSpoiler.
+func tweetSpoilerText(conf *Conf, tweet *Tweet) string {
+	contentWarning := conf.DefaultSpoiler
+	if len(conf.HashtagSpoilers) > 0 {
+		for _, parts := range hashtagRE.FindAllStringSubmatch(tweet.Text, -1) {
+			if spoiler, ok := conf.HashtagSpoilers.GetFold(parts[2]); ok {
+				contentWarning = spoiler
+				break
+			}
+		}
+	}
+	if tweet.Spoiler != nil {
+		contentWarning = *tweet.Spoiler
+	}
+
+	var engagement string
+	if conf.IncludeEngagement == EngagementSpoiler {
+		engagement = formatEngagement(conf, tweet)
+	}
+
+	switch {
+	case contentWarning == "":
+		return engagement
+	case engagement == "":
+		return contentWarning
+	}
+
+	return contentWarning + " · " + engagement
+}
+
 func tweetToTootV1(tweet *Tweet) string {
-	// Originally did nothing with the tweet's content.
-	return tweet.Text
+	return applyTransformers(tweet, tweet.Text, tootTransformersV1)
 }
 
-// Match a t.co shortlink at the end of a tweet. These tend to be added by
-// Twitter for tweets with media embeds, and aren't really needed for anything
-// as the media is already embedded inline.
-var endTcoShortLinkRE = regexp.MustCompile(` https://t\.co/\w{5,}$`)
+// mediaShortlinkPatterns match a t.co shortlink at the end of a tweet, which
+// Twitter adds to tweets with media embeds, and which isn't really needed for
+// anything as the media is already embedded inline. They're stripped from
+// tweets with media along with any TrailingLinkPatterns, and by the base
+// pipelines (see stripMediaShortlink), so they must never change.
+var mediaShortlinkPatterns = ConfRegexpList{
+	regexp.MustCompile(` https://t\.co/\w{5,}$`),
+}
 
 func tweetToTootV2(tweet *Tweet) string {
-	content := tweet.Text
+	return applyTransformers(tweet, tweet.Text, tootTransformersV2)
+}
 
-	// Mastodon doesn't engage in all the idiocy around shortened URLs, so
-	// expand everything out so we don't break the internet with the shortened
-	// versions.
-	if tweet.Entities != nil && tweet.Entities.URLs != nil {
-		for _, url := range tweet.Entities.URLs {
-			content = strings.Replace(content, url.URL, url.ExpandedURL, -1)
+func tweetToTootV3(tweet *Tweet) string {
+	return applyTransformers(tweet, tweet.Text, tootTransformersV3)
+}
+
+// writeMatchReport writes a line for every candidate tweet saying whether it
+// matched an existing status or would be newly posted. Unlike the matching
+// done by syncTwitter, it doesn't stop at the first match.
+func writeMatchReport(w io.Writer, conf *Conf, statuses []*mastodon.Status, tweets []*Tweet) {
+	var numMatched int
+
+	for _, tweet := range tweets {
+		matchingStatus, distance := findMatchingStatus(conf, statuses, tweet)
+		if matchingStatus == nil {
+			fmt.Fprintf(w, "NEW   %v\n", tweet.ID)
+			continue
 		}
+
+		numMatched++
+		fmt.Fprintf(w, "MATCH %v status %v (distance: %v)\n", tweet.ID, matchingStatus.ID, distance)
 	}
 
-	// When tweet media is embedded, Twitter adds one last shortlink back to
-	// the original tweet, which we prune here.
-	//
-	// Note: This should come after our URL replacement step above so we
-	// eliminate the possibility of ever accidentally replacing a legitimate
-	// URL. These media shortlinks don't have an entry in
-	// `tweet.Entities.URLs`, so they will remain `t.co` URLs even after the
-	// replacement step has finished.
-	if tweet.Entities != nil && tweet.Entities.Medias != nil {
-		content = endTcoShortLinkRE.ReplaceAllString(content, "")
-	}
-
-	// Include a link to retweets because the retweet content gets truncated by
-	// Twitter and isn't of much use on Mastodon unfortunately (links are often
-	// near the end).
-	if tweet.Retweet != nil {
-		retweetURL := fmt.Sprintf("https://twitter.com/%s/status/%v",
-			tweet.Retweet.User, tweet.Retweet.StatusID)
-		content += "\n\n" + retweetURL
+	fmt.Fprintf(w, "%d candidate(s), %d matched, %d new\n", len(tweets), numMatched, len(tweets)-numMatched)
+}
+
+// tweetURL returns the URL of the tweet with the given ID, which includes
+// TwitterUser's handle if it's configured.
+func tweetURL(conf *Conf, tweetID string) string {
+	if conf.TwitterUser != "" {
+		return fmt.Sprintf("https://twitter.com/%s/status/%s", conf.TwitterUser, tweetID)
 	}
 
-	return content
+	return fmt.Sprintf("https://twitter.com/i/web/status/%s", tweetID)
+}
+
+// visibilityForHashtags returns the visibility that a tweet's hashtags force
+// according to HashtagVisibility. If several of its hashtags are mapped, the
+// first of them in its text wins.
+func visibilityForHashtags(conf *Conf, tweet *Tweet) (StatusVisibility, bool) {
+	if len(conf.HashtagVisibility) < 1 {
+		return "", false
+	}
+
+	for _, parts := range hashtagRE.FindAllStringSubmatch(tweet.Text, -1) {
+		if visibility, ok := conf.HashtagVisibility.GetFold(parts[2]); ok {
+			return visibility, true
+		}
+	}
+
+	return "", false
+}
+
+// Matches URLs in the same way that Mastodon does for the purposes of counting
+// a status' length.
+var weightedURLRE = regexp.MustCompile(`https?://\S+`)
+
+// Matches mentions, including remote mentions with a domain like
+// `@user@example.com`. Go's regexp doesn't support lookbehinds, so the
+// character preceding the mention (if any) is captured and preserved.
+var weightedMentionRE = regexp.MustCompile(`(^|[^=/\w])@(\w+)(?:@[\w.-]+\w)?`)
+
+// weightedLength returns the length of toot content as Mastodon counts it for
+// the purposes of its character limit. This differs from the naive length in
+// that every URL counts as a fixed length (`urlWeight`, 23 by default on
+// Mastodon) and mentions of remote users only count their local part, so
+// `@user@example.com` counts the same as `@user`. Length is measured in runes
+// rather than bytes.
+func weightedLength(content string, urlWeight int) int {
+	content = weightedURLRE.ReplaceAllString(content, strings.Repeat("x", urlWeight))
+	content = weightedMentionRE.ReplaceAllString(content, "$1@$2")
+	return utf8.RuneCountInString(content)
+}
+
+// writeStatusDump writes each status' raw content and the normalized form
+// produced by tootToTweet that tweets are matched against.
+func writeStatusDump(w io.Writer, statuses []*mastodon.Status) {
+	for _, status := range statuses {
+		fmt.Fprintf(w, "Status %v (%v)\n", status.ID, status.URL)
+		fmt.Fprintf(w, "  Raw:        %q\n", status.Content)
+		fmt.Fprintf(w, "  Normalized: %q\n", tootToTweet(status))
+	}
 }
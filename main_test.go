@@ -1,12 +1,218 @@
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/mattn/go-mastodon"
 	assert "github.com/stretchr/testify/require"
 )
 
+func TestAuditMatchDrift(t *testing.T) {
+	status := &mastodon.Status{ID: "123", Content: `A basic tweet that will match, but with some drift.`}
+	tweet := &Tweet{ID: 456, Text: `A basic tweet that will match, but with some drift!!`}
+
+	t.Run("FlagsDrift", func(t *testing.T) {
+		logOutput := captureLogger(t)
+
+		matchingStatus, distance := findMatchingStatus(&Conf{}, []*mastodon.Status{status}, tweet)
+		assert.Equal(t, status, matchingStatus)
+		assert.Equal(t, 2, distance)
+
+		assert.True(t, auditMatchDrift(matchingStatus, tweet, distance))
+		assert.Contains(t, logOutput.String(),
+			"[WARN] Content drift for tweet 456 in Mastodon status 123 (distance: 2)")
+	})
+
+	t.Run("NoDriftOnExactMatch", func(t *testing.T) {
+		logOutput := captureLogger(t)
+
+		assert.False(t, auditMatchDrift(status, tweet, 0))
+		assert.Empty(t, logOutput.String())
+	})
+}
+
+func TestConfCutoffDecode(t *testing.T) {
+	now := time.Date(2022, 11, 10, 0, 0, 0, 0, time.UTC)
+
+	var c ConfCutoff
+	assert.True(t, c.time(now).IsZero())
+
+	assert.NoError(t, c.Decode("2022-11-01T00:00:00Z"))
+	assert.Equal(t, time.Date(2022, 11, 1, 0, 0, 0, 0, time.UTC), c.time(now))
+
+	assert.NoError(t, c.Decode("72h"))
+	assert.Equal(t, time.Date(2022, 11, 7, 0, 0, 0, 0, time.UTC), c.time(now))
+
+	assert.EqualError(t, c.Decode("-72h"), "cutoff age must not be negative, but got: -72h")
+	assert.EqualError(t, c.Decode("last week"),
+		"cutoff must be an RFC 3339 timestamp or a duration, but got: last week")
+}
+
+func TestConfFractionDecode(t *testing.T) {
+	var f ConfFraction
+	assert.NoError(t, f.Decode("0.25"))
+	assert.Equal(t, ConfFraction(0.25), f)
+
+	assert.EqualError(t, f.Decode("1.5"), "fraction must be between 0 and 1, but got: 1.5")
+	assert.EqualError(t, f.Decode("lots"), `error parsing fraction: strconv.ParseFloat: parsing "lots": invalid syntax`)
+}
+
+func TestConfMapDecode(t *testing.T) {
+	t.Run("Decodes", func(t *testing.T) {
+		var m ConfMap
+		assert.NoError(t, m.Decode("a=b; c = d ;"))
+		assert.Equal(t, ConfMap{"a": "b", "c": "d"}, m)
+	})
+
+	t.Run("InvalidPair", func(t *testing.T) {
+		var m ConfMap
+		assert.EqualError(t, m.Decode("a=b;c"),
+			"expected map pair in form 'key=value', but got: 'c'")
+	})
+
+	t.Run("GetFold", func(t *testing.T) {
+		m := ConfMap{"Brandur": "brandur@mastodon.social"}
+
+		value, ok := m.GetFold("brandur")
+		assert.True(t, ok)
+		assert.Equal(t, "brandur@mastodon.social", value)
+
+		_, ok = m.GetFold("other")
+		assert.False(t, ok)
+	})
+}
+
+func TestConfRegexpListDecode(t *testing.T) {
+	t.Run("Decodes", func(t *testing.T) {
+		var l ConfRegexpList
+		assert.NoError(t, l.Decode(` https://youtu\.be/\w+$ ; https://instagr\.am/\S+$;`))
+		assert.Len(t, l, 2)
+		assert.Equal(t, `https://youtu\.be/\w+$`, l[0].String())
+	})
+
+	t.Run("InvalidPattern", func(t *testing.T) {
+		var l ConfRegexpList
+		assert.EqualError(t, l.Decode(`https://(`),
+			"error compiling pattern 'https://(': error parsing regexp: missing closing ): `https://(`")
+	})
+}
+
+func TestConfVisibilityMapDecode(t *testing.T) {
+	t.Run("Decodes", func(t *testing.T) {
+		var m ConfVisibilityMap
+		assert.NoError(t, m.Decode(`private=private; public = public`))
+		assert.Equal(t, ConfVisibilityMap{"private": "private", "public": "public"}, m)
+	})
+
+	t.Run("UnknownVisibility", func(t *testing.T) {
+		var m ConfVisibilityMap
+		assert.EqualError(t, m.Decode(`private=secret`), "unknown status visibility: 'secret'")
+	})
+}
+
+func TestDefangMentions(t *testing.T) {
+	assert.Equal(t,
+		"Replying to @\u200buser and @\u200bother, but not user@example.com",
+		defangMentions("Replying to @user and @other, but not user@example.com"),
+	)
+}
+
+func TestDisplayTextTweet(t *testing.T) {
+	text := "@user Café time, with a photo https://t.co/abc123"
+
+	t.Run("TrimsToRange", func(t *testing.T) {
+		tweet := &Tweet{Text: text, DisplayTextRange: []int{6, 29}}
+		assert.Equal(t, "Café time, with a photo", displayTextTweet(tweet).Text)
+
+		// The original tweet isn't modified.
+		assert.Equal(t, text, tweet.Text)
+
+		assert.Equal(t, "Café time, with a photo", renderToot(&Conf{}, tweet))
+	})
+
+	t.Run("NoRange", func(t *testing.T) {
+		tweet := &Tweet{Text: text}
+		assert.Equal(t, tweet, displayTextTweet(tweet))
+	})
+
+	t.Run("InvalidRange", func(t *testing.T) {
+		tweet := &Tweet{Text: text, DisplayTextRange: []int{6, 500}}
+		assert.Equal(t, tweet, displayTextTweet(tweet))
+	})
+}
+
+func TestFetchAccountStatuses(t *testing.T) {
+	client := &fakeClient{statusPages: [][]*mastodon.Status{
+		{{ID: "5"}, {ID: "4"}},
+		{{ID: "3"}, {ID: "2"}},
+		{{ID: "1"}},
+	}}
+
+	t.Run("Paginates", func(t *testing.T) {
+		statuses, err := fetchAccountStatuses(context.Background(), client, "1", 10)
+		assert.NoError(t, err)
+		assert.Len(t, statuses, 5)
+		assert.Equal(t, mastodon.ID("1"), statuses[4].ID)
+	})
+
+	t.Run("Limit", func(t *testing.T) {
+		statuses, err := fetchAccountStatuses(context.Background(), client, "1", 3)
+		assert.NoError(t, err)
+		assert.Len(t, statuses, 3)
+		assert.Equal(t, mastodon.ID("3"), statuses[2].ID)
+	})
+}
+
+func TestFilterTweetsNotAfter(t *testing.T) {
+	cutoff := time.Date(2022, 11, 1, 0, 0, 0, 0, time.UTC)
+
+	tooRecent := &Tweet{ID: 3, CreatedAt: cutoff.Add(time.Hour)}
+	atCutoff := &Tweet{ID: 2, CreatedAt: cutoff}
+	withinRange := &Tweet{ID: 1, CreatedAt: cutoff.Add(-24 * time.Hour)}
+	unknown := &Tweet{ID: 0}
+
+	assert.Equal(t, []*Tweet{atCutoff, withinRange},
+		filterTweetsNotAfter([]*Tweet{tooRecent, atCutoff, withinRange, unknown}, cutoff))
+}
+
+func TestFormatEngagement(t *testing.T) {
+	conf := &Conf{EngagementTemplate: []string{"♥ {favorites}", "🔁 {retweets}"}}
+
+	t.Run("Formats", func(t *testing.T) {
+		assert.Equal(t, "♥ 42 · 🔁 7", formatEngagement(conf, &Tweet{FavoriteCount: 42, RetweetCount: 7}))
+	})
+
+	t.Run("OmitsZeroCounts", func(t *testing.T) {
+		assert.Equal(t, "♥ 42", formatEngagement(conf, &Tweet{FavoriteCount: 42}))
+		assert.Equal(t, "", formatEngagement(conf, &Tweet{}))
+	})
+
+	t.Run("Footer", func(t *testing.T) {
+		conf := *conf
+		conf.IncludeEngagement = EngagementFooter
+
+		assert.Equal(t, "A popular tweet\n\n♥ 42 · 🔁 7",
+			renderToot(&conf, &Tweet{Text: `A popular tweet`, FavoriteCount: 42, RetweetCount: 7}))
+		assert.Equal(t, "An unpopular tweet",
+			renderToot(&conf, &Tweet{Text: `An unpopular tweet`}))
+	})
+}
+
 func TestFindMatchingStatus(t *testing.T) {
 	// Because we're using fuzzy matching instead of matching a perfect string,
 	// these will need to be sufficiently different for the results to be
@@ -16,67 +222,2031 @@ func TestFindMatchingStatus(t *testing.T) {
 	status3 := &mastodon.Status{Content: `A tweet with Mastodon/Twitter different: https://this-should-be-a-pretty-long-link.example.com`}
 	status4 := &mastodon.Status{Content: `A tweet with Mastodon/Twitter different: https://short`}
 
-	statuses := []*mastodon.Status{status1, status2, status3, status4}
+	statuses := []*mastodon.Status{status1, status2, status3, status4}
+
+	t.Run("BasicMatch", func(t *testing.T) {
+		status, distance := findMatchingStatus(
+			&Conf{},
+			statuses,
+			&Tweet{Text: `A basic tweet that will match against the first few cases.`},
+		)
+		assert.Equal(t, status2, status)
+		assert.Equal(t, 0, distance)
+	})
+
+	t.Run("FuzzyMatch", func(t *testing.T) {
+		status, distance := findMatchingStatus(
+			&Conf{},
+			statuses,
+			&Tweet{Text: `A basic tweet that will match against the first few cases. (fuzzy)`},
+		)
+		assert.Equal(t, status2, status)
+		assert.Equal(t, 8, distance)
+	})
+
+	t.Run("NoMatchTooFuzzy", func(t *testing.T) {
+		status, distance := findMatchingStatus(
+			&Conf{},
+			statuses,
+			&Tweet{Text: `A basic tweet that will match against the first few cases. (fuzzy, but overly slow)`},
+		)
+		assert.Nil(t, status)
+		assert.Equal(t, 0, distance)
+	})
+
+	t.Run("IgnoresVariationSelectors", func(t *testing.T) {
+		status := &mastodon.Status{Content: "<p>Shipped it \u2764\ufe0f and off to celebrate \u2615</p>"}
+
+		matched, distance := findMatchingStatus(
+			&Conf{},
+			[]*mastodon.Status{status},
+			&Tweet{Text: "Shipped it \u2764 and off to celebrate \u2615\ufe0f"},
+		)
+		assert.Equal(t, status, matched)
+		assert.Equal(t, 0, distance)
+	})
+
+	t.Run("IgnoresUnicodeNormalizationForm", func(t *testing.T) {
+		status := &mastodon.Status{Content: "<p>Caf\u00e9 au lait in Z\u00fcrich</p>"}
+
+		matched, distance := findMatchingStatus(
+			&Conf{},
+			[]*mastodon.Status{status},
+			&Tweet{Text: "Cafe\u0301 au lait in Zu\u0308rich"},
+		)
+		assert.Equal(t, status, matched)
+		assert.Equal(t, 0, distance)
+	})
+
+	t.Run("TransformedMatch", func(t *testing.T) {
+		status, distance := findMatchingStatus(
+			&Conf{},
+			statuses,
+			&Tweet{
+				Text: `A tweet with Mastodon/Twitter different: https://short`,
+				Entities: &TweetEntities{
+					URLs: []*TweetEntitiesURL{
+						{URL: "https://short", ExpandedURL: "https://this-should-be-a-pretty-long-link.example.com"},
+					},
+				},
+			},
+		)
+		assert.Equal(t, status3, status)
+		assert.Equal(t, 0, distance)
+	})
+
+	// Simulates a posting before a new version into effect. We should still
+	// find a match by falling back to the old version.
+	t.Run("TransformedMatchOldVersion", func(t *testing.T) {
+		status, distance := findMatchingStatus(
+			&Conf{},
+			statuses,
+			&Tweet{
+				Text: `A tweet with Mastodon/Twitter different: https://short`,
+				Entities: &TweetEntities{
+					URLs: []*TweetEntitiesURL{
+						{URL: "https://short", ExpandedURL: "https://this-should-be-a-pretty-long-link.example.com"},
+					},
+				},
+			},
+		)
+		assert.Equal(t, status3, status)
+		assert.Equal(t, 0, distance)
+	})
+
+	t.Run("MaxStatusesToCompare", func(t *testing.T) {
+		logOutput := captureLogger(t)
+
+		statuses := []*mastodon.Status{
+			{CreatedAt: time.Date(2021, 1, 3, 0, 0, 0, 0, time.UTC), Content: `The newest status, which is unrelated to the tweet at all.`},
+			{CreatedAt: time.Date(2021, 1, 2, 0, 0, 0, 0, time.UTC), Content: `Another status that doesn't match the tweet either.`},
+			{CreatedAt: time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC), Content: `A basic tweet that will match against the first few cases.`},
+		}
+		tweet := &Tweet{
+			ID:        123,
+			CreatedAt: time.Date(2020, 12, 31, 0, 0, 0, 0, time.UTC),
+			Text:      `A basic tweet that will match against the first few cases.`,
+		}
+
+		status, _ := findMatchingStatus(&Conf{}, statuses, tweet)
+		assert.Equal(t, statuses[2], status)
+
+		status, _ = findMatchingStatus(&Conf{MaxStatusesToCompare: 2}, statuses, tweet)
+		assert.Nil(t, status)
+		assert.Contains(t, logOutput.String(),
+			"[WARN] Tweet 123 is older than the oldest of the 2 status(es) compared")
+	})
+
+	t.Run("IgnoresReblogs", func(t *testing.T) {
+		// A boost of someone else's status that happens to read like one of
+		// the account's tweets.
+		reblog := &mastodon.Status{
+			Content: `A basic tweet that will match against the first few cases.`,
+			Reblog:  &mastodon.Status{Content: `A basic tweet that will match against the first few cases.`},
+		}
+		tweet := &Tweet{Text: `A basic tweet that will match against the first few cases.`}
+
+		status, _ := findMatchingStatus(&Conf{}, []*mastodon.Status{reblog, status1}, tweet)
+		assert.Nil(t, status)
+
+		status, _ = findMatchingStatus(&Conf{}, []*mastodon.Status{reblog, status2}, tweet)
+		assert.Equal(t, status2, status)
+
+		// Reblogs don't count towards the statuses compared.
+		status, _ = findMatchingStatus(&Conf{MaxStatusesToCompare: 1}, []*mastodon.Status{reblog, status2}, tweet)
+		assert.Equal(t, status2, status)
+	})
+}
+
+func TestFindMatchingStatusRenderFallbacks(t *testing.T) {
+	long := strings.TrimSpace(strings.Repeat("word ", 450))
+	tweet := &Tweet{Text: long, Entities: &TweetEntities{Medias: []*TweetEntitiesMedia{
+		{ID: 1, Type: "photo", URL: "https://pbs.twimg.com/media/cat.jpg", AltText: "A cat"},
+	}}}
+
+	// Reading time notes were already on when the status was posted, and
+	// inline alt text was turned on since.
+	conf := &Conf{IncludeReadingTime: true, InlineAltText: true, ReadingTimeMinLength: 100, ReadingTimeWPM: 200}
+	status := &mastodon.Status{Content: "<p>(3 min read)</p><p>" + long + "</p>"}
+
+	match, _ := findMatchingStatus(conf, []*mastodon.Status{status}, tweet)
+	assert.Equal(t, status, match)
+
+	t.Run("AllTurnedOnSince", func(t *testing.T) {
+		status := &mastodon.Status{Content: "<p>" + long + "</p>"}
+
+		match, _ := findMatchingStatus(conf, []*mastodon.Status{status}, tweet)
+		assert.Equal(t, status, match)
+	})
+
+	t.Run("EngagementFooterTurnedOnSince", func(t *testing.T) {
+		tweet := &Tweet{Text: long, FavoriteCount: 42, RetweetCount: 7}
+
+		// Reading time notes were already on when the status was posted, but
+		// the engagement footer wasn't.
+		conf := &Conf{
+			EngagementTemplate:   []string{"♥ {favorites}", "🔁 {retweets}"},
+			IncludeEngagement:    EngagementFooter,
+			IncludeReadingTime:   true,
+			ReadingTimeMinLength: 100,
+			ReadingTimeWPM:       200,
+		}
+		status := &mastodon.Status{Content: "<p>(3 min read)</p><p>" + long + "</p>"}
+
+		match, _ := findMatchingStatus(conf, []*mastodon.Status{status}, tweet)
+		assert.Equal(t, status, match)
+	})
+}
+
+func TestHashtagCaseRuleDecode(t *testing.T) {
+	var r HashtagCaseRule
+	assert.NoError(t, r.Decode("preserve_first"))
+	assert.Equal(t, HashtagCasePreserveFirst, r)
+
+	assert.EqualError(t, r.Decode("upper"), "unknown hashtag case rule: 'upper'")
+}
+
+func TestMediaRequestHeader(t *testing.T) {
+	conf := &Conf{
+		TwitterBearerToken: "secret-token",
+		TwitterMediaHosts:  []string{"pbs.twimg.com", "twitter.com"},
+	}
+
+	t.Run("TwitterHost", func(t *testing.T) {
+		assert.Equal(t, "Bearer secret-token",
+			mediaRequestHeader(conf, "https://pbs.twimg.com/media/abc.jpg").Get("Authorization"))
+		assert.Equal(t, "Bearer secret-token",
+			mediaRequestHeader(conf, "https://ton.twitter.com/1.1/ton/data/abc.jpg").Get("Authorization"))
+	})
+
+	t.Run("OtherHost", func(t *testing.T) {
+		assert.Empty(t, mediaRequestHeader(conf, "https://example.com/abc.jpg").Get("Authorization"))
+		assert.Empty(t, mediaRequestHeader(conf, "https://nottwitter.com/abc.jpg").Get("Authorization"))
+	})
+
+	t.Run("SentWhenFetching", func(t *testing.T) {
+		var authorization string
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			authorization = r.Header.Get("Authorization")
+			w.Write([]byte("GIF89a fake image contents"))
+		}))
+		t.Cleanup(server.Close)
+
+		target := filepath.Join(t.TempDir(), "image.jpg")
+		conf := &Conf{TwitterBearerToken: "secret-token", TwitterMediaHosts: []string{"127.0.0.1"}}
+		assert.NoError(t, fetchURL(conf, server.URL+"/image.jpg", target, mediaRequestHeader(conf, server.URL+"/image.jpg")))
+		assert.Equal(t, "Bearer secret-token", authorization)
+	})
+}
+
+func TestMediaURLVariants(t *testing.T) {
+	conf := &Conf{MediaURLVariants: []string{"large", "medium"}, TwitterMediaHosts: []string{"twimg.com"}}
+
+	assert.Equal(t,
+		[]string{
+			"https://pbs.twimg.com/media/abc.jpg:orig",
+			"https://pbs.twimg.com/media/abc.jpg:large",
+			"https://pbs.twimg.com/media/abc.jpg:medium",
+		},
+		mediaURLVariants(conf, "https://pbs.twimg.com/media/abc.jpg:orig"),
+	)
+
+	assert.Equal(t,
+		[]string{
+			"https://pbs.twimg.com/media/abc.jpg",
+			"https://pbs.twimg.com/media/abc.jpg:large",
+			"https://pbs.twimg.com/media/abc.jpg:medium",
+		},
+		mediaURLVariants(conf, "https://pbs.twimg.com/media/abc.jpg"),
+	)
+
+	// A variant that's the same as the URL isn't tried twice.
+	assert.Equal(t,
+		[]string{
+			"https://pbs.twimg.com/media/abc.jpg:large",
+			"https://pbs.twimg.com/media/abc.jpg:medium",
+		},
+		mediaURLVariants(conf, "https://pbs.twimg.com/media/abc.jpg:large"),
+	)
+
+	// Other hosts don't support variants.
+	assert.Equal(t,
+		[]string{"https://example.com/abc.jpg"},
+		mediaURLVariants(conf, "https://example.com/abc.jpg"),
+	)
+}
+
+func TestNewHTTPClient(t *testing.T) {
+	// A server that never responds until the test is over.
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	t.Run("SlowServerFailsWithinResponseHeaderTimeout", func(t *testing.T) {
+		client := newHTTPClient(&Conf{
+			HTTPResponseHeaderTimeout: 100 * time.Millisecond,
+			HTTPTimeout:               10 * time.Second,
+		})
+
+		start := time.Now()
+		_, err := client.Get(server.URL)
+		assert.Error(t, err)
+		assert.Less(t, int64(time.Since(start)), int64(5*time.Second))
+	})
+
+	t.Run("SlowServerFailsWithinTimeout", func(t *testing.T) {
+		client := newHTTPClient(&Conf{
+			HTTPTimeout: 100 * time.Millisecond,
+		})
+
+		start := time.Now()
+		_, err := client.Get(server.URL)
+		assert.Error(t, err)
+		assert.Less(t, int64(time.Since(start)), int64(5*time.Second))
+	})
+}
+
+func TestNormalizeEmoji(t *testing.T) {
+	// Variation selectors following other characters are kept.
+	assert.Equal(t, "\u2764\ufe0f \u263a\ufe0e", normalizeEmoji("\u2764\ufe0f \u263a\ufe0e"))
+
+	// Stray ones are stripped.
+	assert.Equal(t, "Hi \u2764\ufe0f", normalizeEmoji("\ufe0fHi \ufe0f\u2764\ufe0f\ufe0f"))
+}
+
+func TestNormalizeHashtags(t *testing.T) {
+	content := `Upgrading to #PostgreSQL 15 with #golang, see https://example.com/#Notes`
+
+	t.Run("NoRuleByDefault", func(t *testing.T) {
+		assert.Equal(t, content, normalizeHashtags(&Conf{}, content))
+	})
+
+	t.Run("Lower", func(t *testing.T) {
+		assert.Equal(t,
+			`Upgrading to #postgresql 15 with #golang, see https://example.com/#Notes`,
+			normalizeHashtags(&Conf{HashtagCase: HashtagCaseLower}, content),
+		)
+	})
+
+	t.Run("PreserveFirst", func(t *testing.T) {
+		assert.Equal(t,
+			`Upgrading to #Postgresql 15 with #golang, see https://example.com/#Notes`,
+			normalizeHashtags(&Conf{HashtagCase: HashtagCasePreserveFirst}, content),
+		)
+	})
+
+	t.Run("MappingOverridesRule", func(t *testing.T) {
+		assert.Equal(t,
+			`Upgrading to #postgresql 15 with #GoLang, see https://example.com/#Notes`,
+			normalizeHashtags(&Conf{
+				HashtagCase:         HashtagCaseLower,
+				HashtagCaseMappings: ConfMap{"GOLANG": "GoLang"},
+			}, content),
+		)
+	})
+
+	t.Run("NonASCII", func(t *testing.T) {
+		assert.Equal(t,
+			`Back in #zürich for #東京2020`,
+			normalizeHashtags(&Conf{HashtagCase: HashtagCaseLower}, `Back in #Zürich for #東京2020`),
+		)
+	})
+}
+
+func TestOverflowMediaCount(t *testing.T) {
+	photos := func(n int) *Tweet {
+		tweet := &Tweet{Entities: &TweetEntities{
+			Medias: []*TweetEntitiesMedia{{Type: "video"}},
+		}}
+		for i := 0; i < n; i++ {
+			tweet.Entities.Medias = append(tweet.Entities.Medias, &TweetEntitiesMedia{Type: "photo"})
+		}
+		return tweet
+	}
+
+	assert.Equal(t, 0, overflowMediaCount(&Tweet{}))
+	assert.Equal(t, 0, overflowMediaCount(photos(4)))
+	assert.Equal(t, 2, overflowMediaCount(photos(6)))
+}
+
+func TestPollForTweet(t *testing.T) {
+	conf := &Conf{
+		PollExpiresIn: 24 * time.Hour,
+		PollOptions:   []string{"Yes", "No"},
+		PollTrigger:   "thoughts?",
+	}
+
+	t.Run("TriggerMatch", func(t *testing.T) {
+		assert.Equal(t,
+			&mastodon.TootPoll{ExpiresInSeconds: 86400, Options: []string{"Yes", "No"}},
+			pollForTweet(conf, &Tweet{Text: `Tabs over spaces. Thoughts?`}),
+		)
+	})
+
+	t.Run("NoMatch", func(t *testing.T) {
+		assert.Nil(t, pollForTweet(conf, &Tweet{Text: `Tabs over spaces.`}))
+	})
+
+	t.Run("NotConfigured", func(t *testing.T) {
+		assert.Nil(t, pollForTweet(&Conf{}, &Tweet{Text: `Tabs over spaces. Thoughts?`}))
+	})
+}
+
+func TestPostBackfillSummary(t *testing.T) {
+	firstStatus := &mastodon.Status{ID: "123", URL: "https://mastodon.example.com/@user/123"}
+
+	t.Run("PostsSummary", func(t *testing.T) {
+		client := &fakeClient{}
+
+		err := postBackfillSummary(context.Background(), &Conf{}, client, firstStatus, 42)
+		assert.NoError(t, err)
+
+		assert.Len(t, client.postedToots, 1)
+		assert.Equal(t,
+			`Backfilled 42 old tweets from Twitter, starting here: https://mastodon.example.com/@user/123`,
+			client.postedToots[0].Status,
+		)
+	})
+
+	t.Run("CustomTemplate", func(t *testing.T) {
+		client := &fakeClient{}
+
+		err := postBackfillSummary(context.Background(),
+			&Conf{BackfillSummaryTemplate: "{count} tweets imported: {url}"}, client, firstStatus, 42)
+		assert.NoError(t, err)
+
+		assert.Len(t, client.postedToots, 1)
+		assert.Equal(t,
+			`42 tweets imported: https://mastodon.example.com/@user/123`,
+			client.postedToots[0].Status,
+		)
+	})
+
+	t.Run("DryRun", func(t *testing.T) {
+		client := &fakeClient{}
+
+		err := postBackfillSummary(context.Background(), &Conf{DryRun: true}, client, nil, 42)
+		assert.NoError(t, err)
+
+		assert.Len(t, client.postedToots, 0)
+	})
+}
+
+func TestPostStatusRetryingMedia(t *testing.T) {
+	conf := &Conf{MediaProcessingRetries: 2, MediaProcessingRetryDelay: time.Millisecond}
+	toot := &mastodon.Toot{MediaIDs: []mastodon.ID{"media-1"}, Status: "A tweet with a photo"}
+	mediaNotReadyErr := &mastodon.APIError{Message: "Cannot attach files that have not finished processing", StatusCode: 422}
+
+	t.Run("RetriesMediaNotReady", func(t *testing.T) {
+		client := &fakeClient{postStatusErrs: []error{mediaNotReadyErr}}
+
+		status, err := postStatusRetryingMedia(context.Background(), conf, client, toot)
+		assert.NoError(t, err)
+		assert.Equal(t, mastodon.ID("1"), status.ID)
+		assert.Len(t, client.postedToots, 1)
+	})
+
+	t.Run("GivesUpAfterRetries", func(t *testing.T) {
+		client := &fakeClient{postStatusErrs: []error{mediaNotReadyErr, mediaNotReadyErr, mediaNotReadyErr}}
+
+		_, err := postStatusRetryingMedia(context.Background(), conf, client, toot)
+		assert.Equal(t, mediaNotReadyErr, err)
+		assert.Len(t, client.postedToots, 0)
+	})
+
+	t.Run("NoRetryForOtherErrors", func(t *testing.T) {
+		otherErr := &mastodon.APIError{StatusCode: 500}
+		client := &fakeClient{postStatusErrs: []error{otherErr}}
+
+		_, err := postStatusRetryingMedia(context.Background(), conf, client, toot)
+		assert.Equal(t, otherErr, err)
+	})
+}
+
+func TestProxyMediaURL(t *testing.T) {
+	t.Run("NoProxyByDefault", func(t *testing.T) {
+		assert.Equal(t, "https://pbs.twimg.com/media/abc.jpg",
+			proxyMediaURL(&Conf{}, "https://pbs.twimg.com/media/abc.jpg"))
+	})
+
+	t.Run("RewritesThroughProxy", func(t *testing.T) {
+		assert.Equal(t, "https://proxy.example.com/?url=https%3A%2F%2Fpbs.twimg.com%2Fmedia%2Fabc.jpg",
+			proxyMediaURL(&Conf{MediaProxyBase: "https://proxy.example.com/?url="}, "https://pbs.twimg.com/media/abc.jpg"))
+	})
+
+	t.Run("FetchesThroughProxy", func(t *testing.T) {
+		var proxiedURL string
+		proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			proxiedURL = r.URL.Query().Get("url")
+			w.Write([]byte("GIF89a fake image contents"))
+		}))
+		t.Cleanup(proxy.Close)
+
+		tweet := &Tweet{
+			Entities: &TweetEntities{
+				Medias: []*TweetEntitiesMedia{
+					{ID: 1, Type: "photo", URL: "https://pbs.twimg.com/media/abc.jpg"},
+				},
+			},
+		}
+
+		client := &fakeClient{}
+		attachmentIDs, err := syncMedia(context.Background(), &Conf{MediaProxyBase: proxy.URL + "/?url="},
+			client, &State{}, tweet, t.TempDir())
+		assert.NoError(t, err)
+		assert.Len(t, attachmentIDs, 1)
+		assert.Equal(t, "https://pbs.twimg.com/media/abc.jpg", proxiedURL)
+	})
+}
+
+func TestReadTweets(t *testing.T) {
+	data := `
+[[tweets]]
+created_at = 2021-01-02T03:04:05Z
+id = 2
+text = "The second tweet"
+
+[[tweets]]
+created_at = 2021-01-01T03:04:05Z
+id = 1
+text = "The first tweet"
+`
+
+	assertTweets := func(t *testing.T, tweets []*Tweet) {
+		assert.Len(t, tweets, 2)
+		assert.Equal(t, int64(2), tweets[0].ID)
+		assert.Equal(t, "The second tweet", tweets[0].Text)
+		assert.Equal(t, int64(1), tweets[1].ID)
+		assert.Equal(t, "The first tweet", tweets[1].Text)
+	}
+
+	t.Run("Uncompressed", func(t *testing.T) {
+		tweets, err := readTweets(strings.NewReader(data))
+		assert.NoError(t, err)
+		assertTweets(t, tweets)
+	})
+
+	t.Run("Gzipped", func(t *testing.T) {
+		var buf bytes.Buffer
+		gzipWriter := gzip.NewWriter(&buf)
+		_, err := gzipWriter.Write([]byte(data))
+		assert.NoError(t, err)
+		assert.NoError(t, gzipWriter.Close())
+
+		tweets, err := readTweets(&buf)
+		assert.NoError(t, err)
+		assertTweets(t, tweets)
+	})
+}
+
+func TestReadTweetsFromFile(t *testing.T) {
+	data := `
+[[tweets]]
+created_at = 2021-01-01T03:04:05Z
+id = 1
+text = "The first tweet"
+`
+	checksum := fmt.Sprintf("%x", sha256.Sum256([]byte(data)))
+
+	t.Run("MatchingChecksum", func(t *testing.T) {
+		tweets, err := readTweetsFromFile(writeTweetData(t, data), checksum)
+		assert.NoError(t, err)
+		assert.Len(t, tweets, 1)
+	})
+
+	t.Run("MismatchedChecksum", func(t *testing.T) {
+		_, err := readTweetsFromFile(writeTweetData(t, data), "abc123")
+		assert.EqualError(t, err, fmt.Sprintf(
+			"source twitter data checksum %v doesn't match expected checksum abc123", checksum))
+	})
+
+	t.Run("WarnsOnZeroTweetsFromNonEmptyFile", func(t *testing.T) {
+		logOutput := captureLogger(t)
+
+		source := writeTweetData(t, "[[statuses]]\nid = 1\n")
+		tweets, err := readTweetsFromFile(source, "")
+		assert.NoError(t, err)
+		assert.Len(t, tweets, 0)
+		assert.Contains(t, logOutput.String(),
+			"[WARN] Parsed zero tweets from non-empty source "+source)
+	})
+}
+
+func TestRedactError(t *testing.T) {
+	u := "https://private.example/private.jpg"
+	err := &url.Error{Op: "Get", URL: u, Err: errors.New("dial tcp: lookup private.example: no such host")}
+
+	redacted := redactError(&Conf{RedactLogs: true}, err, u)
+	assert.Equal(t, `Get "`+logURL(&Conf{RedactLogs: true}, u)+`": dial tcp: lookup `+
+		logURL(&Conf{RedactLogs: true}, "private.example")+`: no such host`, redacted.Error())
+
+	var urlErr *url.Error
+	assert.True(t, errors.As(redacted, &urlErr))
+
+	t.Run("OffByDefault", func(t *testing.T) {
+		assert.Equal(t, err, redactError(&Conf{}, err, u))
+	})
+}
+
+func TestRenderToot(t *testing.T) {
+	replyTweet := &Tweet{
+		Text:  `@user That's a great point, and here's some substance to go with it.`,
+		Reply: &TweetReply{StatusID: 1234567890, User: "user"},
+	}
+
+	t.Run("NoReplyPrefixByDefault", func(t *testing.T) {
+		assert.Equal(t,
+			`@user That's a great point, and here's some substance to go with it.`,
+			renderToot(&Conf{IncludeReplies: true}, replyTweet),
+		)
+	})
+
+	t.Run("AddsReplyPrefix", func(t *testing.T) {
+		assert.Equal(t,
+			"Replying to @\u200buser (on Twitter): @user That's a great point, and here's some substance to go with it.",
+			renderToot(&Conf{IncludeReplies: true, ReplyPrefix: "Replying to @{user} (on Twitter):"}, replyTweet),
+		)
+	})
+
+	t.Run("NoReplyPrefixForNonReplies", func(t *testing.T) {
+		assert.Equal(t,
+			`A tweet containing nothing interesting`,
+			renderToot(
+				&Conf{IncludeReplies: true, ReplyPrefix: "In reply to @{user}:"},
+				&Tweet{Text: `A tweet containing nothing interesting`},
+			),
+		)
+	})
+
+	t.Run("StripsRTPrefix", func(t *testing.T) {
+		assert.Equal(t,
+			"Something worth reading\n\nhttps://twitter.com/user/status/1234567890",
+			renderToot(
+				&Conf{StripRTPrefix: true},
+				&Tweet{
+					Text:    `RT @user: Something worth reading`,
+					Retweet: &TweetRetweet{StatusID: 1234567890, User: "user"},
+				},
+			),
+		)
+	})
+
+	t.Run("KeepsRTPrefixByDefault", func(t *testing.T) {
+		assert.Equal(t,
+			"RT @user: Something worth reading\n\nhttps://twitter.com/user/status/1234567890",
+			renderToot(
+				&Conf{},
+				&Tweet{
+					Text:    `RT @user: Something worth reading`,
+					Retweet: &TweetRetweet{StatusID: 1234567890, User: "user"},
+				},
+			),
+		)
+	})
+
+	t.Run("NormalizesEmoji", func(t *testing.T) {
+		tweet := &Tweet{Text: "\ufe0fLove this \u2764\ufe0f \ufe0f"}
+
+		assert.Equal(t, "Love this \u2764\ufe0f ", renderToot(&Conf{NormalizeEmoji: true}, tweet))
+		assert.Equal(t, tweet.Text, renderToot(&Conf{}, tweet))
+	})
+
+	t.Run("OnlyStripsLeadingRTPrefix", func(t *testing.T) {
+		conf := &Conf{StripRTPrefix: true}
+
+		for _, text := range []string{
+			`Please RT @user: it's important`,
+			`RT if you agree`,
+			`ART @user: a gallery opening`,
+			`RT @user without a colon`,
+		} {
+			assert.Equal(t, text, renderToot(conf, &Tweet{Text: text}))
+		}
+	})
+}
+
+func TestSampleContent(t *testing.T) {
+	t.Run("ShortContent", func(t *testing.T) {
+		assert.Equal(t, "A short tweet", sampleContent("A short tweet", 50))
+	})
+
+	t.Run("TruncatesLongContent", func(t *testing.T) {
+		assert.Equal(t, "A longer tweet ...", sampleContent("A longer tweet\nthat gets truncated", 15))
+	})
+
+	t.Run("TruncatesOnRuneBoundary", func(t *testing.T) {
+		assert.Equal(t, "日本語 🎉 ...", sampleContent("日本語 🎉🎉 のツイート", 6))
+	})
+}
+
+func TestSelectTweetCandidates(t *testing.T) {
+	tweet1 := &Tweet{ID: 3, Text: `A regular tweet`}
+	tweet2 := &Tweet{ID: 2, Text: `@user A reply`, Reply: &TweetReply{StatusID: 1, User: "user"}}
+	tweet3 := &Tweet{ID: 1, Text: `A tweet that's too old`}
+
+	allTweets := []*Tweet{tweet1, tweet2, tweet3}
+
+	t.Run("IncludeRepliesOff", func(t *testing.T) {
+		assert.Equal(t,
+			[]*Tweet{tweet1},
+			selectTweetCandidates(&Conf{MinTweetID: 2}, allTweets),
+		)
+	})
+
+	t.Run("IncludeRepliesOn", func(t *testing.T) {
+		assert.Equal(t,
+			[]*Tweet{tweet1, tweet2},
+			selectTweetCandidates(&Conf{IncludeReplies: true, MinTweetID: 2}, allTweets),
+		)
+	})
+
+	t.Run("ThreadSelfReplies", func(t *testing.T) {
+		selfReply := &Tweet{ID: 4, Text: `A follow up`, Reply: &TweetReply{StatusID: 3, User: "brandur"}}
+
+		assert.Equal(t,
+			[]*Tweet{selfReply, tweet1},
+			selectTweetCandidates(&Conf{MinTweetID: 2, ThreadSelfReplies: true, TwitterUser: "brandur"},
+				[]*Tweet{selfReply, tweet1, tweet2, tweet3}),
+		)
+	})
+
+	t.Run("ThreadsOnly", func(t *testing.T) {
+		root := &Tweet{ID: 10, Text: `The first part of a long story`}
+		standalone := &Tweet{ID: 11, Text: `A one-off thought`}
+		reply1 := &Tweet{ID: 12, Text: `The second part`, Reply: &TweetReply{StatusID: 10, User: "brandur"}}
+		otherStandalone := &Tweet{ID: 13, Text: `Another one-off thought`}
+		reply2 := &Tweet{ID: 14, Text: `The end`, Reply: &TweetReply{StatusID: 12, User: "brandur"}}
+
+		assert.Equal(t,
+			[]*Tweet{reply2, reply1, root},
+			selectTweetCandidates(&Conf{MinTweetID: 2, ThreadSelfReplies: true, ThreadsOnly: 3, TwitterUser: "brandur"},
+				[]*Tweet{reply2, otherStandalone, reply1, standalone, root}),
+		)
+	})
+
+	t.Run("AllowedTweetLanguages", func(t *testing.T) {
+		english := &Tweet{ID: 6, Text: `This is the best write up of the new release that I've seen so far`}
+		spanish := &Tweet{ID: 5, Text: `Esta es la mejor explicación de la nueva versión que he visto`}
+		unclear := &Tweet{ID: 4, Text: `👍`}
+
+		assert.Equal(t,
+			[]*Tweet{english, unclear},
+			selectTweetCandidates(&Conf{AllowedTweetLanguages: []string{"en"}, MinTweetID: 2},
+				[]*Tweet{english, spanish, unclear}),
+		)
+	})
+
+	t.Run("ExcludedSources", func(t *testing.T) {
+		bot := &Tweet{ID: 6, Text: `New post on my blog`,
+			Source: `<a href="https://ifttt.com" rel="nofollow">IFTTT</a>`}
+		human := &Tweet{ID: 5, Text: `Just got back from the lake`,
+			Source: `<a href="http://twitter.com/download/iphone" rel="nofollow">Twitter for iPhone</a>`}
+		plainBot := &Tweet{ID: 4, Text: `Another new post on my blog`, Source: `IFTTT`}
+		unknown := &Tweet{ID: 3, Text: `A tweet from an older export`}
+
+		assert.Equal(t,
+			[]*Tweet{human, unknown},
+			selectTweetCandidates(&Conf{ExcludedSources: []string{"ifttt"}, MinTweetID: 2},
+				[]*Tweet{bot, human, plainBot, unknown}),
+		)
+
+		// Off by default.
+		assert.Len(t, selectTweetCandidates(&Conf{MinTweetID: 2}, []*Tweet{bot, human, plainBot, unknown}), 4)
+	})
+
+	t.Run("MinAuthoredLength", func(t *testing.T) {
+		quoteURLs := &TweetEntities{
+			URLs: []*TweetEntitiesURL{
+				{URL: "https://t.co/abc123", ExpandedURL: "https://twitter.com/other/status/100"},
+			},
+		}
+
+		bareQuote := &Tweet{ID: 6, Text: `https://t.co/abc123`,
+			Entities: quoteURLs, Quote: &TweetQuote{StatusID: 100, User: "other"}}
+		commentedQuote := &Tweet{ID: 5, Text: `This is a great write up on indexes https://t.co/abc123`,
+			Entities: quoteURLs, Quote: &TweetQuote{StatusID: 100, User: "other"}}
+		mentionsOnly := &Tweet{ID: 4, Text: `@user @other`, Reply: &TweetReply{StatusID: 1, User: "user"}}
+		retweet := &Tweet{ID: 3, Text: `RT @other: Something else`, Retweet: &TweetRetweet{StatusID: 101, User: "other"}}
+
+		assert.Equal(t,
+			[]*Tweet{commentedQuote, retweet},
+			selectTweetCandidates(&Conf{IncludeReplies: true, MinAuthoredLength: 10, MinTweetID: 2},
+				[]*Tweet{bareQuote, commentedQuote, mentionsOnly, retweet}),
+		)
+	})
+
+	t.Run("SkipHashtagOnly", func(t *testing.T) {
+		hashtagsOnly := &Tweet{ID: 5, Text: `#tbt #nofilter https://t.co/abc123`}
+		hashtagsAndText := &Tweet{ID: 4, Text: `Back at the lake #tbt #nofilter`}
+		mentionsAndPunctuation := &Tweet{ID: 3, Text: `@user #tbt !!!`}
+
+		assert.Equal(t,
+			[]*Tweet{hashtagsAndText},
+			selectTweetCandidates(&Conf{SkipHashtagOnly: true, MinTweetID: 2},
+				[]*Tweet{hashtagsOnly, hashtagsAndText, mentionsAndPunctuation}),
+		)
+
+		// Off by default.
+		assert.Len(t, selectTweetCandidates(&Conf{MinTweetID: 2},
+			[]*Tweet{hashtagsOnly, hashtagsAndText, mentionsAndPunctuation}), 3)
+
+		// Composes with MinAuthoredLength.
+		assert.Empty(t, selectTweetCandidates(&Conf{MinAuthoredLength: 50, SkipHashtagOnly: true, MinTweetID: 2},
+			[]*Tweet{hashtagsOnly, hashtagsAndText}))
+	})
+}
+
+func TestSourceAuthor(t *testing.T) {
+	author, err := sourceAuthor(&Conf{}, "/data/brandur.toml.gz")
+	assert.NoError(t, err)
+	assert.Equal(t, "brandur", author)
+
+	author, err = sourceAuthor(&Conf{AttributionHandle: "@someone"}, "/data/brandur.toml")
+	assert.NoError(t, err)
+	assert.Equal(t, "someone", author)
+
+	_, err = sourceAuthor(&Conf{}, "-")
+	assert.EqualError(t, err, "attribution handle must be set to use attribution when reading from stdin")
+}
+
+func TestStatusVisibilityDecode(t *testing.T) {
+	var v StatusVisibility
+	assert.NoError(t, v.Decode("unlisted"))
+	assert.Equal(t, StatusVisibility("unlisted"), v)
+
+	assert.EqualError(t, v.Decode("secret"), "unknown status visibility: 'secret'")
+}
+
+func TestStripTrailingLinks(t *testing.T) {
+	var patterns ConfRegexpList
+	assert.NoError(t, patterns.Decode(`https://youtu\.be/\w+$`))
+
+	t.Run("NoPatternsByDefault", func(t *testing.T) {
+		assert.Equal(t,
+			`New video is up! https://youtu.be/abc123`,
+			stripTrailingLinks(&Conf{}, &Tweet{}, `New video is up! https://youtu.be/abc123`),
+		)
+	})
+
+	t.Run("StripsMatch", func(t *testing.T) {
+		assert.Equal(t,
+			`New video is up!`,
+			stripTrailingLinks(&Conf{TrailingLinkPatterns: patterns}, &Tweet{},
+				`New video is up! https://youtu.be/abc123`),
+		)
+	})
+
+	t.Run("OnlyStripsAtEnd", func(t *testing.T) {
+		assert.Equal(t,
+			`https://youtu.be/abc123 is up!`,
+			stripTrailingLinks(&Conf{TrailingLinkPatterns: patterns}, &Tweet{},
+				`https://youtu.be/abc123 is up!`),
+		)
+	})
+
+	t.Run("KeepsEntityURLs", func(t *testing.T) {
+		tweet := &Tweet{
+			Entities: &TweetEntities{
+				URLs: []*TweetEntitiesURL{
+					{URL: "https://t.co/abc123", ExpandedURL: "https://youtu.be/abc123"},
+				},
+			},
+		}
+		assert.Equal(t,
+			`New video is up! https://youtu.be/abc123`,
+			stripTrailingLinks(&Conf{TrailingLinkPatterns: patterns}, tweet,
+				`New video is up! https://youtu.be/abc123`),
+		)
+	})
+
+	t.Run("StripsMediaShortlink", func(t *testing.T) {
+		tweet := &Tweet{
+			Entities: &TweetEntities{
+				Medias: []*TweetEntitiesMedia{
+					{Type: "photo", URL: "https://media1"},
+				},
+			},
+		}
+		assert.Equal(t,
+			`A tweet containing media`,
+			stripTrailingLinks(&Conf{}, tweet, `A tweet containing media https://t.co/YuY4wvg3uM`),
+		)
+
+		// Along with any configured patterns, including ones that are only
+		// exposed once the shortlink is gone.
+		assert.Equal(t,
+			`A tweet containing media`,
+			stripTrailingLinks(&Conf{TrailingLinkPatterns: patterns}, tweet,
+				`A tweet containing media https://t.co/YuY4wvg3uM`),
+		)
+		assert.Equal(t,
+			`New video is up!`,
+			stripTrailingLinks(&Conf{TrailingLinkPatterns: patterns}, tweet,
+				`New video is up! https://youtu.be/abc123 https://t.co/YuY4wvg3uM`),
+		)
+	})
+
+	t.Run("MediaShortlinkOnlyForMedia", func(t *testing.T) {
+		assert.Equal(t,
+			`Read this: https://t.co/YuY4wvg3uM`,
+			stripTrailingLinks(&Conf{}, &Tweet{}, `Read this: https://t.co/YuY4wvg3uM`),
+		)
+	})
+
+	t.Run("DefaultMediaShortlinkStillStripped", func(t *testing.T) {
+		tweet := &Tweet{
+			Text: `A tweet containing media https://t.co/YuY4wvg3uM`,
+			Entities: &TweetEntities{
+				Medias: []*TweetEntitiesMedia{
+					{Type: "photo", URL: "https://media1"},
+				},
+			},
+		}
+		assert.Equal(t, `A tweet containing media`, renderToot(&Conf{}, tweet))
+	})
+}
+
+func TestStripVariationSelectors(t *testing.T) {
+	assert.Equal(t, "Love \u2764 and \u263a", stripVariationSelectors("Love \u2764\ufe0f and \u263a\ufe0e"))
+	assert.Equal(t, "\u845b", stripVariationSelectors("\u845b\U000E0100"))
+}
+
+func TestSyncMedia(t *testing.T) {
+	contents := []byte("GIF89a fake image contents")
+	hash := fmt.Sprintf("%x", sha256.Sum256(contents))
+
+	server := serveMedia(t, contents)
+
+	tweet := &Tweet{
+		Entities: &TweetEntities{
+			Medias: []*TweetEntitiesMedia{
+				{ID: 1, Type: "photo", URL: server.URL + "/image.jpg"},
+			},
+		},
+	}
+
+	conf := &Conf{MediaReuseTTL: 12 * time.Hour}
+
+	t.Run("Uploads", func(t *testing.T) {
+		client := &fakeClient{}
+		state := &State{}
+
+		attachmentIDs, err := syncMedia(context.Background(), conf, client, state, tweet, t.TempDir())
+		assert.NoError(t, err)
+		assert.Equal(t, []mastodon.ID{"media-1"}, attachmentIDs)
+		assert.Len(t, client.uploadedMedia, 1)
+
+		// Upload is recorded in case it needs to be reused.
+		assert.Equal(t, "media-1", state.Media[hash].ID)
+	})
+
+	t.Run("UploadsWithAltText", func(t *testing.T) {
+		client := &fakeClient{}
+		tweet := &Tweet{
+			Entities: &TweetEntities{
+				Medias: []*TweetEntitiesMedia{
+					{ID: 1, Type: "photo", URL: server.URL + "/image.jpg", AltText: "A cat asleep in the sun"},
+				},
+			},
+		}
+
+		_, err := syncMedia(context.Background(), conf, client, &State{}, tweet, t.TempDir())
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"A cat asleep in the sun"}, client.uploadedDescriptions)
+	})
+
+	t.Run("SkipsDisallowedType", func(t *testing.T) {
+		logOutput := captureLogger(t)
+		client := &fakeClient{}
+
+		server := serveMedia(t, []byte("<html><body>Not an image</body></html>"))
+		tweet := &Tweet{
+			ID: 123,
+			Entities: &TweetEntities{
+				Medias: []*TweetEntitiesMedia{
+					{ID: 1, Type: "photo", URL: server.URL + "/image.jpg"},
+				},
+			},
+		}
+
+		attachmentIDs, err := syncMedia(context.Background(), conf, client, &State{}, tweet, t.TempDir())
+		assert.NoError(t, err)
+		assert.Empty(t, attachmentIDs)
+		assert.Len(t, client.uploadedMedia, 0)
+		assert.Contains(t, logOutput.String(), "Skipping media 1 from tweet 123: type text/html isn't allowed")
+	})
+
+	t.Run("SkipsTypeServerDoesNotSupport", func(t *testing.T) {
+		limits := defaultInstanceLimits
+		limits.SupportedMIMETypes = []string{"image/jpeg", "image/png"}
+
+		origLimits := instanceLimits
+		instanceLimits = &limits
+		t.Cleanup(func() { instanceLimits = origLimits })
+
+		logOutput := captureLogger(t)
+		client := &fakeClient{}
+
+		attachmentIDs, err := syncMedia(context.Background(), conf, client, &State{}, tweet, t.TempDir())
+		assert.NoError(t, err)
+		assert.Empty(t, attachmentIDs)
+		assert.Len(t, client.uploadedMedia, 0)
+		assert.Contains(t, logOutput.String(), "type image/gif isn't allowed")
+	})
+
+	t.Run("StrictMediaFailsOnDisallowedType", func(t *testing.T) {
+		client := &fakeClient{}
+
+		server := serveMedia(t, []byte("<html><body>Not an image</body></html>"))
+		tweet := &Tweet{
+			ID: 123,
+			Entities: &TweetEntities{
+				Medias: []*TweetEntitiesMedia{
+					{ID: 1, Type: "photo", URL: server.URL + "/image.jpg"},
+				},
+			},
+		}
+
+		_, err := syncMedia(context.Background(), &Conf{StrictMedia: true}, client, &State{}, tweet, t.TempDir())
+		assert.EqualError(t, err, "media 1 of tweet 123 has type text/html, which isn't allowed")
+		assert.Len(t, client.uploadedMedia, 0)
+	})
+
+	t.Run("FallsBackToURLVariant", func(t *testing.T) {
+		logOutput := captureLogger(t)
+		client := &fakeClient{}
+
+		var requestedPaths []string
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requestedPaths = append(requestedPaths, r.URL.Path)
+			if strings.HasSuffix(r.URL.Path, ":orig") {
+				w.WriteHeader(http.StatusRequestEntityTooLarge)
+				return
+			}
+			w.Write(contents)
+		}))
+		t.Cleanup(server.Close)
+
+		tweet := &Tweet{
+			ID: 123,
+			Entities: &TweetEntities{
+				Medias: []*TweetEntitiesMedia{
+					{ID: 1, Type: "photo", URL: server.URL + "/image.jpg:orig"},
+				},
+			},
+		}
+
+		conf := &Conf{MediaURLVariants: []string{"orig", "large"}, TwitterMediaHosts: []string{"127.0.0.1"}}
+
+		attachmentIDs, err := syncMedia(context.Background(), conf, client, &State{}, tweet, t.TempDir())
+		assert.NoError(t, err)
+		assert.Equal(t, []mastodon.ID{"media-1"}, attachmentIDs)
+		assert.Equal(t, []string{"/image.jpg:orig", "/image.jpg:large"}, requestedPaths)
+		assert.Contains(t, logOutput.String(), "Retrying media 1 from tweet 123 with '"+server.URL+"/image.jpg:large'")
+
+		// Without variants, the failure is final.
+		_, err = syncMedia(context.Background(), &Conf{}, client, &State{}, tweet, t.TempDir())
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "error fetching media 1 of tweet 123: unexpected status code")
+	})
+
+	t.Run("ReusesValidUpload", func(t *testing.T) {
+		client := &fakeClient{}
+		state := &State{Media: map[string]*StateMedia{
+			hash: {ID: "media-previous", UploadedAt: time.Now().Add(-1 * time.Hour)},
+		}}
+
+		attachmentIDs, err := syncMedia(context.Background(), conf, client, state, tweet, t.TempDir())
+		assert.NoError(t, err)
+		assert.Equal(t, []mastodon.ID{"media-previous"}, attachmentIDs)
+		assert.Len(t, client.uploadedMedia, 0)
+	})
+
+	t.Run("ReuploadsExpiredUpload", func(t *testing.T) {
+		client := &fakeClient{}
+		state := &State{Media: map[string]*StateMedia{
+			hash: {ID: "media-previous", UploadedAt: time.Now().Add(-24 * time.Hour)},
+		}}
+
+		attachmentIDs, err := syncMedia(context.Background(), conf, client, state, tweet, t.TempDir())
+		assert.NoError(t, err)
+		assert.Equal(t, []mastodon.ID{"media-1"}, attachmentIDs)
+		assert.Len(t, client.uploadedMedia, 1)
+		assert.Equal(t, "media-1", state.Media[hash].ID)
+	})
+}
+
+func TestSyncTweetAuthFailedMedia(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer server.Close()
+
+	tweet := &Tweet{
+		ID:   123,
+		Text: `A photo from a protected account`,
+		Entities: &TweetEntities{
+			Medias: []*TweetEntitiesMedia{
+				{ID: 1, Type: "photo", URL: server.URL + "/image1.jpg"},
+			},
+		},
+	}
+
+	t.Run("FailsByDefault", func(t *testing.T) {
+		client := &fakeClient{}
+
+		_, err := syncTweet(context.Background(), &Conf{}, client, &State{}, nil, nil, tweet, t.TempDir())
+		assert.EqualError(t, err, fmt.Sprintf("error syncing media: error fetching media 1 of tweet 123: "+
+			"'%s/image1.jpg' requires authentication to fetch (status code 401), probably because the account "+
+			"was protected; set SKIP_AUTH_FAILED_MEDIA to post tweets with such media as text only", server.URL))
+		assert.Empty(t, client.postedToots)
+	})
+
+	t.Run("PostsTextOnly", func(t *testing.T) {
+		client := &fakeClient{}
+		logOutput := captureLogger(t)
+
+		_, err := syncTweet(context.Background(), &Conf{SkipAuthFailedMedia: true}, client, &State{}, nil, nil, tweet,
+			t.TempDir())
+		assert.NoError(t, err)
+
+		assert.Len(t, client.postedToots, 1)
+		assert.Equal(t, "A photo from a protected account", client.postedToots[0].Status)
+		assert.Empty(t, client.postedToots[0].MediaIDs)
+		assert.Empty(t, client.uploadedMedia)
+		assert.Contains(t, logOutput.String(), "[WARN] Posting tweet 123 as text only because its media 1 "+
+			"requires authentication to fetch (status code 401), probably because the account was protected")
+	})
+}
+
+func TestSyncTweetHashtagVisibility(t *testing.T) {
+	conf := &Conf{
+		HashtagVisibility: ConfVisibilityMap{"private": "private", "public": "public"},
+		Visibility:        "unlisted",
+	}
+
+	t.Run("Private", func(t *testing.T) {
+		client := &fakeClient{}
+		tweet := &Tweet{ID: 1, Text: `Family dinner tonight #Private`}
+
+		_, err := syncTweet(context.Background(), conf, client, &State{}, nil, nil, tweet, "")
+		assert.NoError(t, err)
+		assert.Len(t, client.postedToots, 1)
+		assert.Equal(t, "private", client.postedToots[0].Visibility)
+		assert.Equal(t, "Family dinner tonight #Private", client.postedToots[0].Status)
+	})
+
+	t.Run("Default", func(t *testing.T) {
+		client := &fakeClient{}
+		tweet := &Tweet{ID: 2, Text: `Nothing to see here #privateer`}
+
+		_, err := syncTweet(context.Background(), conf, client, &State{}, nil, nil, tweet, "")
+		assert.NoError(t, err)
+		assert.Len(t, client.postedToots, 1)
+		assert.Equal(t, "unlisted", client.postedToots[0].Visibility)
+	})
+
+	t.Run("OverridesThreadReplyVisibility", func(t *testing.T) {
+		conf := *conf
+		conf.ThreadReplyVisibility = "unlisted"
+		conf.ThreadSelfReplies = true
+		conf.TwitterUser = "brandur"
+
+		state := &State{}
+		state.recordTweetStatus(1, "100", "private")
+
+		client := &fakeClient{}
+		tweet := &Tweet{ID: 3, Text: `And everyone should see this #public`,
+			Reply: &TweetReply{StatusID: 1, User: "brandur"}}
+
+		_, err := syncTweet(context.Background(), &conf, client, state, nil, nil, tweet, "")
+		assert.NoError(t, err)
+		assert.Len(t, client.postedToots, 1)
+		assert.Equal(t, "public", client.postedToots[0].Visibility)
+	})
+
+	t.Run("Strip", func(t *testing.T) {
+		conf := *conf
+		conf.HashtagVisibilityStrip = true
+
+		client := &fakeClient{}
+		tweet := &Tweet{ID: 1, Text: `Family dinner #private tonight #food`}
+
+		_, err := syncTweet(context.Background(), &conf, client, &State{}, nil, nil, tweet, "")
+		assert.NoError(t, err)
+		assert.Len(t, client.postedToots, 1)
+		assert.Equal(t, "private", client.postedToots[0].Visibility)
+		assert.Equal(t, "Family dinner tonight #food", client.postedToots[0].Status)
+
+		// Statuses posted before stripping was turned on still match.
+		status, _ := findMatchingStatus(&conf, []*mastodon.Status{
+			{ID: "100", Content: `<p>Family dinner #private tonight #food</p>`},
+		}, tweet)
+		assert.NotNil(t, status)
+
+		// Including those posted with other options that were already on.
+		conf.HashtagVisibility = ConfVisibilityMap{"familyonly": "private"}
+		conf.InlineAltText = true
+		photoTweet := &Tweet{ID: 2, Text: `Family dinner #familyonly tonight #food`, Entities: &TweetEntities{
+			Medias: []*TweetEntitiesMedia{
+				{ID: 1, Type: "photo", URL: "https://pbs.twimg.com/media/dinner.jpg", AltText: "A table set for six people"},
+			},
+		}}
+		status, _ = findMatchingStatus(&conf, []*mastodon.Status{
+			{ID: "100", Content: `<p>Family dinner #familyonly tonight #food</p><p>[image: A table set for six people]</p>`},
+		}, photoTweet)
+		assert.NotNil(t, status)
+	})
+}
+
+func TestSyncTweetNativeBoosts(t *testing.T) {
+	conf := &Conf{
+		HandleMappings: ConfMap{"Retweeted": "retweeted@mastodon.example.com"},
+		NativeBoosts:   true,
+	}
+
+	newClient := func() *fakeClient {
+		return &fakeClient{
+			accountStatuses: map[mastodon.ID][]*mastodon.Status{
+				"99": {
+					{ID: "201", Content: `<p>Something unrelated that was also posted to Mastodon.</p>`},
+					{ID: "202", Content: `<p>A long thought about databases that got truncated by Twitter when it was retweeted, but which is whole here.</p>`},
+				},
+			},
+			searchAccounts: []*mastodon.Account{
+				{ID: "99", Acct: "retweeted@mastodon.example.com"},
+			},
+		}
+	}
+
+	t.Run("BoostsMatchingToot", func(t *testing.T) {
+		client := newClient()
+
+		status, err := syncTweet(context.Background(), conf, client, &State{}, nil, nil, &Tweet{
+			ID:      123,
+			Text:    `RT @retweeted: A long thought about databases that got truncated by Twitter when it was…`,
+			Retweet: &TweetRetweet{StatusID: 456, User: "retweeted"},
+		}, "")
+		assert.NoError(t, err)
+		assert.Equal(t, mastodon.ID("reblog-202"), status.ID)
+
+		assert.Equal(t, []mastodon.ID{"202"}, client.reblogged)
+		assert.Len(t, client.postedToots, 0)
+	})
+
+	t.Run("FallsBackWithoutMatchingToot", func(t *testing.T) {
+		client := newClient()
+
+		_, err := syncTweet(context.Background(), conf, client, &State{}, nil, nil, &Tweet{
+			ID:      123,
+			Text:    `RT @retweeted: A thought that was never posted to Mastodon at all…`,
+			Retweet: &TweetRetweet{StatusID: 456, User: "retweeted"},
+		}, "")
+		assert.NoError(t, err)
+
+		assert.Len(t, client.reblogged, 0)
+		assert.Len(t, client.postedToots, 1)
+		assert.Equal(t,
+			`RT @retweeted: A thought that was never posted to Mastodon at all…
+
+https://twitter.com/retweeted/status/456`,
+			client.postedToots[0].Status,
+		)
+	})
+
+	t.Run("FallsBackForUnmappedUser", func(t *testing.T) {
+		client := newClient()
+
+		_, err := syncTweet(context.Background(), conf, client, &State{}, nil, nil, &Tweet{
+			ID:      123,
+			Text:    `RT @someone: A long thought about databases that got truncated by Twitter when it was…`,
+			Retweet: &TweetRetweet{StatusID: 456, User: "someone"},
+		}, "")
+		assert.NoError(t, err)
+
+		assert.Len(t, client.reblogged, 0)
+		assert.Len(t, client.postedToots, 1)
+	})
+
+	t.Run("NotLinkedFromBackfillSummary", func(t *testing.T) {
+		source := writeTweetData(t, `
+[[tweets]]
+id = 123
+text = "RT @retweeted: A long thought about databases that got truncated by Twitter when it was…"
+
+  [tweets.retweet]
+  status_id = 456
+  user = "retweeted"
+`)
+
+		conf := *conf
+		conf.MaxTweetsToSync = 10
+		conf.PostBackfillSummary = true
+
+		client := newClient()
+		logs := captureLogger(t)
+		assert.NoError(t, syncTwitter(context.Background(), &conf, client, source))
+		assert.Equal(t, []mastodon.ID{"202"}, client.reblogged)
+		assert.Len(t, client.postedToots, 0)
+		assert.Contains(t, logs.String(), "No new status to link to; skipping backfill summary")
+	})
+}
+
+func TestSyncTweetOverflowMediaNote(t *testing.T) {
+	server := serveMedia(t, []byte("GIF89a fake image contents"))
+
+	tweet := &Tweet{
+		ID:       123,
+		Text:     `A tweet with six photos`,
+		Entities: &TweetEntities{},
+	}
+	for i := 1; i <= 6; i++ {
+		tweet.Entities.Medias = append(tweet.Entities.Medias, &TweetEntitiesMedia{
+			ID: int64(i), Type: "photo", URL: fmt.Sprintf("%s/image%d.jpg", server.URL, i),
+		})
+	}
+
+	conf := &Conf{
+		OverflowMediaNote: "+{count} more images in the original: {url}",
+		TwitterUser:       "brandur",
+	}
+
+	client := &fakeClient{}
+	_, err := syncTweet(context.Background(), conf, client, &State{}, nil, nil, tweet, t.TempDir())
+	assert.NoError(t, err)
+
+	assert.Len(t, client.postedToots, 1)
+	assert.Equal(t, []mastodon.ID{"media-1", "media-2", "media-3", "media-4"}, client.postedToots[0].MediaIDs)
+	assert.Equal(t, "A tweet with six photos\n\n+2 more images in the original: https://twitter.com/brandur/status/123",
+		client.postedToots[0].Status)
+}
+
+func TestSyncTweetPartialMedia(t *testing.T) {
+	server := serveMedia(t, []byte("GIF89a fake image contents"))
+
+	tweet := &Tweet{
+		ID:   123,
+		Text: `A tweet with several photos`,
+		Entities: &TweetEntities{
+			Medias: []*TweetEntitiesMedia{
+				{ID: 1, Type: "photo", URL: server.URL + "/image1.jpg"},
+				{ID: 2, Type: "photo", URL: server.URL + "/image2.jpg"},
+				{ID: 3, Type: "photo", URL: server.URL + "/image3.jpg"},
+			},
+		},
+	}
+
+	newClient := func() *fakeClient {
+		return &fakeClient{
+			uploadMediaErr: func(file string) error {
+				if filepath.Base(file) == "image2.jpg" {
+					return fmt.Errorf("upload failed")
+				}
+				return nil
+			},
+		}
+	}
+
+	t.Run("FailsByDefault", func(t *testing.T) {
+		client := newClient()
+
+		_, err := syncTweet(context.Background(), &Conf{}, client, &State{}, nil, nil, tweet, t.TempDir())
+		assert.EqualError(t, err, "error syncing media: error uploading media 2 of tweet 123: upload failed")
+		assert.Len(t, client.postedToots, 0)
+	})
+
+	t.Run("PostsWithSuccessfulSubset", func(t *testing.T) {
+		client := newClient()
+		logOutput := captureLogger(t)
+
+		_, err := syncTweet(context.Background(), &Conf{PartialMediaOK: true}, client, &State{}, nil, nil, tweet, t.TempDir())
+		assert.NoError(t, err)
+
+		assert.Len(t, client.postedToots, 1)
+		assert.Equal(t, []mastodon.ID{"media-1", "media-2"}, client.postedToots[0].MediaIDs)
+		assert.Equal(t, []string{"image1.jpg", "image3.jpg"},
+			[]string{filepath.Base(client.uploadedMedia[0]), filepath.Base(client.uploadedMedia[1])})
+		assert.Contains(t, logOutput.String(),
+			"[WARN] Dropping media 2 from tweet 123: error uploading: upload failed")
+	})
+
+	t.Run("StrictMediaOverridesPartialMediaOK", func(t *testing.T) {
+		client := newClient()
+
+		_, err := syncTweet(context.Background(), &Conf{PartialMediaOK: true, StrictMedia: true}, client, &State{}, nil, nil, tweet, t.TempDir())
+		assert.EqualError(t, err, "error syncing media: error uploading media 2 of tweet 123: upload failed")
+		assert.Len(t, client.postedToots, 0)
+	})
+
+	t.Run("NilAttachment", func(t *testing.T) {
+		client := &fakeClient{uploadMediaNil: true}
+		logOutput := captureLogger(t)
+
+		_, err := syncTweet(context.Background(), &Conf{}, client, &State{}, nil, nil, tweet, t.TempDir())
+		assert.EqualError(t, err, "error syncing media: error uploading media 1 of tweet 123: server returned no attachment")
+
+		_, err = syncTweet(context.Background(), &Conf{PartialMediaOK: true}, client, &State{}, nil, nil, tweet, t.TempDir())
+		assert.NoError(t, err)
+
+		assert.Len(t, client.postedToots, 1)
+		assert.Empty(t, client.postedToots[0].MediaIDs)
+		assert.Contains(t, logOutput.String(),
+			"[WARN] Dropping media 1 from tweet 123: error uploading: server returned no attachment")
+	})
+}
+
+func TestSyncTweetPlaceholderForEmptyText(t *testing.T) {
+	server := serveMedia(t, []byte("GIF89a fake image contents"))
+
+	tweet := &Tweet{
+		ID:   123,
+		Text: "https://t.co/abc123",
+		Entities: &TweetEntities{
+			Medias: []*TweetEntitiesMedia{
+				{ID: 1, Type: "photo", URL: server.URL + "/image1.jpg"},
+			},
+		},
+	}
+
+	client := &fakeClient{}
+	_, err := syncTweet(context.Background(), &Conf{PlaceholderForEmptyText: "📷"}, client, &State{}, nil, nil, tweet, t.TempDir())
+	assert.NoError(t, err)
+
+	assert.Len(t, client.postedToots, 1)
+	assert.Equal(t, "📷", client.postedToots[0].Status)
+	assert.Equal(t, []mastodon.ID{"media-1"}, client.postedToots[0].MediaIDs)
+
+	// Tweets without media are left alone.
+	assert.Equal(t, " ", renderToot(&Conf{PlaceholderForEmptyText: "📷"}, &Tweet{Text: " "}))
+}
+
+func TestSyncTweetPoll(t *testing.T) {
+	conf := &Conf{
+		PollExpiresIn: 24 * time.Hour,
+		PollOptions:   []string{"Yes", "No"},
+		PollTrigger:   "thoughts?",
+	}
+
+	t.Run("AttachesPoll", func(t *testing.T) {
+		client := &fakeClient{}
+
+		_, err := syncTweet(context.Background(), conf, client, &State{}, nil, nil,
+			&Tweet{Text: `Tabs over spaces. Thoughts?`}, "")
+		assert.NoError(t, err)
+
+		assert.Len(t, client.postedToots, 1)
+		assert.Equal(t, []string{"Yes", "No"}, client.postedToots[0].Poll.Options)
+	})
+
+	t.Run("PostsPlainly", func(t *testing.T) {
+		client := &fakeClient{}
+
+		_, err := syncTweet(context.Background(), conf, client, &State{}, nil, nil,
+			&Tweet{Text: `Tabs over spaces.`}, "")
+		assert.NoError(t, err)
+
+		assert.Len(t, client.postedToots, 1)
+		assert.Nil(t, client.postedToots[0].Poll)
+	})
+}
+
+func TestSyncTweetQuoteSelfAsEdit(t *testing.T) {
+	conf := &Conf{QuoteSelfAsEdit: true, TwitterUser: "brandur"}
+
+	quote := &Tweet{
+		ID:    2,
+		Text:  `Correction: it was Postgres 15, not 14.`,
+		Quote: &TweetQuote{StatusID: 1, User: "brandur"},
+	}
+
+	newState := func() *State {
+		state := &State{}
+		state.recordTweetStatus(1, "100", "public")
+		return state
+	}
+
+	t.Run("EditsEarlierStatus", func(t *testing.T) {
+		client := &fakeClient{}
+		state := newState()
+
+		status, err := syncTweet(context.Background(), conf, client, state, nil, nil, quote, "")
+		assert.NoError(t, err)
+		assert.Equal(t, mastodon.ID("100"), status.ID)
+
+		assert.Len(t, client.postedToots, 0)
+		assert.Equal(t, "Correction: it was Postgres 15, not 14.", client.updatedToots["100"].Status)
+
+		edited, ok := state.tweetStatus(2)
+		assert.True(t, ok)
+		assert.Equal(t, "100", edited.StatusID)
+	})
+
+	t.Run("WithoutQuoteLinkBeforeAppendages", func(t *testing.T) {
+		conf := *conf
+		conf.RepliesNote = "(I don't check replies here)"
+
+		client := &fakeClient{}
+
+		_, err := syncTweet(context.Background(), &conf, client, newState(), nil, nil, quote, "")
+		assert.NoError(t, err)
+		assert.Equal(t, "Correction: it was Postgres 15, not 14.\n\n(I don't check replies here)",
+			client.updatedToots["100"].Status)
+	})
+
+	t.Run("FallsBackWithoutPriorStatus", func(t *testing.T) {
+		client := &fakeClient{}
+
+		_, err := syncTweet(context.Background(), conf, client, &State{}, nil, nil, quote, "")
+		assert.NoError(t, err)
+
+		assert.Len(t, client.updatedToots, 0)
+		assert.Len(t, client.postedToots, 1)
+		assert.Equal(t, "Correction: it was Postgres 15, not 14.\n\nhttps://twitter.com/brandur/status/1",
+			client.postedToots[0].Status)
+	})
+
+	t.Run("FallsBackWhenEditingUnsupported", func(t *testing.T) {
+		client := &fakeClient{updateStatusErr: &mastodon.APIError{StatusCode: 404}}
+
+		_, err := syncTweet(context.Background(), conf, client, newState(), nil, nil, quote, "")
+		assert.NoError(t, err)
+
+		assert.Len(t, client.postedToots, 1)
+	})
+}
+
+func TestSyncTweetRedactLogs(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer server.Close()
+
+	tweet := &Tweet{
+		ID:   123,
+		Text: `Some private plans for the weekend`,
+		Entities: &TweetEntities{
+			Medias: []*TweetEntitiesMedia{
+				{ID: 1, Type: "photo", URL: server.URL + "/private.jpg"},
+			},
+		},
+	}
+	conf := &Conf{LogSampleLength: 50, PartialMediaOK: true, RedactLogs: true}
+
+	client := &fakeClient{}
+	logOutput := captureLogger(t)
+
+	_, err := syncTweet(context.Background(), conf, client, &State{}, nil, nil, tweet, t.TempDir())
+	assert.NoError(t, err)
+	assert.Len(t, client.postedToots, 1)
+
+	assert.Contains(t, logOutput.String(), "Posted Mastodon status: 1 (<redacted, 34 characters>)")
+	assert.Contains(t, logOutput.String(), "Dropping media 1 from tweet 123: error fetching: "+
+		"unexpected status code fetching '"+logURL(conf, server.URL+"/private.jpg")+"': 404")
+	assert.NotContains(t, logOutput.String(), "private plans")
+	assert.NotContains(t, logOutput.String(), "private.jpg")
+
+	t.Run("OffByDefault", func(t *testing.T) {
+		conf := *conf
+		conf.RedactLogs = false
+
+		logOutput := captureLogger(t)
+
+		_, err := syncTweet(context.Background(), &conf, &fakeClient{}, &State{}, nil, nil, tweet, t.TempDir())
+		assert.NoError(t, err)
+		assert.Contains(t, logOutput.String(), "Posted Mastodon status: 1 (Some private plans for the weekend)")
+		assert.Contains(t, logOutput.String(), "private.jpg")
+	})
+
+	t.Run("RequestErrors", func(t *testing.T) {
+		// Nothing is listening here any more, so every request fails.
+		unreachable := httptest.NewServer(http.NotFoundHandler())
+		unreachable.Close()
+
+		origHTTPClient := httpClient
+		origAvailability, origAccounts, origHashes := quotedAvailability, webFingerAccounts, perceptualHashes
+		httpClient = &http.Client{Transport: rewriteHostTransport{host: strings.TrimPrefix(unreachable.URL, "http://")}}
+		quotedAvailability, webFingerAccounts, perceptualHashes =
+			newQuotedAvailabilityCache(), newWebFingerCache(), newPerceptualHashCache()
+		t.Cleanup(func() {
+			httpClient = origHTTPClient
+			quotedAvailability, webFingerAccounts, perceptualHashes = origAvailability, origAccounts, origHashes
+		})
+
+		logOutput := captureLogger(t)
+
+		err := fetchURL(conf, "https://private.example/private.jpg", filepath.Join(t.TempDir(), "private.jpg"), nil)
+		assert.Error(t, err)
+		var urlErr *url.Error
+		assert.True(t, errors.As(err, &urlErr))
+		assert.NotContains(t, err.Error(), "private")
+
+		_, err = fetchOGImageURL(context.Background(), conf, "https://private.example/plans")
+		assert.Error(t, err)
+		assert.NotContains(t, err.Error(), "private")
+
+		_, ok := perceptualHashes.hash(conf, "https://private.example/private.jpg")
+		assert.False(t, ok)
+		assert.True(t, quotedAvailability.isAvailable(conf, "https://twitter.com/private/status/123"))
+		_, ok = webFingerAccounts.resolve(conf, "private@private.example")
+		assert.False(t, ok)
+
+		assert.Contains(t, logOutput.String(), "Couldn't hash image '<redacted URL ")
+		assert.Contains(t, logOutput.String(), "Couldn't check whether quoted tweet '<redacted URL ")
+		assert.Contains(t, logOutput.String(), "Couldn't resolve fediverse address '<redacted URL ")
+		assert.NotContains(t, logOutput.String(), "private")
+	})
+}
+
+func TestSyncTweetThreads(t *testing.T) {
+	reply := &Tweet{
+		ID:    2,
+		Text:  `And a second thought to follow up on the first.`,
+		Reply: &TweetReply{StatusID: 1, User: "Brandur"},
+	}
+
+	newState := func() *State {
+		state := &State{}
+		state.recordTweetStatus(1, "100", "public")
+		return state
+	}
+
+	t.Run("InheritsRootVisibility", func(t *testing.T) {
+		client := &fakeClient{}
+		conf := &Conf{ThreadSelfReplies: true, TwitterUser: "brandur"}
+
+		_, err := syncTweet(context.Background(), conf, client, newState(), nil, nil, reply, "")
+		assert.NoError(t, err)
+
+		assert.Len(t, client.postedToots, 1)
+		assert.Equal(t, mastodon.ID("100"), client.postedToots[0].InReplyToID)
+		assert.Equal(t, "public", client.postedToots[0].Visibility)
+	})
+
+	t.Run("ConfiguredReplyVisibility", func(t *testing.T) {
+		client := &fakeClient{}
+		conf := &Conf{ThreadReplyVisibility: "unlisted", ThreadSelfReplies: true, TwitterUser: "brandur"}
+		state := newState()
+
+		_, err := syncTweet(context.Background(), conf, client, state, nil, nil, reply, "")
+		assert.NoError(t, err)
+
+		assert.Len(t, client.postedToots, 1)
+		assert.Equal(t, mastodon.ID("100"), client.postedToots[0].InReplyToID)
+		assert.Equal(t, "unlisted", client.postedToots[0].Visibility)
+
+		// Reply is recorded so that the thread can continue from it.
+		replyStatus, ok := state.tweetStatus(2)
+		assert.True(t, ok)
+		assert.Equal(t, "1", replyStatus.StatusID)
+	})
+
+	t.Run("UnsyncedParent", func(t *testing.T) {
+		client := &fakeClient{}
+		conf := &Conf{ThreadSelfReplies: true, TwitterUser: "brandur"}
+
+		_, err := syncTweet(context.Background(), conf, client, &State{}, nil, nil, reply, "")
+		assert.NoError(t, err)
+
+		assert.Len(t, client.postedToots, 1)
+		assert.Equal(t, mastodon.ID(""), client.postedToots[0].InReplyToID)
+	})
+}
+
+func TestSyncTweetUnrolledTweets(t *testing.T) {
+	server := serveMedia(t, []byte("GIF89a fake image contents"))
+
+	conf := &Conf{UnrolledTweets: ConfMap{"1": "I wrote this thread up properly: https://brandur.org/thread"}}
+
+	unrolled := &Tweet{
+		ID:   1,
+		Text: `The first part of a long thread about Postgres. 1/`,
+		Entities: &TweetEntities{Medias: []*TweetEntitiesMedia{
+			{ID: 10, Type: "photo", URL: server.URL + "/image.jpg"},
+		}},
+	}
+
+	client := &fakeClient{}
+	_, err := syncTweet(context.Background(), conf, client, &State{}, nil, nil, unrolled, t.TempDir())
+	assert.NoError(t, err)
+
+	assert.Len(t, client.postedToots, 1)
+	assert.Equal(t, "I wrote this thread up properly: https://brandur.org/thread", client.postedToots[0].Status)
+	assert.Empty(t, client.postedToots[0].MediaIDs)
+	assert.Empty(t, client.uploadedMedia)
+
+	t.Run("UnmappedPostsNormally", func(t *testing.T) {
+		client := &fakeClient{}
+		_, err := syncTweet(context.Background(), conf, client, &State{}, nil, nil,
+			&Tweet{ID: 2, Text: `An ordinary tweet.`}, t.TempDir())
+		assert.NoError(t, err)
+
+		assert.Len(t, client.postedToots, 1)
+		assert.Equal(t, "An ordinary tweet.", client.postedToots[0].Status)
+	})
+}
+
+func TestSyncTwitter(t *testing.T) {
+	source := writeTweetData(t, `
+[[tweets]]
+created_at = 2021-01-05T00:00:00Z
+id = 5
+text = "The fifth tweet, which is the newest and still needs syncing."
+
+[[tweets]]
+created_at = 2021-01-04T00:00:00Z
+id = 4
+text = "@someone The fourth tweet, which is a reply to another user."
+
+[tweets.reply]
+status_id = 100
+user = "someone"
+
+[[tweets]]
+created_at = 2021-01-03T00:00:00Z
+id = 3
+text = "The third tweet, which is the oldest one that still needs syncing."
+
+[[tweets]]
+created_at = 2021-01-02T00:00:00Z
+id = 2
+text = "The second tweet, which was synced to Mastodon on a previous run."
+
+[[tweets]]
+created_at = 2021-01-01T00:00:00Z
+id = 1
+text = "The first tweet, which is old enough to be before the minimum ID."
+`)
+
+	syncedStatuses := []*mastodon.Status{
+		{ID: "200", Content: `<p>The second tweet, which was synced to Mastodon on a previous run.</p>`},
+	}
+
+	conf := &Conf{MaxTweetsToSync: 10, MinTweetID: 2}
+
+	t.Run("SyncsOldestFirst", func(t *testing.T) {
+		client := &fakeClient{}
+
+		assert.NoError(t, syncTwitter(context.Background(), conf, client, source))
 
-	t.Run("BasicMatch", func(t *testing.T) {
-		status, distance := findMatchingStatus(
-			statuses,
-			&Tweet{Text: `A basic tweet that will match against the first few cases.`},
-		)
-		assert.Equal(t, status2, status)
-		assert.Equal(t, 0, distance)
+		assert.Len(t, client.postedToots, 3)
+		assert.Equal(t, "The second tweet, which was synced to Mastodon on a previous run.", client.postedToots[0].Status)
+		assert.Equal(t, "The third tweet, which is the oldest one that still needs syncing.", client.postedToots[1].Status)
+		assert.Equal(t, "The fifth tweet, which is the newest and still needs syncing.", client.postedToots[2].Status)
 	})
 
-	t.Run("FuzzyMatch", func(t *testing.T) {
-		status, distance := findMatchingStatus(
-			statuses,
-			&Tweet{Text: `A basic tweet that will match against the first few cases. (fuzzy)`},
-		)
-		assert.Equal(t, status2, status)
-		assert.Equal(t, 8, distance)
+	t.Run("StopsAtFirstMatch", func(t *testing.T) {
+		client := &fakeClient{statuses: syncedStatuses}
+
+		assert.NoError(t, syncTwitter(context.Background(), conf, client, source))
+
+		assert.Len(t, client.postedToots, 2)
+		assert.Equal(t, "The third tweet, which is the oldest one that still needs syncing.", client.postedToots[0].Status)
+		assert.Equal(t, "The fifth tweet, which is the newest and still needs syncing.", client.postedToots[1].Status)
 	})
 
-	t.Run("NoMatchTooFuzzy", func(t *testing.T) {
-		status, distance := findMatchingStatus(
-			statuses,
-			&Tweet{Text: `A basic tweet that will match against the first few cases. (fuzzy, but overly slow)`},
-		)
-		assert.Nil(t, status)
-		assert.Equal(t, 0, distance)
+	t.Run("StopsAtTweetInState", func(t *testing.T) {
+		conf := *conf
+		conf.DetectEditedStatuses = true
+		conf.StateFile = filepath.Join(t.TempDir(), "state.toml")
+
+		state := &State{}
+		state.recordTweetStatus(3, "300", "public")
+		assert.NoError(t, state.save(conf.StateFile))
+
+		// The status for tweet 3 was edited, so it no longer matches.
+		createdAt := time.Date(2021, 1, 3, 0, 0, 0, 0, time.UTC)
+		client := &fakeClient{statuses: []*mastodon.Status{
+			{ID: "300", Content: `<p>The third tweet, which I've since edited.</p>`,
+				CreatedAt: createdAt, EditedAt: createdAt.Add(time.Hour)},
+			syncedStatuses[0],
+		}}
+
+		logs := captureLogger(t)
+		assert.NoError(t, syncTwitter(context.Background(), &conf, client, source))
+
+		assert.Len(t, client.postedToots, 1)
+		assert.Equal(t, "The fifth tweet, which is the newest and still needs syncing.", client.postedToots[0].Status)
+		assert.Contains(t, logs.String(), "Tweet 3 was already posted as Mastodon status 300 according to state")
+		assert.Contains(t, logs.String(),
+			"Mastodon status 300 for tweet 3 was edited at 2021-01-03T01:00:00Z after it was posted; leaving it alone")
 	})
 
-	t.Run("TransformedMatch", func(t *testing.T) {
-		status, distance := findMatchingStatus(
-			statuses,
-			&Tweet{
-				Text: `A tweet with Mastodon/Twitter different: https://short`,
-				Entities: &TweetEntities{
-					URLs: []*TweetEntitiesURL{
-						{URL: "https://short", ExpandedURL: "https://this-should-be-a-pretty-long-link.example.com"},
-					},
-				},
-			},
-		)
-		assert.Equal(t, status3, status)
-		assert.Equal(t, 0, distance)
+	t.Run("DryRun", func(t *testing.T) {
+		client := &fakeClient{statuses: syncedStatuses}
+
+		conf := *conf
+		conf.DryRun = true
+
+		assert.NoError(t, syncTwitter(context.Background(), &conf, client, source))
+
+		assert.Len(t, client.postedToots, 0)
 	})
 
-	// Simulates a posting before a new version into effect. We should still
-	// find a match by falling back to the old version.
-	t.Run("TransformedMatchOldVersion", func(t *testing.T) {
-		status, distance := findMatchingStatus(
-			statuses,
-			&Tweet{
-				Text: `A tweet with Mastodon/Twitter different: https://short`,
-				Entities: &TweetEntities{
-					URLs: []*TweetEntitiesURL{
-						{URL: "https://short", ExpandedURL: "https://this-should-be-a-pretty-long-link.example.com"},
-					},
-				},
-			},
-		)
-		assert.Equal(t, status3, status)
-		assert.Equal(t, 0, distance)
+	t.Run("RequiresConfirmationOnEmptyAccount", func(t *testing.T) {
+		conf := *conf
+		conf.EmptyAccountSyncThreshold = 2
+		conf.RequireConfirmationOnEmptyAccount = true
+
+		client := &fakeClient{}
+		assert.EqualError(t, syncTwitter(context.Background(), &conf, client, source),
+			"account has no existing statuses, but 3 tweet(s) would be synced to it; "+
+				"check that the access token is for the right account and re-run with -yes to proceed")
+		assert.Len(t, client.postedToots, 0)
+
+		conf.Yes = true
+
+		client = &fakeClient{}
+		assert.NoError(t, syncTwitter(context.Background(), &conf, client, source))
+		assert.Len(t, client.postedToots, 3)
+	})
+
+	t.Run("CatchUpOnly", func(t *testing.T) {
+		conf := *conf
+		conf.CatchUpOnly = true
+
+		// The newest status doesn't match any tweet, so its creation time is
+		// used as the floor and only the fifth tweet is newer.
+		client := &fakeClient{statuses: []*mastodon.Status{
+			{ID: "300", CreatedAt: time.Date(2021, 1, 4, 12, 0, 0, 0, time.UTC), Content: `<p>Something posted directly to Mastodon.</p>`},
+		}}
+		assert.NoError(t, syncTwitter(context.Background(), &conf, client, source))
+		assert.Len(t, client.postedToots, 1)
+		assert.Equal(t, "The fifth tweet, which is the newest and still needs syncing.", client.postedToots[0].Status)
+
+		assert.EqualError(t, syncTwitter(context.Background(), &conf, &fakeClient{}, source),
+			"catch-up only mode can't find a floor for an account with no existing statuses; "+
+				"check that the access token is for the right account and re-run with -yes to sync everything")
+	})
+
+	t.Run("Attribution", func(t *testing.T) {
+		client := &fakeClient{statuses: syncedStatuses}
+
+		conf := *conf
+		conf.Attribution = true
+		conf.AttributionHandle = "@someone"
+
+		assert.NoError(t, syncTwitter(context.Background(), &conf, client, source))
+
+		assert.Len(t, client.postedToots, 2)
+		assert.Equal(t, "The third tweet, which is the oldest one that still needs syncing.\n\n— @\u200bsomeone",
+			client.postedToots[0].Status)
+	})
+
+	t.Run("IntroToot", func(t *testing.T) {
+		conf := *conf
+		conf.IntroToot = "Mirroring my tweets here"
+		conf.StateFile = filepath.Join(t.TempDir(), "state.toml")
+
+		// Both runs see an account without statuses, so only state keeps the
+		// intro from being posted again.
+		var posted []string
+		for i := 0; i < 2; i++ {
+			client := &fakeClient{}
+			assert.NoError(t, syncTwitter(context.Background(), &conf, client, source))
+			for _, toot := range client.postedToots {
+				posted = append(posted, toot.Status)
+			}
+		}
+
+		assert.Equal(t, "Mirroring my tweets here", posted[0])
+
+		var numIntros int
+		for _, status := range posted {
+			if status == "Mirroring my tweets here" {
+				numIntros++
+			}
+		}
+		assert.Equal(t, 1, numIntros)
+
+		// Not posted to an account that already has statuses.
+		client := &fakeClient{statuses: syncedStatuses}
+		conf.StateFile = ""
+		assert.NoError(t, syncTwitter(context.Background(), &conf, client, source))
+		assert.NotContains(t, client.postedToots[0].Status, "Mirroring")
+	})
+
+	t.Run("MaxTweetsToSync", func(t *testing.T) {
+		client := &fakeClient{statuses: syncedStatuses}
+
+		conf := *conf
+		conf.MaxTweetsToSync = 1
+
+		assert.NoError(t, syncTwitter(context.Background(), &conf, client, source))
+
+		assert.Len(t, client.postedToots, 1)
+		assert.Equal(t, "The third tweet, which is the oldest one that still needs syncing.", client.postedToots[0].Status)
+	})
+
+	t.Run("MaxRunDuration", func(t *testing.T) {
+		conf := *conf
+		conf.LastRunFile = filepath.Join(t.TempDir(), "last_run")
+		conf.MaxRunDuration = 50 * time.Millisecond
+
+		client := &fakeClient{postStatusDelay: 100 * time.Millisecond, statuses: syncedStatuses}
+		logs := captureLogger(t)
+
+		assert.NoError(t, syncTwitter(context.Background(), &conf, client, source))
+		assert.Len(t, client.postedToots, 1)
+		assert.Equal(t, "The third tweet, which is the oldest one that still needs syncing.", client.postedToots[0].Status)
+		assert.Contains(t, logs.String(), "Hit maximum run duration (50ms) after syncing 1 tweet(s)")
+
+		// The next run resumes from where this one stopped.
+		lastRun, err := readLastRun(conf.LastRunFile)
+		assert.NoError(t, err)
+		assert.Equal(t, time.Date(2021, 1, 3, 0, 0, 0, 0, time.UTC), lastRun)
+
+		t.Run("FinishesThread", func(t *testing.T) {
+			source := writeTweetData(t, `
+[[tweets]]
+created_at = 2021-01-03T00:00:00Z
+id = 3
+text = "An unrelated tweet that has to wait for the next run."
+
+[[tweets]]
+created_at = 2021-01-02T00:00:00Z
+id = 2
+text = "The second part of a thread."
+
+[tweets.reply]
+status_id = 1
+user = "brandur"
+
+[[tweets]]
+created_at = 2021-01-01T00:00:00Z
+id = 1
+text = "The first part of a thread."
+`)
+
+			conf := conf
+			conf.LastRunFile = ""
+			conf.MinTweetID = 0
+			conf.ThreadSelfReplies = true
+			conf.TwitterUser = "brandur"
+
+			client := &fakeClient{postStatusDelay: 100 * time.Millisecond}
+			assert.NoError(t, syncTwitter(context.Background(), &conf, client, source))
+			assert.Len(t, client.postedToots, 2)
+			assert.Equal(t, "The first part of a thread.", client.postedToots[0].Status)
+			assert.Equal(t, "The second part of a thread.", client.postedToots[1].Status)
+			assert.Equal(t, mastodon.ID("1"), client.postedToots[1].InReplyToID)
+		})
+	})
+
+	t.Run("MaxTweetFailures", func(t *testing.T) {
+		conf := *conf
+		conf.MaxTweetFailures = 2
+		conf.StateFile = filepath.Join(t.TempDir(), "state.toml")
+
+		failingClient := func() *fakeClient {
+			return &fakeClient{
+				postStatusErrs: []error{fmt.Errorf("content rejected")},
+				statuses:       syncedStatuses,
+			}
+		}
+
+		// The first failure stops the run like usual.
+		client := failingClient()
+		err := syncTwitter(context.Background(), &conf, client, source)
+		assert.EqualError(t, err, "error syncing tweet: error posting status: content rejected")
+		assert.Empty(t, client.postedToots)
+
+		// The second reaches the threshold, so the tweet is skipped and the
+		// run carries on.
+		client = failingClient()
+		assert.NoError(t, syncTwitter(context.Background(), &conf, client, source))
+		assert.Len(t, client.postedToots, 1)
+		assert.Equal(t, "The fifth tweet, which is the newest and still needs syncing.", client.postedToots[0].Status)
+
+		// Later runs don't try it again, and the tweet after it is known to
+		// have been posted from state.
+		client = &fakeClient{statuses: syncedStatuses}
+		assert.NoError(t, syncTwitter(context.Background(), &conf, client, source))
+		assert.Empty(t, client.postedToots)
+
+		state, err := loadState(conf.StateFile, false)
+		assert.NoError(t, err)
+		failure, ok := state.tweetSkipped(3)
+		assert.True(t, ok)
+		assert.Equal(t, 2, failure.Count)
+		assert.Contains(t, failure.Reason, "content rejected")
+	})
+
+	t.Run("MinRunInterval", func(t *testing.T) {
+		conf := *conf
+		conf.MinRunInterval = 1 * time.Hour
+		conf.RunLockFile = filepath.Join(t.TempDir(), "run")
+
+		assert.NoError(t, syncTwitter(context.Background(), &conf, &fakeClient{statuses: syncedStatuses}, source))
+
+		// A second run straight after the first is refused without syncing
+		// anything.
+		client := &fakeClient{}
+		err := syncTwitter(context.Background(), &conf, client, source)
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "less than the minimum run interval of 1h0m0s ago")
+		assert.Empty(t, client.postedToots)
+
+		// Unless forced.
+		conf.Force = true
+		assert.NoError(t, syncTwitter(context.Background(), &conf, &fakeClient{statuses: syncedStatuses}, source))
+		assert.NoFileExists(t, conf.RunLockFile+".lock")
+	})
+
+	t.Run("SyncNotAfter", func(t *testing.T) {
+		conf := *conf
+		assert.NoError(t, conf.SyncNotAfter.Decode("2021-01-04T12:00:00Z"))
+
+		client := &fakeClient{statuses: syncedStatuses}
+		assert.NoError(t, syncTwitter(context.Background(), &conf, client, source))
+
+		// The fifth tweet is too recent.
+		assert.Len(t, client.postedToots, 1)
+		assert.Equal(t, "The third tweet, which is the oldest one that still needs syncing.", client.postedToots[0].Status)
+	})
+
+	t.Run("ScheduleSpacing", func(t *testing.T) {
+		conf := *conf
+		conf.MaxTweetsToSync = 1
+		conf.ScheduleSpacing = 2 * time.Hour
+		conf.ScheduleStart = time.Now().Add(24 * time.Hour).UTC().Truncate(time.Second)
+		conf.StateFile = filepath.Join(t.TempDir(), "state.toml")
+
+		client := &fakeClient{statuses: syncedStatuses}
+		assert.NoError(t, syncTwitter(context.Background(), &conf, client, source))
+		assert.Len(t, client.postedToots, 1)
+		assert.Equal(t, conf.ScheduleStart, *client.postedToots[0].ScheduledAt)
+
+		// A second run schedules after the status scheduled by the first
+		// rather than at the same time.
+		client = &fakeClient{statuses: syncedStatuses}
+		assert.NoError(t, syncTwitter(context.Background(), &conf, client, source))
+		assert.Len(t, client.postedToots, 1)
+		assert.Equal(t, "The fifth tweet, which is the newest and still needs syncing.", client.postedToots[0].Status)
+		assert.Equal(t, conf.ScheduleStart.Add(2*time.Hour), *client.postedToots[0].ScheduledAt)
+	})
+
+	t.Run("ScheduleSpacingLimit", func(t *testing.T) {
+		conf := *conf
+		conf.ScheduleSpacing = 2 * time.Hour
+		conf.StateFile = filepath.Join(t.TempDir(), "state.toml")
+
+		// As many statuses as Mastodon allows are already scheduled.
+		state := &State{}
+		for i := 0; i < maxScheduledStatuses; i++ {
+			state.recordTweetScheduledStatus(int64(1000+i), mastodon.ID(fmt.Sprintf("%d", 1000+i)), "public",
+				time.Now().Add(time.Duration(i+1)*time.Hour))
+		}
+		assert.NoError(t, state.save(conf.StateFile))
+
+		client := &fakeClient{statuses: syncedStatuses}
+		logs := captureLogger(t)
+
+		assert.NoError(t, syncTwitter(context.Background(), &conf, client, source))
+		assert.Empty(t, client.postedToots)
+		assert.Contains(t, logs.String(), "Hit Mastodon's limit of 300 scheduled statuses after syncing 0 tweet(s)")
 	})
 }
 
@@ -107,6 +2277,65 @@ https://t.co/EF80vm1hEU`,
 	)
 }
 
+func TestTweetSpoilerText(t *testing.T) {
+	conf := &Conf{
+		DefaultSpoiler:  "Archived tweet",
+		HashtagSpoilers: ConfMap{"politics": "Politics"},
+	}
+	empty := ""
+	custom := "Spoilers for the finale"
+
+	t.Run("Default", func(t *testing.T) {
+		assert.Equal(t, "Archived tweet", tweetSpoilerText(conf, &Tweet{Text: "A nice walk"}))
+	})
+
+	t.Run("NoneByDefault", func(t *testing.T) {
+		assert.Equal(t, "", tweetSpoilerText(&Conf{}, &Tweet{Text: "A nice walk"}))
+	})
+
+	t.Run("PerTweetClears", func(t *testing.T) {
+		assert.Equal(t, "", tweetSpoilerText(conf, &Tweet{Text: "A nice walk", Spoiler: &empty}))
+	})
+
+	t.Run("HashtagOverridesDefault", func(t *testing.T) {
+		assert.Equal(t, "Politics", tweetSpoilerText(conf, &Tweet{Text: "Go vote #Politics"}))
+	})
+
+	t.Run("PerTweetOverridesHashtag", func(t *testing.T) {
+		assert.Equal(t, custom, tweetSpoilerText(conf, &Tweet{Text: "What an ending #politics", Spoiler: &custom}))
+	})
+
+	t.Run("WithEngagement", func(t *testing.T) {
+		conf := *conf
+		conf.EngagementTemplate = []string{"{favorites} likes"}
+		conf.IncludeEngagement = EngagementSpoiler
+		assert.Equal(t, "Archived tweet · 3 likes",
+			tweetSpoilerText(&conf, &Tweet{Text: "A nice walk", FavoriteCount: 3}))
+		assert.Equal(t, "3 likes",
+			tweetSpoilerText(&conf, &Tweet{Text: "A nice walk", FavoriteCount: 3, Spoiler: &empty}))
+	})
+
+	t.Run("Syncs", func(t *testing.T) {
+		source := writeTweetData(t, `
+[[tweets]]
+id = 2
+text = "Nothing to hide here"
+spoiler = ""
+
+[[tweets]]
+id = 1
+text = "An old tweet"
+`)
+
+		client := &fakeClient{}
+		assert.NoError(t, syncTwitter(context.Background(), &Conf{DefaultSpoiler: "Archived tweet", MaxTweetsToSync: 10},
+			client, source))
+		assert.Len(t, client.postedToots, 2)
+		assert.Equal(t, "Archived tweet", client.postedToots[0].SpoilerText)
+		assert.Equal(t, "", client.postedToots[1].SpoilerText)
+	})
+}
+
 func TestTweetToTootV1(t *testing.T) {
 	t.Run("NoOps", func(t *testing.T) {
 		tweet := &Tweet{
@@ -187,3 +2416,341 @@ https://twitter.com/user/status/1234567890`,
 		)
 	})
 }
+
+func TestTweetToTootV3(t *testing.T) {
+	t.Run("NoOpForBasicTweet", func(t *testing.T) {
+		tweet := &Tweet{
+			Text: `A tweet containing nothing interesting`,
+		}
+		assert.Equal(t,
+			`A tweet containing nothing interesting`,
+			tweetToTootV3(tweet),
+		)
+	})
+
+	t.Run("QuoteMovesLinkToEnd", func(t *testing.T) {
+		tweet := &Tweet{
+			Text: `Worth a read https://t.co/abc123 for anyone running Postgres`,
+			Entities: &TweetEntities{
+				URLs: []*TweetEntitiesURL{
+					{URL: "https://t.co/abc123", ExpandedURL: "https://twitter.com/user/status/1234567890"},
+				},
+			},
+			Quote: &TweetQuote{StatusID: 1234567890, User: "user"},
+		}
+		assert.Equal(t,
+			"Worth a read for anyone running Postgres\n\nhttps://twitter.com/user/status/1234567890",
+			tweetToTootV3(tweet),
+		)
+	})
+
+	t.Run("QuoteAndRetweetAppendOneLink", func(t *testing.T) {
+		tweet := &Tweet{
+			Text: `Worth a read https://t.co/abc123`,
+			Entities: &TweetEntities{
+				URLs: []*TweetEntitiesURL{
+					{URL: "https://t.co/abc123", ExpandedURL: "https://twitter.com/user/status/1234567890?s=20"},
+				},
+			},
+			Quote:   &TweetQuote{StatusID: 1234567890, User: "user"},
+			Retweet: &TweetRetweet{StatusID: 1234567890, User: "user"},
+		}
+		assert.Equal(t,
+			"Worth a read\n\nhttps://twitter.com/user/status/1234567890",
+			tweetToTootV3(tweet),
+		)
+	})
+
+	t.Run("QuoteWithoutCommentary", func(t *testing.T) {
+		tweet := &Tweet{
+			Quote: &TweetQuote{StatusID: 1234567890, User: "user"},
+		}
+		assert.Equal(t,
+			"https://twitter.com/user/status/1234567890",
+			tweetToTootV3(tweet),
+		)
+	})
+}
+
+func TestWeightedLength(t *testing.T) {
+	t.Run("PlainText", func(t *testing.T) {
+		assert.Equal(t, 11, weightedLength(`Hello world`, 23))
+	})
+
+	t.Run("CountsRunes", func(t *testing.T) {
+		assert.Equal(t, 7, weightedLength(`Hello 🌍`, 23))
+	})
+
+	t.Run("URLsCountAsFixedWeight", func(t *testing.T) {
+		assert.Equal(t, 6+23, weightedLength(`Link: https://example.com/a/very/long/path/that/goes/on/and/on`, 23))
+		assert.Equal(t, 6+23, weightedLength(`Link: http://a.co`, 23))
+		assert.Equal(t, 6+10+5+10, weightedLength(`Link: https://a.co and https://b.co`, 10))
+	})
+
+	t.Run("RemoteMentionsCountLocalPart", func(t *testing.T) {
+		assert.Equal(t, len(`Hi @user!`), weightedLength(`Hi @user@example.com!`, 23))
+		assert.Equal(t, len(`@user hi`), weightedLength(`@user@mastodon.social hi`, 23))
+	})
+
+	t.Run("LocalMentionsUnchanged", func(t *testing.T) {
+		assert.Equal(t, len(`Hi @user`), weightedLength(`Hi @user`, 23))
+	})
+
+	t.Run("EmailAddressesUnchanged", func(t *testing.T) {
+		assert.Equal(t, len(`Mail me@example.com`), weightedLength(`Mail me@example.com`, 23))
+	})
+}
+
+func TestWriteMatchReport(t *testing.T) {
+	statuses := []*mastodon.Status{
+		{ID: "1", Content: `<p>A tweet that has already been synced to Mastodon.</p>`},
+		{ID: "2", Content: `<p>Another tweet that was synced to Mastodon earlier.</p>`},
+	}
+
+	tweets := []*Tweet{
+		{ID: 3, Text: `A brand new tweet that hasn't been synced anywhere.`},
+		{ID: 2, Text: `A tweet that has already been synced to Mastodon.`},
+		{ID: 1, Text: `Another tweet that was synced to Mastodon earlier.`},
+	}
+
+	var buf bytes.Buffer
+	writeMatchReport(&buf, &Conf{}, statuses, tweets)
+
+	assert.Equal(t, `NEW   3
+MATCH 2 status 1 (distance: 0)
+MATCH 1 status 2 (distance: 0)
+3 candidate(s), 2 matched, 1 new
+`, buf.String())
+}
+
+func TestWriteStatusDump(t *testing.T) {
+	var buf bytes.Buffer
+	writeStatusDump(&buf, []*mastodon.Status{
+		{
+			ID:      "1",
+			Content: `<p>Tabs &amp; spaces</p><p>A second paragraph</p>`,
+			URL:     "https://mastodon.example.com/@user/1",
+		},
+	})
+
+	assert.Equal(t, `Status 1 (https://mastodon.example.com/@user/1)
+  Raw:        "<p>Tabs &amp; spaces</p><p>A second paragraph</p>"
+  Normalized: "Tabs & spaces\n\nA second paragraph"
+`, buf.String())
+}
+
+//
+// Helpers
+//
+
+// fakeClient is a fake implementation of mastodonClient that records the
+// toots posted to it.
+type fakeClient struct {
+	account              *mastodon.Account
+	accountFetches       int
+	accountStatuses      map[mastodon.ID][]*mastodon.Status
+	favourited           []mastodon.ID
+	idempotencyKeys      []string
+	instance             *mastodon.Instance
+	mediaPolls           []mastodon.ID
+	mediaProcessing      map[mastodon.ID]int
+	mediaRejections      int
+	postStatusDelay      time.Duration
+	postStatusErrs       []error
+	postedToots          []*mastodon.Toot
+	reblogged            []mastodon.ID
+	searchAccounts       []*mastodon.Account
+	statusPages          [][]*mastodon.Status
+	statuses             []*mastodon.Status
+	updateStatusErr      error
+	updatedMedia         map[mastodon.ID]map[mastodon.ID]string
+	updatedToots         map[mastodon.ID]*mastodon.Toot
+	uploadMediaErr       func(file string) error
+	uploadMediaNil       bool
+	uploadedDescriptions []string
+	uploadedMedia        []string
+}
+
+func (c *fakeClient) AccountsSearch(ctx context.Context, q string, limit int64) ([]*mastodon.Account, error) {
+	var accounts []*mastodon.Account
+	for _, account := range c.searchAccounts {
+		if account.Acct == q {
+			accounts = append(accounts, account)
+		}
+	}
+	return accounts, nil
+}
+
+func (c *fakeClient) Favourite(ctx context.Context, id mastodon.ID) (*mastodon.Status, error) {
+	c.favourited = append(c.favourited, id)
+	return &mastodon.Status{ID: id, Favourited: true}, nil
+}
+
+func (c *fakeClient) GetAccountCurrentUser(ctx context.Context) (*mastodon.Account, error) {
+	c.accountFetches++
+	if c.account == nil {
+		return &mastodon.Account{ID: "1"}, nil
+	}
+	return c.account, nil
+}
+
+func (c *fakeClient) GetAccountStatuses(ctx context.Context, id mastodon.ID, pg *mastodon.Pagination) ([]*mastodon.Status, error) {
+	if statuses, ok := c.accountStatuses[id]; ok {
+		return statuses, nil
+	}
+
+	// Pages are handed out using the index of the next one as a max ID.
+	if c.statusPages != nil {
+		var i int
+		if pg != nil && pg.MaxID != "" {
+			i, _ = strconv.Atoi(string(pg.MaxID))
+		}
+
+		if pg != nil {
+			pg.MaxID = ""
+			if i+1 < len(c.statusPages) {
+				pg.MaxID = mastodon.ID(strconv.Itoa(i + 1))
+			}
+		}
+
+		return c.statusPages[i], nil
+	}
+
+	return c.statuses, nil
+}
+
+func (c *fakeClient) GetInstance(ctx context.Context) (*mastodon.Instance, error) {
+	if c.instance == nil {
+		return &mastodon.Instance{}, nil
+	}
+	return c.instance, nil
+}
+
+// GetMediaProcessed reports media as processed once it's been polled the
+// number of times given for it in mediaProcessing.
+func (c *fakeClient) GetMediaProcessed(ctx context.Context, id mastodon.ID) (bool, error) {
+	c.mediaPolls = append(c.mediaPolls, id)
+
+	if c.mediaProcessing[id] > 0 {
+		c.mediaProcessing[id]--
+	}
+	return c.mediaProcessing[id] < 1, nil
+}
+
+func (c *fakeClient) GetStatusSource(ctx context.Context, id mastodon.ID) (*mastodon.Source, error) {
+	return &mastodon.Source{ID: id, Text: "source of " + string(id)}, nil
+}
+
+func (c *fakeClient) PostStatus(ctx context.Context, toot *mastodon.Toot) (*mastodon.Status, error) {
+	time.Sleep(c.postStatusDelay)
+
+	if len(c.postStatusErrs) > 0 {
+		err := c.postStatusErrs[0]
+		c.postStatusErrs = c.postStatusErrs[1:]
+		return nil, err
+	}
+
+	// Like Mastodon, refuse to attach media that's still processing.
+	for _, mediaID := range toot.MediaIDs {
+		if c.mediaProcessing[mediaID] > 0 {
+			c.mediaRejections++
+			return nil, &mastodon.APIError{Message: "Cannot attach files that have not finished processing", StatusCode: 422}
+		}
+	}
+
+	c.postedToots = append(c.postedToots, toot)
+	if key, ok := ctx.Value(idempotencyKeyContextKey{}).(string); ok {
+		c.idempotencyKeys = append(c.idempotencyKeys, key)
+	}
+
+	id := mastodon.ID(fmt.Sprintf("%d", len(c.postedToots)))
+	return &mastodon.Status{
+		ID:  id,
+		URL: fmt.Sprintf("https://mastodon.example.com/@user/%s", id),
+	}, nil
+}
+
+func (c *fakeClient) Reblog(ctx context.Context, id mastodon.ID) (*mastodon.Status, error) {
+	c.reblogged = append(c.reblogged, id)
+	return &mastodon.Status{ID: "reblog-" + id, Reblog: &mastodon.Status{ID: id}}, nil
+}
+
+func (c *fakeClient) UpdateStatus(ctx context.Context, toot *mastodon.Toot, id mastodon.ID) (*mastodon.Status, error) {
+	if c.updateStatusErr != nil {
+		return nil, c.updateStatusErr
+	}
+
+	if c.updatedToots == nil {
+		c.updatedToots = make(map[mastodon.ID]*mastodon.Toot)
+	}
+	c.updatedToots[id] = toot
+
+	return &mastodon.Status{ID: id}, nil
+}
+
+func (c *fakeClient) UpdateStatusMedia(ctx context.Context, toot *mastodon.Toot, id mastodon.ID,
+	descriptions map[mastodon.ID]string) (*mastodon.Status, error) {
+	status, err := c.UpdateStatus(ctx, toot, id)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.updatedMedia == nil {
+		c.updatedMedia = make(map[mastodon.ID]map[mastodon.ID]string)
+	}
+	c.updatedMedia[id] = descriptions
+
+	return status, nil
+}
+
+func (c *fakeClient) UploadMediaFromMedia(ctx context.Context, media *mastodon.Media) (*mastodon.Attachment, error) {
+	var file string
+	if f, ok := media.File.(*os.File); ok {
+		file = f.Name()
+	}
+
+	if c.uploadMediaErr != nil {
+		if err := c.uploadMediaErr(file); err != nil {
+			return nil, err
+		}
+	}
+
+	if c.uploadMediaNil {
+		return nil, nil
+	}
+
+	c.uploadedDescriptions = append(c.uploadedDescriptions, media.Description)
+	c.uploadedMedia = append(c.uploadedMedia, file)
+	return &mastodon.Attachment{ID: mastodon.ID(fmt.Sprintf("media-%d", len(c.uploadedMedia)))}, nil
+}
+
+// serveMedia starts a test server that serves the given media contents at any
+// path. It's closed when the test finishes.
+func serveMedia(t *testing.T, contents []byte) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(contents)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// captureLogger swaps out the package-level logger for one that writes to a
+// buffer so that tests can make assertions against log output. The original
+// logger is restored when the test finishes.
+func captureLogger(t *testing.T) *bytes.Buffer {
+	var buf bytes.Buffer
+
+	originalLogger := logger
+	logger = &LeveledLogger{Level: LevelDebug, stderrOverride: &buf, stdoutOverride: &buf}
+	t.Cleanup(func() { logger = originalLogger })
+
+	return &buf
+}
+
+// writeTweetData writes TOML tweet data to a temporary file and returns its
+// path.
+func writeTweetData(t *testing.T, data string) string {
+	path := filepath.Join(t.TempDir(), "tweets.toml")
+	assert.NoError(t, ioutil.WriteFile(path, []byte(data), 0o600))
+	return path
+}
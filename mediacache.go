@@ -0,0 +1,166 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MediaCache is a persistent cache of fetched media on disk (see
+// `Conf.MediaCacheDir`), so that media doesn't have to be fetched again by
+// later runs, like when a run fails before a tweet could be posted.
+//
+// The cache is bounded to `Conf.MediaCacheMaxBytes` in total, evicting the
+// least recently used media first. Media that's in use (fetched, but not yet
+// released) is never evicted. A cache is safe for concurrent use.
+type MediaCache struct {
+	conf     *Conf
+	dir      string
+	maxBytes int64
+
+	mu    sync.Mutex
+	inUse map[string]int
+}
+
+// newMediaCache initializes a media cache in `Conf.MediaCacheDir`, creating
+// the directory if necessary. Returns nil if no cache is configured.
+func newMediaCache(conf *Conf) (*MediaCache, error) {
+	if conf.MediaCacheDir == "" {
+		return nil, nil
+	}
+
+	if err := os.MkdirAll(conf.MediaCacheDir, 0o700); err != nil {
+		return nil, fmt.Errorf("error creating media cache dir: %w", err)
+	}
+
+	return &MediaCache{
+		conf:     conf,
+		dir:      conf.MediaCacheDir,
+		maxBytes: conf.MediaCacheMaxBytes,
+		inUse:    make(map[string]int),
+	}, nil
+}
+
+// fetch returns the path to a cached copy of the media at the given URL,
+// fetching it if it's not in the cache already. The media is in use until the
+// returned function is called, and won't be evicted until then.
+func (c *MediaCache) fetch(url string, header http.Header) (string, func(), error) {
+	sum := sha256.Sum256([]byte(url))
+	target := filepath.Join(c.dir, hex.EncodeToString(sum[:])+path.Ext(url))
+
+	c.mu.Lock()
+	c.inUse[target]++
+	c.mu.Unlock()
+
+	release := func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+
+		c.inUse[target]--
+		if c.inUse[target] < 1 {
+			delete(c.inUse, target)
+		}
+	}
+
+	if _, err := os.Stat(target); err == nil {
+		logger.Infof("Using cached '%s' for '%s'", target, logURL(c.conf, url))
+
+		// Modification time is used to track recency of use for eviction.
+		now := time.Now()
+		if err := os.Chtimes(target, now, now); err != nil {
+			release()
+			return "", nil, fmt.Errorf("error touching cached media: %w", err)
+		}
+
+		return target, release, nil
+	}
+
+	// Fetch to a temporary file that's renamed into place so that a failed
+	// fetch never leaves a partial file in the cache.
+	f, err := ioutil.TempFile(c.dir, ".fetch-*")
+	if err != nil {
+		release()
+		return "", nil, fmt.Errorf("error creating temp file: %w", err)
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+
+	if err := fetchURL(c.conf, url, f.Name(), header); err != nil {
+		release()
+		return "", nil, err
+	}
+
+	if err := os.Rename(f.Name(), target); err != nil {
+		release()
+		return "", nil, fmt.Errorf("error moving media into cache: %w", err)
+	}
+
+	if err := c.evict(); err != nil {
+		release()
+		return "", nil, err
+	}
+
+	return target, release, nil
+}
+
+// evict removes the least recently used media from the cache until it's
+// within its maximum size, skipping any media that's in use. Does nothing if
+// the cache has no maximum size.
+func (c *MediaCache) evict() error {
+	if c.maxBytes <= 0 {
+		return nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	infos, err := ioutil.ReadDir(c.dir)
+	if err != nil {
+		return fmt.Errorf("error reading media cache dir: %w", err)
+	}
+
+	var files []os.FileInfo
+	var total int64
+	for _, info := range infos {
+		// Skip in-progress fetches.
+		if info.IsDir() || strings.HasPrefix(info.Name(), ".") {
+			continue
+		}
+
+		files = append(files, info)
+		total += info.Size()
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].ModTime().Before(files[j].ModTime())
+	})
+
+	for _, info := range files {
+		if total <= c.maxBytes {
+			break
+		}
+
+		target := filepath.Join(c.dir, info.Name())
+		if c.inUse[target] > 0 {
+			continue
+		}
+
+		if err := os.Remove(target); err != nil {
+			return fmt.Errorf("error evicting cached media: %w", err)
+		}
+
+		logger.Infof("Evicted '%s' from media cache", target)
+		total -= info.Size()
+	}
+
+	return nil
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	assert "github.com/stretchr/testify/require"
+)
+
+func TestMediaCache(t *testing.T) {
+	var numRequests int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&numRequests, 1)
+		w.Write([]byte("0123456789")) // 10 bytes
+	}))
+	t.Cleanup(server.Close)
+
+	newCache := func(t *testing.T, maxBytes int64) *MediaCache {
+		cache, err := newMediaCache(&Conf{
+			MediaCacheDir:      filepath.Join(t.TempDir(), "cache"),
+			MediaCacheMaxBytes: maxBytes,
+		})
+		assert.NoError(t, err)
+		return cache
+	}
+
+	// fetchAt fetches media and backdates it so that recency of use is
+	// deterministic.
+	fetchAt := func(t *testing.T, cache *MediaCache, url string, at time.Time) (string, func()) {
+		target, release, err := cache.fetch(url, nil)
+		assert.NoError(t, err)
+		assert.NoError(t, os.Chtimes(target, at, at))
+		return target, release
+	}
+
+	now := time.Now()
+
+	t.Run("NoCacheDir", func(t *testing.T) {
+		cache, err := newMediaCache(&Conf{})
+		assert.NoError(t, err)
+		assert.Nil(t, cache)
+	})
+
+	t.Run("FetchesOnce", func(t *testing.T) {
+		cache := newCache(t, 0)
+		atomic.StoreInt64(&numRequests, 0)
+
+		target1, release := fetchAt(t, cache, server.URL+"/a.jpg", now)
+		release()
+		target2, release := fetchAt(t, cache, server.URL+"/a.jpg", now)
+		release()
+
+		assert.Equal(t, target1, target2)
+		assert.Equal(t, ".jpg", filepath.Ext(target1))
+		assert.Equal(t, int64(1), atomic.LoadInt64(&numRequests))
+	})
+
+	t.Run("EvictsLeastRecentlyUsed", func(t *testing.T) {
+		cache := newCache(t, 25)
+
+		targetA, release := fetchAt(t, cache, server.URL+"/a.jpg", now.Add(-3*time.Hour))
+		release()
+		targetB, release := fetchAt(t, cache, server.URL+"/b.jpg", now.Add(-2*time.Hour))
+		release()
+
+		// Using A again makes B the least recently used.
+		_, release = fetchAt(t, cache, server.URL+"/a.jpg", now.Add(-1*time.Hour))
+		release()
+
+		targetC, release := fetchAt(t, cache, server.URL+"/c.jpg", now)
+		release()
+
+		assert.FileExists(t, targetA)
+		assert.NoFileExists(t, targetB)
+		assert.FileExists(t, targetC)
+	})
+
+	t.Run("KeepsMediaInUse", func(t *testing.T) {
+		cache := newCache(t, 25)
+
+		targetA, releaseA := fetchAt(t, cache, server.URL+"/a.jpg", now.Add(-3*time.Hour))
+		targetB, release := fetchAt(t, cache, server.URL+"/b.jpg", now.Add(-2*time.Hour))
+		release()
+
+		// A is the least recently used, but it's still in use, so B is
+		// evicted instead.
+		targetC, release := fetchAt(t, cache, server.URL+"/c.jpg", now)
+		release()
+
+		assert.FileExists(t, targetA)
+		assert.NoFileExists(t, targetB)
+		assert.FileExists(t, targetC)
+
+		// Once released, A can be evicted too.
+		releaseA()
+		_, release = fetchAt(t, cache, server.URL+"/d.jpg", now)
+		release()
+		assert.NoFileExists(t, targetA)
+	})
+
+	t.Run("ConcurrentFetches", func(t *testing.T) {
+		cache := newCache(t, 25)
+
+		errs := make([]error, 10)
+
+		var wg sync.WaitGroup
+		for i := range errs {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+
+				target, release, err := cache.fetch(server.URL+"/"+string(rune('a'+i))+".jpg", nil)
+				if err != nil {
+					errs[i] = err
+					return
+				}
+				defer release()
+
+				// Media in use is never evicted out from under its user.
+				_, errs[i] = os.Stat(target)
+			}(i)
+		}
+		wg.Wait()
+
+		for _, err := range errs {
+			assert.NoError(t, err)
+		}
+	})
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"time"
+
+	"github.com/mattn/go-mastodon"
+)
+
+// GetMediaProcessed returns whether an uploaded media attachment has finished
+// processing. Mastodon responds to a request for an attachment with a 206
+// while it's still processing and a 200 once it's done.
+func (c *apiClient) GetMediaProcessed(ctx context.Context, id mastodon.ID) (bool, error) {
+	u, err := url.Parse(c.Config.Server)
+	if err != nil {
+		return false, fmt.Errorf("error parsing server URL: %w", err)
+	}
+	u.Path = path.Join(u.Path, "/api/v1/media", string(id))
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return false, fmt.Errorf("error creating request: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+c.Config.AccessToken)
+
+	resp, err := c.Do(req)
+	if err != nil {
+		return false, fmt.Errorf("error getting media: %w", err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusPartialContent:
+		return false, nil
+	default:
+		return false, fmt.Errorf("unexpected status getting media: %v", resp.Status)
+	}
+}
+
+// waitForMediaProcessed polls uploaded media attachments until they've
+// finished processing, checking each up to MediaProcessingRetries more times
+// with MediaProcessingRetryDelay in between.
+//
+// This is best effort: media that's still processing afterwards, or that
+// can't be checked at all, is posted anyway, in which case the server's
+// rejection is handled by postStatusRetryingMedia. An error is only returned
+// if the context is cancelled.
+func waitForMediaProcessed(ctx context.Context, conf *Conf, client mastodonClient, mediaIDs []mastodon.ID) error {
+	for _, mediaID := range mediaIDs {
+		for attempt := 0; ; attempt++ {
+			processed, err := client.GetMediaProcessed(ctx, mediaID)
+			if err != nil {
+				if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+					return err
+				}
+
+				logger.Warnf("Couldn't check whether media %v has finished processing: %v", mediaID, err)
+				break
+			}
+
+			if processed {
+				break
+			}
+
+			if attempt >= conf.MediaProcessingRetries {
+				logger.Warnf("Media %v still hasn't finished processing; posting anyway", mediaID)
+				break
+			}
+
+			logger.Infof("Media %v is still processing; checking again in %v", mediaID, conf.MediaProcessingRetryDelay)
+
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(conf.MediaProcessingRetryDelay):
+			}
+		}
+	}
+
+	return nil
+}
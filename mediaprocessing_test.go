@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/mattn/go-mastodon"
+	assert "github.com/stretchr/testify/require"
+)
+
+func TestAPIClientGetMediaProcessed(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodGet, r.Method)
+		assert.Equal(t, "Bearer token", r.Header.Get("Authorization"))
+
+		switch r.URL.Path {
+		case "/api/v1/media/processed":
+			w.WriteHeader(http.StatusOK)
+		case "/api/v1/media/processing":
+			w.WriteHeader(http.StatusPartialContent)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+		w.Write([]byte(`{}`))
+	}))
+	defer server.Close()
+
+	client := &apiClient{mastodon.NewClient(&mastodon.Config{AccessToken: "token", Server: server.URL})}
+
+	processed, err := client.GetMediaProcessed(context.Background(), "processed")
+	assert.NoError(t, err)
+	assert.True(t, processed)
+
+	processed, err = client.GetMediaProcessed(context.Background(), "processing")
+	assert.NoError(t, err)
+	assert.False(t, processed)
+
+	_, err = client.GetMediaProcessed(context.Background(), "missing")
+	assert.EqualError(t, err, "unexpected status getting media: 404 Not Found")
+}
+
+func TestSyncTweetThreadMediaProcessing(t *testing.T) {
+	server := serveMedia(t, []byte("GIF89a fake image contents"))
+
+	photoTweet := func(id int64, replyTo int64) *Tweet {
+		tweet := &Tweet{
+			ID:   id,
+			Text: fmt.Sprintf("Photo %v of a thread", id),
+			Entities: &TweetEntities{Medias: []*TweetEntitiesMedia{
+				{ID: id * 10, Type: "photo", URL: fmt.Sprintf("%s/image%v.jpg", server.URL, id)},
+			}},
+		}
+		if replyTo != 0 {
+			tweet.Reply = &TweetReply{StatusID: replyTo, User: "brandur"}
+		}
+		return tweet
+	}
+	thread := []*Tweet{photoTweet(1, 0), photoTweet(2, 1), photoTweet(3, 2)}
+
+	conf := &Conf{
+		MediaProcessingRetries:    3,
+		MediaProcessingRetryDelay: time.Millisecond,
+		ThreadSelfReplies:         true,
+		TwitterUser:               "brandur",
+	}
+
+	// Each photo takes a different number of polls to finish processing.
+	client := &fakeClient{mediaProcessing: map[mastodon.ID]int{
+		"media-1": 2,
+		"media-2": 3,
+		"media-3": 1,
+	}}
+
+	state := &State{}
+	for _, tweet := range thread {
+		_, err := syncTweet(context.Background(), conf, client, state, nil, nil, tweet, t.TempDir())
+		assert.NoError(t, err)
+	}
+
+	// Every status was posted only once its media was ready, so none was
+	// rejected, and each reply's media was only checked after the status
+	// before it was posted.
+	assert.Equal(t, 0, client.mediaRejections)
+	assert.Equal(t, []mastodon.ID{
+		"media-1", "media-1",
+		"media-2", "media-2", "media-2",
+		"media-3",
+	}, client.mediaPolls)
+
+	assert.Len(t, client.postedToots, 3)
+	assert.Equal(t, mastodon.ID(""), client.postedToots[0].InReplyToID)
+	assert.Equal(t, mastodon.ID("1"), client.postedToots[1].InReplyToID)
+	assert.Equal(t, mastodon.ID("2"), client.postedToots[2].InReplyToID)
+
+	t.Run("PostsAnywayAfterRetries", func(t *testing.T) {
+		conf := *conf
+		conf.MediaProcessingRetries = 1
+
+		client := &fakeClient{mediaProcessing: map[mastodon.ID]int{"media-1": 5}}
+
+		_, err := syncTweet(context.Background(), &conf, client, &State{}, nil, nil, thread[0], t.TempDir())
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "Cannot attach files that have not finished processing")
+
+		// Polled until out of retries, then posting was attempted anyway.
+		assert.Equal(t, []mastodon.ID{"media-1", "media-1"}, client.mediaPolls)
+		assert.Equal(t, 2, client.mediaRejections)
+	})
+}
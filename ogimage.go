@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/mattn/go-mastodon"
+	"golang.org/x/net/html"
+)
+
+// maxOGPageBytes is the maximum number of bytes of a page that are read
+// looking for its OpenGraph image. The tag is in the page's head, so there's
+// no need to read all of a large page.
+const maxOGPageBytes = 1 << 20
+
+// attachOGImage fetches the OpenGraph image of the page linked by a link-only
+// tweet (see linkOnlyURL) and uploads it, returning the ID of the uploaded
+// attachment. This is best effort, so nil is returned without an error if the
+// tweet isn't link-only, the page doesn't have an OpenGraph image, or fetching
+// or uploading it fails.
+func attachOGImage(ctx context.Context, conf *Conf, client mastodonClient, state *State, tweet *Tweet,
+	tempDir string) []mastodon.ID {
+	pageURL := linkOnlyURL(tweet)
+	if pageURL == "" {
+		return nil
+	}
+
+	imageURL, err := fetchOGImageURL(ctx, conf, pageURL)
+	if err != nil {
+		logger.Warnf("Not attaching OpenGraph image to tweet %v: %v", tweet.ID, err)
+		return nil
+	}
+	if imageURL == "" {
+		logger.Infof("No OpenGraph image found for '%s' linked by tweet %v", logURL(conf, pageURL), tweet.ID)
+		return nil
+	}
+
+	media := &TweetEntitiesMedia{Type: "photo", URL: imageURL}
+	attachmentID, err := syncMediaURL(ctx, conf, client, state, tweet, media, imageURL, tempDir)
+	if err != nil {
+		logger.Warnf("Not attaching OpenGraph image '%s' to tweet %v: %v", logURL(conf, imageURL), tweet.ID, err)
+		return nil
+	}
+	if attachmentID == "" {
+		return nil
+	}
+
+	logger.Infof("Attaching OpenGraph image '%s' to tweet %v", logURL(conf, imageURL), tweet.ID)
+	return []mastodon.ID{attachmentID}
+}
+
+// fetchOGImageURL fetches the page at pageURL and returns the absolute URL of
+// its OpenGraph image, or an empty string if it doesn't have one.
+func fetchOGImageURL(ctx context.Context, conf *Conf, pageURL string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, pageURL, nil)
+	if err != nil {
+		return "", fmt.Errorf("error creating request: %w", redactError(conf, err, pageURL))
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("error fetching page '%s': %w", logURL(conf, pageURL), redactError(conf, err, pageURL))
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected status fetching page '%s': %v", logURL(conf, pageURL), resp.Status)
+	}
+
+	imageURL := findOGImage(io.LimitReader(resp.Body, maxOGPageBytes))
+	if imageURL == "" {
+		return "", nil
+	}
+
+	// Images are sometimes given relative to the page.
+	base, err := url.Parse(pageURL)
+	if err != nil {
+		return "", fmt.Errorf("error parsing page URL: %w", redactError(conf, err, pageURL))
+	}
+	resolved, err := base.Parse(imageURL)
+	if err != nil {
+		return "", fmt.Errorf("error parsing OpenGraph image URL '%s': %w",
+			logURL(conf, imageURL), redactError(conf, err, imageURL))
+	}
+
+	return resolved.String(), nil
+}
+
+// findOGImage returns the content of the first `og:image` meta tag in an HTML
+// document's head, or an empty string if there isn't one.
+func findOGImage(r io.Reader) string {
+	tokenizer := html.NewTokenizer(r)
+
+	for {
+		switch tokenizer.Next() {
+		case html.ErrorToken:
+			return ""
+
+		case html.StartTagToken, html.SelfClosingTagToken:
+			name, hasAttr := tokenizer.TagName()
+			switch string(name) {
+			case "body":
+				return ""
+			case "meta":
+				// Handled below.
+			default:
+				continue
+			}
+
+			var property, content string
+			for hasAttr {
+				var key, val []byte
+				key, val, hasAttr = tokenizer.TagAttr()
+
+				switch string(key) {
+				case "property", "name":
+					property = string(val)
+				case "content":
+					content = string(val)
+				}
+			}
+
+			if property == "og:image" && strings.TrimSpace(content) != "" {
+				return strings.TrimSpace(content)
+			}
+
+		case html.EndTagToken:
+			if name, _ := tokenizer.TagName(); string(name) == "head" {
+				return ""
+			}
+		}
+	}
+}
+
+// linkOnlyURL returns the expanded URL linked by a tweet that's nothing but a
+// link, or an empty string for any other tweet, including those with media.
+// If a tweet has several links, the last is returned, which is the one that
+// Twitter would show a card for.
+func linkOnlyURL(tweet *Tweet) string {
+	if tweet.Entities == nil || len(tweet.Entities.Medias) > 0 || len(tweet.Entities.URLs) < 1 {
+		return ""
+	}
+
+	text := tweet.Text
+	for _, url := range tweet.Entities.URLs {
+		text = strings.Replace(text, url.URL, "", -1)
+	}
+	if strings.TrimSpace(text) != "" {
+		return ""
+	}
+
+	return tweet.Entities.URLs[len(tweet.Entities.URLs)-1].ExpandedURL
+}
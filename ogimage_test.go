@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/mattn/go-mastodon"
+	assert "github.com/stretchr/testify/require"
+)
+
+func TestAttachOGImage(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/post":
+			w.Write([]byte(`<html><head><meta property="og:image" content="/card.gif"></head><body></body></html>`))
+		case "/plain":
+			w.Write([]byte(`<html><head><title>No image</title></head><body></body></html>`))
+		case "/card.gif":
+			w.Write([]byte("GIF89a fake image contents"))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	linkTweet := func(pageURL string) *Tweet {
+		return &Tweet{
+			ID:   123,
+			Text: "https://t.co/abc123",
+			Entities: &TweetEntities{
+				URLs: []*TweetEntitiesURL{{URL: "https://t.co/abc123", ExpandedURL: pageURL}},
+			},
+		}
+	}
+
+	conf := &Conf{AttachOGImage: true}
+
+	t.Run("Attaches", func(t *testing.T) {
+		client := &fakeClient{}
+
+		_, err := syncTweet(context.Background(), conf, client, &State{}, nil, nil, linkTweet(server.URL+"/post"), t.TempDir())
+		assert.NoError(t, err)
+
+		assert.Len(t, client.uploadedMedia, 1)
+		assert.True(t, strings.HasSuffix(client.uploadedMedia[0], "card.gif"))
+		assert.Equal(t, []mastodon.ID{"media-1"}, client.postedToots[0].MediaIDs)
+	})
+
+	t.Run("NoOGImage", func(t *testing.T) {
+		client := &fakeClient{}
+
+		_, err := syncTweet(context.Background(), conf, client, &State{}, nil, nil, linkTweet(server.URL+"/plain"), t.TempDir())
+		assert.NoError(t, err)
+		assert.Empty(t, client.uploadedMedia)
+		assert.Len(t, client.postedToots, 1)
+	})
+
+	t.Run("FetchFails", func(t *testing.T) {
+		logOutput := captureLogger(t)
+		client := &fakeClient{}
+
+		_, err := syncTweet(context.Background(), conf, client, &State{}, nil, nil, linkTweet(server.URL+"/missing"), t.TempDir())
+		assert.NoError(t, err)
+		assert.Empty(t, client.uploadedMedia)
+		assert.Len(t, client.postedToots, 1)
+		assert.Contains(t, logOutput.String(), "Not attaching OpenGraph image to tweet 123")
+	})
+
+	t.Run("OffByDefault", func(t *testing.T) {
+		client := &fakeClient{}
+
+		_, err := syncTweet(context.Background(), &Conf{}, client, &State{}, nil, nil, linkTweet(server.URL+"/post"), t.TempDir())
+		assert.NoError(t, err)
+		assert.Empty(t, client.uploadedMedia)
+	})
+}
+
+func TestFindOGImage(t *testing.T) {
+	assert.Equal(t, "https://example.com/card.png", findOGImage(strings.NewReader(
+		`<html><head><meta name="description" content="A post"><meta property="og:image" content=" https://example.com/card.png " /></head></html>`)))
+
+	// Tags outside of the head are ignored.
+	assert.Equal(t, "", findOGImage(strings.NewReader(
+		`<html><head></head><body><meta property="og:image" content="https://example.com/card.png"></body></html>`)))
+
+	assert.Equal(t, "", findOGImage(strings.NewReader(`not html at all`)))
+}
+
+func TestLinkOnlyURL(t *testing.T) {
+	urls := []*TweetEntitiesURL{
+		{URL: "https://t.co/first", ExpandedURL: "https://example.com/first"},
+		{URL: "https://t.co/second", ExpandedURL: "https://example.com/second"},
+	}
+
+	assert.Equal(t, "https://example.com/second", linkOnlyURL(&Tweet{
+		Text:     "https://t.co/first https://t.co/second",
+		Entities: &TweetEntities{URLs: urls},
+	}))
+
+	// Tweets with any other text aren't link-only.
+	assert.Equal(t, "", linkOnlyURL(&Tweet{
+		Text:     "Worth a read: https://t.co/second",
+		Entities: &TweetEntities{URLs: urls[1:]},
+	}))
+
+	// Nor are those with media.
+	assert.Equal(t, "", linkOnlyURL(&Tweet{
+		Text: "https://t.co/second",
+		Entities: &TweetEntities{
+			Medias: []*TweetEntitiesMedia{{Type: "photo"}},
+			URLs:   urls[1:],
+		},
+	}))
+
+	assert.Equal(t, "", linkOnlyURL(&Tweet{Text: "No links"}))
+}
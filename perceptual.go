@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"io"
+	"math/bits"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/mattn/go-mastodon"
+)
+
+// perceptualHashTolerance is the maximum number of bits by which the
+// perceptual hashes of two images can differ for them to be considered the
+// same image (see perceptualHash). Recompressing or resizing an image
+// usually changes only a few.
+const perceptualHashTolerance = 10
+
+// perceptualHashTimeout bounds each fetch of an image to hash, which is made
+// while matching and shouldn't hold it up.
+const perceptualHashTimeout = 10 * time.Second
+
+// maxPerceptualHashBytes is the maximum size of an image that will be fetched
+// to be hashed.
+const maxPerceptualHashBytes = 20 << 20
+
+// perceptualHashes caches the perceptual hashes of images for the rest of
+// the run. Tweets are matched against the same statuses repeatedly, so each
+// image is only fetched once.
+var perceptualHashes = newPerceptualHashCache()
+
+// perceptualHashCache is a cache of the perceptual hashes of images keyed by
+// their URLs. Images that couldn't be fetched or decoded are cached as such.
+type perceptualHashCache struct {
+	mu     sync.Mutex
+	hashes map[string]uint64
+	failed map[string]bool
+}
+
+func newPerceptualHashCache() *perceptualHashCache {
+	return &perceptualHashCache{hashes: make(map[string]uint64), failed: make(map[string]bool)}
+}
+
+// hash returns the perceptual hash of the image at imageURL, or false if it
+// couldn't be fetched or decoded, which is logged.
+func (c *perceptualHashCache) hash(conf *Conf, imageURL string) (uint64, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if hash, ok := c.hashes[imageURL]; ok {
+		return hash, true
+	}
+	if c.failed[imageURL] {
+		return 0, false
+	}
+
+	hash, err := fetchPerceptualHash(conf, imageURL)
+	if err != nil {
+		logger.Warnf("Couldn't hash image '%s' for matching: %v", logURL(conf, imageURL), err)
+		c.failed[imageURL] = true
+		return 0, false
+	}
+
+	c.hashes[imageURL] = hash
+	return hash, true
+}
+
+func fetchPerceptualHash(conf *Conf, imageURL string) (uint64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), perceptualHashTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, imageURL, nil)
+	if err != nil {
+		return 0, fmt.Errorf("error creating request: %w", redactError(conf, err, imageURL))
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("error fetching '%s': %w", logURL(conf, imageURL), redactError(conf, err, imageURL))
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("unexpected status fetching '%s': %v", logURL(conf, imageURL), resp.Status)
+	}
+
+	img, _, err := image.Decode(io.LimitReader(resp.Body, maxPerceptualHashBytes))
+	if err != nil {
+		return 0, fmt.Errorf("error decoding '%s': %w", logURL(conf, imageURL), err)
+	}
+
+	return perceptualHash(img), nil
+}
+
+// mediaSimilarity returns how many of a tweet's photos look like the
+// attachment of a status in the same position, along with whether any pair
+// could be compared at all.
+func mediaSimilarity(conf *Conf, tweet *Tweet, status *mastodon.Status) (int, bool) {
+	var similar int
+	var compared bool
+
+	for i, photo := range tweetPhotos(tweet) {
+		if i >= len(status.MediaAttachments) {
+			break
+		}
+
+		attachment := status.MediaAttachments[i]
+		attachmentURL := attachment.PreviewURL
+		if attachmentURL == "" {
+			attachmentURL = attachment.URL
+		}
+
+		tweetHash, ok := perceptualHashes.hash(conf, photo.URL)
+		if !ok {
+			continue
+		}
+		statusHash, ok := perceptualHashes.hash(conf, attachmentURL)
+		if !ok {
+			continue
+		}
+
+		compared = true
+		if bits.OnesCount64(tweetHash^statusHash) <= perceptualHashTolerance {
+			similar++
+		}
+	}
+
+	return similar, compared
+}
+
+// perceptualHash computes a difference hash of an image: it's shrunk to 9x8
+// pixels, and each bit records whether a pixel is brighter than its
+// neighbour to the right. Images that look alike have hashes that differ by
+// few bits regardless of their size or compression.
+func perceptualHash(img image.Image) uint64 {
+	small := downscaleImage(img, 9, 8)
+
+	brightness := func(x, y int) uint32 {
+		r, g, b, _ := small.At(x, y).RGBA()
+		return 299*r + 587*g + 114*b
+	}
+
+	var hash uint64
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			hash <<= 1
+			if brightness(x, y) > brightness(x+1, y) {
+				hash |= 1
+			}
+		}
+	}
+
+	return hash
+}
+
+// pickByMediaSimilarity returns the index of the status amongst candidates
+// whose attachments look most like a tweet's photos (see
+// PerceptualMediaMatch), for when the text of several matches the tweet
+// equally well. Falls back to the first candidate, which is what would've
+// been matched otherwise, if there's only one or no media could be compared.
+func pickByMediaSimilarity(conf *Conf, candidates []*mastodon.Status, tweet *Tweet) int {
+	if len(candidates) < 2 {
+		return 0
+	}
+
+	best, bestSimilar := 0, 0
+	for i, status := range candidates {
+		similar, compared := mediaSimilarity(conf, tweet, status)
+		if compared && similar > bestSimilar {
+			best, bestSimilar = i, similar
+		}
+	}
+
+	if best != 0 {
+		logger.Infof("Matched tweet %v to Mastodon status %v of %v with the same text by its media",
+			tweet.ID, candidates[best].ID, len(candidates))
+	}
+
+	return best
+}
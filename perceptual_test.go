@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"math/bits"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/mattn/go-mastodon"
+	assert "github.com/stretchr/testify/require"
+)
+
+func TestPerceptualHash(t *testing.T) {
+	cat := perceptualHash(gradientImage(640, 480, false))
+
+	// Smaller and recompressed.
+	recompressed, err := jpeg.Decode(bytes.NewReader(encodeJPEG(t, gradientImage(320, 240, false), 20)))
+	assert.NoError(t, err)
+	assert.LessOrEqual(t, bits.OnesCount64(cat^perceptualHash(recompressed)), perceptualHashTolerance)
+
+	dog := perceptualHash(gradientImage(640, 480, true))
+	assert.Greater(t, bits.OnesCount64(cat^dog), perceptualHashTolerance)
+}
+
+func TestPickByMediaSimilarity(t *testing.T) {
+	var catPNG bytes.Buffer
+	assert.NoError(t, png.Encode(&catPNG, gradientImage(640, 480, false)))
+	var dogPNG bytes.Buffer
+	assert.NoError(t, png.Encode(&dogPNG, gradientImage(640, 480, true)))
+	catJPEG := encodeJPEG(t, gradientImage(320, 240, false), 50)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/cat.png":
+			w.Write(catPNG.Bytes())
+		case "/cat-small.jpg":
+			w.Write(catJPEG)
+		case "/dog.png":
+			w.Write(dogPNG.Bytes())
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	origHashes := perceptualHashes
+	t.Cleanup(func() { perceptualHashes = origHashes })
+
+	tweet := &Tweet{ID: 1, Text: "Look at this", Entities: &TweetEntities{Medias: []*TweetEntitiesMedia{
+		{ID: 10, Type: "photo", URL: server.URL + "/cat.png"},
+	}}}
+
+	newStatuses := func(dogURL, catURL string) []*mastodon.Status {
+		return []*mastodon.Status{
+			{ID: "200", Content: "<p>Look at this</p>", MediaAttachments: []mastodon.Attachment{{PreviewURL: dogURL}}},
+			{ID: "100", Content: "<p>Look at this</p>", MediaAttachments: []mastodon.Attachment{{PreviewURL: catURL}}},
+		}
+	}
+
+	t.Run("DisambiguatesByMedia", func(t *testing.T) {
+		perceptualHashes = newPerceptualHashCache()
+
+		statuses := newStatuses(server.URL+"/dog.png", server.URL+"/cat-small.jpg")
+		status, _ := findMatchingStatus(&Conf{PerceptualMediaMatch: true}, statuses, tweet)
+		assert.Equal(t, mastodon.ID("100"), status.ID)
+	})
+
+	t.Run("OffByDefault", func(t *testing.T) {
+		perceptualHashes = newPerceptualHashCache()
+
+		statuses := newStatuses(server.URL+"/dog.png", server.URL+"/cat-small.jpg")
+		status, _ := findMatchingStatus(&Conf{}, statuses, tweet)
+		assert.Equal(t, mastodon.ID("200"), status.ID)
+	})
+
+	t.Run("UnfetchableMedia", func(t *testing.T) {
+		perceptualHashes = newPerceptualHashCache()
+		logs := captureLogger(t)
+
+		statuses := newStatuses(server.URL+"/missing.png", server.URL+"/missing.jpg")
+		status, _ := findMatchingStatus(&Conf{PerceptualMediaMatch: true}, statuses, tweet)
+		assert.Equal(t, mastodon.ID("200"), status.ID)
+		assert.Contains(t, logs.String(), "Couldn't hash image")
+	})
+}
+
+// encodeJPEG encodes an image as a JPEG of the given quality.
+func encodeJPEG(t *testing.T, img image.Image, quality int) []byte {
+	var buf bytes.Buffer
+	assert.NoError(t, jpeg.Encode(&buf, img, &jpeg.Options{Quality: quality}))
+	return buf.Bytes()
+}
+
+// gradientImage returns an image that fades from light on the left to dark
+// on the right, or the other way around if reversed.
+func gradientImage(width, height int, reversed bool) image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			v := uint8(255 - x*255/width)
+			if reversed {
+				v = 255 - v
+			}
+			img.Set(x, y, color.RGBA{R: v, G: v, B: v, A: 255})
+		}
+	}
+	return img
+}
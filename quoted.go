@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// quotedUnavailableNote replaces the link to a quoted tweet that's no longer
+// available (see CheckQuotedAvailability).
+const quotedUnavailableNote = "(quoted tweet no longer available)"
+
+// quotedAvailabilityTimeout bounds each check of a quoted tweet's
+// availability.
+const quotedAvailabilityTimeout = 10 * time.Second
+
+// quotedOEmbedURL is Twitter's oEmbed endpoint, which is used to check
+// whether a quoted tweet still exists. Unlike the tweet's own page, which
+// comes back fine (or redirects to a login) whether the tweet exists or not,
+// it responds with an error for tweets that have been deleted or are
+// protected.
+const quotedOEmbedURL = "https://publish.twitter.com/oembed"
+
+// quotedAvailability caches whether quoted tweets are still available for the
+// rest of the run so that each is only checked once, even if it's quoted by
+// several tweets.
+var quotedAvailability = newQuotedAvailabilityCache()
+
+// quotedAvailabilityCache is a cache of whether quoted tweets are still
+// available, keyed by their URLs.
+type quotedAvailabilityCache struct {
+	mu        sync.Mutex
+	available map[string]bool
+}
+
+func newQuotedAvailabilityCache() *quotedAvailabilityCache {
+	return &quotedAvailabilityCache{available: make(map[string]bool)}
+}
+
+// isAvailable checks whether the tweet at quoteURL still exists through
+// Twitter's oEmbed endpoint, which is considered to have failed only if the
+// tweet comes back as not found, gone, or forbidden (for a protected tweet).
+// Errors making the request are logged and the tweet is assumed to be
+// available so that a link isn't dropped because of a transient problem.
+func (c *quotedAvailabilityCache) isAvailable(conf *Conf, quoteURL string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if available, ok := c.available[quoteURL]; ok {
+		return available
+	}
+
+	available, err := checkQuotedAvailability(conf, quoteURL)
+	if err != nil {
+		logger.Warnf("Couldn't check whether quoted tweet '%s' is available: %v", logURL(conf, quoteURL), err)
+		available = true
+	}
+
+	c.available[quoteURL] = available
+	return available
+}
+
+func checkQuotedAvailability(conf *Conf, quoteURL string) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), quotedAvailabilityTimeout)
+	defer cancel()
+
+	endpoint := quotedOEmbedURL + "?omit_script=true&url=" + url.QueryEscape(quoteURL)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return false, fmt.Errorf("error creating request: %w", redactError(conf, err, endpoint))
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return false, fmt.Errorf("error checking '%s': %w", logURL(conf, quoteURL), redactError(conf, err, endpoint))
+	}
+	resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusForbidden, http.StatusNotFound, http.StatusGone:
+		return false, nil
+	case http.StatusOK:
+		return true, nil
+	}
+
+	return false, fmt.Errorf("unexpected status checking '%s': %v", logURL(conf, quoteURL), resp.Status)
+}
+
+// quoteURL returns the URL of the tweet quoted by a quote tweet.
+func quoteURL(tweet *Tweet) string {
+	return fmt.Sprintf("https://twitter.com/%s/status/%v", tweet.Quote.User, tweet.Quote.StatusID)
+}
+
+// resolveQuotedAvailability checks whether the tweets quoted by tweets are
+// still available if CheckQuotedAvailability is on, and records the result on
+// each quote tweet for replaceUnavailableQuoteLink. This is done once up front
+// rather than while rendering because tweets are rendered over and over while
+// being matched against existing statuses, and rendering shouldn't depend on
+// the network.
+func resolveQuotedAvailability(conf *Conf, tweets []*Tweet) {
+	if !conf.CheckQuotedAvailability {
+		return
+	}
+
+	for _, tweet := range tweets {
+		if tweet.Quote != nil {
+			tweet.quoteUnavailable = !quotedAvailability.isAvailable(conf, quoteURL(tweet))
+		}
+	}
+}
+
+// replaceUnavailableQuoteLink replaces the link to the quoted tweet that
+// appendQuoteLink leaves at the end of a quote tweet with
+// quotedUnavailableNote if the quoted tweet was found to no longer exist (see
+// resolveQuotedAvailability).
+func replaceUnavailableQuoteLink(tweet *Tweet, content string) string {
+	if tweet.Quote == nil || !tweet.quoteUnavailable {
+		return content
+	}
+
+	link := quoteURL(tweet)
+	if !strings.HasSuffix(content, link) {
+		return content
+	}
+
+	return strings.TrimSuffix(content, link) + quotedUnavailableNote
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/mattn/go-mastodon"
+	assert "github.com/stretchr/testify/require"
+)
+
+func TestReplaceUnavailableQuoteLink(t *testing.T) {
+	var requests int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		assert.Equal(t, "/oembed", r.URL.Path)
+
+		switch r.URL.Query().Get("url") {
+		case "https://twitter.com/deleted/status/456":
+			w.WriteHeader(http.StatusNotFound)
+		case "https://twitter.com/flaky/status/123":
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+
+	// Send requests for Twitter to the stub instead.
+	serverURL, err := url.Parse(server.URL)
+	assert.NoError(t, err)
+	origHTTPClient, origAvailability := httpClient, quotedAvailability
+	httpClient = &http.Client{Transport: rewriteHostTransport{host: serverURL.Host}}
+	quotedAvailability = newQuotedAvailabilityCache()
+	t.Cleanup(func() { httpClient, quotedAvailability = origHTTPClient, origAvailability })
+
+	conf := &Conf{CheckQuotedAvailability: true}
+
+	deleted := &Tweet{Text: `Look at this`, Quote: &TweetQuote{StatusID: 456, User: "deleted"}}
+	alsoDeleted := &Tweet{Text: `And this`, Quote: &TweetQuote{StatusID: 456, User: "deleted"}}
+	available := &Tweet{Text: `Look at this`, Quote: &TweetQuote{StatusID: 789, User: "someone"}}
+	flaky := &Tweet{Text: `Look at this`, Quote: &TweetQuote{StatusID: 123, User: "flaky"}}
+
+	// Checked once a run, before rendering.
+	resolveQuotedAvailability(conf, []*Tweet{deleted, alsoDeleted, available, flaky})
+	assert.Equal(t, 3, requests)
+
+	assert.Equal(t, "Look at this\n\n(quoted tweet no longer available)", renderToot(conf, deleted))
+	assert.Equal(t, "And this\n\n(quoted tweet no longer available)", renderToot(conf, alsoDeleted))
+	assert.Equal(t, "Look at this\n\nhttps://twitter.com/someone/status/789", renderToot(conf, available))
+
+	// Errors assume that the quoted tweet is available.
+	assert.Equal(t, "Look at this\n\nhttps://twitter.com/flaky/status/123", renderToot(conf, flaky))
+
+	// Rendering doesn't make any requests.
+	assert.Equal(t, 3, requests)
+
+	t.Run("MatchesStatusPostedBeforeDeletion", func(t *testing.T) {
+		status := &mastodon.Status{Content: `<p>Look at this</p><p><a href="https://twitter.com/deleted/status/456">https://twitter.com/deleted/status/456</a></p>`}
+		match, _ := findMatchingStatus(conf, []*mastodon.Status{status}, deleted)
+		assert.Equal(t, status, match)
+	})
+
+	t.Run("OffByDefault", func(t *testing.T) {
+		tweet := &Tweet{Text: `Look at this`, Quote: &TweetQuote{StatusID: 456, User: "deleted"}}
+		resolveQuotedAvailability(&Conf{}, []*Tweet{tweet})
+		assert.Equal(t, "Look at this\n\nhttps://twitter.com/deleted/status/456", renderToot(&Conf{}, tweet))
+		assert.Equal(t, 3, requests)
+	})
+}
+
+// rewriteHostTransport sends every request to the given host over plain HTTP.
+type rewriteHostTransport struct {
+	host string
+}
+
+func (t rewriteHostTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.URL.Scheme = "http"
+	req.URL.Host = t.host
+	return http.DefaultTransport.RoundTrip(req)
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// reconcile matches tweets against the account's existing statuses and
+// records every match in the state file, repairing any tweets recorded as a
+// different status than the one they match. It never posts anything.
+//
+// This heals state that's drifted from what's on Mastodon, like after
+// improvements to matching find statuses that previous runs missed. Unlike a
+// normal run, matching doesn't stop at the first match, so all tweets are
+// compared against up to ReconcileLimit of the account's most recent
+// statuses.
+func reconcile(ctx context.Context, conf *Conf, client mastodonClient, state *State, tweets []*Tweet) error {
+	if conf.StateFile == "" {
+		return fmt.Errorf("reconciling requires a state file to be configured")
+	}
+
+	account, err := currentAccount(ctx, conf, client, state, time.Now())
+	if err != nil {
+		return err
+	}
+
+	statuses, err := fetchAccountStatuses(ctx, client, account.ID, conf.ReconcileLimit)
+	if err != nil {
+		return err
+	}
+	logger.Infof("Reconciling %v tweet(s) against %v existing status(es)", len(tweets), len(statuses))
+
+	var numFound, numRepaired int
+
+	for _, tweet := range tweets {
+		status, distance := findMatchingStatus(conf, statuses, tweet)
+		if status == nil {
+			continue
+		}
+
+		existing, ok := state.tweetStatus(tweet.ID)
+		switch {
+		case !ok:
+			logger.Infof("Found Mastodon status %v for tweet %v (distance: %v)", status.ID, tweet.ID, distance)
+			numFound++
+		case existing.StatusID != string(status.ID) || !existing.ScheduledAt.IsZero():
+			logger.Infof("Repairing tweet %v recorded as status %v, which matches Mastodon status %v (distance: %v)",
+				tweet.ID, existing.StatusID, status.ID, distance)
+			numRepaired++
+		default:
+			continue
+		}
+
+		state.recordTweetPost(tweet.ID, status, string(status.Visibility))
+		for _, mergedID := range tweet.mergedIDs {
+			state.recordTweetPost(mergedID, status, string(status.Visibility))
+		}
+	}
+
+	logger.Infof("Reconciled state: %v tweet(s) newly found, %v repaired", numFound, numRepaired)
+
+	if conf.DryRun {
+		logger.Infof("Would have saved state file")
+		return nil
+	}
+
+	return state.save(conf.StateFile)
+}
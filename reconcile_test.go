@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/mattn/go-mastodon"
+	assert "github.com/stretchr/testify/require"
+)
+
+func TestReconcile(t *testing.T) {
+	source := writeTweetData(t, `
+[[tweets]]
+id = 3
+text = "The third tweet, which was never posted to Mastodon."
+
+[[tweets]]
+id = 2
+text = "The second tweet, which an earlier run failed to match."
+
+[[tweets]]
+id = 1
+text = "The first tweet, which was recorded as the wrong status."
+`)
+
+	statePath := filepath.Join(t.TempDir(), "state.toml")
+	{
+		state := &State{}
+		state.recordTweetStatus(1, "999", "public")
+		assert.NoError(t, state.save(statePath))
+	}
+
+	conf := &Conf{MaxTweetsToSync: 10, Reconcile: true, ReconcileLimit: 100, StateFile: statePath}
+
+	client := &fakeClient{statuses: []*mastodon.Status{
+		{ID: "200", URL: "https://mastodon.example/@brandur/200", Visibility: "public",
+			Content: `<p>The second tweet, which an earlier run failed to match.</p>`},
+		{ID: "100", URL: "https://mastodon.example/@brandur/100", Visibility: "unlisted",
+			Content: `<p>The first tweet, which was recorded as the wrong status.</p>`},
+	}}
+
+	assert.NoError(t, syncTwitter(context.Background(), conf, client, source))
+
+	// Never posts.
+	assert.Empty(t, client.postedToots)
+
+	state, err := loadState(statePath, false)
+	assert.NoError(t, err)
+
+	found, ok := state.tweetStatus(2)
+	assert.True(t, ok)
+	assert.Equal(t, "200", found.StatusID)
+	assert.Equal(t, "https://mastodon.example/@brandur/200", found.StatusURL)
+
+	repaired, ok := state.tweetStatus(1)
+	assert.True(t, ok)
+	assert.Equal(t, "100", repaired.StatusID)
+	assert.Equal(t, "unlisted", repaired.Visibility)
+
+	_, ok = state.tweetStatus(3)
+	assert.False(t, ok)
+
+	t.Run("RequiresStateFile", func(t *testing.T) {
+		conf := *conf
+		conf.StateFile = ""
+
+		assert.EqualError(t, syncTwitter(context.Background(), &conf, &fakeClient{}, source),
+			"reconciling requires a state file to be configured")
+	})
+}
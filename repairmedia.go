@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/mattn/go-mastodon"
+)
+
+// repairMissingMedia finds statuses that tweets were previously synced to but
+// which have fewer media attachments than the tweets have photos, like when
+// uploading some of a tweet's media failed with PartialMediaOK on, and edits
+// them to carry all of the tweet's media. It never posts anything.
+//
+// Tweets are matched to statuses the same way as by reconcile, against up to
+// ReconcileLimit of the account's most recent statuses. There's no telling
+// which of a tweet's photos are the ones that are missing, so all of them are
+// uploaded again and replace the status' existing attachments.
+func repairMissingMedia(ctx context.Context, conf *Conf, client mastodonClient, state *State, tweets []*Tweet) error {
+	account, err := currentAccount(ctx, conf, client, state, time.Now())
+	if err != nil {
+		return err
+	}
+
+	statuses, err := fetchAccountStatuses(ctx, client, account.ID, conf.ReconcileLimit)
+	if err != nil {
+		return err
+	}
+	logger.Infof("Looking for missing media of %v tweet(s) amongst %v existing status(es)", len(tweets), len(statuses))
+
+	tempDir, err := ioutil.TempDir("", "twitter-media-downloads")
+	if err != nil {
+		return fmt.Errorf("error creating temporary directory: %w", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	var numRepaired int
+
+	for _, tweet := range tweets {
+		numPhotos := min(len(tweetPhotos(tweet)), instanceLimits.MaxMediaAttachments)
+		if numPhotos < 1 {
+			continue
+		}
+
+		status, _ := findMatchingStatus(conf, statuses, tweet)
+		if status == nil || len(status.MediaAttachments) >= numPhotos {
+			continue
+		}
+
+		logger.Infof("Mastodon status %v for tweet %v has %v media attachment(s), but the tweet has %v photo(s)",
+			status.ID, tweet.ID, len(status.MediaAttachments), numPhotos)
+
+		if conf.DryRun {
+			logger.Infof("Would have re-attached media of tweet %v to Mastodon status %v", tweet.ID, status.ID)
+			numRepaired++
+			continue
+		}
+
+		mediaIDs, err := syncMedia(ctx, conf, client, state, tweet, tempDir)
+		if err != nil {
+			return fmt.Errorf("error syncing media of tweet %v: %w", tweet.ID, err)
+		}
+
+		// Media that still couldn't be synced would make things worse.
+		if len(mediaIDs) <= len(status.MediaAttachments) {
+			logger.Warnf("Skipping Mastodon status %v for tweet %v: only %v of its media could be synced",
+				status.ID, tweet.ID, len(mediaIDs))
+			continue
+		}
+
+		// Edits replace a status' text wholesale, so start from its source
+		// to leave everything but its media untouched.
+		source, err := client.GetStatusSource(ctx, status.ID)
+		if err != nil {
+			return fmt.Errorf("error getting source of status %v: %w", status.ID, err)
+		}
+
+		toot := &mastodon.Toot{
+			Language:    status.Language,
+			MediaIDs:    mediaIDs,
+			Sensitive:   status.Sensitive,
+			SpoilerText: source.SpoilerText,
+			Status:      source.Text,
+		}
+
+		if _, err := client.UpdateStatus(ctx, toot, status.ID); err != nil {
+			return fmt.Errorf("error updating media of status %v: %w", status.ID, err)
+		}
+
+		state.attachMedia(mediaIDs)
+
+		logger.Infof("Re-attached %v media attachment(s) of tweet %v to Mastodon status %v",
+			len(mediaIDs), tweet.ID, status.ID)
+		numRepaired++
+	}
+
+	logger.Infof("Repaired media of %v status(es)", numRepaired)
+
+	if conf.StateFile != "" && !conf.DryRun {
+		return state.save(conf.StateFile)
+	}
+
+	return nil
+}
+
+// tweetPhotos returns a tweet's photos, which are the only media that's
+// synced.
+func tweetPhotos(tweet *Tweet) []*TweetEntitiesMedia {
+	if tweet.Entities == nil {
+		return nil
+	}
+
+	var photos []*TweetEntitiesMedia
+	for _, media := range tweet.Entities.Medias {
+		if media.Type == "photo" {
+			photos = append(photos, media)
+		}
+	}
+
+	return photos
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/mattn/go-mastodon"
+	assert "github.com/stretchr/testify/require"
+)
+
+func TestRepairMissingMedia(t *testing.T) {
+	server := serveMedia(t, []byte("GIF89a fake image contents"))
+
+	source := writeTweetData(t, `
+[[tweets]]
+id = 2
+text = "Birdwatching this morning turned up a heron."
+
+  [[tweets.entities.medias]]
+  id = 20
+  type = "photo"
+  url = "`+server.URL+`/bird.jpg"
+
+[[tweets]]
+id = 1
+text = "My cats found the only sunny spot in the house."
+
+  [[tweets.entities.medias]]
+  id = 10
+  type = "photo"
+  url = "`+server.URL+`/cat1.jpg"
+
+  [[tweets.entities.medias]]
+  id = 11
+  type = "photo"
+  url = "`+server.URL+`/cat2.jpg"
+`)
+
+	conf := &Conf{MaxTweetsToSync: 10, ReconcileLimit: 100, RepairMissingMedia: true}
+
+	newClient := func() *fakeClient {
+		return &fakeClient{statuses: []*mastodon.Status{
+			{ID: "200", Content: `<p>Birdwatching this morning turned up a heron.</p>`,
+				MediaAttachments: []mastodon.Attachment{{ID: "old-2"}}},
+			{ID: "100", Content: `<p>My cats found the only sunny spot in the house.</p>`, Language: "en",
+				MediaAttachments: []mastodon.Attachment{{ID: "old-1"}}},
+		}}
+	}
+
+	client := newClient()
+	assert.NoError(t, syncTwitter(context.Background(), conf, client, source))
+
+	// Never posts.
+	assert.Empty(t, client.postedToots)
+
+	// Only the status missing media is edited, and gets all of it.
+	assert.Len(t, client.updatedToots, 1)
+	assert.Equal(t, &mastodon.Toot{
+		Language: "en",
+		MediaIDs: []mastodon.ID{"media-1", "media-2"},
+		Status:   "source of 100",
+	}, client.updatedToots["100"])
+
+	t.Run("DryRun", func(t *testing.T) {
+		conf := *conf
+		conf.DryRun = true
+
+		client := newClient()
+		logs := captureLogger(t)
+		assert.NoError(t, syncTwitter(context.Background(), &conf, client, source))
+		assert.Empty(t, client.uploadedMedia)
+		assert.Empty(t, client.updatedToots)
+		assert.Contains(t, logs.String(), "Would have re-attached media of tweet 1 to Mastodon status 100")
+	})
+}
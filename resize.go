@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"os"
+)
+
+// resizeImage downscales the JPEG or PNG image at src to fit within
+// maxDimension pixels on its longest side, preserving its aspect ratio, and
+// writes the result to dst. Returns false without writing anything if src is
+// already small enough, or isn't a JPEG or PNG. GIFs are left alone because
+// only their first frame could be resized.
+func resizeImage(src, dst string, maxDimension int) (bool, error) {
+	f, err := os.Open(src)
+	if err != nil {
+		return false, fmt.Errorf("error opening '%v': %w", src, err)
+	}
+	defer f.Close()
+
+	config, format, err := image.DecodeConfig(f)
+	if err != nil || (format != "jpeg" && format != "png") {
+		return false, nil
+	}
+
+	if config.Width <= maxDimension && config.Height <= maxDimension {
+		return false, nil
+	}
+
+	if _, err := f.Seek(0, 0); err != nil {
+		return false, fmt.Errorf("error rewinding '%v': %w", src, err)
+	}
+
+	img, _, err := image.Decode(f)
+	if err != nil {
+		return false, fmt.Errorf("error decoding '%v': %w", src, err)
+	}
+
+	width, height := maxDimension, maxDimension
+	if config.Width > config.Height {
+		height = max(1, config.Height*maxDimension/config.Width)
+	} else {
+		width = max(1, config.Width*maxDimension/config.Height)
+	}
+
+	resized := downscaleImage(img, width, height)
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return false, fmt.Errorf("error creating '%v': %w", dst, err)
+	}
+	defer out.Close()
+
+	if format == "jpeg" {
+		err = jpeg.Encode(out, resized, &jpeg.Options{Quality: 90})
+	} else {
+		err = png.Encode(out, resized)
+	}
+	if err != nil {
+		return false, fmt.Errorf("error encoding '%v': %w", dst, err)
+	}
+
+	if err := out.Close(); err != nil {
+		return false, fmt.Errorf("error closing '%v': %w", dst, err)
+	}
+
+	logger.Infof("Resized '%s' from %dx%d to %dx%d", src, config.Width, config.Height, width, height)
+
+	return true, nil
+}
+
+// downscaleImage scales an image down to the given size, setting each pixel
+// to the average of the pixels in the area of the original that it covers.
+func downscaleImage(img image.Image, width, height int) *image.RGBA {
+	bounds := img.Bounds()
+	srcWidth, srcHeight := bounds.Dx(), bounds.Dy()
+
+	resized := image.NewRGBA(image.Rect(0, 0, width, height))
+
+	for y := 0; y < height; y++ {
+		y0 := bounds.Min.Y + y*srcHeight/height
+		y1 := max(y0+1, bounds.Min.Y+(y+1)*srcHeight/height)
+
+		for x := 0; x < width; x++ {
+			x0 := bounds.Min.X + x*srcWidth/width
+			x1 := max(x0+1, bounds.Min.X+(x+1)*srcWidth/width)
+
+			var r, g, b, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					pr, pg, pb, pa := img.At(sx, sy).RGBA()
+					r, g, b, a = r+uint64(pr), g+uint64(pg), b+uint64(pb), a+uint64(pa)
+					n++
+				}
+			}
+
+			resized.Set(x, y, color.RGBA64{
+				R: uint16(r / n), G: uint16(g / n), B: uint16(b / n), A: uint16(a / n),
+			})
+		}
+	}
+
+	return resized
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	assert "github.com/stretchr/testify/require"
+)
+
+func TestResizeImage(t *testing.T) {
+	writeImage := func(t *testing.T, name string, width, height int) string {
+		img := image.NewRGBA(image.Rect(0, 0, width, height))
+		for y := 0; y < height; y++ {
+			for x := 0; x < width; x++ {
+				img.Set(x, y, color.RGBA{R: 200, G: 100, B: 50, A: 255})
+			}
+		}
+
+		path := filepath.Join(t.TempDir(), name)
+		f, err := os.Create(path)
+		assert.NoError(t, err)
+		defer f.Close()
+
+		if filepath.Ext(name) == ".png" {
+			assert.NoError(t, png.Encode(f, img))
+		} else {
+			assert.NoError(t, jpeg.Encode(f, img, nil))
+		}
+
+		return path
+	}
+
+	readConfig := func(t *testing.T, path string) (image.Config, string) {
+		f, err := os.Open(path)
+		assert.NoError(t, err)
+		defer f.Close()
+
+		config, format, err := image.DecodeConfig(f)
+		assert.NoError(t, err)
+		return config, format
+	}
+
+	t.Run("DownscalesPNG", func(t *testing.T) {
+		dst := filepath.Join(t.TempDir(), "resized.png")
+
+		resized, err := resizeImage(writeImage(t, "wide.png", 400, 200), dst, 100)
+		assert.NoError(t, err)
+		assert.True(t, resized)
+
+		config, format := readConfig(t, dst)
+		assert.Equal(t, "png", format)
+		assert.Equal(t, 100, config.Width)
+		assert.Equal(t, 50, config.Height)
+
+		// Colors survive averaging.
+		f, err := os.Open(dst)
+		assert.NoError(t, err)
+		defer f.Close()
+		img, err := png.Decode(f)
+		assert.NoError(t, err)
+		r, g, b, _ := img.At(50, 25).RGBA()
+		assert.Equal(t, []uint32{200, 100, 50}, []uint32{r >> 8, g >> 8, b >> 8})
+	})
+
+	t.Run("DownscalesJPEG", func(t *testing.T) {
+		dst := filepath.Join(t.TempDir(), "resized.jpg")
+
+		resized, err := resizeImage(writeImage(t, "tall.jpg", 150, 600), dst, 200)
+		assert.NoError(t, err)
+		assert.True(t, resized)
+
+		config, format := readConfig(t, dst)
+		assert.Equal(t, "jpeg", format)
+		assert.Equal(t, 50, config.Width)
+		assert.Equal(t, 200, config.Height)
+	})
+
+	t.Run("WithinLimit", func(t *testing.T) {
+		dst := filepath.Join(t.TempDir(), "resized.png")
+
+		resized, err := resizeImage(writeImage(t, "small.png", 100, 50), dst, 100)
+		assert.NoError(t, err)
+		assert.False(t, resized)
+		assert.NoFileExists(t, dst)
+	})
+
+	t.Run("NotAnImage", func(t *testing.T) {
+		src := filepath.Join(t.TempDir(), "video.mp4")
+		assert.NoError(t, ioutil.WriteFile(src, []byte("not an image"), 0o600))
+		dst := filepath.Join(t.TempDir(), "resized.mp4")
+
+		resized, err := resizeImage(src, dst, 100)
+		assert.NoError(t, err)
+		assert.False(t, resized)
+		assert.NoFileExists(t, dst)
+	})
+}
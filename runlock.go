@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"strings"
+	"time"
+)
+
+// acquireRunLock guards against the program being run again too soon after
+// (or while) a previous run, which might double-post tweets whose statuses
+// aren't visible through the API yet.
+//
+// A lock file at the given path with a `.lock` suffix is held for the
+// duration of a run, and the time at which each run started is recorded at
+// the path itself. An error is returned if the lock is already held or if the
+// last run started less than minInterval ago, unless force is set.
+//
+// The lock file holds a token unique to the run that created it, and is only
+// removed by that run, so a forced run leaves a lock held by another run in
+// place.
+//
+// The returned function releases the lock, and should be deferred so that the
+// lock is released even if the run fails.
+func acquireRunLock(path string, minInterval time.Duration, force bool, now time.Time) (func(), error) {
+	lockPath := path + ".lock"
+	token := fmt.Sprintf("%d-%x\n", os.Getpid(), rand.Int63())
+
+	f, err := os.OpenFile(lockPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+	switch {
+	case os.IsExist(err) && force:
+		logger.Warnf("Lock file '%v' exists, but ignoring it because of -force", lockPath)
+	case os.IsExist(err):
+		return nil, fmt.Errorf("another run appears to be in progress because lock file '%v' exists; "+
+			"if it's stale, remove it or re-run with -force", lockPath)
+	case err != nil:
+		return nil, fmt.Errorf("error creating lock file: %w", err)
+	default:
+		_, err := f.WriteString(token)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			os.Remove(lockPath)
+			return nil, fmt.Errorf("error writing lock file: %w", err)
+		}
+	}
+
+	release := func() {
+		data, err := ioutil.ReadFile(lockPath)
+		if os.IsNotExist(err) {
+			return
+		}
+		if err != nil {
+			logger.Warnf("Error reading lock file '%v': %v", lockPath, err)
+			return
+		}
+
+		if string(data) != token {
+			logger.Infof("Lock file '%v' is held by another run; leaving it in place", lockPath)
+			return
+		}
+
+		if err := os.Remove(lockPath); err != nil && !os.IsNotExist(err) {
+			logger.Warnf("Error removing lock file '%v': %v", lockPath, err)
+		}
+	}
+
+	lastStart, err := readRunStart(path)
+	if err != nil {
+		release()
+		return nil, err
+	}
+
+	if !force && minInterval > 0 && !lastStart.IsZero() && now.Sub(lastStart) < minInterval {
+		release()
+		return nil, fmt.Errorf("last run started at %v, less than the minimum run interval of %v ago; "+
+			"re-run with -force to run anyway", lastStart.Format(time.RFC3339), minInterval)
+	}
+
+	err = writeFileAtomic(path, []byte(now.UTC().Format(time.RFC3339)+"\n"))
+	if err != nil {
+		release()
+		return nil, fmt.Errorf("error writing run lock file: %w", err)
+	}
+
+	return release, nil
+}
+
+// readRunStart reads the time at which the last run started from a run lock
+// file (see `Conf.RunLockFile`). A zero time is returned if the file doesn't
+// exist yet.
+func readRunStart(path string) (time.Time, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, fmt.Errorf("error reading run lock file: %w", err)
+	}
+
+	lastStart, err := time.Parse(time.RFC3339, strings.TrimSpace(string(data)))
+	if err != nil {
+		return time.Time{}, fmt.Errorf("error parsing run lock file: %w", err)
+	}
+
+	return lastStart, nil
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	assert "github.com/stretchr/testify/require"
+)
+
+func TestAcquireRunLock(t *testing.T) {
+	now := time.Date(2021, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	t.Run("RefusesTooSoonRun", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "run")
+
+		release, err := acquireRunLock(path, 10*time.Minute, false, now)
+		assert.NoError(t, err)
+		release()
+		assert.NoFileExists(t, path+".lock")
+
+		_, err = acquireRunLock(path, 10*time.Minute, false, now.Add(5*time.Second))
+		assert.EqualError(t, err, "last run started at 2021-01-02T03:04:05Z, less than the minimum "+
+			"run interval of 10m0s ago; re-run with -force to run anyway")
+
+		// The lock isn't left behind by a refused run.
+		assert.NoFileExists(t, path+".lock")
+	})
+
+	t.Run("AllowsRunAfterInterval", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "run")
+
+		release, err := acquireRunLock(path, 10*time.Minute, false, now)
+		assert.NoError(t, err)
+		release()
+
+		release, err = acquireRunLock(path, 10*time.Minute, false, now.Add(11*time.Minute))
+		assert.NoError(t, err)
+		release()
+
+		data, err := ioutil.ReadFile(path)
+		assert.NoError(t, err)
+		assert.Equal(t, "2021-01-02T03:15:05Z\n", string(data))
+	})
+
+	t.Run("RefusesConcurrentRun", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "run")
+
+		release, err := acquireRunLock(path, 0, false, now)
+		assert.NoError(t, err)
+		defer release()
+
+		_, err = acquireRunLock(path, 0, false, now.Add(1*time.Hour))
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "another run appears to be in progress")
+
+		// The refused run doesn't release the lock held by the first.
+		assert.FileExists(t, path+".lock")
+	})
+
+	t.Run("Force", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "run")
+
+		_, err := acquireRunLock(path, 10*time.Minute, false, now)
+		assert.NoError(t, err)
+
+		// Neither the held lock nor the interval stop a forced run.
+		release, err := acquireRunLock(path, 10*time.Minute, true, now.Add(5*time.Second))
+		assert.NoError(t, err)
+		release()
+	})
+
+	t.Run("ForcedRunLeavesLockOfOtherRun", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "run")
+
+		release, err := acquireRunLock(path, 0, false, now)
+		assert.NoError(t, err)
+
+		forcedRelease, err := acquireRunLock(path, 0, true, now.Add(5*time.Second))
+		assert.NoError(t, err)
+
+		// The forced run finishing doesn't remove the lock held by the first,
+		// but the first finishing does.
+		forcedRelease()
+		assert.FileExists(t, path+".lock")
+
+		release()
+		assert.NoFileExists(t, path+".lock")
+	})
+}
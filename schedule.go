@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"math/rand"
+	"time"
+	"unicode/utf8"
+)
+
+// minScheduleLead is how far in the future a status must be scheduled for.
+// Mastodon rejects statuses scheduled less than five minutes out, and an extra
+// minute is added to account for time that passes before a request reaches
+// the server.
+const minScheduleLead = 6 * time.Minute
+
+// Mastodon limits how many statuses an account can have scheduled at once, and
+// how many can be scheduled for any one day (in UTC), rejecting any more.
+const (
+	maxScheduledStatuses       = 300
+	maxScheduledStatusesPerDay = 25
+)
+
+// Schedule hands out spaced times at which to schedule statuses when
+// `Conf.ScheduleSpacing` is set. Spacing is even unless `Conf.PostJitter` is
+// set.
+type Schedule struct {
+	jitter  float64
+	nextAt  time.Time
+	spacing time.Duration
+
+	// perDay and total count the statuses that are scheduled, including those
+	// scheduled by earlier runs that haven't been published yet, so that
+	// Mastodon's limits aren't exceeded. perDay is keyed by the start of each
+	// day in UTC.
+	perDay map[time.Time]int
+	total  int
+
+	// rand is the source of randomness for jitter. It can be replaced with
+	// one that's seeded for deterministic output.
+	rand *rand.Rand
+}
+
+// newSchedule initializes a schedule that starts at `Conf.ScheduleStart` (or
+// as soon as possible if it's not set), or after the last of the statuses
+// that earlier runs scheduled if it's later, so that a second run doesn't
+// double up on the times handed out by the first. Returns nil if scheduling
+// isn't configured.
+func newSchedule(conf *Conf, state *State, now time.Time) *Schedule {
+	if conf.ScheduleSpacing <= 0 {
+		return nil
+	}
+
+	s := &Schedule{
+		jitter:  float64(conf.PostJitter),
+		nextAt:  conf.ScheduleStart,
+		perDay:  make(map[time.Time]int),
+		rand:    rand.New(rand.NewSource(time.Now().UnixNano())),
+		spacing: conf.ScheduleSpacing,
+	}
+
+	// Merged tweets are recorded against the same status, which is only
+	// counted once.
+	counted := make(map[string]bool)
+	for _, stateTweet := range state.Tweets {
+		if !stateTweet.ScheduledAt.After(now) || counted[stateTweet.StatusID] {
+			continue
+		}
+		counted[stateTweet.StatusID] = true
+
+		s.count(stateTweet.ScheduledAt)
+
+		if after := stateTweet.ScheduledAt.Add(s.spacing); after.After(s.nextAt) {
+			s.nextAt = after
+		}
+	}
+
+	return s
+}
+
+// count counts a status scheduled for the given time against Mastodon's
+// limits.
+func (s *Schedule) count(at time.Time) {
+	s.perDay[scheduleDay(at)]++
+	s.total++
+}
+
+// full returns whether as many statuses are scheduled as Mastodon allows, in
+// which case no more can be until some of them are published. Always false
+// for a nil schedule.
+func (s *Schedule) full() bool {
+	return s != nil && s.total >= maxScheduledStatuses
+}
+
+// next returns the time at which to schedule the next status, which is never
+// sooner than minScheduleLead from now, or on a day that's already full.
+// Returns nil for a nil schedule so that statuses are posted immediately.
+func (s *Schedule) next(now time.Time) *time.Time {
+	if s == nil {
+		return nil
+	}
+
+	at := s.nextAt
+	if earliest := now.Add(minScheduleLead); at.Before(earliest) {
+		at = earliest
+	}
+
+	// Move on to the start of the next day once a day has as many statuses
+	// as Mastodon allows.
+	for s.perDay[scheduleDay(at)] >= maxScheduledStatusesPerDay {
+		at = scheduleDay(at).Add(24 * time.Hour)
+	}
+
+	s.count(at)
+	s.nextAt = at.Add(s.interval())
+
+	return &at
+}
+
+// interval returns the interval until the status after the next one, which is
+// the schedule's spacing varied randomly by up to its jitter in either
+// direction.
+func (s *Schedule) interval() time.Duration {
+	return applyJitter(s.spacing, s.jitter, s.rand)
+}
+
+// applyJitter varies a duration randomly by up to the given fraction of it in
+// either direction.
+func applyJitter(d time.Duration, jitter float64, r *rand.Rand) time.Duration {
+	if jitter <= 0 {
+		return d
+	}
+
+	// A factor in [1 - jitter, 1 + jitter).
+	factor := 1 + jitter*(2*r.Float64()-1)
+
+	return time.Duration(float64(d) * factor)
+}
+
+// postDelay returns how long to wait after posting content before posting the
+// next status, which is `Conf.DelayPerChar` for each of its characters,
+// clamped to between `Conf.DelayPerCharMin` and `Conf.DelayPerCharMax` (if
+// set), and then varied by `Conf.PostJitter`. Returns zero if DelayPerChar
+// isn't set.
+func postDelay(conf *Conf, content string, r *rand.Rand) time.Duration {
+	if conf.DelayPerChar <= 0 {
+		return 0
+	}
+
+	delay := time.Duration(utf8.RuneCountInString(content)) * conf.DelayPerChar
+
+	if delay < conf.DelayPerCharMin {
+		delay = conf.DelayPerCharMin
+	}
+	if conf.DelayPerCharMax > 0 && delay > conf.DelayPerCharMax {
+		delay = conf.DelayPerCharMax
+	}
+
+	return applyJitter(delay, float64(conf.PostJitter), r)
+}
+
+// scheduleDay returns the start of the day (in UTC) that a status scheduled
+// for the given time counts against for Mastodon's daily limit.
+func scheduleDay(at time.Time) time.Time {
+	return at.UTC().Truncate(24 * time.Hour)
+}
+
+// sleepContext sleeps for the given duration, returning early with the
+// context's error if it's cancelled first.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(d):
+		return nil
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mattn/go-mastodon"
+	assert "github.com/stretchr/testify/require"
+)
+
+func TestPostDelay(t *testing.T) {
+	conf := &Conf{
+		DelayPerChar:    100 * time.Millisecond,
+		DelayPerCharMax: 30 * time.Second,
+		DelayPerCharMin: 2 * time.Second,
+	}
+
+	// Scales with length.
+	assert.Equal(t, 5*time.Second, postDelay(conf, strings.Repeat("x", 50), nil))
+	assert.Equal(t, 10*time.Second, postDelay(conf, strings.Repeat("x", 100), nil))
+
+	// Clamped to the minimum and maximum.
+	assert.Equal(t, 2*time.Second, postDelay(conf, "Short", nil))
+	assert.Equal(t, 30*time.Second, postDelay(conf, strings.Repeat("x", 500), nil))
+
+	t.Run("DisabledByDefault", func(t *testing.T) {
+		assert.Equal(t, time.Duration(0), postDelay(&Conf{}, strings.Repeat("x", 100), nil))
+	})
+
+	t.Run("Jitter", func(t *testing.T) {
+		conf := *conf
+		conf.PostJitter = 0.2
+
+		r := rand.New(rand.NewSource(1))
+		for i := 0; i < 100; i++ {
+			delay := postDelay(&conf, strings.Repeat("x", 100), r)
+			assert.GreaterOrEqual(t, int64(delay), int64(8*time.Second))
+			assert.Less(t, int64(delay), int64(12*time.Second))
+		}
+	})
+}
+
+func TestScheduleNext(t *testing.T) {
+	now := time.Date(2021, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	t.Run("NotConfigured", func(t *testing.T) {
+		assert.Nil(t, newSchedule(&Conf{}, &State{}, now).next(now))
+	})
+
+	t.Run("SpacesFromStart", func(t *testing.T) {
+		schedule := newSchedule(&Conf{
+			ScheduleSpacing: 2 * time.Hour,
+			ScheduleStart:   now.Add(24 * time.Hour),
+		}, &State{}, now)
+
+		assert.Equal(t, now.Add(24*time.Hour), *schedule.next(now))
+		assert.Equal(t, now.Add(26*time.Hour), *schedule.next(now))
+		assert.Equal(t, now.Add(28*time.Hour), *schedule.next(now))
+	})
+
+	t.Run("RespectsMinimumLead", func(t *testing.T) {
+		schedule := newSchedule(&Conf{ScheduleSpacing: 2 * time.Minute}, &State{}, now)
+
+		assert.Equal(t, now.Add(minScheduleLead), *schedule.next(now))
+		assert.Equal(t, now.Add(minScheduleLead+2*time.Minute), *schedule.next(now))
+
+		// If posting falls behind the schedule, times are pushed back.
+		later := now.Add(time.Hour)
+		assert.Equal(t, later.Add(minScheduleLead), *schedule.next(later))
+	})
+
+	t.Run("Jitter", func(t *testing.T) {
+		schedule := newSchedule(&Conf{
+			PostJitter:      0.25,
+			ScheduleSpacing: 1 * time.Hour,
+			ScheduleStart:   now.Add(24 * time.Hour),
+		}, &State{}, now)
+		schedule.rand = rand.New(rand.NewSource(1))
+
+		var intervals []time.Duration
+		last := *schedule.next(now)
+		for i := 0; i < 100; i++ {
+			at := *schedule.next(now)
+			intervals = append(intervals, at.Sub(last))
+			last = at
+		}
+
+		for _, interval := range intervals {
+			assert.GreaterOrEqual(t, int64(interval), int64(45*time.Minute))
+			assert.Less(t, int64(interval), int64(75*time.Minute))
+		}
+
+		// Intervals actually vary.
+		assert.NotEqual(t, intervals[0], intervals[1])
+
+		// The same seed produces the same intervals.
+		other := newSchedule(&Conf{
+			PostJitter:      0.25,
+			ScheduleSpacing: 1 * time.Hour,
+			ScheduleStart:   now.Add(24 * time.Hour),
+		}, &State{}, now)
+		other.rand = rand.New(rand.NewSource(1))
+		other.next(now)
+		assert.Equal(t, now.Add(24*time.Hour).Add(intervals[0]), *other.next(now))
+	})
+
+	t.Run("ContinuesAfterEarlierRun", func(t *testing.T) {
+		conf := &Conf{
+			ScheduleSpacing: 2 * time.Hour,
+			ScheduleStart:   now.Add(24 * time.Hour),
+		}
+
+		state := &State{}
+		first := newSchedule(conf, state, now)
+		for i, tweetID := range []int64{1, 2, 3} {
+			at := *first.next(now)
+			state.recordTweetScheduledStatus(tweetID, mastodon.ID(fmt.Sprintf("%d", i)), "public", at)
+		}
+
+		// A status that's since been published doesn't hold the schedule
+		// back.
+		state.recordTweetScheduledStatus(4, "4", "public", now.Add(-time.Hour))
+
+		second := newSchedule(conf, state, now)
+		assert.Equal(t, now.Add(30*time.Hour), *second.next(now))
+		assert.Equal(t, now.Add(32*time.Hour), *second.next(now))
+	})
+
+	t.Run("DailyLimit", func(t *testing.T) {
+		midnight := time.Date(2021, 1, 2, 0, 0, 0, 0, time.UTC)
+		schedule := newSchedule(&Conf{
+			ScheduleSpacing: 10 * time.Minute,
+			ScheduleStart:   midnight,
+		}, &State{}, now)
+
+		for i := 0; i < maxScheduledStatusesPerDay; i++ {
+			assert.Equal(t, midnight.Add(time.Duration(i)*10*time.Minute), *schedule.next(now))
+		}
+
+		// The day is full, so the schedule moves on to the next one.
+		assert.Equal(t, midnight.Add(24*time.Hour), *schedule.next(now))
+	})
+
+	t.Run("TotalLimit", func(t *testing.T) {
+		state := &State{}
+		for i := 0; i < maxScheduledStatuses-1; i++ {
+			state.recordTweetScheduledStatus(int64(i), mastodon.ID(fmt.Sprintf("%d", i)), "public",
+				now.Add(time.Duration(i+1)*time.Hour))
+		}
+
+		schedule := newSchedule(&Conf{ScheduleSpacing: time.Hour}, state, now)
+		assert.False(t, schedule.full())
+
+		schedule.next(now)
+		assert.True(t, schedule.full())
+
+		assert.False(t, newSchedule(&Conf{}, state, now).full())
+	})
+}
+
+func TestSleepContext(t *testing.T) {
+	assert.NoError(t, sleepContext(context.Background(), time.Millisecond))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.Equal(t, context.Canceled, sleepContext(ctx, time.Hour))
+}
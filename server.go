@@ -0,0 +1,287 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// ServerProfile describes how the software that a Mastodon-compatible server
+// runs differs from Mastodon in ways that matter when posting to it.
+type ServerProfile struct {
+	// Software is the name of the server's software as reported through
+	// nodeinfo, like `mastodon` or `gotosocial`.
+	Software string
+
+	// Version is the version of the server's software, if known.
+	Version string
+
+	// DefaultLimits are the limits assumed for any that the server doesn't
+	// advertise through its instance configuration (see
+	// fetchInstanceLimits).
+	DefaultLimits InstanceLimits
+
+	// Idempotency is whether the server honors the Idempotency-Key header,
+	// which keeps a status that's posted again (like after a retry) from
+	// being duplicated.
+	Idempotency bool
+
+	// PollMediaProcessing is whether media may still be processing after
+	// it's been uploaded, in which case it's polled until it's ready before
+	// posting (see waitForMediaProcessed).
+	PollMediaProcessing bool
+}
+
+// mastodonServerProfile is the profile of a stock Mastodon server, which is
+// also assumed for any server running unknown software.
+var mastodonServerProfile = ServerProfile{
+	Software:            "mastodon",
+	DefaultLimits:       defaultInstanceLimits,
+	Idempotency:         true,
+	PollMediaProcessing: true,
+}
+
+// pleromaServerProfile is the profile of Pleroma and its fork Akkoma. They
+// advertise their character limit in a field of their own rather than in the
+// instance configuration, so their stock limit is assumed instead, and they
+// process media as it's uploaded.
+var pleromaServerProfile = ServerProfile{
+	Software:            "pleroma",
+	DefaultLimits:       withMaxCharacters(defaultInstanceLimits, 5000),
+	Idempotency:         true,
+	PollMediaProcessing: false,
+}
+
+// serverProfiles are the profiles of known server software by name.
+var serverProfiles = map[string]ServerProfile{
+	"akkoma":   pleromaServerProfile,
+	"mastodon": mastodonServerProfile,
+	"pleroma":  pleromaServerProfile,
+
+	// GoToSocial ignores the Idempotency-Key header and only returns media
+	// from an upload once it's been processed.
+	"gotosocial": {
+		Software:            "gotosocial",
+		DefaultLimits:       withMaxCharacters(defaultInstanceLimits, 5000),
+		Idempotency:         false,
+		PollMediaProcessing: false,
+	},
+}
+
+// serverProfile is the profile of the server being posted to. It's set on
+// startup by detectServerProfile, and assumed to be Mastodon until then.
+var serverProfile = &mastodonServerProfile
+
+// compatibleVersionRE matches the version that Mastodon-compatible servers
+// like Pleroma report through the instance endpoint, like
+// `2.7.2 (compatible; Pleroma 2.5.0)`, capturing the name and version of
+// their software.
+var compatibleVersionRE = regexp.MustCompile(`\(compatible; ([\w-]+) ([^)\s]+)\)`)
+
+// nodeInfoSchemaPrefix prefixes the `rel` of the links to nodeinfo documents
+// listed by a server's `/.well-known/nodeinfo`.
+const nodeInfoSchemaPrefix = "http://nodeinfo.diaspora.software/ns/schema/"
+
+// detectServerProfile determines the profile of the server at serverURL from
+// the software it reports through nodeinfo, falling back to the version
+// reported through its instance endpoint. ServerSoftware takes precedence
+// over detection if it's set. Software that can't be detected or isn't known
+// is assumed to behave like Mastodon.
+func detectServerProfile(ctx context.Context, conf *Conf, client mastodonClient, serverURL string) *ServerProfile {
+	software, version := strings.ToLower(conf.ServerSoftware), ""
+
+	if software == "" {
+		var err error
+		software, version, err = fetchNodeInfoSoftware(ctx, serverURL)
+		if err != nil {
+			logger.Warnf("Couldn't detect server software through nodeinfo: %v", err)
+
+			if instance, err := client.GetInstance(ctx); err == nil {
+				if matches := compatibleVersionRE.FindStringSubmatch(instance.Version); matches != nil {
+					software, version = strings.ToLower(matches[1]), matches[2]
+				} else if instance.Version != "" {
+					software, version = "mastodon", instance.Version
+				}
+			}
+		}
+	}
+
+	profile, ok := serverProfiles[software]
+	if !ok {
+		if software == "" {
+			logger.Warnf("Couldn't detect server software; assuming it behaves like Mastodon")
+		} else {
+			logger.Warnf("Unknown server software '%s'; assuming it behaves like Mastodon", software)
+		}
+		profile = mastodonServerProfile
+	}
+
+	if software != "" {
+		profile.Software = software
+	}
+	profile.Version = version
+
+	logger.Infof("Server is running %s %s", profile.Software, profile.Version)
+
+	return &profile
+}
+
+// fetchNodeInfoSoftware fetches the name and version of the software that
+// the server at serverURL runs through nodeinfo.
+func fetchNodeInfoSoftware(ctx context.Context, serverURL string) (string, string, error) {
+	var wellKnown struct {
+		Links []struct {
+			Href string `json:"href"`
+			Rel  string `json:"rel"`
+		} `json:"links"`
+	}
+	if err := fetchJSON(ctx, strings.TrimSuffix(serverURL, "/")+"/.well-known/nodeinfo", &wellKnown); err != nil {
+		return "", "", err
+	}
+
+	var href string
+	for _, link := range wellKnown.Links {
+		if strings.HasPrefix(link.Rel, nodeInfoSchemaPrefix) {
+			href = link.Href
+		}
+	}
+	if href == "" {
+		return "", "", fmt.Errorf("no nodeinfo document linked")
+	}
+
+	var nodeInfo struct {
+		Software struct {
+			Name    string `json:"name"`
+			Version string `json:"version"`
+		} `json:"software"`
+	}
+	if err := fetchJSON(ctx, href, &nodeInfo); err != nil {
+		return "", "", err
+	}
+
+	if nodeInfo.Software.Name == "" {
+		return "", "", fmt.Errorf("nodeinfo document doesn't name software")
+	}
+
+	return strings.ToLower(nodeInfo.Software.Name), nodeInfo.Software.Version, nil
+}
+
+// fetchJSON fetches the JSON document at a URL and decodes it into v.
+func fetchJSON(ctx context.Context, url string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return fmt.Errorf("error creating request: %w", err)
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("error fetching '%s': %w", url, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status fetching '%s': %v", url, resp.Status)
+	}
+
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(v); err != nil {
+		return fmt.Errorf("error decoding '%s': %w", url, err)
+	}
+
+	return nil
+}
+
+// idempotencyKeyContextKey is the context key under which the idempotency
+// key of a request is stored (see withIdempotencyKey).
+type idempotencyKeyContextKey struct{}
+
+// idempotencyTransport sends the idempotency key stored in a request's
+// context (if any) as an Idempotency-Key header on POST requests, as long as
+// the server supports them according to serverProfile. Requests made
+// through go-mastodon can't be given headers of their own, so this is how
+// keys get to the server.
+type idempotencyTransport struct {
+	base http.RoundTripper
+}
+
+func (t *idempotencyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	base := t.base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+
+	key, ok := req.Context().Value(idempotencyKeyContextKey{}).(string)
+	if !ok || req.Method != http.MethodPost || !serverProfile.Idempotency {
+		return base.RoundTrip(req)
+	}
+
+	req = req.Clone(req.Context())
+	req.Header.Set("Idempotency-Key", key)
+	return base.RoundTrip(req)
+}
+
+// withIdempotencyKey returns a context whose POST requests are sent with the
+// given idempotency key (see idempotencyTransport).
+func withIdempotencyKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, idempotencyKeyContextKey{}, key)
+}
+
+// serverHostRE matches a valid server host name or IPv4 address, including
+// internationalized domain names in their Unicode form. IPv6 addresses are
+// checked separately (see validServerHost).
+var serverHostRE = regexp.MustCompile(`^[\p{L}\p{N}]([\p{L}\p{N}-]*[\p{L}\p{N}])?(\.[\p{L}\p{N}]([\p{L}\p{N}-]*[\p{L}\p{N}])?)*$`)
+
+// normalizeServerURL produces the canonical form of MastodonServerURL that
+// requests are built from, which is a base URL like
+// `https://mastodon.social` with a scheme and without a trailing slash. A
+// bare domain is assumed to be served over HTTPS. Anything that isn't an
+// HTTP or HTTPS URL of a valid host is rejected.
+func normalizeServerURL(serverURL string) (string, error) {
+	raw := strings.TrimSpace(serverURL)
+	if raw == "" {
+		return "", fmt.Errorf("MASTODON_SERVER_URL is empty")
+	}
+
+	if !strings.Contains(raw, "://") {
+		raw = "https://" + raw
+	}
+
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "", fmt.Errorf("MASTODON_SERVER_URL '%s' isn't a valid URL: %w", serverURL, err)
+	}
+
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return "", fmt.Errorf("MASTODON_SERVER_URL '%s' must be an HTTP or HTTPS URL, like https://mastodon.social",
+			serverURL)
+	}
+
+	if u.User != nil || u.RawQuery != "" || u.Fragment != "" {
+		return "", fmt.Errorf("MASTODON_SERVER_URL '%s' must be the server's base URL, like https://mastodon.social",
+			serverURL)
+	}
+
+	if !validServerHost(u.Hostname()) {
+		return "", fmt.Errorf("MASTODON_SERVER_URL '%s' doesn't have a valid host", serverURL)
+	}
+
+	return u.Scheme + "://" + strings.ToLower(u.Host) + strings.TrimRight(u.Path, "/"), nil
+}
+
+// validServerHost checks whether host, as returned by url.URL.Hostname, is a
+// valid host name or IP address for a server.
+func validServerHost(host string) bool {
+	return net.ParseIP(host) != nil || serverHostRE.MatchString(host)
+}
+
+// withMaxCharacters returns a copy of limits with a different MaxCharacters.
+func withMaxCharacters(limits InstanceLimits, maxCharacters int) InstanceLimits {
+	limits.MaxCharacters = maxCharacters
+	return limits
+}
@@ -0,0 +1,450 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mattn/go-mastodon"
+	"github.com/pelletier/go-toml"
+)
+
+// State is program state that's persisted between runs to a TOML file (see
+// `Conf.StateFile`).
+type State struct {
+	// Version is the version of the state file's format. Files written before
+	// the format was versioned don't have one, and are version 1.
+	Version int `toml:"version"`
+
+	// Account caches the Mastodon account that the access token belongs to
+	// (see `Conf.AccountCacheTTL`).
+	Account *StateAccount `toml:"account,omitempty"`
+
+	// Failures contains tweets that have failed to post, keyed by tweet ID,
+	// so that tweets which fail consistently can be skipped (see
+	// `Conf.MaxTweetFailures`).
+	Failures map[string]*StateFailure `toml:"failures,omitempty"`
+
+	// GapNotes contains the IDs of the statuses of gap notes that have been
+	// posted, keyed by the ID of the tweet that each was posted before, so
+	// that a note isn't posted again if the tweet has to be retried (see
+	// `Conf.GapNotes`).
+	GapNotes map[string]string `toml:"gap_notes,omitempty"`
+
+	// IntroStatusID is the ID of the status posted for `Conf.IntroToot`, so
+	// that it's never posted again.
+	IntroStatusID string `toml:"intro_status_id,omitempty"`
+
+	// Media contains media that's been uploaded to Mastodon but not yet
+	// attached to a status, keyed by the SHA256 hash of its contents.
+	Media map[string]*StateMedia `toml:"media"`
+
+	// Tweets contains tweets that have been posted to Mastodon, keyed by
+	// tweet ID, so that replies to them can be threaded (see
+	// `Conf.ThreadSelfReplies`).
+	Tweets map[string]*StateTweet `toml:"tweets"`
+}
+
+// StateAccount is the Mastodon account that the access token belongs to,
+// cached in the state file so that it doesn't have to be fetched every run.
+type StateAccount struct {
+	Acct      string    `toml:"acct"`
+	FetchedAt time.Time `toml:"fetched_at"`
+	ID        string    `toml:"id"`
+
+	// Server is the server URL that the account was fetched from. The cache
+	// is invalidated if MastodonServerURL changes.
+	Server string `toml:"server"`
+
+	// TokenHash is the SHA256 hash of the access token that the account was
+	// fetched with, so that the cache is invalidated if MastodonAccessToken
+	// changes to one for another account on the same server. The token itself
+	// is never stored.
+	TokenHash string `toml:"token_hash"`
+}
+
+// StateFailure is a tweet that's failed to post, recorded in the state file.
+type StateFailure struct {
+	// Count is the number of consecutive runs that the tweet has failed to
+	// post in.
+	Count int `toml:"count"`
+
+	// Reason is the error from the tweet's most recent failure.
+	Reason string `toml:"reason"`
+
+	// SkippedAt is set once the tweet has failed `Conf.MaxTweetFailures`
+	// times, after which it's skipped by all future runs.
+	SkippedAt time.Time `toml:"skipped_at,omitempty"`
+}
+
+// StateMedia is a media upload recorded in the state file.
+//
+// Mastodon only allows a media attachment to be attached to a single status,
+// and reaps media that's been uploaded but left unattached after about a day.
+// Uploads are recorded so that media which was uploaded during a run that
+// failed before its status could be posted can be reused by the next run
+// instead of being uploaded again, but they're removed as soon as they're
+// attached to a status, and only reused within `Conf.MediaReuseTTL` of having
+// been uploaded. When in doubt, media is uploaded again.
+type StateMedia struct {
+	ID         string    `toml:"id"`
+	UploadedAt time.Time `toml:"uploaded_at"`
+}
+
+// StateTweet is a tweet that's been posted to Mastodon, recorded in the state
+// file.
+type StateTweet struct {
+	// PostedAt is when the status was posted. Not recorded by older versions
+	// of the program.
+	PostedAt time.Time `toml:"posted_at,omitempty"`
+
+	// ScheduledAt is set if the tweet was scheduled rather than published
+	// immediately, in which case StatusID is the ID of the scheduled status.
+	// A scheduled status gets a new ID when it's published, so it's cleared
+	// once the published status is found (see resolveScheduledTweets).
+	ScheduledAt time.Time `toml:"scheduled_at,omitempty"`
+
+	// Snippet is the start of the status' text, for generateIndex. Not
+	// recorded for scheduled statuses, or by older versions of the program.
+	Snippet string `toml:"snippet,omitempty"`
+
+	StatusID string `toml:"status_id"`
+
+	// StatusURL is the public URL of the status. Not recorded for scheduled
+	// statuses, or by older versions of the program.
+	StatusURL string `toml:"status_url,omitempty"`
+
+	Visibility string `toml:"visibility"`
+}
+
+// currentStateVersion is the version of the state file's format written by
+// this version of the program.
+//
+// The version must be bumped along with a migration whenever a field is added
+// to state, even if the migration has nothing to do, so that older versions
+// of the program refuse to load the file rather than dropping the field when
+// they save it.
+const currentStateVersion = 10
+
+// stateMigrations upgrade state from older versions of the state file's
+// format, keyed by the version that they upgrade from to the next one.
+var stateMigrations = map[int]func(s *State){
+	// Version 2 added tweets so that threads can be reconstructed. Version 1
+	// files don't have any, which is fine, but also don't have a version.
+	1: func(s *State) {},
+
+	// Version 3 added the scheduled times of tweets posted as scheduled
+	// statuses. Older files don't have any scheduled tweets.
+	2: func(s *State) {},
+
+	// Version 4 added the posting times and URLs of tweets' statuses, which
+	// aren't known for tweets posted before.
+	3: func(s *State) {},
+
+	// Version 5 added the ID of the intro status. Older files predate it.
+	4: func(s *State) {},
+
+	// Version 6 added failures of tweets to post. Older files don't have any.
+	5: func(s *State) {},
+
+	// Version 7 added snippets of tweets' statuses, which aren't known for
+	// tweets posted before.
+	6: func(s *State) {},
+
+	// Version 8 added the cached account, which is fetched on the next run.
+	7: func(s *State) {},
+
+	// Version 9 added the hash of the access token to the cached account.
+	// Older caches don't have one, so they never match and are refreshed on
+	// the next run.
+	8: func(s *State) {},
+
+	// Version 10 added the gap notes that have been posted. Older files don't
+	// record any.
+	9: func(s *State) {},
+}
+
+// loadState loads state from the given path. An empty state is returned if
+// the path is empty (meaning no state file is configured) or if the file
+// doesn't exist yet.
+//
+// State files in an older format are migrated to the current one, and written
+// back in place if persistMigration is true, which it shouldn't be for modes
+// that only read state, like dry runs. An error is returned for state files
+// in a newer format than this version of the program knows about rather than
+// risking losing data that it doesn't understand.
+func loadState(path string, persistMigration bool) (*State, error) {
+	state := &State{Version: currentStateVersion}
+
+	if path != "" {
+		data, err := ioutil.ReadFile(path)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("error reading state file: %w", err)
+		}
+
+		if err == nil {
+			state.Version = 0
+
+			err = toml.Unmarshal(data, state)
+			if err != nil {
+				return nil, fmt.Errorf("error unmarshaling state file: %w", err)
+			}
+
+			migrated, err := state.migrate()
+			if err != nil {
+				return nil, err
+			}
+
+			if migrated && persistMigration {
+				if err := state.save(path); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+
+	if state.Media == nil {
+		state.Media = make(map[string]*StateMedia)
+	}
+	if state.Tweets == nil {
+		state.Tweets = make(map[string]*StateTweet)
+	}
+
+	return state, nil
+}
+
+// attachMedia removes records of media that have been attached to a status
+// because they're no longer eligible for reuse.
+func (s *State) attachMedia(ids []mastodon.ID) {
+	for hash, media := range s.Media {
+		for _, id := range ids {
+			if media.ID == string(id) {
+				delete(s.Media, hash)
+			}
+		}
+	}
+}
+
+// migrate upgrades state loaded from an older version of the state file's
+// format to the current version. Returns whether any migration was necessary.
+func (s *State) migrate() (bool, error) {
+	if s.Version == 0 {
+		s.Version = 1
+	}
+
+	if s.Version > currentStateVersion {
+		return false, fmt.Errorf("state file version %d is newer than the supported version %d; "+
+			"upgrade this program to use it", s.Version, currentStateVersion)
+	}
+
+	var migrated bool
+	for ; s.Version < currentStateVersion; s.Version++ {
+		stateMigrations[s.Version](s)
+		migrated = true
+	}
+
+	return migrated, nil
+}
+
+// clearTweetFailures forgets any failures of a tweet, like after it's been
+// posted successfully.
+func (s *State) clearTweetFailures(tweetID int64) {
+	delete(s.Failures, strconv.FormatInt(tweetID, 10))
+}
+
+// gapNoteStatusID returns the ID of the status of the gap note posted before
+// a tweet, if one was.
+func (s *State) gapNoteStatusID(tweetID int64) (string, bool) {
+	statusID, ok := s.GapNotes[strconv.FormatInt(tweetID, 10)]
+	return statusID, ok
+}
+
+// recordGapNote records the status of a gap note posted before a tweet so
+// that it isn't posted again.
+func (s *State) recordGapNote(tweetID int64, statusID mastodon.ID) {
+	if s.GapNotes == nil {
+		s.GapNotes = make(map[string]string)
+	}
+
+	s.GapNotes[strconv.FormatInt(tweetID, 10)] = string(statusID)
+}
+
+// recordMediaUpload records media that's been uploaded so that it can be
+// reused if it doesn't end up being attached to a status.
+func (s *State) recordMediaUpload(hash string, id mastodon.ID, now time.Time) {
+	if s.Media == nil {
+		s.Media = make(map[string]*StateMedia)
+	}
+
+	s.Media[hash] = &StateMedia{ID: string(id), UploadedAt: now}
+}
+
+// recordTweetStatus records the status that a tweet was posted as, along with
+// its visibility.
+func (s *State) recordTweetStatus(tweetID int64, statusID mastodon.ID, visibility string) {
+	if s.Tweets == nil {
+		s.Tweets = make(map[string]*StateTweet)
+	}
+
+	s.Tweets[strconv.FormatInt(tweetID, 10)] = &StateTweet{StatusID: string(statusID), Visibility: visibility}
+}
+
+// recordTweetFailure records a failure to post a tweet, marking it as skipped
+// once it's failed maxFailures times. Returns whether the tweet is now
+// skipped.
+func (s *State) recordTweetFailure(tweetID int64, err error, maxFailures int, now time.Time) bool {
+	if s.Failures == nil {
+		s.Failures = make(map[string]*StateFailure)
+	}
+
+	key := strconv.FormatInt(tweetID, 10)
+	failure, ok := s.Failures[key]
+	if !ok {
+		failure = &StateFailure{}
+		s.Failures[key] = failure
+	}
+
+	failure.Count++
+	failure.Reason = err.Error()
+
+	if failure.Count >= maxFailures && failure.SkippedAt.IsZero() {
+		failure.SkippedAt = now
+	}
+
+	return !failure.SkippedAt.IsZero()
+}
+
+// recordTweetPost records a status that a tweet was posted as, along with its
+// visibility, the status' URL and creation time for exportMap, and a snippet
+// of its text for generateIndex.
+func (s *State) recordTweetPost(tweetID int64, status *mastodon.Status, visibility string) {
+	s.recordTweetStatus(tweetID, status.ID, visibility)
+
+	stateTweet := s.Tweets[strconv.FormatInt(tweetID, 10)]
+	stateTweet.PostedAt = status.CreatedAt
+	stateTweet.Snippet = sampleContent(strings.Join(strings.Fields(tootToTweet(status)), " "), indexSnippetLength)
+	stateTweet.StatusURL = status.URL
+}
+
+// recordTweetScheduledStatus records the scheduled status that a tweet will
+// be published as, along with its visibility and the time it's scheduled for.
+func (s *State) recordTweetScheduledStatus(tweetID int64, statusID mastodon.ID, visibility string, scheduledAt time.Time) {
+	s.recordTweetStatus(tweetID, statusID, visibility)
+	s.Tweets[strconv.FormatInt(tweetID, 10)].ScheduledAt = scheduledAt
+}
+
+// resetTweetFailures forgets all recorded failures, including those of
+// skipped tweets so that they're tried again. Returns the number of tweets
+// that were skipped.
+func (s *State) resetTweetFailures() int {
+	var numSkipped int
+	for _, failure := range s.Failures {
+		if !failure.SkippedAt.IsZero() {
+			numSkipped++
+		}
+	}
+
+	s.Failures = nil
+
+	return numSkipped
+}
+
+// reusableMediaID returns the ID of previously uploaded media with the given
+// content hash if there is some and it's recent enough that it's very likely
+// to still be available on the server.
+func (s *State) reusableMediaID(hash string, ttl time.Duration, now time.Time) (mastodon.ID, bool) {
+	media, ok := s.Media[hash]
+	if !ok {
+		return "", false
+	}
+
+	if now.Sub(media.UploadedAt) > ttl {
+		delete(s.Media, hash)
+		return "", false
+	}
+
+	return mastodon.ID(media.ID), true
+}
+
+// save saves state to the given path atomically.
+func (s *State) save(path string) error {
+	s.Version = currentStateVersion
+
+	data, err := toml.Marshal(s)
+	if err != nil {
+		return fmt.Errorf("error marshaling state: %w", err)
+	}
+
+	err = writeFileAtomic(path, data)
+	if err != nil {
+		return fmt.Errorf("error writing state file: %w", err)
+	}
+
+	return nil
+}
+
+// tweetSkipped returns the recorded failure of a tweet if it's failed enough
+// times to be skipped.
+func (s *State) tweetSkipped(tweetID int64) (*StateFailure, bool) {
+	failure, ok := s.Failures[strconv.FormatInt(tweetID, 10)]
+	if !ok || failure.SkippedAt.IsZero() {
+		return nil, false
+	}
+	return failure, true
+}
+
+// tweetStatus returns the recorded status that a tweet was posted as, if any.
+func (s *State) tweetStatus(tweetID int64) (*StateTweet, bool) {
+	tweet, ok := s.Tweets[strconv.FormatInt(tweetID, 10)]
+	return tweet, ok
+}
+
+// hashFile produces a hex-encoded SHA256 hash of the contents of the file at
+// the given path.
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("error opening '%v': %w", path, err)
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", fmt.Errorf("error hashing '%v': %w", path, err)
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// writeFileAtomic writes data to a temporary file in the same directory as
+// the target and then renames it into place so that the target is never left
+// partially written.
+func writeFileAtomic(path string, data []byte) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return fmt.Errorf("error creating temp file: %w", err)
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return fmt.Errorf("error writing temp file: %w", err)
+	}
+
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("error closing temp file: %w", err)
+	}
+
+	if err := os.Rename(f.Name(), path); err != nil {
+		return fmt.Errorf("error renaming temp file: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mattn/go-mastodon"
+	assert "github.com/stretchr/testify/require"
+)
+
+func TestLoadState(t *testing.T) {
+	t.Run("NoPath", func(t *testing.T) {
+		state, err := loadState("", false)
+		assert.NoError(t, err)
+		assert.Empty(t, state.Media)
+	})
+
+	t.Run("MissingFile", func(t *testing.T) {
+		state, err := loadState(filepath.Join(t.TempDir(), "state.toml"), false)
+		assert.NoError(t, err)
+		assert.Empty(t, state.Media)
+	})
+
+	t.Run("RoundTrip", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "state.toml")
+		uploadedAt := time.Date(2021, 1, 2, 3, 4, 5, 0, time.UTC)
+
+		state, err := loadState(path, false)
+		assert.NoError(t, err)
+		state.recordMediaUpload("abc123", "media-1", uploadedAt)
+		state.recordTweetStatus(1, "100", "public")
+		state.recordTweetScheduledStatus(2, "200", "public", uploadedAt)
+		assert.NoError(t, state.save(path))
+
+		state, err = loadState(path, false)
+		assert.NoError(t, err)
+		assert.Equal(t, "media-1", state.Media["abc123"].ID)
+		assert.True(t, uploadedAt.Equal(state.Media["abc123"].UploadedAt))
+		assert.True(t, state.Tweets["1"].ScheduledAt.IsZero())
+		assert.Equal(t, "200", state.Tweets["2"].StatusID)
+		assert.True(t, uploadedAt.Equal(state.Tweets["2"].ScheduledAt))
+	})
+
+	t.Run("MigratesVersion1", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "state.toml")
+		assert.NoError(t, ioutil.WriteFile(path, []byte(`
+[media.abc123]
+id = "media-1"
+uploaded_at = 2021-01-02T03:04:05Z
+`), 0o600))
+
+		// Migrated state isn't written back in modes that only read it.
+		state, err := loadState(path, false)
+		assert.NoError(t, err)
+		assert.Equal(t, currentStateVersion, state.Version)
+		data, err := ioutil.ReadFile(path)
+		assert.NoError(t, err)
+		assert.NotContains(t, string(data), "version")
+
+		state, err = loadState(path, true)
+		assert.NoError(t, err)
+		assert.Equal(t, currentStateVersion, state.Version)
+		assert.Equal(t, "media-1", state.Media["abc123"].ID)
+		assert.NotNil(t, state.Tweets)
+
+		// Migrated state is written back in place.
+		data, err = ioutil.ReadFile(path)
+		assert.NoError(t, err)
+		assert.Contains(t, string(data), fmt.Sprintf("version = %d", currentStateVersion))
+	})
+
+	t.Run("MigratesVersion2", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "state.toml")
+		assert.NoError(t, ioutil.WriteFile(path, []byte(`
+version = 2
+
+[tweets.1]
+status_id = "100"
+visibility = "public"
+`), 0o600))
+
+		state, err := loadState(path, false)
+		assert.NoError(t, err)
+		assert.Equal(t, currentStateVersion, state.Version)
+		assert.Equal(t, "100", state.Tweets["1"].StatusID)
+	})
+
+	t.Run("UnknownFutureVersion", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "state.toml")
+		assert.NoError(t, ioutil.WriteFile(path, []byte("version = 99\n"), 0o600))
+
+		_, err := loadState(path, false)
+		assert.EqualError(t, err, fmt.Sprintf("state file version 99 is newer than the supported version %d; "+
+			"upgrade this program to use it", currentStateVersion))
+	})
+}
+
+func TestStateAttachMedia(t *testing.T) {
+	state := &State{}
+	state.recordMediaUpload("abc123", "media-1", time.Now())
+	state.recordMediaUpload("def456", "media-2", time.Now())
+
+	state.attachMedia([]mastodon.ID{"media-1"})
+
+	assert.Len(t, state.Media, 1)
+	assert.Equal(t, "media-2", state.Media["def456"].ID)
+}
+
+func TestStateRecordTweetFailure(t *testing.T) {
+	now := time.Now()
+	state := &State{}
+
+	assert.False(t, state.recordTweetFailure(1, fmt.Errorf("first"), 3, now))
+	assert.False(t, state.recordTweetFailure(1, fmt.Errorf("second"), 3, now))
+	_, ok := state.tweetSkipped(1)
+	assert.False(t, ok)
+
+	assert.True(t, state.recordTweetFailure(1, fmt.Errorf("third"), 3, now))
+	failure, ok := state.tweetSkipped(1)
+	assert.True(t, ok)
+	assert.Equal(t, 3, failure.Count)
+	assert.Equal(t, "third", failure.Reason)
+	assert.True(t, now.Equal(failure.SkippedAt))
+
+	t.Run("ClearedOnSuccess", func(t *testing.T) {
+		state := &State{}
+		state.recordTweetFailure(1, fmt.Errorf("first"), 3, now)
+		state.clearTweetFailures(1)
+		assert.Empty(t, state.Failures)
+	})
+
+	t.Run("Reset", func(t *testing.T) {
+		state := &State{}
+		state.recordTweetFailure(1, fmt.Errorf("first"), 1, now)
+		state.recordTweetFailure(2, fmt.Errorf("first"), 3, now)
+
+		assert.Equal(t, 1, state.resetTweetFailures())
+		_, ok := state.tweetSkipped(1)
+		assert.False(t, ok)
+		assert.Empty(t, state.Failures)
+	})
+}
+
+func TestStateReusableMediaID(t *testing.T) {
+	now := time.Now()
+	ttl := 12 * time.Hour
+
+	t.Run("Valid", func(t *testing.T) {
+		state := &State{}
+		state.recordMediaUpload("abc123", "media-1", now.Add(-1*time.Hour))
+
+		id, ok := state.reusableMediaID("abc123", ttl, now)
+		assert.True(t, ok)
+		assert.Equal(t, mastodon.ID("media-1"), id)
+	})
+
+	t.Run("Expired", func(t *testing.T) {
+		state := &State{}
+		state.recordMediaUpload("abc123", "media-1", now.Add(-13*time.Hour))
+
+		_, ok := state.reusableMediaID("abc123", ttl, now)
+		assert.False(t, ok)
+
+		// Expired media is pruned.
+		assert.Empty(t, state.Media)
+	})
+
+	t.Run("Missing", func(t *testing.T) {
+		state := &State{}
+
+		_, ok := state.reusableMediaID("abc123", ttl, now)
+		assert.False(t, ok)
+	})
+}
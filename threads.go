@@ -0,0 +1,330 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mattn/go-mastodon"
+)
+
+// legacyPhotoThreadBatchSize is the number of photos that photo threads were
+// merged into each status with before the server's advertised attachment
+// limit was used (see mergePhotoThreads), which was Mastodon's default.
+const legacyPhotoThreadBatchSize = 4
+
+// checkThreadsOnly returns an error if ThreadsOnly is set to something that
+// wouldn't do what's intended: a length below 2, which every tweet meets, or
+// any length without ThreadSelfReplies and TwitterUser, without which no
+// thread is ever found and nothing is synced.
+func checkThreadsOnly(conf *Conf) error {
+	if conf.ThreadsOnly == 0 {
+		return nil
+	}
+
+	if conf.ThreadsOnly < 2 {
+		return fmt.Errorf("THREADS_ONLY must be at least 2 to select threads, but got: %v", conf.ThreadsOnly)
+	}
+
+	if !conf.ThreadSelfReplies || conf.TwitterUser == "" {
+		return fmt.Errorf("THREAD_SELF_REPLIES and TWITTER_USER must be configured to select threads with THREADS_ONLY")
+	}
+
+	return nil
+}
+
+// hasPendingParent checks whether a tweet is a thread reply whose parent was
+// scheduled but hasn't been published yet. Such a reply can't be posted
+// because a scheduled status gets a new ID when it's published, so there's
+// nothing yet that the reply could reference as its parent.
+func hasPendingParent(conf *Conf, state *State, tweet *Tweet) bool {
+	if !isThreadReply(conf, tweet) {
+		return false
+	}
+
+	parent, ok := state.tweetStatus(tweet.Reply.StatusID)
+	return ok && !parent.ScheduledAt.IsZero()
+}
+
+// isPhotoTweet checks whether a tweet has media, all of which are photos.
+func isPhotoTweet(tweet *Tweet) bool {
+	if tweet.Entities == nil || len(tweet.Entities.Medias) < 1 {
+		return false
+	}
+
+	for _, media := range tweet.Entities.Medias {
+		if media.Type != "photo" {
+			return false
+		}
+	}
+
+	return true
+}
+
+// legacyPhotoThreadBatches regroups the photo thread that a merged tweet came
+// from into statuses of legacyPhotoThreadBatchSize photos like it would have
+// been before the server's attachment limit was used, returning those that
+// share any tweets with the merged tweet. Statuses posted with the old
+// grouping then still match (see renderTootVersions). Returns nothing if the
+// grouping wouldn't differ.
+func legacyPhotoThreadBatches(conf *Conf, tweet *Tweet) []*Tweet {
+	if tweet.photoThread == nil || conf.OverflowMediaNote != "" ||
+		instanceLimits.MaxMediaAttachments == legacyPhotoThreadBatchSize {
+		return nil
+	}
+
+	ids := make(map[int64]bool)
+	for _, id := range tweet.mergedIDs {
+		ids[id] = true
+	}
+
+	var batches []*Tweet
+	for _, batch := range mergePhotoThread(conf, tweet.photoThread, legacyPhotoThreadBatchSize) {
+		for _, id := range batch.mergedIDs {
+			if ids[id] {
+				batches = append(batches, batch)
+				break
+			}
+		}
+	}
+
+	return batches
+}
+
+// mergePhotoThreads finds photo threads (chains of photo tweets where each is
+// a self-reply to the last) in tweets, which are ordered by descending ID, and
+// merges each into as few tweets as possible with up to the maximum number of
+// media attachments allowed on a status (see mergePhotoThread). Other tweets
+// are returned as they are. Does nothing unless MergePhotoThreads is on.
+func mergePhotoThreads(conf *Conf, tweets []*Tweet) []*Tweet {
+	if !conf.MergePhotoThreads {
+		return tweets
+	}
+
+	// Group tweets into threads, moving in reverse order so that parents are
+	// seen before their replies.
+	var threads [][]*Tweet
+	threadIndexes := make(map[int64]int)
+
+	for i := len(tweets) - 1; i >= 0; i-- {
+		tweet := tweets[i]
+
+		if isPhotoTweet(tweet) && isThreadReply(conf, tweet) {
+			if j, ok := threadIndexes[tweet.Reply.StatusID]; ok {
+				thread := threads[j]
+				if last := thread[len(thread)-1]; last.ID == tweet.Reply.StatusID && isPhotoTweet(last) {
+					threads[j] = append(thread, tweet)
+					threadIndexes[tweet.ID] = j
+					continue
+				}
+			}
+		}
+
+		threads = append(threads, []*Tweet{tweet})
+		threadIndexes[tweet.ID] = len(threads) - 1
+	}
+
+	var merged []*Tweet
+	for _, thread := range threads {
+		if len(thread) < 2 {
+			merged = append(merged, thread...)
+			continue
+		}
+
+		for _, tweet := range mergePhotoThread(conf, thread, instanceLimits.MaxMediaAttachments) {
+			tweet.photoThread = thread
+			merged = append(merged, tweet)
+		}
+	}
+
+	sort.SliceStable(merged, func(i, j int) bool { return merged[i].ID > merged[j].ID })
+
+	return merged
+}
+
+// mergePhotoThread merges a photo thread, ordered oldest first, into tweets
+// that each combine the text and photos of consecutive tweets in the thread
+// up to maxMedia, the number of media attachments allowed on a status. Each
+// merged tweet after the first is a reply to the one before it so that
+// overflow continues the thread.
+//
+// With OverflowMediaNote set, the whole thread is merged into a single tweet
+// instead, and photos that don't fit are left to its overflow note.
+//
+// A merged tweet takes the ID of the first tweet it contains, and records the
+// IDs of all of them so that later replies to any of them can be threaded.
+func mergePhotoThread(conf *Conf, thread []*Tweet, maxMedia int) []*Tweet {
+	var merged []*Tweet
+	var current *Tweet
+	var texts []string
+
+	finish := func() {
+		if current == nil {
+			return
+		}
+
+		current.Text = strings.Join(texts, "\n\n")
+		merged = append(merged, current)
+		current, texts = nil, nil
+	}
+
+	for _, tweet := range thread {
+		if current != nil && conf.OverflowMediaNote == "" &&
+			len(current.Entities.Medias)+len(tweet.Entities.Medias) > maxMedia {
+			finish()
+		}
+
+		if current == nil {
+			current = &Tweet{
+				Entities: &TweetEntities{},
+				ID:       tweet.ID,
+				Reply:    tweet.Reply,
+			}
+
+			if len(merged) > 0 {
+				previous := merged[len(merged)-1]
+				current.Reply = &TweetReply{StatusID: previous.ID, User: conf.TwitterUser}
+			}
+		}
+
+		// Each tweet's trailing links, like its media shortlink, would
+		// otherwise end up in the middle of the merged text where they
+		// wouldn't be stripped.
+		if text := stripTrailingLinks(conf, tweet, tweet.Text); text != "" {
+			texts = append(texts, text)
+		}
+
+		current.CreatedAt = tweet.CreatedAt
+		current.Entities.Medias = append(current.Entities.Medias, tweet.Entities.Medias...)
+		current.Entities.URLs = append(current.Entities.URLs, tweet.Entities.URLs...)
+		current.Entities.UserMentions = append(current.Entities.UserMentions, tweet.Entities.UserMentions...)
+		current.FavoriteCount += tweet.FavoriteCount
+		current.RetweetCount += tweet.RetweetCount
+		current.mergedIDs = append(current.mergedIDs, tweet.ID)
+	}
+
+	finish()
+
+	return merged
+}
+
+// recoverThreadParents records the statuses of the parents of thread replies
+// about to be synced that were posted without being recorded in state, which
+// happens when a run is interrupted after posting a status but before saving
+// state. They're found amongst the account's statuses by content like any
+// other tweet so that the rest of the thread resumes as replies to them
+// rather than as standalone statuses. Members of a thread are posted with
+// idempotency keys derived from their tweet IDs (see syncTweet), so one that
+// was posted just before the interruption isn't duplicated either.
+func recoverThreadParents(conf *Conf, state *State, statuses []*mastodon.Status, candidates, tweetsToSync []*Tweet) {
+	candidatesByID := make(map[int64]*Tweet)
+	for _, tweet := range candidates {
+		candidatesByID[tweet.ID] = tweet
+		for _, mergedID := range tweet.mergedIDs {
+			candidatesByID[mergedID] = tweet
+		}
+	}
+
+	for _, tweet := range tweetsToSync {
+		if !isThreadReply(conf, tweet) {
+			continue
+		}
+
+		if _, ok := state.tweetStatus(tweet.Reply.StatusID); ok {
+			continue
+		}
+
+		parent, ok := candidatesByID[tweet.Reply.StatusID]
+		if !ok {
+			continue
+		}
+
+		status, _ := findMatchingStatus(conf, statuses, parent)
+		if status == nil {
+			continue
+		}
+
+		logger.Infof("Parent tweet %v of tweet %v was posted as Mastodon status %v without being recorded; "+
+			"resuming thread", parent.ID, tweet.ID, status.ID)
+
+		state.recordTweetPost(parent.ID, status, status.Visibility)
+		for _, mergedID := range parent.mergedIDs {
+			state.recordTweetPost(mergedID, status, status.Visibility)
+		}
+	}
+}
+
+// resolveScheduledTweets finds the published statuses for tweets recorded in
+// state as scheduled whose scheduled time has passed, and records their IDs in
+// place of those of the scheduled statuses so that replies to them can be
+// threaded. Tweets whose statuses can't be found yet are left as they are.
+func resolveScheduledTweets(conf *Conf, state *State, statuses []*mastodon.Status, tweets []*Tweet, now time.Time) {
+	for _, tweet := range tweets {
+		stateTweet, ok := state.tweetStatus(tweet.ID)
+		if !ok || stateTweet.ScheduledAt.IsZero() || stateTweet.ScheduledAt.After(now) {
+			continue
+		}
+
+		status, _ := findMatchingStatus(conf, statuses, tweet)
+		if status == nil {
+			continue
+		}
+
+		logger.Infof("Scheduled status for tweet %v was published as Mastodon status %v",
+			tweet.ID, status.ID)
+
+		state.recordTweetPost(tweet.ID, status, stateTweet.Visibility)
+	}
+}
+
+// selectThreads narrows tweets, which are ordered by descending ID, down to
+// those in self-reply threads of at least minLength tweets (see
+// ThreadsOnly). A thread is a chain of thread replies (see isThreadReply)
+// back to a root that's amongst tweets, so a thread whose middle was left
+// out is considered to be two.
+func selectThreads(conf *Conf, tweets []*Tweet, minLength int) []*Tweet {
+	roots := make(map[int64]int64)
+	lengths := make(map[int64]int)
+
+	// Move in reverse order so that parents are seen before their replies.
+	for i := len(tweets) - 1; i >= 0; i-- {
+		tweet := tweets[i]
+
+		root := tweet.ID
+		if isThreadReply(conf, tweet) {
+			if parentRoot, ok := roots[tweet.Reply.StatusID]; ok {
+				root = parentRoot
+			}
+		}
+
+		roots[tweet.ID] = root
+		lengths[root]++
+	}
+
+	var selected []*Tweet
+	for _, tweet := range tweets {
+		if lengths[roots[tweet.ID]] >= minLength {
+			selected = append(selected, tweet)
+		}
+	}
+
+	return selected
+}
+
+// threadReplyScheduledAt returns the time at which to schedule a thread reply
+// when ThreadReplySpacing is set, which is the spacing from now, but never
+// sooner than Mastodon allows.
+//
+// Only a reply whose parent has already been published can be scheduled (see
+// hasPendingParent), so the spacing is counted from the first run that finds
+// the parent published rather than from the parent's publication itself, and
+// a thread grows by one reply each time that the program runs after the last
+// one was published.
+func threadReplyScheduledAt(spacing time.Duration, now time.Time) time.Time {
+	if spacing < minScheduleLead {
+		spacing = minScheduleLead
+	}
+
+	return now.Add(spacing)
+}
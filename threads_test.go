@@ -0,0 +1,426 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mattn/go-mastodon"
+	assert "github.com/stretchr/testify/require"
+)
+
+func TestCheckThreadsOnly(t *testing.T) {
+	assert.NoError(t, checkThreadsOnly(&Conf{}))
+	assert.NoError(t, checkThreadsOnly(&Conf{ThreadSelfReplies: true, ThreadsOnly: 2, TwitterUser: "brandur"}))
+
+	assert.EqualError(t, checkThreadsOnly(&Conf{ThreadSelfReplies: true, ThreadsOnly: 1, TwitterUser: "brandur"}),
+		"THREADS_ONLY must be at least 2 to select threads, but got: 1")
+	assert.EqualError(t, checkThreadsOnly(&Conf{ThreadSelfReplies: true, ThreadsOnly: -1, TwitterUser: "brandur"}),
+		"THREADS_ONLY must be at least 2 to select threads, but got: -1")
+
+	for _, conf := range []*Conf{
+		{ThreadsOnly: 3, TwitterUser: "brandur"},
+		{ThreadSelfReplies: true, ThreadsOnly: 3},
+	} {
+		assert.EqualError(t, checkThreadsOnly(conf),
+			"THREAD_SELF_REPLIES and TWITTER_USER must be configured to select threads with THREADS_ONLY")
+	}
+
+	t.Run("CheckedBeforeSyncing", func(t *testing.T) {
+		client := &fakeClient{}
+		source := writeTweetData(t, `
+[[tweets]]
+id = 1
+text = "A standalone tweet"
+`)
+		assert.Error(t, syncTwitter(context.Background(), &Conf{MaxTweetsToSync: 10, ThreadsOnly: 3}, client, source))
+		assert.Empty(t, client.postedToots)
+	})
+}
+
+func TestHasPendingParent(t *testing.T) {
+	conf := &Conf{ThreadSelfReplies: true, TwitterUser: "brandur"}
+	reply := &Tweet{ID: 2, Reply: &TweetReply{StatusID: 1, User: "brandur"}}
+
+	state := &State{}
+	assert.False(t, hasPendingParent(conf, state, reply))
+
+	state.recordTweetStatus(1, "100", "public")
+	assert.False(t, hasPendingParent(conf, state, reply))
+
+	state.recordTweetScheduledStatus(1, "200", "public", time.Now())
+	assert.True(t, hasPendingParent(conf, state, reply))
+}
+
+func TestMergePhotoThreads(t *testing.T) {
+	conf := &Conf{MergePhotoThreads: true, ThreadSelfReplies: true, TwitterUser: "brandur"}
+
+	photoTweet := func(id, replyTo int64, numPhotos int, text string) *Tweet {
+		tweet := &Tweet{ID: id, Text: text + " https://t.co/abc123", Entities: &TweetEntities{}}
+		for i := 0; i < numPhotos; i++ {
+			tweet.Entities.Medias = append(tweet.Entities.Medias,
+				&TweetEntitiesMedia{ID: id*10 + int64(i), Type: "photo", URL: "https://pbs.twimg.com/media/photo.jpg"})
+		}
+		if replyTo != 0 {
+			tweet.Reply = &TweetReply{StatusID: replyTo, User: "brandur"}
+		}
+		return tweet
+	}
+
+	t.Run("MergesThread", func(t *testing.T) {
+		unrelated := &Tweet{ID: 4, Text: `Something else entirely`}
+		thread := []*Tweet{
+			unrelated,
+			photoTweet(3, 2, 1, "Day three"),
+			photoTweet(2, 1, 1, "Day two"),
+			photoTweet(1, 0, 1, "Day one"),
+		}
+
+		merged := mergePhotoThreads(conf, thread)
+		assert.Len(t, merged, 2)
+		assert.Equal(t, unrelated, merged[0])
+
+		assert.Equal(t, int64(1), merged[1].ID)
+		assert.Nil(t, merged[1].Reply)
+		assert.Equal(t, "Day one\n\nDay two\n\nDay three", merged[1].Text)
+		assert.Len(t, merged[1].Entities.Medias, 3)
+		assert.Equal(t, []int64{1, 2, 3}, merged[1].mergedIDs)
+
+		// Synced as a single toot with all of the thread's photos.
+		server := serveMedia(t, []byte("GIF89a fake image contents"))
+		for _, media := range merged[1].Entities.Medias {
+			media.URL = server.URL + "/photo.jpg"
+		}
+
+		client := &fakeClient{}
+		state := &State{}
+		_, err := syncTweet(context.Background(), conf, client, state, nil, nil, merged[1], t.TempDir())
+		assert.NoError(t, err)
+
+		assert.Len(t, client.postedToots, 1)
+		assert.Equal(t, "Day one\n\nDay two\n\nDay three", client.postedToots[0].Status)
+		assert.Len(t, client.postedToots[0].MediaIDs, 3)
+
+		for _, id := range []int64{1, 2, 3} {
+			status, ok := state.tweetStatus(id)
+			assert.True(t, ok)
+			assert.Equal(t, "1", status.StatusID)
+		}
+	})
+
+	t.Run("OverflowContinuesAsReply", func(t *testing.T) {
+		merged := mergePhotoThreads(conf, []*Tweet{
+			photoTweet(3, 2, 2, "Day three"),
+			photoTweet(2, 1, 2, "Day two"),
+			photoTweet(1, 0, 1, "Day one"),
+		})
+
+		assert.Len(t, merged, 2)
+		assert.Equal(t, int64(3), merged[0].ID)
+		assert.Equal(t, &TweetReply{StatusID: 1, User: "brandur"}, merged[0].Reply)
+		assert.Len(t, merged[0].Entities.Medias, 2)
+		assert.Equal(t, int64(1), merged[1].ID)
+		assert.Len(t, merged[1].Entities.Medias, 3)
+	})
+
+	t.Run("OverflowMediaNote", func(t *testing.T) {
+		conf := *conf
+		conf.OverflowMediaNote = "+{count} more images in the original: {url}"
+
+		merged := mergePhotoThreads(&conf, []*Tweet{
+			photoTweet(3, 2, 2, "Day three"),
+			photoTweet(2, 1, 2, "Day two"),
+			photoTweet(1, 0, 1, "Day one"),
+		})
+
+		assert.Len(t, merged, 1)
+		assert.Len(t, merged[0].Entities.Medias, 5)
+		assert.Equal(t, "Day one\n\nDay two\n\nDay three\n\n+1 more images in the original: https://twitter.com/brandur/status/1",
+			renderToot(&conf, merged[0]))
+	})
+
+	t.Run("InstanceLimit", func(t *testing.T) {
+		limits := defaultInstanceLimits
+		limits.MaxMediaAttachments = 6
+
+		origLimits := instanceLimits
+		instanceLimits = &limits
+		t.Cleanup(func() { instanceLimits = origLimits })
+
+		// Ten photos across a thread of ten tweets.
+		var thread []*Tweet
+		for id := int64(10); id >= 1; id-- {
+			thread = append(thread, photoTweet(id, id-1, 1, fmt.Sprintf("Day %d", id)))
+		}
+
+		merged := mergePhotoThreads(conf, thread)
+		assert.Len(t, merged, 2)
+		assert.Equal(t, int64(7), merged[0].ID)
+		assert.Len(t, merged[0].Entities.Medias, 4)
+		assert.Equal(t, int64(1), merged[1].ID)
+		assert.Len(t, merged[1].Entities.Medias, 6)
+
+		// The thread was posted before the limit was used, in batches of
+		// four photos, so the newest of its statuses has the last two.
+		status := &mastodon.Status{ID: "300", Content: `<p>Day 9</p><p>Day 10</p>`}
+		match, _ := findMatchingStatus(conf, []*mastodon.Status{status}, merged[0])
+		assert.Equal(t, status, match)
+
+		batches := legacyPhotoThreadBatches(conf, merged[0])
+		assert.Len(t, batches, 2)
+		assert.Equal(t, []int64{5, 6, 7, 8}, batches[0].mergedIDs)
+		assert.Equal(t, []int64{9, 10}, batches[1].mergedIDs)
+	})
+
+	t.Run("OffByDefault", func(t *testing.T) {
+		thread := []*Tweet{
+			photoTweet(2, 1, 1, "Day two"),
+			photoTweet(1, 0, 1, "Day one"),
+		}
+
+		assert.Equal(t, thread, mergePhotoThreads(&Conf{}, thread))
+	})
+}
+
+func TestRecoverThreadParents(t *testing.T) {
+	source := writeTweetData(t, `
+[[tweets]]
+id = 3
+text = "And a third to wrap the thread up."
+
+  [tweets.reply]
+  status_id = 2
+  user = "brandur"
+
+[[tweets]]
+id = 2
+text = "A second thought to follow up on the first."
+
+  [tweets.reply]
+  status_id = 1
+  user = "brandur"
+
+[[tweets]]
+id = 1
+text = "The first thought of a thread."
+`)
+
+	conf := &Conf{
+		MaxTweetsToSync:   10,
+		StateFile:         filepath.Join(t.TempDir(), "state.toml"),
+		ThreadSelfReplies: true,
+		TwitterUser:       "brandur",
+	}
+
+	// The run crashed after posting the first two members of the thread, but
+	// before the second was recorded in state.
+	state := &State{}
+	state.recordTweetStatus(1, "100", "public")
+	assert.NoError(t, state.save(conf.StateFile))
+
+	client := &fakeClient{statuses: []*mastodon.Status{
+		{ID: "200", Content: `<p>A second thought to follow up on the first.</p>`, Visibility: "public"},
+		{ID: "100", Content: `<p>The first thought of a thread.</p>`, Visibility: "public"},
+	}}
+	assert.NoError(t, syncTwitter(context.Background(), conf, client, source))
+
+	// Only the third is posted, as a reply to the second.
+	assert.Len(t, client.postedToots, 1)
+	assert.Equal(t, "And a third to wrap the thread up.", client.postedToots[0].Status)
+	assert.Equal(t, mastodon.ID("200"), client.postedToots[0].InReplyToID)
+	assert.Equal(t, []string{"tweet-3"}, client.idempotencyKeys)
+
+	state, err := loadState(conf.StateFile, false)
+	assert.NoError(t, err)
+	recovered, ok := state.tweetStatus(2)
+	assert.True(t, ok)
+	assert.Equal(t, "200", recovered.StatusID)
+}
+
+func TestResolveScheduledTweets(t *testing.T) {
+	conf := &Conf{}
+	now := time.Now()
+
+	tweets := []*Tweet{
+		{ID: 2, Text: "Not published yet"},
+		{ID: 1, Text: "Published"},
+	}
+
+	state := &State{}
+	state.recordTweetScheduledStatus(1, "scheduled-1", "unlisted", now.Add(-1*time.Hour))
+	state.recordTweetScheduledStatus(2, "scheduled-2", "unlisted", now.Add(1*time.Hour))
+
+	resolveScheduledTweets(conf, state, []*mastodon.Status{
+		{ID: "100", Content: "<p>Published</p>"},
+	}, tweets, now)
+
+	published, ok := state.tweetStatus(1)
+	assert.True(t, ok)
+	assert.Equal(t, &StateTweet{Snippet: "Published", StatusID: "100", Visibility: "unlisted"}, published)
+
+	pending, ok := state.tweetStatus(2)
+	assert.True(t, ok)
+	assert.Equal(t, "scheduled-2", pending.StatusID)
+	assert.False(t, pending.ScheduledAt.IsZero())
+}
+
+func TestSyncReplyToScheduledParentBeforeLastRun(t *testing.T) {
+	dir := t.TempDir()
+
+	source := writeTweetData(t, `
+[[tweets]]
+id = 2
+created_at = 2021-01-02T12:00:00Z
+text = "A reply to a tweet that was scheduled on an earlier run."
+
+  [tweets.reply]
+  status_id = 1
+  user = "brandur"
+
+[[tweets]]
+id = 1
+created_at = 2021-01-01T12:00:00Z
+text = "A tweet that was scheduled on an earlier run."
+`)
+
+	conf := &Conf{
+		LastRunFile:       filepath.Join(dir, "last_run"),
+		MaxTweetsToSync:   10,
+		StateFile:         filepath.Join(dir, "state.toml"),
+		ThreadSelfReplies: true,
+		TwitterUser:       "brandur",
+	}
+
+	// The parent was scheduled by an earlier run, which also advanced the
+	// last run past it, and it's since been published.
+	assert.NoError(t, writeLastRun(conf.LastRunFile, time.Date(2021, 1, 1, 12, 0, 0, 0, time.UTC)))
+	state := &State{}
+	state.recordTweetScheduledStatus(1, "scheduled-1", "public", time.Now().Add(-1*time.Hour))
+	assert.NoError(t, state.save(conf.StateFile))
+
+	client := &fakeClient{statuses: []*mastodon.Status{
+		{ID: "100", Content: "<p>A tweet that was scheduled on an earlier run.</p>"},
+	}}
+	assert.NoError(t, syncTwitter(context.Background(), conf, client, source))
+
+	assert.Len(t, client.postedToots, 1)
+	assert.Equal(t, mastodon.ID("100"), client.postedToots[0].InReplyToID)
+}
+
+func TestSelectThreads(t *testing.T) {
+	conf := &Conf{ThreadSelfReplies: true, TwitterUser: "brandur"}
+
+	reply := func(id, parentID int64) *Tweet {
+		return &Tweet{ID: id, Reply: &TweetReply{StatusID: parentID, User: "brandur"}}
+	}
+
+	root := &Tweet{ID: 1}
+	standalone := &Tweet{ID: 2}
+	reply1 := reply(3, 1)
+	otherRoot := &Tweet{ID: 4}
+	reply2 := reply(5, 3)
+	otherReply := reply(6, 4)
+	orphan := reply(7, 100)
+
+	tweets := []*Tweet{orphan, otherReply, reply2, otherRoot, reply1, standalone, root}
+
+	assert.Equal(t, []*Tweet{reply2, reply1, root}, selectThreads(conf, tweets, 3))
+	assert.Equal(t, []*Tweet{otherReply, reply2, otherRoot, reply1, root}, selectThreads(conf, tweets, 2))
+
+	t.Run("BrokenThread", func(t *testing.T) {
+		// With the middle of the thread left out, neither half is long enough.
+		assert.Empty(t, selectThreads(conf, []*Tweet{reply2, root}, 2))
+	})
+}
+
+func TestSyncThreadAcrossSources(t *testing.T) {
+	dir := t.TempDir()
+
+	older := filepath.Join(dir, "2021.toml")
+	assert.NoError(t, ioutil.WriteFile(older, []byte(`
+[[tweets]]
+id = 2
+text = "The second part of a thread from the end of the year."
+
+  [tweets.reply]
+  status_id = 1
+  user = "brandur"
+
+[[tweets]]
+id = 1
+text = "The first part of a thread from the end of the year."
+`), 0o600))
+
+	newer := filepath.Join(dir, "2022.toml")
+	assert.NoError(t, ioutil.WriteFile(newer, []byte(`
+[[tweets]]
+id = 4
+text = "A reply to a tweet that's in neither export."
+
+  [tweets.reply]
+  status_id = 3
+  user = "brandur"
+
+[[tweets]]
+id = 2
+text = "The second part of a thread from the end of the year."
+
+  [tweets.reply]
+  status_id = 1
+  user = "brandur"
+
+[[tweets]]
+id = 5
+text = "The end of a thread from the end of the year."
+
+  [tweets.reply]
+  status_id = 2
+  user = "brandur"
+`), 0o600))
+
+	conf := &Conf{
+		MaxTweetsToSync:   10,
+		StateFile:         filepath.Join(dir, "state.toml"),
+		ThreadSelfReplies: true,
+		TwitterUser:       "brandur",
+	}
+
+	client := &fakeClient{}
+	assert.NoError(t, syncTwitter(context.Background(), conf, client, newer, older))
+
+	// Each tweet is posted once, in order, with the thread spanning both
+	// exports chained together and the reply to the missing tweet posted as
+	// a standalone status.
+	var statuses []string
+	var inReplyToIDs []mastodon.ID
+	for _, toot := range client.postedToots {
+		statuses = append(statuses, toot.Status)
+		inReplyToIDs = append(inReplyToIDs, toot.InReplyToID)
+	}
+	assert.Equal(t, []string{
+		"The first part of a thread from the end of the year.",
+		"The second part of a thread from the end of the year.",
+		"A reply to a tweet that's in neither export.",
+		"The end of a thread from the end of the year.",
+	}, statuses)
+	assert.Equal(t, []mastodon.ID{"", "1", "", "2"}, inReplyToIDs)
+
+	t.Run("SourceChecksum", func(t *testing.T) {
+		conf := *conf
+		conf.SourceChecksum = "abc123"
+		assert.EqualError(t, syncTwitter(context.Background(), &conf, &fakeClient{}, newer, older),
+			"a source checksum can only be checked when reading a single source")
+	})
+}
+
+func TestThreadReplyScheduledAt(t *testing.T) {
+	now := time.Date(2021, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	assert.Equal(t, now.Add(24*time.Hour), threadReplyScheduledAt(24*time.Hour, now))
+
+	// Never sooner than Mastodon allows.
+	assert.Equal(t, now.Add(minScheduleLead), threadReplyScheduledAt(1*time.Minute, now))
+}
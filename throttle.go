@@ -0,0 +1,162 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// throttleLatencyFactor is how many times slower than the fastest
+	// response seen that responses must be on average before the server is
+	// considered loaded (see AdaptiveThrottle).
+	throttleLatencyFactor = 2.0
+
+	// throttleLatencyWeight is the weight of each new response's latency in
+	// the moving average of latencies.
+	throttleLatencyWeight = 0.3
+
+	// throttleMinRateLimitRemaining is the fraction of the rate limit that
+	// must be left before the server is considered loaded.
+	throttleMinRateLimitRemaining = 0.25
+
+	// throttleStep is the delay that throttling starts at, and below which
+	// it stops.
+	throttleStep = 5 * time.Second
+)
+
+// loadThrottle tracks signals of the server's load from the responses to
+// requests made to it for the rest of the run (see AdaptiveThrottle).
+var loadThrottle = newAdaptiveThrottle()
+
+// adaptiveThrottle adapts the delay between posts to signals of how loaded the
+// server is. The signals are the moving average of the latency of its
+// responses to posting statuses compared to the fastest such response seen
+// this run, and the fraction of its rate limit remaining according to the
+// last response that reported it. Only posts are timed because the latency of
+// other endpoints isn't comparable: a page of statuses always takes much
+// longer than a post, so it would look like load next to the fastest post.
+//
+// Before each post, the server is considered loaded if its average latency is
+// more than throttleLatencyFactor times the fastest, or less than
+// throttleMinRateLimitRemaining of the rate limit remains. While it's loaded,
+// the delay starts at throttleStep and doubles before each post, up to
+// AdaptiveThrottleMax. Once it isn't, the delay halves before each post, and
+// stops once it drops below throttleStep. Given the same responses, the same
+// delays are always produced.
+type adaptiveThrottle struct {
+	mu sync.Mutex
+
+	delay     time.Duration
+	fastest   time.Duration
+	latency   time.Duration
+	remaining float64
+}
+
+func newAdaptiveThrottle() *adaptiveThrottle {
+	return &adaptiveThrottle{remaining: 1}
+}
+
+// loaded checks whether the signals observed so far indicate that the server
+// is loaded. The lock must be held.
+func (t *adaptiveThrottle) loaded() bool {
+	if t.fastest > 0 && float64(t.latency) > throttleLatencyFactor*float64(t.fastest) {
+		return true
+	}
+
+	return t.remaining < throttleMinRateLimitRemaining
+}
+
+// next adapts the delay to wait before the next post to the signals observed
+// since the last post and returns it.
+func (t *adaptiveThrottle) next(conf *Conf) time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	previous := t.delay
+
+	if t.loaded() {
+		t.delay *= 2
+		if t.delay < throttleStep {
+			t.delay = throttleStep
+		}
+		if conf.AdaptiveThrottleMax > 0 && t.delay > conf.AdaptiveThrottleMax {
+			t.delay = conf.AdaptiveThrottleMax
+		}
+	} else {
+		t.delay /= 2
+		if t.delay < throttleStep {
+			t.delay = 0
+		}
+	}
+
+	switch {
+	case t.delay > previous:
+		logger.Infof("Server appears loaded (average latency %v, %.0f%% of rate limit remaining); "+
+			"throttling posts by %v", t.latency.Round(time.Millisecond), t.remaining*100, t.delay)
+	case t.delay < previous && t.delay == 0:
+		logger.Infof("Server appears to have recovered; no longer throttling posts")
+	}
+
+	return t.delay
+}
+
+// observe records the signals from a response. latency is how long it took
+// to arrive, and is ignored unless it's positive (it's only measured for
+// posts). remaining and limit are the values of its rate limit headers, and
+// are ignored unless limit is positive.
+func (t *adaptiveThrottle) observe(latency time.Duration, remaining, limit int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if latency > 0 {
+		if t.fastest == 0 || latency < t.fastest {
+			t.fastest = latency
+		}
+
+		if t.latency == 0 {
+			t.latency = latency
+		} else {
+			t.latency = time.Duration(throttleLatencyWeight*float64(latency) +
+				(1-throttleLatencyWeight)*float64(t.latency))
+		}
+	}
+
+	if limit > 0 {
+		t.remaining = float64(remaining) / float64(limit)
+	}
+}
+
+// throttleTransport feeds the rate limit headers of responses to
+// loadThrottle, along with the latency of those to posting statuses (see
+// adaptiveThrottle). Media uploads are left out entirely because they have a
+// rate limit of their own.
+type throttleTransport struct {
+	base http.RoundTripper
+}
+
+func (t *throttleTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	base := t.base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+
+	start := time.Now()
+	resp, err := base.RoundTrip(req)
+	if err != nil || strings.Contains(req.URL.Path, "/media") {
+		return resp, err
+	}
+
+	var latency time.Duration
+	if req.Method == http.MethodPost && strings.HasSuffix(req.URL.Path, "/api/v1/statuses") {
+		latency = time.Since(start)
+	}
+
+	remaining, _ := strconv.Atoi(resp.Header.Get("X-RateLimit-Remaining"))
+	limit, _ := strconv.Atoi(resp.Header.Get("X-RateLimit-Limit"))
+	loadThrottle.observe(latency, remaining, limit)
+
+	return resp, nil
+}
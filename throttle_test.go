@@ -0,0 +1,111 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	assert "github.com/stretchr/testify/require"
+)
+
+func TestAdaptiveThrottle(t *testing.T) {
+	conf := &Conf{AdaptiveThrottleMax: 30 * time.Second}
+
+	t.Run("Latency", func(t *testing.T) {
+		throttle := newAdaptiveThrottle()
+
+		throttle.observe(100*time.Millisecond, 0, 0)
+		assert.Equal(t, time.Duration(0), throttle.next(conf))
+
+		// The server slows down, so the delay starts and then doubles up
+		// to the maximum while it stays slow.
+		throttle.observe(1*time.Second, 0, 0)
+		assert.Equal(t, 5*time.Second, throttle.next(conf))
+		throttle.observe(1*time.Second, 0, 0)
+		assert.Equal(t, 10*time.Second, throttle.next(conf))
+		throttle.observe(1*time.Second, 0, 0)
+		assert.Equal(t, 20*time.Second, throttle.next(conf))
+		throttle.observe(1*time.Second, 0, 0)
+		assert.Equal(t, 30*time.Second, throttle.next(conf))
+
+		// It recovers, so the delay halves once the average catches up,
+		// and stops once it's low enough.
+		var delays []time.Duration
+		for i := 0; i < 8; i++ {
+			throttle.observe(100*time.Millisecond, 0, 0)
+			delays = append(delays, throttle.next(conf))
+		}
+		assert.Equal(t, []time.Duration{
+			30 * time.Second,
+			30 * time.Second,
+			30 * time.Second,
+			30 * time.Second,
+			30 * time.Second,
+			15 * time.Second,
+			7500 * time.Millisecond,
+			0,
+		}, delays)
+	})
+
+	t.Run("RateLimit", func(t *testing.T) {
+		throttle := newAdaptiveThrottle()
+
+		throttle.observe(100*time.Millisecond, 250, 300)
+		assert.Equal(t, time.Duration(0), throttle.next(conf))
+
+		throttle.observe(100*time.Millisecond, 50, 300)
+		assert.Equal(t, 5*time.Second, throttle.next(conf))
+		throttle.observe(100*time.Millisecond, 40, 300)
+		assert.Equal(t, 10*time.Second, throttle.next(conf))
+
+		// The rate limit resets.
+		throttle.observe(100*time.Millisecond, 299, 300)
+		assert.Equal(t, 5*time.Second, throttle.next(conf))
+		assert.Equal(t, time.Duration(0), throttle.next(conf))
+	})
+
+	t.Run("Transport", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("X-RateLimit-Limit", "300")
+			w.Header().Set("X-RateLimit-Remaining", "30")
+		}))
+		defer server.Close()
+
+		origThrottle := loadThrottle
+		loadThrottle = newAdaptiveThrottle()
+		t.Cleanup(func() { loadThrottle = origThrottle })
+
+		client := &http.Client{Transport: &throttleTransport{}}
+
+		// Media uploads are ignored.
+		resp, err := client.Post(server.URL+"/api/v2/media", "image/png", nil)
+		assert.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, time.Duration(0), loadThrottle.next(conf))
+
+		// Other requests report the rate limit, but their latency isn't
+		// comparable to that of posts, so it's ignored.
+		resp, err = client.Get(server.URL + "/api/v1/accounts/1/statuses")
+		assert.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, time.Duration(0), loadThrottle.latency)
+		assert.Equal(t, 5*time.Second, loadThrottle.next(conf))
+
+		resp, err = client.Post(server.URL+"/api/v1/statuses", "application/x-www-form-urlencoded", nil)
+		assert.NoError(t, err)
+		resp.Body.Close()
+		assert.NotEqual(t, time.Duration(0), loadThrottle.latency)
+		assert.Equal(t, 10*time.Second, loadThrottle.next(conf))
+	})
+
+	t.Run("IgnoresUntimedResponses", func(t *testing.T) {
+		throttle := newAdaptiveThrottle()
+
+		throttle.observe(100*time.Millisecond, 0, 0)
+		throttle.observe(0, 250, 300)
+		assert.Equal(t, 100*time.Millisecond, throttle.latency)
+		assert.Equal(t, 100*time.Millisecond, throttle.fastest)
+		assert.Equal(t, time.Duration(0), throttle.next(conf))
+	})
+}
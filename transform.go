@@ -0,0 +1,486 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// appendage is a note appended to a toot after its body, like the engagement
+// footer. Appendages are named so that they can be prioritized when they're
+// budgeted (see appendBudgeted).
+type appendage struct {
+	name string
+	note func(tweet *Tweet) string
+}
+
+// Transformer is a step in rendering a tweet as a toot. It takes the content
+// produced by the steps before it and returns a transformed version of it.
+type Transformer func(tweet *Tweet, content string) string
+
+// tootTransformersV1 through tootTransformersV3 are the pipelines that every
+// version of the program has used to render tweets as toots before any
+// optional transformations configured in Conf.
+//
+// Statuses posted by older versions are still matched using their pipelines
+// (see tootTransformerVersions), so a released version must never change.
+// Changes to the base rendering are made by adding a new version instead.
+var (
+	// tootTransformersV1 originally did nothing with the tweet's content.
+	tootTransformersV1 = []Transformer{}
+
+	tootTransformersV2 = []Transformer{
+		expandURLs,
+		stripMediaShortlink,
+		appendRetweetLink,
+	}
+
+	tootTransformersV3 = []Transformer{
+		expandURLs,
+		stripMediaShortlink,
+		appendRetweetLinkUnlessQuote,
+		appendQuoteLink,
+	}
+)
+
+// tootTransformerVersions are all versions of the base pipeline used to render
+// tweets as toots, newest first. The newest is the one used by renderToot, and
+// findMatchingStatus falls back to older ones so that statuses posted by
+// older versions of the program aren't mistaken for new tweets.
+var tootTransformerVersions = [][]Transformer{
+	tootTransformersV3,
+	tootTransformersV2,
+	tootTransformersV1,
+}
+
+// quoteEditTransformers are the newest base pipeline with the link to a
+// quoted tweet stripped rather than appended, for quote tweets that are synced
+// as an edit of the status of the tweet they quote (see QuoteSelfAsEdit).
+var quoteEditTransformers = []Transformer{
+	expandURLs,
+	stripMediaShortlink,
+	appendRetweetLinkUnlessQuote,
+	stripQuoteLink,
+}
+
+// applyTransformers runs a tweet's content through each transformer in order.
+func applyTransformers(tweet *Tweet, content string, transformers []Transformer) string {
+	for _, transformer := range transformers {
+		content = transformer(tweet, content)
+	}
+
+	return content
+}
+
+// renderTransformers returns the pipeline that renders tweets as toots with
+// the given configuration. It starts by trimming tweets to their display text
+// and running them through the newest base pipeline, and follows with the
+// optional transformations enabled in conf in a fixed order.
+func renderTransformers(conf *Conf) []Transformer {
+	return renderTransformersWithBase(conf, tootTransformerVersions[0])
+}
+
+// renderTransformersWithBase is renderTransformers with a base pipeline other
+// than the newest, like quoteEditTransformers.
+func renderTransformersWithBase(conf *Conf, base []Transformer) []Transformer {
+	transformers := []Transformer{trimToDisplayText}
+	transformers = append(transformers, base...)
+
+	if conf.CheckQuotedAvailability {
+		transformers = append(transformers, replaceUnavailableQuoteLink)
+	}
+
+	transformers = append(transformers, func(tweet *Tweet, content string) string {
+		return stripTrailingLinks(conf, tweet, content)
+	})
+
+	if conf.StripRTPrefix {
+		transformers = append(transformers, func(tweet *Tweet, content string) string {
+			return retweetPrefixRE.ReplaceAllString(content, "")
+		})
+	}
+
+	if conf.PlaceholderForEmptyText != "" {
+		transformers = append(transformers, func(tweet *Tweet, content string) string {
+			// The text of a tweet that's only media is just the media's
+			// shortlink, which isn't preceded by a space and so isn't stripped
+			// by the transformations above.
+			if tweet.Entities != nil && len(tweet.Entities.Medias) > 0 &&
+				strings.TrimSpace(stripTrailingLinks(conf, tweet, " "+content)) == "" {
+				return conf.PlaceholderForEmptyText
+			}
+			return content
+		})
+	}
+
+	if conf.HashtagVisibilityStrip && len(conf.HashtagVisibility) > 0 {
+		transformers = append(transformers, func(tweet *Tweet, content string) string {
+			return stripVisibilityHashtags(conf, content)
+		})
+	}
+
+	if len(conf.TextHandleMappings) > 0 || len(conf.WebFingerHandleMappings) > 0 {
+		transformers = append(transformers, func(tweet *Tweet, content string) string {
+			return mapTextHandles(conf, tweet, content)
+		})
+	}
+
+	transformers = append(transformers, func(tweet *Tweet, content string) string {
+		return normalizeHashtags(conf, content)
+	})
+
+	if conf.NormalizeEmoji {
+		transformers = append(transformers, func(tweet *Tweet, content string) string {
+			return normalizeEmoji(content)
+		})
+	}
+
+	if len(conf.UnrolledTweets) > 0 {
+		transformers = append(transformers, func(tweet *Tweet, content string) string {
+			if replacement, ok := unrolledContent(conf, tweet); ok {
+				return replacement
+			}
+			return content
+		})
+	}
+
+	if conf.InlineAltText {
+		transformers = append(transformers, func(tweet *Tweet, content string) string {
+			// Unrolled tweets are posted without their media.
+			if _, unrolled := unrolledContent(conf, tweet); unrolled {
+				return content
+			}
+			return appendInlineAltText(tweet, content)
+		})
+	}
+
+	// Appendages are added after the content above, either each as its own
+	// step, or all in one step that budgets them when AppendedContentRatio
+	// is set.
+	var appendages []appendage
+
+	if conf.OverflowMediaNote != "" {
+		appendages = append(appendages, appendage{"overflow", func(tweet *Tweet) string {
+			numOverflow := overflowMediaCount(tweet)
+			if numOverflow < 1 {
+				return ""
+			}
+
+			note := strings.Replace(conf.OverflowMediaNote, "{count}", strconv.Itoa(numOverflow), -1)
+			return strings.Replace(note, "{url}", tweetURL(conf, strconv.FormatInt(tweet.ID, 10)), -1)
+		}})
+	}
+
+	if conf.Attribution {
+		appendages = append(appendages, appendage{"attribution", func(tweet *Tweet) string {
+			if tweet.author == "" {
+				return ""
+			}
+
+			// The author is on Twitter rather than Mastodon, so their mention
+			// is defanged like the reply prefix.
+			return "— " + defangMentions("@"+tweet.author)
+		}})
+	}
+
+	if conf.IncludeEngagement == EngagementFooter {
+		appendages = append(appendages, appendage{"engagement", func(tweet *Tweet) string {
+			return formatEngagement(conf, tweet)
+		}})
+	}
+
+	if conf.RepliesNote != "" {
+		appendages = append(appendages, appendage{"replies", func(tweet *Tweet) string {
+			if conf.RepliesNoteThreadRootsOnly && isThreadReply(conf, tweet) {
+				return ""
+			}
+			return conf.RepliesNote
+		}})
+	}
+
+	if conf.AppendedContentRatio > 0 && len(appendages) > 0 {
+		transformers = append(transformers, func(tweet *Tweet, content string) string {
+			return appendBudgeted(conf, appendages, tweet, content)
+		})
+	} else {
+		for _, a := range appendages {
+			a := a
+			transformers = append(transformers, func(tweet *Tweet, content string) string {
+				if note := a.note(tweet); note != "" {
+					return content + "\n\n" + note
+				}
+				return content
+			})
+		}
+	}
+
+	if conf.IncludeReplies && conf.ReplyPrefix != "" {
+		transformers = append(transformers, func(tweet *Tweet, content string) string {
+			if tweet.Reply == nil || isThreadReply(conf, tweet) {
+				return content
+			}
+
+			prefix := strings.Replace(conf.ReplyPrefix, "{user}", tweet.Reply.User, -1)
+			return defangMentions(prefix) + " " + content
+		})
+	}
+
+	if conf.IncludeReadingTime {
+		transformers = append(transformers, func(tweet *Tweet, content string) string {
+			return prependReadingTime(conf, content)
+		})
+	}
+
+	return transformers
+}
+
+// appendBudgeted appends the notes of appendages to content, dropping those
+// lowest in AppendedContentPriority first for as long as their total length
+// is more than AppendedContentRatio times the length of content. Appendages
+// missing from AppendedContentPriority are dropped before any that are in it.
+// Notes that are kept are appended in their usual order.
+func appendBudgeted(conf *Conf, appendages []appendage, tweet *Tweet, content string) string {
+	type candidate struct {
+		length int
+		note   string
+		rank   int
+	}
+
+	var candidates []*candidate
+	var total int
+	for _, a := range appendages {
+		note := a.note(tweet)
+		if note == "" {
+			continue
+		}
+
+		rank := len(conf.AppendedContentPriority)
+		for i, name := range conf.AppendedContentPriority {
+			if strings.EqualFold(strings.TrimSpace(name), a.name) {
+				rank = i
+				break
+			}
+		}
+
+		c := &candidate{length: utf8.RuneCountInString("\n\n" + note), note: note, rank: rank}
+		candidates = append(candidates, c)
+		total += c.length
+	}
+
+	budget := int(conf.AppendedContentRatio * float64(utf8.RuneCountInString(content)))
+
+	for total > budget && len(candidates) > 0 {
+		// Drop the lowest priority note, and the last of several that are
+		// tied.
+		lowest := 0
+		for i, c := range candidates {
+			if c.rank >= candidates[lowest].rank {
+				lowest = i
+			}
+		}
+
+		total -= candidates[lowest].length
+		candidates = append(candidates[:lowest], candidates[lowest+1:]...)
+	}
+
+	for _, c := range candidates {
+		content += "\n\n" + c.note
+	}
+
+	return content
+}
+
+// appendInlineAltText appends the alt text of each of a tweet's photos that
+// has one to content as a line like "[image: A cat]" (see InlineAltText).
+func appendInlineAltText(tweet *Tweet, content string) string {
+	var lines []string
+	for _, photo := range tweetPhotos(tweet) {
+		if altText := strings.TrimSpace(photo.AltText); altText != "" {
+			lines = append(lines, "[image: "+strings.Join(strings.Fields(altText), " ")+"]")
+		}
+	}
+
+	if len(lines) < 1 {
+		return content
+	}
+
+	return content + "\n\n" + strings.Join(lines, "\n")
+}
+
+// appendQuoteLink appends a link to the tweet quoted by a quote tweet.
+//
+// Twitter includes a link to the quoted tweet in the quote commentary, but
+// not reliably at the end, and not at all in some older exports. Remove any
+// that are there and append exactly one.
+func appendQuoteLink(tweet *Tweet, content string) string {
+	if tweet.Quote == nil {
+		return content
+	}
+
+	content = stripQuoteLink(tweet, content)
+
+	quoteURL := fmt.Sprintf("https://twitter.com/%s/status/%v",
+		tweet.Quote.User, tweet.Quote.StatusID)
+	if content == "" {
+		return quoteURL
+	}
+
+	return content + "\n\n" + quoteURL
+}
+
+// stripQuoteLink removes any links to the tweet quoted by a quote tweet from
+// its content (see appendQuoteLink).
+func stripQuoteLink(tweet *Tweet, content string) string {
+	if tweet.Quote == nil {
+		return content
+	}
+
+	statusID := strconv.FormatInt(tweet.Quote.StatusID, 10)
+	content = quoteLinkRE.ReplaceAllStringFunc(content, func(link string) string {
+		if quoteLinkRE.FindStringSubmatch(link)[1] != statusID {
+			return link
+		}
+		return ""
+	})
+	return strings.TrimSpace(content)
+}
+
+// quoteLinkRE matches a link to a tweet (along with any whitespace before it),
+// capturing the tweet's ID.
+var quoteLinkRE = regexp.MustCompile(`\s*https?://(?:mobile\.)?twitter\.com/\w+/status/(\d+)\S*`)
+
+// appendRetweetLink appends a link to the original of a retweet because the
+// retweet content gets truncated by Twitter and isn't of much use on Mastodon
+// unfortunately (links are often near the end).
+func appendRetweetLink(tweet *Tweet, content string) string {
+	if tweet.Retweet == nil {
+		return content
+	}
+
+	retweetURL := fmt.Sprintf("https://twitter.com/%s/status/%v",
+		tweet.Retweet.User, tweet.Retweet.StatusID)
+	return content + "\n\n" + retweetURL
+}
+
+// appendRetweetLinkUnlessQuote is like appendRetweetLink, but skips tweets
+// that are also quotes, which get a link from appendQuoteLink instead.
+func appendRetweetLinkUnlessQuote(tweet *Tweet, content string) string {
+	if tweet.Quote != nil {
+		return content
+	}
+
+	return appendRetweetLink(tweet, content)
+}
+
+// expandURLs replaces shortened URLs with their expanded versions. Mastodon
+// doesn't engage in all the idiocy around shortened URLs, so expand everything
+// out so we don't break the internet with the shortened versions.
+func expandURLs(tweet *Tweet, content string) string {
+	if tweet.Entities == nil || tweet.Entities.URLs == nil {
+		return content
+	}
+
+	for _, url := range tweet.Entities.URLs {
+		content = strings.Replace(content, url.URL, url.ExpandedURL, -1)
+	}
+
+	return content
+}
+
+// textHandleRE matches an `@handle` in prose, capturing the character before
+// it (if any), the handle, and the domain of a fediverse handle like
+// `@handle@example.com` (if any). The handle must not be preceded by a word
+// character so that email addresses don't match.
+var textHandleRE = regexp.MustCompile(`(^|[^=/\w.])@(\w+)(@[\w.-]*\w)?`)
+
+// mapTextHandles rewrites handles mentioned in the prose of a tweet according
+// to TextHandleMappings, or to the accounts that WebFingerHandleMappings
+// resolved to (see resolveWebFingerHandleMappings), leaving alone any that are
+// the tweet's mention entities. Handles whose accounts can't be resolved are
+// rewritten as plain text so that they don't mention someone else on the
+// Mastodon server.
+func mapTextHandles(conf *Conf, tweet *Tweet, content string) string {
+	return textHandleRE.ReplaceAllStringFunc(content, func(match string) string {
+		parts := textHandleRE.FindStringSubmatch(match)
+		prefix, handle, domain := parts[1], parts[2], parts[3]
+
+		if domain != "" {
+			return match
+		}
+
+		if tweet.Entities != nil {
+			for _, mention := range tweet.Entities.UserMentions {
+				if strings.EqualFold(mention.User, handle) {
+					return match
+				}
+			}
+		}
+
+		mapped, ok := conf.TextHandleMappings.GetFold(handle)
+		if !ok {
+			hint, ok := conf.WebFingerHandleMappings.GetFold(handle)
+			if !ok {
+				return match
+			}
+
+			if mapped, ok = webFingerAccounts.account(hint); !ok {
+				return prefix + handle
+			}
+		}
+
+		if strings.Contains(mapped, "@") {
+			return prefix + "@" + strings.TrimPrefix(mapped, "@")
+		}
+		return prefix + mapped
+	})
+}
+
+// prependReadingTime prepends a note with an estimate of how long content
+// takes to read (see IncludeReadingTime) if it's at least
+// ReadingTimeMinLength characters long. Estimates are rounded up to whole
+// minutes.
+func prependReadingTime(conf *Conf, content string) string {
+	if utf8.RuneCountInString(content) < conf.ReadingTimeMinLength || conf.ReadingTimeWPM < 1 {
+		return content
+	}
+
+	numWords := len(strings.Fields(content))
+	minutes := max((numWords+conf.ReadingTimeWPM-1)/conf.ReadingTimeWPM, 1)
+
+	return fmt.Sprintf("(%d min read)\n\n%s", minutes, content)
+}
+
+// stripMediaShortlink prunes the shortlink back to the original tweet that
+// Twitter adds when tweet media is embedded.
+//
+// Note: This should come after expandURLs so we eliminate the possibility of
+// ever accidentally replacing a legitimate URL. These media shortlinks don't
+// have an entry in `tweet.Entities.URLs`, so they will remain `t.co` URLs even
+// after the replacement step has finished.
+func stripMediaShortlink(tweet *Tweet, content string) string {
+	if tweet.Entities == nil || tweet.Entities.Medias == nil {
+		return content
+	}
+
+	for _, re := range mediaShortlinkPatterns {
+		content = re.ReplaceAllString(content, "")
+	}
+
+	return content
+}
+
+// trimToDisplayText trims a tweet's text to its display text range (see
+// displayTextTweet). The range is in terms of the tweet's original text, so
+// this must come first in a pipeline.
+func trimToDisplayText(tweet *Tweet, content string) string {
+	return displayTextTweet(tweet).Text
+}
+
+// unrolledContent returns the content that a tweet is replaced with through
+// UnrolledTweets, if any.
+func unrolledContent(conf *Conf, tweet *Tweet) (string, bool) {
+	replacement, ok := conf.UnrolledTweets[strconv.FormatInt(tweet.ID, 10)]
+	return replacement, ok
+}
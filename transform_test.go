@@ -0,0 +1,235 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/mattn/go-mastodon"
+	assert "github.com/stretchr/testify/require"
+)
+
+func TestAppendBudgeted(t *testing.T) {
+	conf := &Conf{
+		AppendedContentPriority: []string{"overflow", "attribution", "engagement"},
+		AppendedContentRatio:    1.0,
+		Attribution:             true,
+		EngagementTemplate:      []string{"{favorites} likes"},
+		IncludeEngagement:       EngagementFooter,
+	}
+	tweet := &Tweet{Text: "Agreed, absolutely.", FavoriteCount: 3, author: "brandur"}
+
+	// Both notes together are longer than the body, so the engagement
+	// footer, which is the least important, is dropped.
+	assert.Equal(t, "Agreed, absolutely.\n\n— @\u200bbrandur", renderToot(conf, tweet))
+
+	t.Run("Priority", func(t *testing.T) {
+		conf := *conf
+		conf.AppendedContentPriority = []string{"engagement", "attribution"}
+		assert.Equal(t, "Agreed, absolutely.\n\n3 likes", renderToot(&conf, tweet))
+	})
+
+	t.Run("DropsEverything", func(t *testing.T) {
+		conf := *conf
+		conf.AppendedContentRatio = 0.1
+		assert.Equal(t, "Agreed, absolutely.", renderToot(&conf, tweet))
+	})
+
+	t.Run("KeepsWhatFits", func(t *testing.T) {
+		tweet := *tweet
+		tweet.Text = "A tweet with a body that's long enough for all of its notes."
+		assert.Equal(t, tweet.Text+"\n\n— @\u200bbrandur\n\n3 likes", renderToot(conf, &tweet))
+	})
+
+	t.Run("UnlimitedByDefault", func(t *testing.T) {
+		conf := *conf
+		conf.AppendedContentRatio = 0
+		assert.Equal(t, "Agreed, absolutely.\n\n— @\u200bbrandur\n\n3 likes", renderToot(&conf, tweet))
+	})
+}
+
+func TestAppendInlineAltText(t *testing.T) {
+	conf := &Conf{InlineAltText: true}
+	tweet := &Tweet{Text: "Two of my favorite animals https://t.co/abc123", Entities: &TweetEntities{
+		Medias: []*TweetEntitiesMedia{
+			{ID: 1, Type: "photo", URL: "https://pbs.twimg.com/media/cat.jpg", AltText: "A cat"},
+			{ID: 2, Type: "photo", URL: "https://pbs.twimg.com/media/blank.jpg"},
+			{ID: 3, Type: "photo", URL: "https://pbs.twimg.com/media/dog.jpg", AltText: "A dog\nasleep"},
+		},
+	}}
+
+	expected := "Two of my favorite animals\n\n[image: A cat]\n[image: A dog asleep]"
+	assert.Equal(t, expected, renderToot(conf, tweet))
+
+	t.Run("NoAltText", func(t *testing.T) {
+		assert.Equal(t, "A toot", appendInlineAltText(&Tweet{Text: "A toot"}, "A toot"))
+	})
+
+	t.Run("OffByDefault", func(t *testing.T) {
+		assert.Equal(t, "Two of my favorite animals", renderToot(&Conf{}, tweet))
+	})
+
+	t.Run("MatchesStatusWithoutAltText", func(t *testing.T) {
+		status := &mastodon.Status{Content: "<p>Two of my favorite animals</p>"}
+
+		match, _ := findMatchingStatus(conf, []*mastodon.Status{status}, tweet)
+		assert.Equal(t, status, match)
+
+		status = &mastodon.Status{Content: "<p>Two of my favorite animals</p><p>[image: A cat]<br>[image: A dog asleep]</p>"}
+		match, _ = findMatchingStatus(conf, []*mastodon.Status{status}, tweet)
+		assert.Equal(t, status, match)
+	})
+}
+
+func TestAppendRepliesNote(t *testing.T) {
+	conf := &Conf{
+		RepliesNote:       "(I don't check replies here)",
+		ThreadSelfReplies: true,
+		TwitterUser:       "brandur",
+	}
+	root := &Tweet{ID: 1, Text: "A thread about cats"}
+	reply := &Tweet{ID: 2, Text: "Continued", Reply: &TweetReply{StatusID: 1, User: "brandur"}}
+
+	assert.Equal(t, "A thread about cats\n\n(I don't check replies here)", renderToot(conf, root))
+	assert.Equal(t, "Continued\n\n(I don't check replies here)", renderToot(conf, reply))
+
+	t.Run("ThreadRootsOnly", func(t *testing.T) {
+		conf := *conf
+		conf.RepliesNoteThreadRootsOnly = true
+		assert.Equal(t, "A thread about cats\n\n(I don't check replies here)", renderToot(&conf, root))
+		assert.Equal(t, "Continued", renderToot(&conf, reply))
+	})
+
+	t.Run("CountsTowardsLength", func(t *testing.T) {
+		conf := *conf
+		conf.RepliesNote = strings.Repeat("x", 490)
+		validation := validateTweet(&conf, &defaultInstanceLimits, root)
+		assert.Equal(t, []string{"length 511 exceeds maximum of 500 characters"}, validation.Violations)
+	})
+
+	t.Run("MatchesStatusPostedWithoutNote", func(t *testing.T) {
+		statuses := []*mastodon.Status{{ID: "100", Content: "<p>A thread about cats</p>"}}
+		status, _ := findMatchingStatus(conf, statuses, root)
+		assert.NotNil(t, status)
+		assert.Equal(t, mastodon.ID("100"), status.ID)
+	})
+
+	t.Run("MatchesStatusPostedWithReadingTimeButWithoutNote", func(t *testing.T) {
+		conf := *conf
+		conf.IncludeReadingTime = true
+		conf.ReadingTimeMinLength = 100
+		conf.ReadingTimeWPM = 200
+
+		long := strings.TrimSpace(strings.Repeat("word ", 450))
+		statuses := []*mastodon.Status{{ID: "100", Content: "<p>(3 min read)</p><p>" + long + "</p>"}}
+		status, _ := findMatchingStatus(&conf, statuses, &Tweet{ID: 1, Text: long})
+		assert.NotNil(t, status)
+		assert.Equal(t, mastodon.ID("100"), status.ID)
+	})
+}
+
+func TestApplyTransformers(t *testing.T) {
+	tweet := &Tweet{
+		Text: "Read this https://t.co/short #golang",
+		Entities: &TweetEntities{
+			URLs: []*TweetEntitiesURL{{URL: "https://t.co/short", ExpandedURL: "https://example.com/post"}},
+		},
+	}
+
+	upper := func(tweet *Tweet, content string) string { return strings.ToUpper(content) }
+	suffix := func(tweet *Tweet, content string) string { return content + " (via Twitter)" }
+
+	// Transformers run in order, each seeing the output of the last.
+	assert.Equal(t, "READ THIS HTTPS://EXAMPLE.COM/POST #GOLANG (via Twitter)",
+		applyTransformers(tweet, tweet.Text, []Transformer{expandURLs, upper, suffix}))
+	assert.Equal(t, "READ THIS HTTPS://T.CO/SHORT #GOLANG (VIA TWITTER)",
+		applyTransformers(tweet, tweet.Text, []Transformer{suffix, upper, expandURLs}))
+
+	assert.Equal(t, tweet.Text, applyTransformers(tweet, tweet.Text, nil))
+}
+
+func TestMapTextHandles(t *testing.T) {
+	conf := &Conf{TextHandleMappings: ConfMap{"alice": "alice@mastodon.social", "jack": "Jack"}}
+
+	t.Run("RewritesProseMention", func(t *testing.T) {
+		assert.Equal(t, "Great talk by @alice@mastodon.social and Jack today",
+			mapTextHandles(conf, &Tweet{}, "Great talk by @Alice and @jack today"))
+	})
+
+	t.Run("LeavesEmailAlone", func(t *testing.T) {
+		assert.Equal(t, "Email me at me@alice.com or bob@alice",
+			mapTextHandles(conf, &Tweet{}, "Email me at me@alice.com or bob@alice"))
+	})
+
+	t.Run("LeavesFediverseHandleAlone", func(t *testing.T) {
+		assert.Equal(t, "Follow @alice@example.com",
+			mapTextHandles(conf, &Tweet{}, "Follow @alice@example.com"))
+	})
+
+	t.Run("LeavesEntityMentionAlone", func(t *testing.T) {
+		tweet := &Tweet{Entities: &TweetEntities{
+			UserMentions: []*TweetEntitiesUserMention{{User: "alice"}},
+		}}
+		assert.Equal(t, "Thanks @alice!", mapTextHandles(conf, tweet, "Thanks @alice!"))
+	})
+
+	t.Run("AppliedByRenderToot", func(t *testing.T) {
+		assert.Equal(t, "Thanks @alice@mastodon.social!", renderToot(conf, &Tweet{Text: "Thanks @alice!"}))
+	})
+}
+
+func TestPrependReadingTime(t *testing.T) {
+	conf := &Conf{IncludeReadingTime: true, ReadingTimeMinLength: 100, ReadingTimeWPM: 200}
+
+	// 450 words at 200 words a minute rounds up to 3 minutes.
+	long := strings.TrimSpace(strings.Repeat("word ", 450))
+	assert.Equal(t, "(3 min read)\n\n"+long, prependReadingTime(conf, long))
+	assert.Equal(t, "(3 min read)\n\n"+long, renderToot(conf, &Tweet{Text: long}))
+
+	t.Run("ShortUnaffected", func(t *testing.T) {
+		assert.Equal(t, "A short toot.", prependReadingTime(conf, "A short toot."))
+		assert.Equal(t, "A short toot.", renderToot(conf, &Tweet{Text: "A short toot."}))
+	})
+
+	t.Run("MinimumOfOneMinute", func(t *testing.T) {
+		content := strings.Repeat("x", 100)
+		assert.Equal(t, "(1 min read)\n\n"+content, prependReadingTime(conf, content))
+	})
+
+	t.Run("MatchesStatusWithoutNote", func(t *testing.T) {
+		tweet := &Tweet{Text: long}
+		status := &mastodon.Status{Content: "<p>" + long + "</p>"}
+
+		match, _ := findMatchingStatus(conf, []*mastodon.Status{status}, tweet)
+		assert.Equal(t, status, match)
+	})
+}
+
+func TestRenderTransformers(t *testing.T) {
+	base := len(renderTransformers(&Conf{}))
+
+	// The base pipeline is display text trimming, the newest version, trailing
+	// link stripping, and hashtag normalization.
+	assert.Equal(t, 1+len(tootTransformerVersions[0])+2, base)
+
+	// Each optional transformation adds a step when it's enabled.
+	assert.Len(t, renderTransformers(&Conf{StripRTPrefix: true, NormalizeEmoji: true}), base+2)
+
+	t.Run("OrdersOptionalTransformations", func(t *testing.T) {
+		conf := &Conf{
+			Attribution:        true,
+			EngagementTemplate: []string{"{favorites} likes"},
+			IncludeEngagement:  EngagementFooter,
+			IncludeReplies:     true,
+			ReplyPrefix:        "Re @{user}:",
+		}
+		tweet := &Tweet{
+			Text:          "@user Agreed",
+			FavoriteCount: 3,
+			Reply:         &TweetReply{StatusID: 1, User: "user"},
+			author:        "brandur",
+		}
+
+		assert.Equal(t, "Re @\u200buser: @user Agreed\n\n— @\u200bbrandur\n\n3 likes",
+			renderToot(conf, tweet))
+	})
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/mattn/go-mastodon"
+)
+
+// reportUnmatchedStatuses lists the account's statuses that don't match any
+// of the candidate tweets, like ones that were posted by hand or that
+// matching failed to pick up, for auditing the account against the source.
+// The report is written to UnmatchedStatusesFile if it's set, and to w
+// otherwise. It never posts anything.
+//
+// This is the reverse of normal matching: each of up to ReconcileLimit of
+// the account's most recent statuses is compared against every tweet. Boosts
+// never match a tweet, so they're left out of the report.
+func reportUnmatchedStatuses(ctx context.Context, conf *Conf, client mastodonClient, tweets []*Tweet, w io.Writer) error {
+	account, err := client.GetAccountCurrentUser(ctx)
+	if err != nil {
+		return fmt.Errorf("error getting current user account: %w", err)
+	}
+
+	statuses, err := fetchAccountStatuses(ctx, client, account.ID, conf.ReconcileLimit)
+	if err != nil {
+		return err
+	}
+	logger.Infof("Looking for unmatched statuses amongst %v existing status(es) and %v tweet(s)",
+		len(statuses), len(tweets))
+
+	var unmatched []*mastodon.Status
+
+StatusLoop:
+	for _, status := range statuses {
+		if status.Reblog != nil {
+			continue
+		}
+
+		for _, tweet := range tweets {
+			if match, _ := findMatchingStatus(conf, []*mastodon.Status{status}, tweet); match != nil {
+				continue StatusLoop
+			}
+		}
+
+		unmatched = append(unmatched, status)
+	}
+
+	var buf bytes.Buffer
+	for _, status := range unmatched {
+		fmt.Fprintf(&buf, "Status %v (%v) posted %v\n", status.ID, status.URL, status.CreatedAt.Format("2006-01-02"))
+		fmt.Fprintf(&buf, "  %q\n", tootToTweet(status))
+	}
+
+	if conf.UnmatchedStatusesFile != "" {
+		if err := writeFileAtomic(conf.UnmatchedStatusesFile, buf.Bytes()); err != nil {
+			return fmt.Errorf("error writing unmatched statuses: %w", err)
+		}
+	} else if _, err := w.Write(buf.Bytes()); err != nil {
+		return fmt.Errorf("error writing unmatched statuses: %w", err)
+	}
+
+	logger.Infof("Found %v unmatched status(es)", len(unmatched))
+
+	return nil
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mattn/go-mastodon"
+	assert "github.com/stretchr/testify/require"
+)
+
+func TestReportUnmatchedStatuses(t *testing.T) {
+	tweets := []*Tweet{
+		{ID: 2, Text: `A tweet that was synced to Mastodon by an earlier run.`},
+		{ID: 1, Text: `Another synced tweet, which is older than the first.`},
+	}
+
+	client := &fakeClient{statuses: []*mastodon.Status{
+		{ID: "400", URL: "https://mastodon.example.com/@user/400", CreatedAt: time.Date(2021, 1, 4, 0, 0, 0, 0, time.UTC),
+			Content: `<p>Something I posted by hand on Mastodon.</p>`},
+		{ID: "300", Content: `<p>A boost of someone else's status.</p>`,
+			Reblog: &mastodon.Status{Content: `<p>A boost of someone else's status.</p>`}},
+		{ID: "200", Content: `<p>A tweet that was synced to Mastodon by an earlier run.</p>`},
+		{ID: "100", Content: `<p>Another synced tweet, which is older than the first.</p>`},
+	}}
+
+	conf := &Conf{ReconcileLimit: 100}
+
+	var buf bytes.Buffer
+	assert.NoError(t, reportUnmatchedStatuses(context.Background(), conf, client, tweets, &buf))
+	assert.Equal(t, "Status 400 (https://mastodon.example.com/@user/400) posted 2021-01-04\n"+
+		"  \"Something I posted by hand on Mastodon.\"\n", buf.String())
+
+	// Never posts.
+	assert.Empty(t, client.postedToots)
+
+	t.Run("File", func(t *testing.T) {
+		conf := *conf
+		conf.UnmatchedStatusesFile = filepath.Join(t.TempDir(), "unmatched.txt")
+
+		var buf bytes.Buffer
+		assert.NoError(t, reportUnmatchedStatuses(context.Background(), &conf, client, tweets, &buf))
+		assert.Empty(t, buf.String())
+
+		data, err := os.ReadFile(conf.UnmatchedStatusesFile)
+		assert.NoError(t, err)
+		assert.Contains(t, string(data), "Status 400")
+		assert.NotContains(t, string(data), "Status 200")
+	})
+}
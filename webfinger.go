@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// webFingerTimeout bounds each WebFinger lookup.
+const webFingerTimeout = 10 * time.Second
+
+// webFingerAccounts holds the accounts resolved from the address hints of
+// WebFingerHandleMappings for the rest of the run. They're resolved once up
+// front by resolveWebFingerHandleMappings rather than while rendering because
+// tweets are rendered over and over while being matched against existing
+// statuses, and rendering shouldn't depend on the network.
+var webFingerAccounts = newWebFingerCache()
+
+// webFingerCache is a cache of canonical accounts, keyed by the address hints
+// that they were resolved from. Hints that couldn't be resolved are cached as
+// empty strings.
+type webFingerCache struct {
+	mu       sync.Mutex
+	accounts map[string]string
+}
+
+func newWebFingerCache() *webFingerCache {
+	return &webFingerCache{accounts: make(map[string]string)}
+}
+
+// account returns the account that an address hint was resolved to, without
+// looking it up if it hasn't been. Hints that haven't been resolved, or that
+// couldn't be, return false.
+func (c *webFingerCache) account(hint string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	account := c.accounts[hint]
+	return account, account != ""
+}
+
+// resolve resolves an address hint like `alice@example.com` to the canonical
+// account it belongs to, like `alice@social.example.com`. Errors are logged,
+// and return false so that the caller can fall back to something that
+// doesn't depend on the lookup.
+func (c *webFingerCache) resolve(conf *Conf, hint string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if account, ok := c.accounts[hint]; ok {
+		return account, account != ""
+	}
+
+	account, err := lookupWebFinger(conf, hint)
+	if err != nil {
+		logger.Warnf("Couldn't resolve fediverse address '%s' with WebFinger: %v", logURL(conf, hint), err)
+	}
+
+	c.accounts[hint] = account
+	return account, account != ""
+}
+
+// resolveWebFingerHandleMappings resolves the address hints of
+// WebFingerHandleMappings to canonical accounts so that mapTextHandles can
+// rewrite handles to them.
+func resolveWebFingerHandleMappings(conf *Conf) {
+	for _, hint := range conf.WebFingerHandleMappings {
+		webFingerAccounts.resolve(conf, hint)
+	}
+}
+
+// webFingerResource is the subset of a WebFinger JSON resource descriptor
+// that's used.
+type webFingerResource struct {
+	Subject string `json:"subject"`
+}
+
+// lookupWebFinger queries the WebFinger endpoint of the domain of an address
+// hint for the account it belongs to, returning the account of the subject of
+// the response, which is canonical even if the hint uses an alias or a domain
+// that delegates to another.
+func lookupWebFinger(conf *Conf, hint string) (string, error) {
+	user, domain, ok := strings.Cut(strings.TrimPrefix(hint, "@"), "@")
+	if !ok || user == "" || domain == "" {
+		return "", fmt.Errorf("address should look like user@example.com")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), webFingerTimeout)
+	defer cancel()
+
+	endpoint := "https://" + domain + "/.well-known/webfinger?resource=" +
+		url.QueryEscape("acct:"+user+"@"+domain)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return "", fmt.Errorf("error creating request: %w", redactError(conf, err, endpoint))
+	}
+	req.Header.Set("Accept", "application/jrd+json, application/json")
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("error requesting '%s': %w", logURL(conf, endpoint), redactError(conf, err, endpoint))
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected status %d from '%s'", resp.StatusCode, logURL(conf, endpoint))
+	}
+
+	var resource webFingerResource
+	if err := json.NewDecoder(resp.Body).Decode(&resource); err != nil {
+		return "", fmt.Errorf("error decoding response from '%s': %w", logURL(conf, endpoint), err)
+	}
+
+	account := strings.TrimPrefix(resource.Subject, "acct:")
+	if account == resource.Subject || !strings.Contains(account, "@") {
+		return "", fmt.Errorf("unexpected subject '%s' from '%s'", logURL(conf, resource.Subject), logURL(conf, endpoint))
+	}
+
+	return account, nil
+}
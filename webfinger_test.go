@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/mattn/go-mastodon"
+	assert "github.com/stretchr/testify/require"
+)
+
+func TestMapTextHandlesWebFinger(t *testing.T) {
+	var requests int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		assert.Equal(t, "/.well-known/webfinger", r.URL.Path)
+
+		switch r.URL.Query().Get("resource") {
+		case "acct:alice@example.com":
+			w.Header().Set("Content-Type", "application/jrd+json")
+			w.Write([]byte(`{"subject": "acct:alice@social.example.com"}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	serverURL, err := url.Parse(server.URL)
+	assert.NoError(t, err)
+
+	origHTTPClient, origAccounts := httpClient, webFingerAccounts
+	httpClient = &http.Client{Transport: rewriteHostTransport{host: serverURL.Host}}
+	webFingerAccounts = newWebFingerCache()
+	t.Cleanup(func() { httpClient, webFingerAccounts = origHTTPClient, origAccounts })
+
+	conf := &Conf{WebFingerHandleMappings: ConfMap{"alice": "alice@example.com", "bob": "bob@example.com"}}
+
+	// Resolved once up front, before rendering.
+	logs := captureLogger(t)
+	resolveWebFingerHandleMappings(conf)
+	assert.Equal(t, 2, requests)
+	assert.Contains(t, logs.String(), "Couldn't resolve fediverse address 'bob@example.com' with WebFinger")
+
+	assert.Equal(t, "Great talk by @alice@social.example.com today",
+		renderToot(conf, &Tweet{Text: "Great talk by @Alice today"}))
+	assert.Equal(t, "Thanks @alice@social.example.com!", renderToot(conf, &Tweet{Text: "Thanks @alice!"}))
+
+	t.Run("FallsBackToPlainText", func(t *testing.T) {
+		assert.Equal(t, "Lunch with bob", renderToot(conf, &Tweet{Text: "Lunch with @bob"}))
+	})
+
+	t.Run("MatchesStatusPostedBeforeMapping", func(t *testing.T) {
+		conf := *conf
+		conf.TextHandleMappings = ConfMap{"carol": "carol@example.social"}
+
+		status := &mastodon.Status{Content: `<p>Thanks @alice and @carol@example.social!</p>`}
+		match, _ := findMatchingStatus(&conf, []*mastodon.Status{status}, &Tweet{Text: "Thanks @alice and @carol!"})
+		assert.Equal(t, status, match)
+	})
+
+	t.Run("TextHandleMappingsTakePrecedence", func(t *testing.T) {
+		conf := *conf
+		conf.TextHandleMappings = ConfMap{"alice": "alice@mastodon.social"}
+		assert.Equal(t, "Thanks @alice@mastodon.social!", renderToot(&conf, &Tweet{Text: "Thanks @alice!"}))
+	})
+
+	// Rendering doesn't make any requests.
+	assert.Equal(t, 2, requests)
+}